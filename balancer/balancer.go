@@ -0,0 +1,342 @@
+package balancer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"sort"
+	"time"
+
+	"github.com/gridsx/datagos/config"
+	"github.com/siddontang/go-log/log"
+)
+
+var conf = config.GetConf()
+
+const (
+	ModeEtcd = "etcd"
+	ModeDB   = "db"
+
+	defaultPrefix = "/datagos"
+	defaultTTL    = 10
+
+	// 任务自己停止之后在本节点重启的退避时间， 重启之后稳定运行一段时间才重新计算
+	restartBackoff    = 5 * time.Second
+	maxRestartBackoff = 5 * time.Minute
+	restartStable     = 5 * time.Minute
+)
+
+// Runner 本节点上任务的启停， 由 server 实现
+type Runner interface {
+	// StartTask lease 为本节点持有的任务锁， Token 大于0时任务写入位点和状态要校验仍然持有锁
+	StartTask(id int, lease Lease) error
+	StopTask(id int)
+	RunningTasks() []int
+	TaskStats(id int) (TaskStats, bool)
+	// TaskFailed 任务是否按策略失败停止， 这类任务重启也不会成功， 不再自动重启
+	TaskFailed(id int) bool
+}
+
+// Lease 任务锁的持有者和 fencing token
+type Lease struct {
+	Owner string
+	Token int64
+}
+
+// TaskStats 任务的运行统计
+type TaskStats struct {
+	Events uint64 // 收到的事件数
+	Delay  uint32 // 延迟， 秒
+	Memory uint64 // 缓冲数据占用内存的估算， 字节
+}
+
+// Balancer 集群调度， 节点注册、选主以及任务分配
+// 提交的任务由主节点分配到存活节点， 每个任务运行前要拿到任务锁， 保证集群中只运行一份
+type Balancer interface {
+	// Start 注册节点并开始调度， 不阻塞
+	Start() error
+	// Stop 停止本节点上的任务并退出集群， 任务会被分配到其他节点
+	Stop()
+	// Submit 任务加入调度， selector 不为空时只分配到标签匹配的节点
+	Submit(taskId int, selector map[string]string) error
+	// Remove 任务移出调度， 运行该任务的节点会停止它
+	Remove(taskId int) error
+	// Nodes 存活节点以及分配到的任务
+	Nodes() ([]*Node, error)
+	// Drain 节点摘除， 其上的任务保存位点停止后迁移到其他节点， drain 为 false 时恢复
+	Drain(nodeId string, drain bool) error
+}
+
+// Node 集群节点， 节点定时上报标签和负载
+type Node struct {
+	Id       string            `json:"id"`
+	Labels   map[string]string `json:"labels,omitempty"`
+	Memory   uint64            `json:"memory"` // 节点进程堆内存， 字节， 各任务的估算在 Loads 中
+	Loads    map[int]*Load     `json:"loads,omitempty"`
+	Draining bool              `json:"draining"`
+	Tasks    []int             `json:"tasks"`
+	// Restarts 自己停止之后等待重启的任务
+	Restarts map[int]*Restart `json:"restarts,omitempty"`
+}
+
+// Restart 任务自己停止之后的重启状态
+type Restart struct {
+	Attempts int       `json:"attempts"`
+	Next     time.Time `json:"next"`
+}
+
+// Load 节点上运行中任务的负载
+type Load struct {
+	EventsPerSecond float64 `json:"eps"`
+	Delay           uint32  `json:"delay"`
+	// Memory 任务缓冲数据占用内存的估算， 字节
+	Memory uint64 `json:"memory"`
+}
+
+// taskSpec 提交调度的任务
+type taskSpec struct {
+	Id       int               `json:"-"`
+	Selector map[string]string `json:"selector,omitempty"`
+}
+
+// parseSpec 早先提交的任务没有 spec， 按没有选择器处理
+func parseSpec(id int, d string) *taskSpec {
+	spec := &taskSpec{}
+	if len(d) > 0 {
+		_ = json.Unmarshal([]byte(d), spec)
+	}
+	spec.Id = id
+	return spec
+}
+
+// New 根据配置创建， 没有配置集群时返回 nil
+func New(runner Runner) (Balancer, error) {
+	c := conf.Cluster
+	if len(c.Prefix) == 0 {
+		c.Prefix = defaultPrefix
+	}
+	if c.TTL <= 0 {
+		c.TTL = defaultTTL
+	}
+	if len(c.NodeId) == 0 {
+		host, err := os.Hostname()
+		if err != nil {
+			return nil, err
+		}
+		c.NodeId = fmt.Sprintf("%s:%d", host, conf.Server.Port)
+	}
+	switch c.Mode {
+	case "":
+		return nil, nil
+	case ModeEtcd:
+		return newEtcdBalancer(c, runner)
+	case ModeDB:
+		return newDbBalancer(c, runner), nil
+	default:
+		return nil, errors.New("unknown cluster mode: " + c.Mode)
+	}
+}
+
+// withTasks 按分配结果填充节点上的任务
+func withTasks(nodes []*Node, assigns map[int]string) []*Node {
+	index := make(map[string]*Node, len(nodes))
+	for _, n := range nodes {
+		n.Tasks = make([]int, 0)
+		index[n.Id] = n
+	}
+	for taskId, nodeId := range assigns {
+		if n, ok := index[nodeId]; ok {
+			n.Tasks = append(n.Tasks, taskId)
+		}
+	}
+	for _, n := range nodes {
+		sort.Ints(n.Tasks)
+	}
+	return nodes
+}
+
+// taskLocker 分配结果的读取以及任务锁， 由各个后端实现
+type taskLocker interface {
+	assigns(ctx context.Context) (map[int]string, error)
+	// acquire 获取任务锁， 原持有者的锁过期前获取不到
+	acquire(ctx context.Context, id int) bool
+	release(id int)
+	// token 持有的任务锁的 fencing token， 不支持时为0
+	token(id int) int64
+	Remove(taskId int) error
+}
+
+// agent 节点侧按分配结果启停本节点上的任务， 只在调度协程中使用
+type agent struct {
+	nodeId string
+	labels map[string]string
+	runner Runner
+	// owned 本节点持有锁的任务
+	owned   map[int]bool
+	samples map[int]*sample
+	// restarts 自己停止的任务的重启状态， 重启期间继续持有锁
+	restarts map[int]*restart
+}
+
+type restart struct {
+	attempts int
+	next     time.Time
+	// started 最近一次启动的时间， 稳定运行之后清除重启状态
+	started time.Time
+}
+
+// sample 上次采样， 用于计算事件速率
+type sample struct {
+	events uint64
+	eps    float64
+	at     time.Time
+}
+
+func newAgent(c config.ClusterConfig, runner Runner) *agent {
+	return &agent{
+		nodeId:   c.NodeId,
+		labels:   c.Labels,
+		runner:   runner,
+		owned:    make(map[int]bool),
+		samples:  make(map[int]*sample),
+		restarts: make(map[int]*restart),
+	}
+}
+
+// state 采样本节点的负载， 事件速率取与上次采样的平均， 避免抖动
+func (a *agent) state() *Node {
+	now := time.Now()
+	loads := make(map[int]*Load, len(a.owned))
+	for id := range a.owned {
+		stats, ok := a.runner.TaskStats(id)
+		if !ok {
+			continue
+		}
+		l := &Load{Delay: stats.Delay, Memory: stats.Memory}
+		if last, ok := a.samples[id]; ok && now.After(last.at) && stats.Events >= last.events {
+			eps := float64(stats.Events-last.events) / now.Sub(last.at).Seconds()
+			l.EventsPerSecond = (eps + last.eps) / 2
+		}
+		a.samples[id] = &sample{events: stats.Events, eps: l.EventsPerSecond, at: now}
+		loads[id] = l
+	}
+	for id := range a.samples {
+		if !a.owned[id] {
+			delete(a.samples, id)
+		}
+	}
+	restarts := make(map[int]*Restart)
+	for id, r := range a.restarts {
+		if r.attempts > 0 && r.started.Before(r.next) {
+			restarts[id] = &Restart{Attempts: r.attempts, Next: r.next}
+		}
+	}
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	return &Node{Id: a.nodeId, Labels: a.labels, Memory: ms.HeapAlloc, Loads: loads, Restarts: restarts}
+}
+
+func (a *agent) reconcile(ctx context.Context, l taskLocker) {
+	assigns, err := l.assigns(ctx)
+	if err != nil {
+		if ctx.Err() == nil {
+			log.Errorf("balancer get assigns error: %v\n", err)
+		}
+		return
+	}
+	running := make(map[int]bool)
+	for _, id := range a.runner.RunningTasks() {
+		running[id] = true
+	}
+	for id := range a.owned {
+		if assigns[id] != a.nodeId {
+			a.stop(id, l)
+			log.Infof("balancer task moved off node, task: %d, node: %s\n", id, a.nodeId)
+			continue
+		}
+		if running[id] {
+			if r := a.restarts[id]; r != nil && time.Since(r.started) >= restartStable {
+				delete(a.restarts, id)
+			}
+			continue
+		}
+		if a.runner.TaskFailed(id) {
+			// 按策略失败的任务移出调度， 等待人工处理之后重新提交
+			a.drop(id, l)
+			delete(assigns, id)
+			if err := l.Remove(id); err != nil {
+				log.Errorf("balancer remove task error: %v\n", err)
+			}
+			log.Warnf("balancer task failed, removed from schedule, task: %d\n", id)
+			continue
+		}
+		a.restart(id, l)
+	}
+	for id, nodeId := range assigns {
+		if nodeId != a.nodeId || a.owned[id] {
+			continue
+		}
+		if !l.acquire(ctx, id) {
+			continue
+		}
+		a.owned[id] = true
+		a.restarts[id] = &restart{}
+		a.start(id, l)
+	}
+}
+
+// restart 任务自己停止了， 多半是源库或目标的临时错误， 继续持有锁， 按退避时间在本节点重启
+func (a *agent) restart(id int, l taskLocker) {
+	r := a.restarts[id]
+	if r == nil {
+		r = &restart{}
+		a.restarts[id] = r
+	}
+	if r.started.Before(r.next) {
+		if time.Now().After(r.next) {
+			a.start(id, l)
+		}
+		return
+	}
+	r.attempts++
+	d := restartBackoff
+	for i := 1; i < r.attempts && d < maxRestartBackoff; i++ {
+		d *= 2
+	}
+	if d > maxRestartBackoff {
+		d = maxRestartBackoff
+	}
+	r.next = time.Now().Add(d)
+	log.Warnf("balancer task stopped on its own, restart in %v, task: %d, attempts: %d\n", d, id, r.attempts)
+}
+
+// start 启动失败与运行中停止一样按退避时间重启
+func (a *agent) start(id int, l taskLocker) {
+	a.restarts[id].started = time.Now()
+	if err := a.runner.StartTask(id, Lease{Owner: a.nodeId, Token: l.token(id)}); err != nil {
+		log.Errorf("balancer start task error, task: %d, err: %v\n", id, err)
+		return
+	}
+	log.Infof("balancer task started, task: %d, node: %s\n", id, a.nodeId)
+}
+
+func (a *agent) drop(id int, l taskLocker) {
+	delete(a.owned, id)
+	delete(a.restarts, id)
+	l.release(id)
+}
+
+func (a *agent) stop(id int, l taskLocker) {
+	a.runner.StopTask(id)
+	a.drop(id, l)
+}
+
+// stopAll 停止本节点所有任务并释放锁
+func (a *agent) stopAll(l taskLocker) {
+	for id := range a.owned {
+		a.stop(id, l)
+	}
+}
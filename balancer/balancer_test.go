@@ -0,0 +1,195 @@
+package balancer
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gridsx/datagos/config"
+)
+
+// fakeRunner 记录任务的启停， exit 模拟任务自己停止
+type fakeRunner struct {
+	lock    sync.Mutex
+	running map[int]bool
+	failed  map[int]bool
+	starts  map[int]int
+	leases  map[int]Lease
+}
+
+func newFakeRunner() *fakeRunner {
+	return &fakeRunner{running: map[int]bool{}, failed: map[int]bool{}, starts: map[int]int{}, leases: map[int]Lease{}}
+}
+
+func (r *fakeRunner) StartTask(id int, lease Lease) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.running[id] = true
+	r.starts[id]++
+	r.leases[id] = lease
+	return nil
+}
+
+func (r *fakeRunner) StopTask(id int) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	delete(r.running, id)
+}
+
+func (r *fakeRunner) RunningTasks() []int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	ids := make([]int, 0, len(r.running))
+	for id := range r.running {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+func (r *fakeRunner) TaskStats(id int) (TaskStats, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return TaskStats{}, r.running[id]
+}
+
+func (r *fakeRunner) TaskFailed(id int) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.failed[id]
+}
+
+func (r *fakeRunner) exit(id int, failed bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	delete(r.running, id)
+	r.failed[id] = failed
+}
+
+func (r *fakeRunner) isRunning(id int) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.running[id]
+}
+
+func (r *fakeRunner) startCount(id int) int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.starts[id]
+}
+
+// fakeLocker 所有任务都分配到 node 上
+type fakeLocker struct {
+	node    string
+	tasks   map[int]bool
+	locks   map[int]bool
+	removed []int
+}
+
+func (l *fakeLocker) assigns(ctx context.Context) (map[int]string, error) {
+	result := make(map[int]string, len(l.tasks))
+	for id := range l.tasks {
+		result[id] = l.node
+	}
+	return result, nil
+}
+
+func (l *fakeLocker) acquire(ctx context.Context, id int) bool {
+	l.locks[id] = true
+	return true
+}
+
+func (l *fakeLocker) release(id int) {
+	delete(l.locks, id)
+}
+
+func (l *fakeLocker) token(id int) int64 {
+	return int64(id) * 10
+}
+
+func (l *fakeLocker) Remove(taskId int) error {
+	delete(l.tasks, taskId)
+	l.removed = append(l.removed, taskId)
+	return nil
+}
+
+func TestAgentRestartsExitedTask(t *testing.T) {
+	runner := newFakeRunner()
+	a := newAgent(config.ClusterConfig{NodeId: "n1"}, runner)
+	l := &fakeLocker{node: "n1", tasks: map[int]bool{1: true}, locks: map[int]bool{}}
+	ctx := context.Background()
+	// 跳过退避时间
+	due := func() {
+		r := a.restarts[1]
+		r.started, r.next = r.started.Add(-time.Hour), time.Now().Add(-time.Millisecond)
+	}
+
+	a.reconcile(ctx, l)
+	if !runner.isRunning(1) || runner.startCount(1) != 1 {
+		t.Fatal("task not started")
+	}
+	if lease := runner.leases[1]; lease.Owner != "n1" || lease.Token != 10 {
+		t.Fatalf("task lease: %+v", lease)
+	}
+
+	// 自己停止之后继续持有锁， 退避时间之后重启
+	runner.exit(1, false)
+	a.reconcile(ctx, l)
+	if runner.isRunning(1) || !l.locks[1] || len(l.removed) > 0 {
+		t.Fatalf("exited task restarted at once or released, locks: %v, removed: %v", l.locks, l.removed)
+	}
+	r := a.state().Restarts[1]
+	if r == nil || r.Attempts != 1 || time.Until(r.Next) <= 0 {
+		t.Fatalf("restart not reported: %+v", r)
+	}
+	a.reconcile(ctx, l)
+	if runner.isRunning(1) {
+		t.Fatal("task restarted before backoff")
+	}
+	due()
+	a.reconcile(ctx, l)
+	if !runner.isRunning(1) || runner.startCount(1) != 2 {
+		t.Fatal("task not restarted after backoff")
+	}
+	if len(a.state().Restarts) != 0 {
+		t.Fatal("running task still reported as restarting")
+	}
+
+	// 再次停止， 退避时间翻倍
+	runner.exit(1, false)
+	a.reconcile(ctx, l)
+	if r := a.restarts[1]; r.attempts != 2 || time.Until(r.next) <= restartBackoff {
+		t.Fatalf("backoff not increased: %+v", r)
+	}
+
+	// 按策略失败的任务不再重启， 移出调度
+	due()
+	a.reconcile(ctx, l)
+	runner.exit(1, true)
+	a.reconcile(ctx, l)
+	if runner.isRunning(1) || l.locks[1] || len(l.removed) != 1 || a.owned[1] {
+		t.Fatalf("failed task not removed, locks: %v, removed: %v", l.locks, l.removed)
+	}
+}
+
+// 任务的内存随任务计入负载， 迁移时跟着任务走， 节点只计其余的内存
+func TestScoresCountTaskMemory(t *testing.T) {
+	nodes := []*Node{
+		{Id: "n1", Memory: 3 * memoryPerWeight, Loads: map[int]*Load{1: {Memory: 2 * memoryPerWeight}, 2: {}}},
+		{Id: "n2", Memory: memoryPerWeight},
+	}
+	weights := taskWeights(nodes)
+	if weights[1] != 3 || weights[2] != 1 {
+		t.Fatalf("weights: %v", weights)
+	}
+	load := scores(map[int]string{1: "n1", 2: "n1"}, nodes, weights)
+	if load["n1"] != 5 || load["n2"] != 1 {
+		t.Fatalf("scores: %v", load)
+	}
+	load = scores(map[int]string{1: "n2", 2: "n1"}, nodes, weights)
+	if load["n1"] != 2 || load["n2"] != 4 {
+		t.Fatalf("scores after move: %v", load)
+	}
+}
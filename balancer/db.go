@@ -0,0 +1,389 @@
+package balancer
+
+// 基于元数据库的调度， 没有 etcd 时使用， 与 etcd 的调度可以互相替换
+// 节点、主节点以及任务锁都是带过期时间的行， 持有者定时续期， 过期之后其他节点才能接管
+// 每次获取任务锁 token 加一， 续期和释放都要校验 token， 旧的持有者无法再操作已经被接管的任务，
+// token 也交给任务， 任务写入位点和状态时校验 cluster_tasks 的 owner、token， 被接管之后旧的持有者无法覆盖位点
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/gridsx/datagos/config"
+	"github.com/gridsx/datagos/store"
+	"github.com/siddontang/go-log/log"
+)
+
+const (
+	heartbeatSql = `INSERT INTO cluster_nodes(node_id, state, expire_at) VALUES (?, ?, NOW(3) + INTERVAL ? SECOND)
+		ON DUPLICATE KEY UPDATE state = VALUES(state), expire_at = VALUES(expire_at)`
+	unregisterSql   = `DELETE FROM cluster_nodes WHERE node_id = ?`
+	cleanNodesSql   = `DELETE FROM cluster_nodes WHERE expire_at < NOW(3) - INTERVAL ? SECOND`
+	aliveNodesSql   = `SELECT node_id, state, draining FROM cluster_nodes WHERE expire_at > NOW(3)`
+	nodeExistsSql   = `SELECT COUNT(*) FROM cluster_nodes WHERE node_id = ?`
+	drainNodeSql    = `UPDATE cluster_nodes SET draining = ? WHERE node_id = ?`
+	initLeaderSql   = `INSERT IGNORE INTO cluster_leader(id) VALUES (1)`
+	takeLeaderSql   = `UPDATE cluster_leader SET node_id = ?, token = token + 1, expire_at = NOW(3) + INTERVAL ? SECOND WHERE id = 1 AND expire_at <= NOW(3)`
+	renewLeaderSql  = `UPDATE cluster_leader SET expire_at = NOW(3) + INTERVAL ? SECOND WHERE id = 1 AND node_id = ? AND token = ? AND expire_at > NOW(3)`
+	resignLeaderSql = `UPDATE cluster_leader SET expire_at = NOW(3) WHERE id = 1 AND node_id = ? AND token = ?`
+	leaderTokenSql  = `SELECT token FROM cluster_leader WHERE id = 1 AND node_id = ?`
+	submitTaskSql   = `INSERT INTO cluster_tasks(task_id, enabled, selector) VALUES (?, 1, ?) ON DUPLICATE KEY UPDATE enabled = 1, selector = VALUES(selector)`
+	removeTaskSql   = `UPDATE cluster_tasks SET enabled = 0 WHERE task_id = ?`
+	taskListSql     = `SELECT task_id, enabled, node_id, selector FROM cluster_tasks`
+	assignsSql      = `SELECT task_id, node_id FROM cluster_tasks WHERE enabled = 1 AND node_id != ''`
+	// 只有仍是主节点时才能修改分配
+	assignTaskSql = `UPDATE cluster_tasks t JOIN cluster_leader l ON l.id = 1 SET t.node_id = ?
+		WHERE t.task_id = ? AND l.node_id = ? AND l.token = ? AND l.expire_at > NOW(3)`
+	acquireTaskSql = `UPDATE cluster_tasks SET owner = ?, token = token + 1, expire_at = NOW(3) + INTERVAL ? SECOND
+		WHERE task_id = ? AND node_id = ? AND (owner = '' OR expire_at <= NOW(3))`
+	taskTokenSql   = `SELECT token FROM cluster_tasks WHERE task_id = ? AND owner = ?`
+	renewTaskSql   = `UPDATE cluster_tasks SET expire_at = NOW(3) + INTERVAL ? SECOND WHERE task_id = ? AND owner = ? AND token = ?`
+	releaseTaskSql = `UPDATE cluster_tasks SET owner = '', expire_at = NOW(3) WHERE task_id = ? AND owner = ? AND token = ?`
+
+	dbOpTimeout = 5 * time.Second
+	// 过期节点保留的时间， 租约的倍数
+	deadNodeKeep = 10
+)
+
+type dbBalancer struct {
+	nodeId string
+	ttl    int
+	agent  *agent
+
+	// 以下只在调度协程中访问
+	sched scheduler
+	// leaderToken 大于0时为主节点
+	leaderToken int64
+	// tokens 本节点持有的任务锁
+	tokens   map[int]int64
+	lastBeat time.Time
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func newDbBalancer(c config.ClusterConfig, runner Runner) *dbBalancer {
+	return &dbBalancer{
+		nodeId: c.NodeId,
+		ttl:    c.TTL,
+		agent:  newAgent(c, runner),
+		tokens: make(map[int]int64),
+	}
+}
+
+func (b *dbBalancer) Start() error {
+	if _, err := store.GetDb().Exec(initLeaderSql); err != nil {
+		return err
+	}
+	b.ctx, b.cancel = context.WithCancel(context.Background())
+	b.done = make(chan struct{})
+	go b.run()
+	log.Infof("db balancer started, node: %s\n", b.nodeId)
+	return nil
+}
+
+func (b *dbBalancer) Stop() {
+	if b.cancel == nil {
+		return
+	}
+	b.cancel()
+	<-b.done
+}
+
+func (b *dbBalancer) Submit(taskId int, selector map[string]string) error {
+	d, _ := json.Marshal(&taskSpec{Selector: selector})
+	_, err := store.GetDb().Exec(submitTaskSql, taskId, string(d))
+	return err
+}
+
+func (b *dbBalancer) Remove(taskId int) error {
+	_, err := store.GetDb().Exec(removeTaskSql, taskId)
+	return err
+}
+
+func (b *dbBalancer) Drain(nodeId string, drain bool) error {
+	db := store.GetDb()
+	var n int
+	if err := db.QueryRow(nodeExistsSql, nodeId).Scan(&n); err != nil {
+		return err
+	}
+	if n == 0 {
+		return errors.New("node not found: " + nodeId)
+	}
+	_, err := db.Exec(drainNodeSql, drain, nodeId)
+	return err
+}
+
+func (b *dbBalancer) Nodes() ([]*Node, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbOpTimeout)
+	defer cancel()
+	nodes, err := b.aliveNodes(ctx)
+	if err != nil {
+		return nil, err
+	}
+	assigns, err := b.assigns(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return withTasks(nodes, assigns), nil
+}
+
+// interval 续期间隔为租约的三分之一
+func (b *dbBalancer) interval() time.Duration {
+	d := time.Duration(b.ttl) * time.Second / 3
+	if d < time.Second {
+		d = time.Second
+	}
+	return d
+}
+
+func (b *dbBalancer) run() {
+	defer close(b.done)
+	ticker := time.NewTicker(b.interval())
+	defer ticker.Stop()
+	for {
+		b.tick()
+		select {
+		case <-b.ctx.Done():
+			b.leave()
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (b *dbBalancer) tick() {
+	ctx, cancel := context.WithTimeout(b.ctx, dbOpTimeout)
+	defer cancel()
+	state, _ := json.Marshal(b.agent.state())
+	if _, err := store.GetDb().ExecContext(ctx, heartbeatSql, b.nodeId, string(state), b.ttl); err != nil {
+		log.Errorf("db balancer heartbeat error: %v\n", err)
+		// 锁在租约到期后会被其他节点接管， 提前停止本节点的任务
+		if time.Since(b.lastBeat) > time.Duration(b.ttl)*time.Second*2/3 {
+			b.leaderToken = 0
+			b.agent.stopAll(b)
+		}
+		return
+	}
+	b.lastBeat = time.Now()
+	b.renewLocks(ctx)
+	if b.elect(ctx) {
+		if err := b.schedule(ctx); err != nil {
+			log.Errorf("db balancer schedule error: %v\n", err)
+		}
+	}
+	b.agent.reconcile(ctx, b)
+}
+
+// leave 停止本节点任务、释放锁并注销， 其他节点不用等租约过期就能接管
+func (b *dbBalancer) leave() {
+	b.agent.stopAll(b)
+	db := store.GetDb()
+	if b.leaderToken > 0 {
+		if _, err := db.Exec(resignLeaderSql, b.nodeId, b.leaderToken); err != nil {
+			log.Warnf("db balancer resign leader error: %v\n", err)
+		}
+		b.leaderToken = 0
+	}
+	if _, err := db.Exec(unregisterSql, b.nodeId); err != nil {
+		log.Warnf("db balancer unregister node error: %v\n", err)
+	}
+}
+
+// renewLocks 续期本节点持有的任务锁， 续期失败说明锁已经被接管， 停止对应的任务
+func (b *dbBalancer) renewLocks(ctx context.Context) {
+	for id, token := range b.tokens {
+		res, err := store.GetDb().ExecContext(ctx, renewTaskSql, b.ttl, id, b.nodeId, token)
+		if err != nil {
+			log.Errorf("db balancer renew task lock error, task: %d, err: %v\n", id, err)
+			continue
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			log.Warnf("db balancer task lock lost, task: %d, token: %d\n", id, token)
+			b.agent.stop(id, b)
+		}
+	}
+}
+
+// elect 续期或者竞选主节点， 返回是否为主节点
+func (b *dbBalancer) elect(ctx context.Context) bool {
+	db := store.GetDb()
+	if b.leaderToken > 0 {
+		res, err := db.ExecContext(ctx, renewLeaderSql, b.ttl, b.nodeId, b.leaderToken)
+		if err == nil {
+			if n, _ := res.RowsAffected(); n > 0 {
+				return true
+			}
+		}
+		log.Warnf("db balancer no longer leader, node: %s, err: %v\n", b.nodeId, err)
+		b.leaderToken = 0
+	}
+	res, err := db.ExecContext(ctx, takeLeaderSql, b.nodeId, b.ttl)
+	if err != nil {
+		log.Errorf("db balancer campaign error: %v\n", err)
+		return false
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return false
+	}
+	if err := db.QueryRowContext(ctx, leaderTokenSql, b.nodeId).Scan(&b.leaderToken); err != nil {
+		log.Errorf("db balancer get leader token error: %v\n", err)
+		b.leaderToken = 0
+		return false
+	}
+	log.Infof("db balancer elected as leader, node: %s, token: %d\n", b.nodeId, b.leaderToken)
+	return true
+}
+
+// schedule 重新计算分配并写入， 每条写入都校验仍是主节点
+func (b *dbBalancer) schedule(ctx context.Context) error {
+	db := store.GetDb()
+	if _, err := db.ExecContext(ctx, cleanNodesSql, b.ttl*deadNodeKeep); err != nil {
+		return err
+	}
+	nodes, err := b.aliveNodes(ctx)
+	if err != nil {
+		return err
+	}
+	rows, err := db.QueryContext(ctx, taskListSql)
+	if err != nil {
+		return err
+	}
+	tasks := make([]*taskSpec, 0)
+	current := make(map[int]string)
+	for rows.Next() {
+		var id int
+		var enabled bool
+		var nodeId, selector string
+		if err := rows.Scan(&id, &enabled, &nodeId, &selector); err != nil {
+			rows.Close()
+			return err
+		}
+		if enabled {
+			tasks = append(tasks, parseSpec(id, selector))
+		}
+		if len(nodeId) > 0 {
+			current[id] = nodeId
+		}
+	}
+	rows.Close()
+
+	target := b.sched.plan(tasks, nodes, current)
+	for id, nodeId := range current {
+		if target[id] == nodeId {
+			continue
+		}
+		if !b.assignTask(ctx, id, target[id]) {
+			return nil
+		}
+	}
+	for id, nodeId := range target {
+		if _, ok := current[id]; ok {
+			continue
+		}
+		if !b.assignTask(ctx, id, nodeId) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// assignTask 写入分配， 节点为空时取消分配， 返回 false 时已经不是主节点
+func (b *dbBalancer) assignTask(ctx context.Context, id int, nodeId string) bool {
+	res, err := store.GetDb().ExecContext(ctx, assignTaskSql, nodeId, id, b.nodeId, b.leaderToken)
+	if err != nil {
+		log.Errorf("db balancer assign task error, task: %d, err: %v\n", id, err)
+		return true
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		log.Warnf("db balancer no longer leader, node: %s\n", b.nodeId)
+		b.leaderToken = 0
+		return false
+	}
+	if len(nodeId) == 0 {
+		log.Infof("db balancer unassign task %d\n", id)
+	} else {
+		log.Infof("db balancer assign task %d to node %s\n", id, nodeId)
+	}
+	return true
+}
+
+// aliveNodes 存活的节点， 带上报的标签、负载以及是否摘除
+func (b *dbBalancer) aliveNodes(ctx context.Context) ([]*Node, error) {
+	rows, err := store.GetDb().QueryContext(ctx, aliveNodesSql)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	nodes := make([]*Node, 0)
+	for rows.Next() {
+		var id, state string
+		var draining bool
+		if err := rows.Scan(&id, &state, &draining); err != nil {
+			return nil, err
+		}
+		n := &Node{}
+		if err := json.Unmarshal([]byte(state), n); err != nil {
+			log.Warnf("db balancer invalid node state, node: %s, err: %v\n", id, err)
+		}
+		n.Id, n.Draining = id, draining
+		nodes = append(nodes, n)
+	}
+	return nodes, rows.Err()
+}
+
+func (b *dbBalancer) assigns(ctx context.Context) (map[int]string, error) {
+	rows, err := store.GetDb().QueryContext(ctx, assignsSql)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	result := make(map[int]string)
+	for rows.Next() {
+		var id int
+		var nodeId string
+		if err := rows.Scan(&id, &nodeId); err != nil {
+			return nil, err
+		}
+		result[id] = nodeId
+	}
+	return result, rows.Err()
+}
+
+// acquire 获取任务锁， 成功后 token 加一
+func (b *dbBalancer) acquire(ctx context.Context, id int) bool {
+	db := store.GetDb()
+	res, err := db.ExecContext(ctx, acquireTaskSql, b.nodeId, b.ttl, id, b.nodeId)
+	if err != nil {
+		log.Errorf("db balancer acquire task lock error: %v\n", err)
+		return false
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return false
+	}
+	var token int64
+	if err := db.QueryRowContext(ctx, taskTokenSql, id, b.nodeId).Scan(&token); err != nil {
+		log.Errorf("db balancer get task token error: %v\n", err)
+		return false
+	}
+	b.tokens[id] = token
+	return true
+}
+
+func (b *dbBalancer) token(id int) int64 {
+	return b.tokens[id]
+}
+
+func (b *dbBalancer) release(id int) {
+	token, ok := b.tokens[id]
+	if !ok {
+		return
+	}
+	delete(b.tokens, id)
+	if _, err := store.GetDb().Exec(releaseTaskSql, id, b.nodeId, token); err != nil {
+		log.Errorf("db balancer release task lock error: %v\n", err)
+	}
+}
@@ -1,3 +1,364 @@
 package balancer
 
 // 操作etcd， 监听, 心跳等等
+// key 布局， 均在 prefix 之下:
+//   nodes/{node}   节点注册， 绑定节点租约， 节点宕机后自动删除， 值为节点的标签和负载
+//   drain/{node}   摘除的节点
+//   leader         选主
+//   tasks/{id}     需要调度的任务， 值为任务的选择器
+//   assign/{id}    主节点写入的任务分配， 值为节点
+//   locks/{id}     任务锁， 绑定节点租约， 拿到锁的节点才能运行任务
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gridsx/datagos/config"
+	"github.com/siddontang/go-log/log"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/client/v3/concurrency"
+)
+
+const (
+	reconcileInterval = 3 * time.Second
+	etcdOpTimeout     = 5 * time.Second
+	// 单个事务的操作数， etcd 默认上限为 128
+	maxTxnOps = 100
+)
+
+type etcdBalancer struct {
+	cli    *clientv3.Client
+	nodeId string
+	prefix string
+	ttl    int
+	agent  *agent
+	// sched 只在主节点的调度协程中访问
+	sched scheduler
+
+	// session 当前的节点租约， 只在调度协程中访问
+	session *concurrency.Session
+	ctx     context.Context
+	cancel  context.CancelFunc
+	done    chan struct{}
+}
+
+func newEtcdBalancer(c config.ClusterConfig, runner Runner) (*etcdBalancer, error) {
+	cli, err := clientv3.New(clientv3.Config{
+		Endpoints:   c.Endpoints,
+		Username:    c.Username,
+		Password:    c.Password,
+		DialTimeout: etcdOpTimeout,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &etcdBalancer{
+		cli:    cli,
+		nodeId: c.NodeId,
+		prefix: strings.TrimSuffix(c.Prefix, "/"),
+		ttl:    c.TTL,
+		agent:  newAgent(c, runner),
+	}, nil
+}
+
+func (b *etcdBalancer) key(parts ...string) string {
+	return b.prefix + "/" + strings.Join(parts, "/")
+}
+
+func (b *etcdBalancer) Start() error {
+	b.ctx, b.cancel = context.WithCancel(context.Background())
+	b.done = make(chan struct{})
+	go b.run()
+	log.Infof("etcd balancer started, node: %s\n", b.nodeId)
+	return nil
+}
+
+func (b *etcdBalancer) Stop() {
+	if b.cancel == nil {
+		return
+	}
+	b.cancel()
+	<-b.done
+	b.cli.Close()
+}
+
+func (b *etcdBalancer) Submit(taskId int, selector map[string]string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), etcdOpTimeout)
+	defer cancel()
+	d, _ := json.Marshal(&taskSpec{Selector: selector})
+	_, err := b.cli.Put(ctx, b.key("tasks", strconv.Itoa(taskId)), string(d))
+	return err
+}
+
+func (b *etcdBalancer) Remove(taskId int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), etcdOpTimeout)
+	defer cancel()
+	_, err := b.cli.Delete(ctx, b.key("tasks", strconv.Itoa(taskId)))
+	return err
+}
+
+func (b *etcdBalancer) Drain(nodeId string, drain bool) error {
+	ctx, cancel := context.WithTimeout(context.Background(), etcdOpTimeout)
+	defer cancel()
+	k := b.key("drain", nodeId)
+	var err error
+	if drain {
+		_, err = b.cli.Put(ctx, k, time.Now().Format(time.RFC3339))
+	} else {
+		_, err = b.cli.Delete(ctx, k)
+	}
+	return err
+}
+
+func (b *etcdBalancer) Nodes() ([]*Node, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), etcdOpTimeout)
+	defer cancel()
+	nodes, err := b.nodes(ctx)
+	if err != nil {
+		return nil, err
+	}
+	assigns, err := b.assigns(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return withTasks(nodes, assigns), nil
+}
+
+// nodes 存活的节点， 带上报的标签、负载以及是否摘除
+func (b *etcdBalancer) nodes(ctx context.Context) ([]*Node, error) {
+	kvs, err := b.list(ctx, "nodes")
+	if err != nil {
+		return nil, err
+	}
+	drains, err := b.list(ctx, "drain")
+	if err != nil {
+		return nil, err
+	}
+	nodes := make([]*Node, 0, len(kvs))
+	for id, v := range kvs {
+		n := &Node{}
+		if err := json.Unmarshal([]byte(v), n); err != nil {
+			log.Warnf("etcd balancer invalid node state, node: %s, err: %v\n", id, err)
+		}
+		n.Id = id
+		_, n.Draining = drains[id]
+		nodes = append(nodes, n)
+	}
+	return nodes, nil
+}
+
+// publish 上报本节点的标签和负载， 绑定节点租约
+func (b *etcdBalancer) publish(ctx context.Context) error {
+	d, _ := json.Marshal(b.agent.state())
+	_, err := b.cli.Put(ctx, b.key("nodes", b.nodeId), string(d), clientv3.WithLease(b.session.Lease()))
+	return err
+}
+
+// run 每个租约一轮， 租约丢失后停止本节点所有任务， 重新注册
+func (b *etcdBalancer) run() {
+	defer close(b.done)
+	for b.ctx.Err() == nil {
+		session, err := concurrency.NewSession(b.cli, concurrency.WithTTL(b.ttl), concurrency.WithContext(b.ctx))
+		if err != nil {
+			log.Errorf("etcd balancer create session error: %v\n", err)
+			select {
+			case <-b.ctx.Done():
+			case <-time.After(reconcileInterval):
+			}
+			continue
+		}
+		b.session = session
+		b.serve()
+		// 没有租约就不能保证任务只运行一份
+		b.agent.stopAll(b)
+		session.Orphan()
+		ctx, cancel := context.WithTimeout(context.Background(), etcdOpTimeout)
+		if _, err := b.cli.Revoke(ctx, session.Lease()); err != nil {
+			log.Warnf("etcd balancer revoke lease error: %v\n", err)
+		}
+		cancel()
+	}
+}
+
+func (b *etcdBalancer) serve() {
+	session := b.session
+	ctx, cancel := context.WithCancel(b.ctx)
+	defer cancel()
+	if err := b.publish(ctx); err != nil {
+		log.Errorf("etcd balancer register node error: %v\n", err)
+		return
+	}
+	go b.campaign(ctx, session)
+
+	wch := b.cli.Watch(ctx, b.key("assign")+"/", clientv3.WithPrefix())
+	ticker := time.NewTicker(reconcileInterval)
+	defer ticker.Stop()
+	for {
+		b.agent.reconcile(ctx, b)
+		select {
+		case <-ctx.Done():
+			return
+		case <-session.Done():
+			log.Warnf("etcd balancer session expired, node: %s\n", b.nodeId)
+			return
+		case _, ok := <-wch:
+			if !ok {
+				return
+			}
+		case <-ticker.C:
+			if err := b.publish(ctx); err != nil && ctx.Err() == nil {
+				log.Errorf("etcd balancer publish node state error: %v\n", err)
+			}
+		}
+	}
+}
+
+// acquire 获取任务锁， 原节点的锁在其租约过期前一直有效
+func (b *etcdBalancer) acquire(ctx context.Context, id int) bool {
+	k := b.key("locks", strconv.Itoa(id))
+	resp, err := b.cli.Txn(ctx).
+		If(clientv3.Compare(clientv3.CreateRevision(k), "=", 0)).
+		Then(clientv3.OpPut(k, b.nodeId, clientv3.WithLease(b.session.Lease()))).
+		Commit()
+	if err != nil {
+		log.Errorf("etcd balancer acquire task lock error: %v\n", err)
+		return false
+	}
+	return resp.Succeeded
+}
+
+// token etcd 的锁无法与元数据库的写入在同一个事务中校验， 不提供 fencing token
+func (b *etcdBalancer) token(id int) int64 {
+	return 0
+}
+
+func (b *etcdBalancer) release(id int) {
+	ctx, cancel := context.WithTimeout(context.Background(), etcdOpTimeout)
+	defer cancel()
+	k := b.key("locks", strconv.Itoa(id))
+	_, err := b.cli.Txn(ctx).
+		If(clientv3.Compare(clientv3.Value(k), "=", b.nodeId)).
+		Then(clientv3.OpDelete(k)).
+		Commit()
+	if err != nil {
+		log.Errorf("etcd balancer release task lock error: %v\n", err)
+	}
+}
+
+// campaign 竞选主节点， 当选后负责任务分配直到租约丢失
+func (b *etcdBalancer) campaign(ctx context.Context, session *concurrency.Session) {
+	election := concurrency.NewElection(session, b.key("leader"))
+	if err := election.Campaign(ctx, b.nodeId); err != nil {
+		if ctx.Err() == nil {
+			log.Errorf("etcd balancer campaign error: %v\n", err)
+		}
+		return
+	}
+	log.Infof("etcd balancer elected as leader, node: %s\n", b.nodeId)
+	nch := b.cli.Watch(ctx, b.key("nodes")+"/", clientv3.WithPrefix())
+	tch := b.cli.Watch(ctx, b.key("tasks")+"/", clientv3.WithPrefix())
+	ticker := time.NewTicker(reconcileInterval)
+	defer ticker.Stop()
+	for {
+		if err := b.schedule(ctx, election); err != nil {
+			log.Errorf("etcd balancer schedule error: %v\n", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case _, ok := <-nch:
+			if !ok {
+				return
+			}
+		case _, ok := <-tch:
+			if !ok {
+				return
+			}
+		case <-ticker.C:
+		}
+	}
+}
+
+// schedule 重新计算分配并写入， 写入时校验仍是主节点
+func (b *etcdBalancer) schedule(ctx context.Context, election *concurrency.Election) error {
+	nodes, err := b.nodes(ctx)
+	if err != nil {
+		return err
+	}
+	kvs, err := b.list(ctx, "tasks")
+	if err != nil {
+		return err
+	}
+	current, err := b.assigns(ctx)
+	if err != nil {
+		return err
+	}
+	tasks := make([]*taskSpec, 0, len(kvs))
+	for k, v := range kvs {
+		if id, err := strconv.Atoi(k); err == nil {
+			tasks = append(tasks, parseSpec(id, v))
+		}
+	}
+	target := b.sched.plan(tasks, nodes, current)
+
+	ops := make([]clientv3.Op, 0)
+	for id, nodeId := range target {
+		if current[id] != nodeId {
+			ops = append(ops, clientv3.OpPut(b.key("assign", strconv.Itoa(id)), nodeId))
+			log.Infof("etcd balancer assign task %d to node %s\n", id, nodeId)
+		}
+	}
+	for id := range current {
+		if _, ok := target[id]; !ok {
+			ops = append(ops, clientv3.OpDelete(b.key("assign", strconv.Itoa(id))))
+		}
+	}
+	leader := clientv3.Compare(clientv3.CreateRevision(election.Key()), "=", election.Rev())
+	for len(ops) > 0 {
+		n := len(ops)
+		if n > maxTxnOps {
+			n = maxTxnOps
+		}
+		resp, err := b.cli.Txn(ctx).If(leader).Then(ops[:n]...).Commit()
+		if err != nil {
+			return err
+		}
+		if !resp.Succeeded {
+			log.Warnf("etcd balancer no longer leader, node: %s\n", b.nodeId)
+			return nil
+		}
+		ops = ops[n:]
+	}
+	return nil
+}
+
+// list 列出目录下的 key， 返回去掉目录前缀的 key 及值
+func (b *etcdBalancer) list(ctx context.Context, dir string) (map[string]string, error) {
+	p := b.key(dir) + "/"
+	resp, err := b.cli.Get(ctx, p, clientv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string]string, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		result[strings.TrimPrefix(string(kv.Key), p)] = string(kv.Value)
+	}
+	return result, nil
+}
+
+func (b *etcdBalancer) assigns(ctx context.Context) (map[int]string, error) {
+	kvs, err := b.list(ctx, "assign")
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[int]string, len(kvs))
+	for k, v := range kvs {
+		if id, err := strconv.Atoi(k); err == nil {
+			result[id] = v
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,121 @@
+package balancer
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/gridsx/datagos/config"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/server/v3/embed"
+)
+
+func freeURL(t *testing.T) url.URL {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	u, _ := url.Parse("http://" + ln.Addr().String())
+	return *u
+}
+
+// startEtcd 进程内的单节点 etcd
+func startEtcd(t *testing.T) string {
+	cfg := embed.NewConfig()
+	cfg.Dir = t.TempDir()
+	cfg.LogLevel = "error"
+	client, peer := freeURL(t), freeURL(t)
+	cfg.ListenClientUrls, cfg.AdvertiseClientUrls = []url.URL{client}, []url.URL{client}
+	cfg.ListenPeerUrls, cfg.AdvertisePeerUrls = []url.URL{peer}, []url.URL{peer}
+	cfg.InitialCluster = fmt.Sprintf("%s=%s", cfg.Name, peer.String())
+	e, err := embed.StartEtcd(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(e.Close)
+	select {
+	case <-e.Server.ReadyNotify():
+	case <-time.After(10 * time.Second):
+		t.Fatal("etcd not ready")
+	}
+	return client.String()
+}
+
+func newTestEtcdBalancer(t *testing.T, endpoint, nodeId string, runner Runner) *etcdBalancer {
+	b, err := newEtcdBalancer(config.ClusterConfig{
+		Endpoints: []string{endpoint},
+		NodeId:    nodeId,
+		Prefix:    "/datagos-test",
+		TTL:       2,
+	}, runner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func waitFor(t *testing.T, timeout time.Duration, what string, cond func() bool) {
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s", what)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// 节点失联之后租约过期， 任务锁随之释放， 另一个节点接管任务， 失联的节点自己停止任务
+func TestLeaseTakeover(t *testing.T) {
+	endpoint := startEtcd(t)
+	r1, r2 := newFakeRunner(), newFakeRunner()
+	b1 := newTestEtcdBalancer(t, endpoint, "n1", r1)
+	if err := b1.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := b1.Submit(1, nil); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, 10*time.Second, "task started on n1", func() bool { return r1.isRunning(1) })
+
+	b2 := newTestEtcdBalancer(t, endpoint, "n2", r2)
+	if err := b2.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer b2.Stop()
+	time.Sleep(reconcileInterval)
+	if r2.isRunning(1) {
+		t.Fatal("task running on both nodes")
+	}
+
+	// 模拟 n1 失联： 关闭连接， 不释放锁也不撤销租约
+	if err := b1.cli.Close(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		b1.cancel()
+		<-b1.done
+	}()
+	waitFor(t, 20*time.Second, "task taken over by n2", func() bool { return r2.isRunning(1) })
+	if r1.isRunning(1) {
+		t.Fatal("task still running on the lost node")
+	}
+
+	cli, err := clientv3.New(clientv3.Config{Endpoints: []string{endpoint}, DialTimeout: etcdOpTimeout})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), etcdOpTimeout)
+	defer cancel()
+	resp, err := cli.Get(ctx, "/datagos-test/locks/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Kvs) != 1 || string(resp.Kvs[0].Value) != "n2" {
+		t.Fatalf("task lock: %v", resp.Kvs)
+	}
+}
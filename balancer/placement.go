@@ -0,0 +1,206 @@
+package balancer
+
+// 主节点的分配计算
+// 任务只分配到标签匹配且没有摘除的节点， 已分配且仍然合适的任务不动， 其余的分配给负载最低的节点
+// 节点之间负载相差较大时， 每隔一段时间迁移一个任务， 迁移即原节点保存位点停止， 新节点从位点启动
+
+import (
+	"sort"
+	"time"
+
+	"github.com/siddontang/go-log/log"
+)
+
+const (
+	// 负载最高的节点超过最低节点的倍数才迁移
+	rebalanceRatio = 1.5
+	// 两次迁移的最小间隔， 等待新的负载数据， 避免来回迁移
+	rebalanceInterval = time.Minute
+	// 每千条事件每秒算一个任务的负载
+	epsPerWeight = 1000
+	// 延迟每分钟算一个任务的负载， 最多十个
+	delayPerWeight = 60
+	maxDelayWeight = 10
+	// 每 GiB 内存算一个任务的负载
+	memoryPerWeight = 1 << 30
+)
+
+// scheduler 只在主节点的调度协程中使用
+type scheduler struct {
+	lastMove time.Time
+	// unplaced 没有合适节点的任务， 只在变化时打印日志
+	unplaced map[int]bool
+}
+
+func (s *scheduler) plan(tasks []*taskSpec, nodes []*Node, current map[int]string) map[int]string {
+	target := place(tasks, nodes, current)
+	if time.Since(s.lastMove) >= rebalanceInterval && rebalance(target, tasks, nodes) {
+		s.lastMove = time.Now()
+	}
+	unplaced := make(map[int]bool)
+	for _, spec := range tasks {
+		if _, ok := target[spec.Id]; ok {
+			continue
+		}
+		unplaced[spec.Id] = true
+		if !s.unplaced[spec.Id] {
+			log.Warnf("balancer no eligible node for task %d, selector: %v\n", spec.Id, spec.Selector)
+		}
+	}
+	s.unplaced = unplaced
+	return target
+}
+
+// matches 节点标签是否满足任务的选择器
+func matches(labels, selector map[string]string) bool {
+	for k, v := range selector {
+		if labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+func eligible(n *Node, spec *taskSpec) bool {
+	return !n.Draining && matches(n.Labels, spec.Selector)
+}
+
+// weight 任务的负载， 基础为1， 加上事件速率、延迟和缓冲占用的内存
+func weight(l *Load) float64 {
+	if l == nil {
+		return 1
+	}
+	delay := float64(l.Delay) / delayPerWeight
+	if delay > maxDelayWeight {
+		delay = maxDelayWeight
+	}
+	return 1 + l.EventsPerSecond/epsPerWeight + delay + float64(l.Memory)/memoryPerWeight
+}
+
+// taskWeights 各任务的负载， 取自运行该任务的节点上报的数据
+func taskWeights(nodes []*Node) map[int]float64 {
+	weights := make(map[int]float64)
+	for _, n := range nodes {
+		for id, l := range n.Loads {
+			weights[id] = weight(l)
+		}
+	}
+	return weights
+}
+
+// scores 按分配结果计算各节点的负载
+func scores(target map[int]string, nodes []*Node, weights map[int]float64) map[string]float64 {
+	result := make(map[string]float64, len(nodes))
+	for _, n := range nodes {
+		// 任务的内存随任务计入， 节点只计其余的部分
+		memory := n.Memory
+		for _, l := range n.Loads {
+			if l.Memory < memory {
+				memory -= l.Memory
+			} else {
+				memory = 0
+			}
+		}
+		result[n.Id] = float64(memory) / memoryPerWeight
+	}
+	for id, nodeId := range target {
+		if _, ok := result[nodeId]; ok {
+			result[nodeId] += taskWeight(weights, id)
+		}
+	}
+	return result
+}
+
+func taskWeight(weights map[int]float64, id int) float64 {
+	if w, ok := weights[id]; ok {
+		return w
+	}
+	return 1
+}
+
+// place 计算任务分配， 没有合适节点的任务不分配
+func place(tasks []*taskSpec, nodes []*Node, current map[int]string) map[int]string {
+	index := make(map[string]*Node, len(nodes))
+	for _, n := range nodes {
+		index[n.Id] = n
+	}
+	weights := taskWeights(nodes)
+	target := make(map[int]string, len(tasks))
+	pending := make([]*taskSpec, 0)
+	for _, spec := range tasks {
+		if n, ok := index[current[spec.Id]]; ok && eligible(n, spec) {
+			target[spec.Id] = n.Id
+			continue
+		}
+		pending = append(pending, spec)
+	}
+	// 负载大的先分配
+	sort.Slice(pending, func(i, j int) bool {
+		wi, wj := taskWeight(weights, pending[i].Id), taskWeight(weights, pending[j].Id)
+		if wi != wj {
+			return wi > wj
+		}
+		return pending[i].Id < pending[j].Id
+	})
+	load := scores(target, nodes, weights)
+	for _, spec := range pending {
+		var best *Node
+		for _, n := range nodes {
+			if !eligible(n, spec) {
+				continue
+			}
+			if best == nil || load[n.Id] < load[best.Id] || (load[n.Id] == load[best.Id] && n.Id < best.Id) {
+				best = n
+			}
+		}
+		if best == nil {
+			continue
+		}
+		target[spec.Id] = best.Id
+		load[best.Id] += taskWeight(weights, spec.Id)
+	}
+	return target
+}
+
+// rebalance 从负载最高的节点迁移一个任务到负载最低的节点， 迁移之后两者的差距要变小
+func rebalance(target map[int]string, tasks []*taskSpec, nodes []*Node) bool {
+	var from, to *Node
+	weights := taskWeights(nodes)
+	load := scores(target, nodes, weights)
+	for _, n := range nodes {
+		if n.Draining {
+			continue
+		}
+		if from == nil || load[n.Id] > load[from.Id] {
+			from = n
+		}
+		if to == nil || load[n.Id] < load[to.Id] {
+			to = n
+		}
+	}
+	if from == nil || from == to || load[from.Id] <= load[to.Id]*rebalanceRatio {
+		return false
+	}
+	gap := load[from.Id] - load[to.Id]
+	var move *taskSpec
+	for _, spec := range tasks {
+		if target[spec.Id] != from.Id || !eligible(to, spec) {
+			continue
+		}
+		w := taskWeight(weights, spec.Id)
+		// 任务负载接近差距时迁移过去只是两个节点对调， 内存的波动也会让差距在任务负载上下浮动
+		if w >= gap*3/4 {
+			continue
+		}
+		if move == nil || w > taskWeight(weights, move.Id) {
+			move = spec
+		}
+	}
+	if move == nil {
+		return false
+	}
+	target[move.Id] = to.Id
+	log.Infof("balancer rebalance task %d from node %s (%.2f) to node %s (%.2f)\n",
+		move.Id, from.Id, load[from.Id], to.Id, load[to.Id])
+	return true
+}
@@ -0,0 +1,67 @@
+package blender
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/go-mysql-org/go-mysql/canal"
+	"github.com/gridsx/datagos/common"
+	"github.com/siddontang/go-log/log"
+)
+
+// heartbeatWriter 定时向源库的心跳表写入当前时间， 源库没有写入时也能测得延迟
+type heartbeatWriter struct {
+	c        *canal.Canal
+	taskId   int
+	table    string
+	interval time.Duration
+	done     chan struct{}
+}
+
+func newHeartbeatWriter(c *canal.Canal, cfg *common.HeartbeatConfig, taskId int) *heartbeatWriter {
+	schema, table := cfg.Schema()
+	return &heartbeatWriter{
+		c:        c,
+		taskId:   taskId,
+		table:    fmt.Sprintf("`%s`.`%s`", schema, table),
+		interval: cfg.Interval(),
+	}
+}
+
+func (w *heartbeatWriter) start() {
+	w.done = make(chan struct{})
+	go w.run(w.done)
+}
+
+func (w *heartbeatWriter) stop() {
+	if w.done != nil {
+		close(w.done)
+		w.done = nil
+	}
+}
+
+func (w *heartbeatWriter) run(done chan struct{}) {
+	create := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (%s INT NOT NULL PRIMARY KEY, %s BIGINT NOT NULL)",
+		w.table, common.HeartbeatTaskColumn, common.HeartbeatTsColumn)
+	if _, err := w.c.Execute(create); err != nil {
+		log.Warnf("heartbeat create table error, table: %s, err: %v\n", w.table, err)
+	}
+	upsert := fmt.Sprintf("INSERT INTO %s (%s, %s) VALUES (?, ?) ON DUPLICATE KEY UPDATE %s = VALUES(%s)",
+		w.table, common.HeartbeatTaskColumn, common.HeartbeatTsColumn, common.HeartbeatTsColumn, common.HeartbeatTsColumn)
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	// 连续失败只打印一次
+	failed := false
+	for {
+		_, err := w.c.Execute(upsert, w.taskId, time.Now().UnixMilli())
+		if err != nil && !failed {
+			log.Warnf("heartbeat write error, table: %s, err: %v\n", w.table, err)
+		}
+		failed = err != nil
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
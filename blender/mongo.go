@@ -0,0 +1,196 @@
+package blender
+
+import (
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-mysql-org/go-mysql/canal"
+	"github.com/go-mysql-org/go-mysql/mysql"
+	mongoCanal "github.com/gridsx/datagos/canal/mongo"
+	"github.com/gridsx/datagos/common"
+	"github.com/gridsx/datagos/task"
+	"github.com/siddontang/go-log/log"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// mongoTaskInfo 保存在任务 info 字段中的位点， resume token 以扩展 json 保存
+type mongoTaskInfo struct {
+	ResumeToken  json.RawMessage `json:"resumeToken,omitempty"`
+	SnapshotDone bool            `json:"snapshotDone"`
+}
+
+// MongoTask change stream 任务， 位点为 resume token
+type MongoTask struct {
+	taskStats
+	c            *mongoCanal.Canal
+	running      bool
+	seconds      int64
+	lock         sync.Mutex
+	mgr          *task.Task
+	pipeline     *common.Pipeline
+	snapshotDone bool
+	token        bson.Raw
+}
+
+// Start 阻塞直到任务停止或出错
+func (t *MongoTask) Start() error {
+	if t.running {
+		log.Warnf("mongo task start, already running, task: %s\n", t.mgr.Title)
+		return nil
+	}
+	err := t.mgr.UpdateTaskState(task.Running)
+	if err != nil {
+		return err
+	}
+	t.running = true
+	t.updateToken()
+	if err := t.c.Run(t.token); err != nil {
+		log.Errorf("mongo task stopped with error, task: %s, err: %v\n", t.mgr.Title, err)
+		t.Stop()
+		return err
+	}
+	return t.pipeline.Failed()
+}
+
+// 定时保存 resume token
+func (t *MongoTask) updateToken() {
+	go func() {
+		for {
+			if t.running {
+				time.Sleep(time.Second)
+				nowSecond := time.Now().Unix()
+				lastSecond := atomic.LoadInt64(&t.seconds)
+				if nowSecond-lastSecond > binlogPosSaveDuration {
+					atomic.StoreInt64(&t.seconds, nowSecond)
+					t.updateTaskToken()
+				}
+			} else {
+				break
+			}
+		}
+	}()
+}
+
+// Stop 停止任务， 停止前保存 resume token
+func (t *MongoTask) Stop() {
+	if !t.running {
+		log.Warnf("mongo task stop already stopped, task id : %d\n", t.mgr.Id)
+		return
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.running = false
+	t.updateTaskToken()
+	uerr := t.mgr.UpdateTaskState(stopState(t.pipeline))
+	if uerr != nil {
+		log.Errorf("error updating instance state: %v\n", uerr)
+	}
+	t.c.Close()
+	t.pipeline.Close()
+}
+
+// updateTaskToken 先取 token 再 flush， flush 成功之后才保存
+func (t *MongoTask) updateTaskToken() {
+	token := t.c.ResumeToken()
+	if token == nil {
+		return
+	}
+	if err := t.pipeline.Flush(); err != nil {
+		log.Errorf("error flushing sinkers, resume token not saved: %v\n", err)
+		return
+	}
+	t.saveInfo(token)
+}
+
+func (t *MongoTask) saveInfo(token bson.Raw) {
+	info := &mongoTaskInfo{SnapshotDone: t.snapshotDone}
+	if token != nil {
+		d, err := bson.MarshalExtJSON(token, true, false)
+		if err != nil {
+			log.Errorf("error marshaling resume token: %v\n", err)
+			return
+		}
+		info.ResumeToken = d
+	}
+	d, _ := json.Marshal(info)
+	if err := t.mgr.UpdateTaskInfo(string(d)); err != nil {
+		log.Errorf("error updating instance resume token: %v\n", err)
+		return
+	}
+	t.onCheckpoint()
+}
+
+func (t *MongoTask) OnRow(e *canal.RowsEvent, pos mysql.Position) error {
+	t.onEvent(e)
+	t.pipeline.OnRow(e, pos, "")
+	return nil
+}
+
+// OnSnapshotFinish 全量完成之后 flush 并记录全量之后开始消费的位置， 之后重启不再重新全量
+func (t *MongoTask) OnSnapshotFinish(token bson.Raw) error {
+	if err := t.pipeline.Flush(); err != nil {
+		return err
+	}
+	t.snapshotDone = true
+	t.setSnapshotDone(true)
+	t.saveInfo(token)
+	log.Infof("mongo snapshot finished, task: %s\n", t.mgr.Title)
+	return nil
+}
+
+func (t *MongoTask) Running() bool {
+	return t.running
+}
+
+// Restarting 暂停的 sinker 已经恢复， 停止之后需要从保存的位点重新开始
+func (t *MongoTask) Restarting() bool {
+	return t.pipeline.Restarting()
+}
+
+func (t *MongoTask) Stats() TaskStats {
+	return t.collect(t.pipeline)
+}
+
+func NewMongoTask(t *task.Task) *MongoTask {
+	if t.SrcType != int(task.SrcMongo) {
+		return nil
+	}
+	pipeline := buildPipeline(t)
+	if pipeline == nil {
+		return nil
+	}
+	info := new(mongoTaskInfo)
+	if t.Info != nil && len(*t.Info) > 0 {
+		if err := json.Unmarshal([]byte(*t.Info), info); err != nil {
+			log.Warnf("NewMongoTask invalid task info, ignored: %v\n", err)
+		}
+	}
+	var token bson.Raw
+	if len(info.ResumeToken) > 0 {
+		if err := bson.UnmarshalExtJSON(info.ResumeToken, true, &token); err != nil {
+			log.Errorf("NewMongoTask invalid resume token: %s\n", string(info.ResumeToken))
+			return nil
+		}
+	}
+
+	cx, err := mongoCanal.NewMongoCanal(t.Src)
+	if err != nil {
+		log.Errorf("NewMongoTask create canal failed: %v\n", err)
+		return nil
+	}
+	mt := &MongoTask{
+		c:            cx,
+		mgr:          t,
+		pipeline:     pipeline,
+		snapshotDone: info.SnapshotDone,
+		token:        token,
+	}
+	// 有 resume token 的时候不会再做全量
+	mt.setSnapshotDone(info.SnapshotDone || token != nil || !cx.SnapshotEnabled())
+	pipeline.SetOnFail(func(err error) { go mt.Stop() })
+	pipeline.SetOnRestart(func() { go mt.Stop() })
+	cx.SetEventHandler(mt)
+	return mt
+}
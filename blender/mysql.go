@@ -4,13 +4,25 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	mysqlCanal "github.com/gridsx/datagos/canal/mysql"
+	"github.com/gridsx/datagos/canal/mysql/meta"
 	"github.com/gridsx/datagos/common"
+	"github.com/gridsx/datagos/deadletter"
+	clickhouseSinker "github.com/gridsx/datagos/sinker/clickhouse"
+	esSinker "github.com/gridsx/datagos/sinker/es"
+	fileSinker "github.com/gridsx/datagos/sinker/file"
+	kafkaSinker "github.com/gridsx/datagos/sinker/kafka"
+	mongoSinker "github.com/gridsx/datagos/sinker/mongo"
 	mysqlSinker "github.com/gridsx/datagos/sinker/mysql"
+	postgresSinker "github.com/gridsx/datagos/sinker/postgres"
+	redisSinker "github.com/gridsx/datagos/sinker/redis"
+	rocketmqSinker "github.com/gridsx/datagos/sinker/rocketmq"
+	webhookSinker "github.com/gridsx/datagos/sinker/webhook"
 	"github.com/gridsx/datagos/task"
 
 	"github.com/go-mysql-org/go-mysql/canal"
@@ -23,7 +35,13 @@ const dumpExec = "mysqldump"
 // binlog 位置5秒保存一次
 const binlogPosSaveDuration int64 = 5
 
+// mysqlTaskInfo 保存在任务 info 字段中的位点
+type mysqlTaskInfo struct {
+	Position *mysql.Position `json:"position"`
+}
+
 type CanalTask struct {
+	taskStats
 	c          *canal.Canal
 	dumpFinish chan bool
 	dump       bool
@@ -32,10 +50,16 @@ type CanalTask struct {
 	seconds    int64
 	lock       sync.Mutex
 	mgr        *task.Task
+	pipeline   *common.Pipeline
+	// pos 保存的位点， 有位点时从位点继续， 不再全量
+	pos *mysql.Position
+	// heartbeat 没有配置心跳时为 nil
+	heartbeat *heartbeatWriter
 }
 
+// onDumpFinish 全量完成之后保存的位点即为 dump 的位点， 下次启动从位点继续， 不再 dump
 func (t *CanalTask) onDumpFinish() {
-	//  TODO 记录dump是否完成， 如果已经完成， 那么下次开始的时候，则不需要dump
+	t.setSnapshotDone(true)
 }
 
 // Start 开始任务, 如果任务中包含全量， 则新起slave 监听
@@ -52,6 +76,9 @@ func (t *CanalTask) Start() error {
 	}
 	t.running = true
 	t.updateBinlog()
+	if t.heartbeat != nil {
+		t.heartbeat.start()
+	}
 
 	// dump 数据， 如果存在全量配置，那么就先全量，后增量
 	if t.dump {
@@ -65,9 +92,8 @@ func (t *CanalTask) Start() error {
 
 	// 如果任务本身有position， 拿任务本身的position， 没有的话拿当前binlog点位
 	var pos *mysql.Position
-	if t == nil {
-		// TODO 记录POSITION 相关
-		//pos = t.Inst.Position
+	if t.pos != nil {
+		pos = t.pos
 	} else {
 		if t.dump {
 			syncedPos := t.c.SyncedPosition()
@@ -91,10 +117,10 @@ func (t *CanalTask) Start() error {
 		t.Stop()
 		return runErr
 	}
-	return nil
+	return t.pipeline.Failed()
 }
 
-//  定时任务更新 slave的binlog同步到什么地方的位点信息
+// 定时任务更新 slave的binlog同步到什么地方的位点信息
 func (t *CanalTask) updateBinlog() {
 	go func() {
 		for {
@@ -123,37 +149,62 @@ func (t *CanalTask) Stop() {
 	defer t.lock.Unlock()
 	t.running = false
 	t.updateTaskBinlog()
-	uerr := t.mgr.UpdateTaskState(task.Stopped)
+	uerr := t.mgr.UpdateTaskState(stopState(t.pipeline))
 	if uerr != nil {
 		log.Errorf("error updating instance state: %v\n", uerr)
 	}
+	if t.heartbeat != nil {
+		t.heartbeat.stop()
+	}
 	t.c.Close()
+	t.pipeline.Close()
 }
 
 func (t *CanalTask) updateTaskBinlog() {
-	infoMap := make(map[string]interface{}, 1)
-	infoMap["position"] = t.c.SyncedPosition()
-	d, _ := json.Marshal(infoMap)
+	// 先取位点再flush， 位点之前的事件都已经交给了sinker， flush 之后即可认为已经落地
+	pos := t.c.SyncedPosition()
+	// 还没有开始同步， 不能覆盖保存的位点
+	if len(pos.Name) == 0 {
+		return
+	}
+	if err := t.pipeline.Flush(); err != nil {
+		log.Errorf("error flushing sinkers, position not saved: %v\n", err)
+		return
+	}
+	d, _ := json.Marshal(&mysqlTaskInfo{Position: &pos})
 	err := t.mgr.UpdateTaskInfo(string(d))
 	if err != nil {
 		log.Errorf("error updating instance position: %v\n", err)
+		return
 	}
+	t.onCheckpoint()
 }
 
 func (t *CanalTask) Running() bool {
 	return t.running
 }
 
+// Restarting 暂停的 sinker 已经恢复， 停止之后需要从保存的位点重新开始
+func (t *CanalTask) Restarting() bool {
+	return t.pipeline.Restarting()
+}
+
 func (t *CanalTask) GetDelay() uint32 {
 	return t.c.GetDelay()
 }
 
+func (t *CanalTask) Stats() TaskStats {
+	stats := t.collect(t.pipeline)
+	stats.Delay = t.GetDelay()
+	return stats
+}
+
 func NewMySQLCanalTask(t *task.Task) *CanalTask {
 	if t.SrcType != int(task.SrcMySQL) {
 		return nil
 	}
-	sinkers := builderSinkers(t)
-	if sinkers == nil {
+	pipeline := buildPipeline(t)
+	if pipeline == nil {
 		return nil
 	}
 
@@ -162,35 +213,87 @@ func NewMySQLCanalTask(t *task.Task) *CanalTask {
 		log.Errorln("NewMySQLCanalTask create canal failed!")
 		return nil
 	}
+	src := new(meta.MySQLSrcConfig)
+	_ = json.Unmarshal([]byte(t.Src), src)
 
-	cx.SetEventHandler(&mysqlSinker.MySQLBinlogHandler{Sinkers: sinkers, C: cx})
-	return &CanalTask{
+	cx.SetEventHandler(&mysqlSinker.MySQLBinlogHandler{Pipeline: pipeline, C: cx})
+	ct := &CanalTask{
 		c:          cx,
 		dumpFinish: make(chan bool),
 		dump:       dump,
 		key:        fmt.Sprintf("%d", t.Id),
 		lock:       sync.Mutex{},
 		mgr:        t,
+		pipeline:   pipeline,
+	}
+	if t.Info != nil && len(*t.Info) > 0 {
+		info := &mysqlTaskInfo{}
+		if err := json.Unmarshal([]byte(*t.Info), info); err != nil {
+			log.Warnf("NewMySQLCanalTask invalid task info, ignored: %v\n", err)
+		} else if info.Position != nil && len(info.Position.Name) > 0 {
+			// 有位点的时候从位点继续， 全量已经完成
+			ct.pos = info.Position
+			ct.dump = false
+		}
+	}
+	ct.setSnapshotDone(!ct.dump)
+	// 在处理事件的协程中回调， 异步停止， 停止时 flush 失败不会保存出错事件之后的位点
+	pipeline.SetOnFail(func(err error) { go ct.Stop() })
+	pipeline.SetOnRestart(func() { go ct.Stop() })
+	if src.Heartbeat != nil {
+		pipeline.SetHeartbeat(src.Heartbeat, t.Id)
+		ct.heartbeat = newHeartbeatWriter(cx, src.Heartbeat, t.Id)
 	}
+	return ct
 }
 
-func builderSinkers(t *task.Task) []common.Sinker {
+// buildPipeline 按任务的目标创建 sinker， 任意一个创建失败返回 nil
+func buildPipeline(t *task.Task) *common.Pipeline {
 	dest, err := t.GetDest()
 	if err != nil {
 		return nil
 	}
-	sinkers := make([]common.Sinker, 0, len(dest))
+	pipeline := common.NewPipeline(strconv.Itoa(t.Id))
 	for _, d := range dest {
-		switch d.Type {
-		case int(task.DestMySQL):
-			sinkers = append(sinkers, mysqlSinker.Build(d.Config))
-		case int(task.DestEs):
-		case int(task.DestMongo):
-		case int(task.DestRedis):
-		case int(task.DestRocketMQ):
-		case int(task.DestPostgres):
-		default:
+		s, err := BuildSinker(d)
+		if err != nil {
+			log.Errorf("error building sinker, dest: %s, err: %v\n", d.Name, err)
+			return nil
 		}
+		if s != nil {
+			pipeline.Add(d.Name, s, common.ParseRetryPolicy(d.Config))
+		}
+	}
+	if store := deadletter.Default(); store != nil {
+		pipeline.SetDeadLetter(deadletter.NewWriter(store, t.Id))
+	}
+	return pipeline
+}
+
+// BuildSinker 按目标的类型创建 sinker， 未知的类型返回 nil
+func BuildSinker(d *task.Dest) (common.Sinker, error) {
+	switch d.Type {
+	case int(task.DestMySQL):
+		return mysqlSinker.Build(d.Config), nil
+	case int(task.DestEs):
+		return esSinker.Build(d.Config)
+	case int(task.DestMongo):
+		return mongoSinker.Build(d.Config)
+	case int(task.DestRedis):
+		return redisSinker.Build(d.Config)
+	case int(task.DestRocketMQ):
+		return rocketmqSinker.Build(d.Config)
+	case int(task.DestPostgres):
+		return postgresSinker.Build(d.Config)
+	case int(task.DestKafka):
+		return kafkaSinker.Build(d.Config)
+	case int(task.DestClickHouse):
+		return clickhouseSinker.Build(d.Config)
+	case int(task.DestFile):
+		return fileSinker.Build(d.Config)
+	case int(task.DestWebhook):
+		return webhookSinker.Build(d.Config)
+	default:
+		return nil, nil
 	}
-	return sinkers
 }
@@ -0,0 +1,203 @@
+package blender
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-mysql-org/go-mysql/canal"
+	"github.com/go-mysql-org/go-mysql/mysql"
+	pgCanal "github.com/gridsx/datagos/canal/postgres"
+	"github.com/gridsx/datagos/common"
+	"github.com/gridsx/datagos/task"
+	"github.com/jackc/pglogrepl"
+	"github.com/siddontang/go-log/log"
+)
+
+// postgresTaskInfo 保存在任务 info 字段中的位点
+type postgresTaskInfo struct {
+	LSN          string `json:"lsn"`
+	SnapshotDone bool   `json:"snapshotDone"`
+}
+
+// PostgresTask 逻辑复制任务， 位点为 LSN
+// 定时 flush sinker 之后再向服务端确认 LSN， 保证确认之前的数据都已经落地
+type PostgresTask struct {
+	taskStats
+	c            *pgCanal.Canal
+	running      bool
+	seconds      int64
+	lock         sync.Mutex
+	mgr          *task.Task
+	pipeline     *common.Pipeline
+	snapshotDone bool
+	startLSN     pglogrepl.LSN
+}
+
+// Start 阻塞直到任务停止或出错
+func (t *PostgresTask) Start() error {
+	if t.running {
+		log.Warnf("postgres task start, already running, task: %s\n", t.mgr.Title)
+		return nil
+	}
+	err := t.mgr.UpdateTaskState(task.Running)
+	if err != nil {
+		return err
+	}
+	t.running = true
+	t.updateLSN()
+	if err := t.c.Run(t.startLSN); err != nil {
+		log.Errorf("postgres task stopped with error, task: %s, err: %v\n", t.mgr.Title, err)
+		t.Stop()
+		return err
+	}
+	return t.pipeline.Failed()
+}
+
+// 定时保存并确认 LSN
+func (t *PostgresTask) updateLSN() {
+	go func() {
+		for {
+			if t.running {
+				time.Sleep(time.Second)
+				nowSecond := time.Now().Unix()
+				lastSecond := atomic.LoadInt64(&t.seconds)
+				if nowSecond-lastSecond > binlogPosSaveDuration {
+					atomic.StoreInt64(&t.seconds, nowSecond)
+					t.updateTaskLSN()
+				}
+			} else {
+				break
+			}
+		}
+	}()
+}
+
+// Stop 停止任务， 停止前保存 LSN
+func (t *PostgresTask) Stop() {
+	if !t.running {
+		log.Warnf("postgres task stop already stopped, task id : %d\n", t.mgr.Id)
+		return
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.running = false
+	t.updateTaskLSN()
+	uerr := t.mgr.UpdateTaskState(stopState(t.pipeline))
+	if uerr != nil {
+		log.Errorf("error updating instance state: %v\n", uerr)
+	}
+	t.c.Close()
+	t.pipeline.Close()
+}
+
+// updateTaskLSN 先取 LSN 再 flush， flush 成功之后才确认给服务端并保存
+func (t *PostgresTask) updateTaskLSN() {
+	lsn := t.c.ReceivedLSN()
+	if lsn == 0 {
+		return
+	}
+	if err := t.pipeline.Flush(); err != nil {
+		log.Errorf("error flushing sinkers, lsn not confirmed: %v\n", err)
+		return
+	}
+	t.c.Confirm(lsn)
+	t.saveInfo(lsn)
+}
+
+func (t *PostgresTask) saveInfo(lsn pglogrepl.LSN) {
+	d, _ := json.Marshal(&postgresTaskInfo{LSN: lsn.String(), SnapshotDone: t.snapshotDone})
+	if err := t.mgr.UpdateTaskInfo(string(d)); err != nil {
+		log.Errorf("error updating instance lsn: %v\n", err)
+		return
+	}
+	t.onCheckpoint()
+}
+
+// OnRow 与 MySQL 一致， 先告知位点再交给 sinker， 位点的文件名为 LSN
+func (t *PostgresTask) OnRow(e *canal.RowsEvent, lsn pglogrepl.LSN) error {
+	var pos mysql.Position
+	if lsn > 0 {
+		pos = mysql.Position{Name: lsn.String()}
+	}
+	t.onEvent(e)
+	t.pipeline.OnRow(e, pos, "")
+	return nil
+}
+
+// OnCommit 源库事务提交， 通知需要感知事务边界的sinker
+func (t *PostgresTask) OnCommit(lsn pglogrepl.LSN) error {
+	t.pipeline.OnCommit()
+	return nil
+}
+
+// OnSnapshotFinish 全量完成之后 flush 并记录， 之后重启不再重新全量
+func (t *PostgresTask) OnSnapshotFinish() error {
+	if err := t.pipeline.Flush(); err != nil {
+		return err
+	}
+	t.snapshotDone = true
+	t.setSnapshotDone(true)
+	t.saveInfo(t.startLSN)
+	log.Infof("postgres snapshot finished, task: %s\n", t.mgr.Title)
+	return nil
+}
+
+func (t *PostgresTask) Running() bool {
+	return t.running
+}
+
+// Restarting 暂停的 sinker 已经恢复， 停止之后需要从保存的位点重新开始
+func (t *PostgresTask) Restarting() bool {
+	return t.pipeline.Restarting()
+}
+
+func (t *PostgresTask) Stats() TaskStats {
+	return t.collect(t.pipeline)
+}
+
+func NewPostgresTask(t *task.Task) *PostgresTask {
+	if t.SrcType != int(task.SrcPostgres) {
+		return nil
+	}
+	pipeline := buildPipeline(t)
+	if pipeline == nil {
+		return nil
+	}
+	info := new(postgresTaskInfo)
+	if t.Info != nil && len(*t.Info) > 0 {
+		if err := json.Unmarshal([]byte(*t.Info), info); err != nil {
+			log.Warnf("NewPostgresTask invalid task info, ignored: %v\n", err)
+		}
+	}
+	var startLSN pglogrepl.LSN
+	if len(info.LSN) > 0 {
+		lsn, err := pglogrepl.ParseLSN(info.LSN)
+		if err != nil {
+			log.Errorf("NewPostgresTask invalid lsn: %s\n", info.LSN)
+			return nil
+		}
+		startLSN = lsn
+	}
+
+	cx, err := pgCanal.NewPostgresCanal(t.Src, fmt.Sprintf("%d", t.Id))
+	if err != nil {
+		log.Errorf("NewPostgresTask create canal failed: %v\n", err)
+		return nil
+	}
+	cx.SetSnapshotDone(info.SnapshotDone)
+	pt := &PostgresTask{
+		c:            cx,
+		mgr:          t,
+		pipeline:     pipeline,
+		snapshotDone: info.SnapshotDone,
+		startLSN:     startLSN,
+	}
+	pt.setSnapshotDone(info.SnapshotDone || !cx.SnapshotEnabled())
+	pipeline.SetOnFail(func(err error) { go pt.Stop() })
+	pipeline.SetOnRestart(func() { go pt.Stop() })
+	cx.SetEventHandler(pt)
+	return pt
+}
@@ -0,0 +1,185 @@
+package blender
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-mysql-org/go-mysql/canal"
+	"github.com/go-mysql-org/go-mysql/mysql"
+	redisCanal "github.com/gridsx/datagos/canal/redis"
+	"github.com/gridsx/datagos/common"
+	"github.com/gridsx/datagos/task"
+	"github.com/siddontang/go-log/log"
+)
+
+// redisTaskInfo 保存在任务 info 字段中的位点
+type redisTaskInfo struct {
+	ReplID string `json:"replId"`
+	Offset int64  `json:"offset"`
+	// DB 偏移量处命令流选择的库， 部分同步之后主库不会重新发送 SELECT
+	DB int `json:"db"`
+}
+
+// RedisTask 从库复制任务， 位点为 replid 和复制偏移量
+type RedisTask struct {
+	taskStats
+	c        *redisCanal.Canal
+	running  bool
+	seconds  int64
+	lock     sync.Mutex
+	mgr      *task.Task
+	pipeline *common.Pipeline
+	info     redisTaskInfo
+}
+
+// Start 阻塞直到任务停止或出错
+func (t *RedisTask) Start() error {
+	if t.running {
+		log.Warnf("redis task start, already running, task: %s\n", t.mgr.Title)
+		return nil
+	}
+	err := t.mgr.UpdateTaskState(task.Running)
+	if err != nil {
+		return err
+	}
+	t.running = true
+	t.updateOffset()
+	if err := t.c.Run(t.info.ReplID, t.info.Offset, t.info.DB); err != nil {
+		log.Errorf("redis task stopped with error, task: %s, err: %v\n", t.mgr.Title, err)
+		t.Stop()
+		// 源库清空了同步的库， 重启之后还是同样的位置， 记录为失败
+		if errors.Is(err, redisCanal.ErrFlushed) {
+			if uerr := t.mgr.UpdateTaskState(task.Failed); uerr != nil {
+				log.Errorf("error updating instance state: %v\n", uerr)
+			}
+		}
+		return err
+	}
+	return t.pipeline.Failed()
+}
+
+// 定时保存复制偏移量
+func (t *RedisTask) updateOffset() {
+	go func() {
+		for {
+			if t.running {
+				time.Sleep(time.Second)
+				nowSecond := time.Now().Unix()
+				lastSecond := atomic.LoadInt64(&t.seconds)
+				if nowSecond-lastSecond > binlogPosSaveDuration {
+					atomic.StoreInt64(&t.seconds, nowSecond)
+					t.updateTaskOffset()
+				}
+			} else {
+				break
+			}
+		}
+	}()
+}
+
+// Stop 停止任务， 停止前保存复制偏移量
+func (t *RedisTask) Stop() {
+	if !t.running {
+		log.Warnf("redis task stop already stopped, task id : %d\n", t.mgr.Id)
+		return
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.running = false
+	t.updateTaskOffset()
+	uerr := t.mgr.UpdateTaskState(stopState(t.pipeline))
+	if uerr != nil {
+		log.Errorf("error updating instance state: %v\n", uerr)
+	}
+	t.c.Close()
+	t.pipeline.Close()
+}
+
+// updateTaskOffset 先取偏移量再 flush， flush 成功之后才保存
+func (t *RedisTask) updateTaskOffset() {
+	replID, offset, db := t.c.Position()
+	if len(replID) == 0 {
+		return
+	}
+	if err := t.pipeline.Flush(); err != nil {
+		log.Errorf("error flushing sinkers, offset not saved: %v\n", err)
+		return
+	}
+	t.saveInfo(replID, offset, db)
+}
+
+func (t *RedisTask) saveInfo(replID string, offset int64, db int) {
+	d, _ := json.Marshal(&redisTaskInfo{ReplID: replID, Offset: offset, DB: db})
+	if err := t.mgr.UpdateTaskInfo(string(d)); err != nil {
+		log.Errorf("error updating instance offset: %v\n", err)
+		return
+	}
+	t.onCheckpoint()
+}
+
+func (t *RedisTask) OnRow(e *canal.RowsEvent, pos mysql.Position) error {
+	t.onEvent(e)
+	t.pipeline.OnRow(e, pos, "")
+	return nil
+}
+
+// OnCommit 一条命令或者一个事务处理完成， 通知需要感知事务边界的sinker
+func (t *RedisTask) OnCommit() error {
+	t.pipeline.OnCommit()
+	return nil
+}
+
+// OnFullSync 全量完成之后 flush 并保存位点， 之后重启从这里部分同步
+func (t *RedisTask) OnFullSync(replID string, offset int64) error {
+	if err := t.pipeline.Flush(); err != nil {
+		return err
+	}
+	t.setSnapshotDone(true)
+	t.saveInfo(replID, offset, 0)
+	log.Infof("redis full sync finished, task: %s\n", t.mgr.Title)
+	return nil
+}
+
+func (t *RedisTask) Running() bool {
+	return t.running
+}
+
+// Restarting 暂停的 sinker 已经恢复， 停止之后需要从保存的位点重新开始
+func (t *RedisTask) Restarting() bool {
+	return t.pipeline.Restarting()
+}
+
+func (t *RedisTask) Stats() TaskStats {
+	return t.collect(t.pipeline)
+}
+
+func NewRedisTask(t *task.Task) *RedisTask {
+	if t.SrcType != int(task.SrcRedis) {
+		return nil
+	}
+	pipeline := buildPipeline(t)
+	if pipeline == nil {
+		return nil
+	}
+	rt := &RedisTask{mgr: t, pipeline: pipeline}
+	if t.Info != nil && len(*t.Info) > 0 {
+		if err := json.Unmarshal([]byte(*t.Info), &rt.info); err != nil {
+			log.Warnf("NewRedisTask invalid task info, ignored: %v\n", err)
+		}
+	}
+	cx, err := redisCanal.NewRedisCanal(t.Src)
+	if err != nil {
+		log.Errorf("NewRedisTask create canal failed: %v\n", err)
+		return nil
+	}
+	rt.c = cx
+	// 有复制位点的时候部分同步， 不再全量
+	rt.setSnapshotDone(len(rt.info.ReplID) > 0)
+	pipeline.SetOnFail(func(err error) { go rt.Stop() })
+	pipeline.SetOnRestart(func() { go rt.Stop() })
+	cx.SetEventHandler(rt)
+	return rt
+}
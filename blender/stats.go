@@ -0,0 +1,76 @@
+package blender
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/go-mysql-org/go-mysql/canal"
+	"github.com/gridsx/datagos/common"
+	"github.com/gridsx/datagos/task"
+)
+
+// TaskStats 任务的运行统计， 用于调度时衡量负载以及监控
+type TaskStats struct {
+	Events       uint64               // 收到的行事件数
+	Delay        uint32               // 最近一个事件的延迟， 秒
+	Buffered     uint64               // 上次保存位点之后收到的数据大小， 字节， 估算任务缓冲占用的内存
+	Checkpoint   time.Time            // 最近一次保存位点的时间
+	SnapshotDone bool                 // 全量已经完成或者不需要全量
+	Health       string               // running, degraded, paused-on-error, failed
+	Sinkers      []common.SinkerState // 各 sinker 的状态
+}
+
+// taskStats 各任务共用的统计， 嵌入到任务中
+type taskStats struct {
+	checkpoint int64
+	delay      uint32
+	snapshot   int32
+}
+
+// onEvent 全量的事件没有 header， 不更新延迟
+func (s *taskStats) onEvent(e *canal.RowsEvent) {
+	if e.Header == nil || e.Header.Timestamp == 0 {
+		return
+	}
+	var delay uint32
+	if now := uint32(time.Now().Unix()); now > e.Header.Timestamp {
+		delay = now - e.Header.Timestamp
+	}
+	atomic.StoreUint32(&s.delay, delay)
+}
+
+// onCheckpoint 位点保存成功
+func (s *taskStats) onCheckpoint() {
+	atomic.StoreInt64(&s.checkpoint, time.Now().Unix())
+}
+
+func (s *taskStats) setSnapshotDone(done bool) {
+	var v int32
+	if done {
+		v = 1
+	}
+	atomic.StoreInt32(&s.snapshot, v)
+}
+
+func (s *taskStats) collect(p *common.Pipeline) TaskStats {
+	stats := TaskStats{
+		Events:       p.Events(),
+		Delay:        atomic.LoadUint32(&s.delay),
+		Buffered:     p.Buffered(),
+		SnapshotDone: atomic.LoadInt32(&s.snapshot) == 1,
+		Health:       p.Health(),
+		Sinkers:      p.States(),
+	}
+	if ts := atomic.LoadInt64(&s.checkpoint); ts > 0 {
+		stats.Checkpoint = time.Unix(ts, 0)
+	}
+	return stats
+}
+
+// stopState 按重试策略失败的任务停止之后记录为失败
+func stopState(p *common.Pipeline) int {
+	if p.Failed() != nil {
+		return task.Failed
+	}
+	return task.Stopped
+}
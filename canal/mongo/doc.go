@@ -0,0 +1,241 @@
+package mongo
+
+// 文档转换为 canal.RowsEvent 的行
+// 集合配置了列映射（ColMappings）的时候展开： 每个映射的 Src 是文档中以 . 分隔的路径， 列名为 Dst， 没有 Dst 则为 Src
+// 没有配置列映射的时候保持内嵌： 文档的顶层字段为列， 内嵌文档和数组为 json 列， 出现新的字段的时候追加列并生成新的表结构
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-mysql-org/go-mysql/schema"
+	"github.com/gridsx/datagos/canal/mysql/mapper"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	idField        = "_id"
+	datetimeFormat = "2006-01-02 15:04:05.999"
+)
+
+// collection 一个集合对应的表结构
+type collection struct {
+	table   *schema.Table
+	mapping *mapper.TableMapping
+	// paths 展开的时候每列在文档中的路径
+	paths []string
+	index map[string]int
+}
+
+// newCollection _id 固定为第一列， 作为主键
+func newCollection(db, coll string, m *mapper.TableMapping) *collection {
+	c := &collection{
+		table:   &schema.Table{Schema: db, Name: coll, PKColumns: []int{0}},
+		mapping: m,
+		index:   make(map[string]int, 8),
+	}
+	c.addColumn(idField, idField, schema.TYPE_STRING, "varchar(64)")
+	if m != nil {
+		for _, cm := range m.ColMappings {
+			if cm.Src == idField {
+				continue
+			}
+			name := cm.Src
+			if len(cm.Dst) > 0 {
+				name = cm.Dst
+			}
+			// 展开的列类型在第一个值到来之前未知， 按字符串处理
+			c.addColumn(name, cm.Src, schema.TYPE_STRING, "text")
+		}
+	}
+	return c
+}
+
+func (c *collection) flatten() bool {
+	return c.mapping != nil && len(c.mapping.ColMappings) > 0
+}
+
+func (c *collection) addColumn(name, path string, typ int, rawType string) {
+	c.index[name] = len(c.table.Columns)
+	c.paths = append(c.paths, path)
+	c.table.Columns = append(c.table.Columns, schema.TableColumn{Name: name, Type: typ, RawType: rawType})
+}
+
+// row 文档转换为行， 内嵌模式下出现新的字段的时候， 复制一份表结构追加列， sinker 通过表结构指针的变化感知
+func (c *collection) row(doc bson.D) []interface{} {
+	if doc == nil {
+		return nil
+	}
+	if c.flatten() {
+		row := make([]interface{}, len(c.paths))
+		for i, path := range c.paths {
+			row[i] = value(lookup(doc, path))
+		}
+		return row
+	}
+	var added []bson.E
+	for _, e := range doc {
+		if _, ok := c.index[e.Key]; !ok {
+			added = append(added, e)
+		}
+	}
+	if len(added) > 0 {
+		c.grow(added)
+	}
+	row := make([]interface{}, len(c.table.Columns))
+	for _, e := range doc {
+		row[c.index[e.Key]] = value(e.Value)
+	}
+	return row
+}
+
+func (c *collection) pad(row []interface{}) []interface{} {
+	for len(row) < len(c.table.Columns) {
+		row = append(row, nil)
+	}
+	return row
+}
+
+func (c *collection) grow(added []bson.E) {
+	t := *c.table
+	t.Columns = append([]schema.TableColumn{}, c.table.Columns...)
+	c.table = &t
+	for _, e := range added {
+		typ, rawType := columnType(e.Value)
+		c.addColumn(e.Key, e.Key, typ, rawType)
+	}
+}
+
+// lookup 按 . 分隔的路径取内嵌文档中的值
+func lookup(doc bson.D, path string) interface{} {
+	var cur interface{} = doc
+	for _, key := range strings.Split(path, ".") {
+		d, ok := cur.(bson.D)
+		if !ok {
+			return nil
+		}
+		cur = nil
+		for _, e := range d {
+			if e.Key == key {
+				cur = e.Value
+				break
+			}
+		}
+	}
+	return cur
+}
+
+// columnType bson 类型对应的 MySQL 列类型
+func columnType(v interface{}) (int, string) {
+	switch v.(type) {
+	case int32, int64:
+		return schema.TYPE_NUMBER, "bigint"
+	case bool:
+		return schema.TYPE_NUMBER, "tinyint(1)"
+	case float64:
+		return schema.TYPE_FLOAT, "double"
+	case primitive.Decimal128:
+		return schema.TYPE_DECIMAL, "decimal(65,30)"
+	case primitive.DateTime:
+		return schema.TYPE_DATETIME, "datetime(3)"
+	case primitive.Binary:
+		return schema.TYPE_BINARY, "longblob"
+	case bson.D, bson.A:
+		return schema.TYPE_JSON, "json"
+	default:
+		return schema.TYPE_STRING, "text"
+	}
+}
+
+// value bson 值转换为与 binlog 中一致的类型， 时间按 UTC 格式化， 内嵌文档和数组转换为 json 字符串
+func value(v interface{}) interface{} {
+	switch val := v.(type) {
+	case nil:
+		return nil
+	case int32:
+		return int64(val)
+	case int64:
+		return val
+	case bool:
+		if val {
+			return int64(1)
+		}
+		return int64(0)
+	case float64, string:
+		return val
+	case primitive.ObjectID:
+		return val.Hex()
+	case primitive.Decimal128:
+		return val.String()
+	case primitive.DateTime:
+		return val.Time().UTC().Format(datetimeFormat)
+	case primitive.Binary:
+		return val.Data
+	case bson.D, bson.A:
+		d, err := json.Marshal(plain(val))
+		if err != nil {
+			return fmt.Sprint(val)
+		}
+		return string(d)
+	default:
+		return fmt.Sprint(val)
+	}
+}
+
+// plain 转换为可以 json 序列化的值
+func plain(v interface{}) interface{} {
+	switch val := v.(type) {
+	case bson.D:
+		m := make(map[string]interface{}, len(val))
+		for _, e := range val {
+			m[e.Key] = plain(e.Value)
+		}
+		return m
+	case bson.A:
+		a := make([]interface{}, 0, len(val))
+		for _, e := range val {
+			a = append(a, plain(e))
+		}
+		return a
+	case primitive.ObjectID:
+		return val.Hex()
+	case primitive.Decimal128:
+		return val.String()
+	case primitive.DateTime:
+		return val.Time().UTC().Format(time.RFC3339Nano)
+	case primitive.Binary:
+		return val.Data
+	default:
+		return val
+	}
+}
+
+// collections 按 库.集合 缓存表结构
+type collections struct {
+	lock     sync.Mutex
+	mappings []mapper.TableMapping
+	items    map[string]*collection
+}
+
+func (cs *collections) get(db, coll string) *collection {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+	key := db + "." + coll
+	if c, ok := cs.items[key]; ok {
+		return c
+	}
+	var m *mapper.TableMapping
+	for i := range cs.mappings {
+		if cs.mappings[i].Match(db, coll) {
+			m = &cs.mappings[i]
+			break
+		}
+	}
+	c := newCollection(db, coll, m)
+	cs.items[key] = c
+	return c
+}
@@ -1 +1,333 @@
 package mongo
+
+// 基于 change stream 的 Mongo 数据源， 按配置监听单个集合、整个库或者整个集群
+// update 使用 updateLookup 获取完整文档， 转换为与 MySQL binlog 相同的 canal.RowsEvent 交给 sinker
+// 位点为 resume token， 全量的时候先记录 change stream 的起点再扫描集合， 扫描期间的变更在扫描之后继续消费， 写入幂等即可保证一致
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/go-mysql-org/go-mysql/canal"
+	"github.com/go-mysql-org/go-mysql/mysql"
+	"github.com/go-mysql-org/go-mysql/replication"
+	"github.com/gridsx/datagos/canal/mysql/mapper"
+	"github.com/siddontang/go-log/log"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// 集群级别全量的时候跳过的系统库
+var systemDatabases = map[string]bool{"admin": true, "local": true, "config": true}
+
+// MongoSrcConfig 对应库字段 src 字段， 当src_type 为 SrcMongo时
+type MongoSrcConfig struct {
+	URI string `json:"uri"`
+	// Database 为空则监听整个集群
+	Database string `json:"database,omitempty"`
+	// Collections 只有一个的时候监听单个集合， 多个的时候监听整个库并按集合过滤， 为空则监听整个库
+	Collections []string `json:"collections,omitempty"`
+	// Snapshot 没有 resume token 的时候是否先扫描集合同步全量
+	Snapshot bool `json:"snapshot"`
+	// BeforeChange 是否请求变更之前的文档， 需要 MongoDB 6.0 以上并开启集合的 changeStreamPreAndPostImages
+	BeforeChange bool `json:"beforeChange,omitempty"`
+	// Mappings 配置了 ColMappings 的集合展开为列， 没有配置的集合保持内嵌， SrcTable 为集合名， Database 为库名
+	Mappings []mapper.TableMapping `json:"mappings,omitempty"`
+}
+
+// EventHandler 接收解析之后的事件
+type EventHandler interface {
+	// OnRow 行变更， 全量数据的 pos 为空
+	OnRow(e *canal.RowsEvent, pos mysql.Position) error
+	// OnSnapshotFinish 全量数据同步完成， token 为全量之后开始消费的位置
+	OnSnapshotFinish(token bson.Raw) error
+}
+
+// changeEvent change stream 的事件
+type changeEvent struct {
+	OperationType string              `bson:"operationType"`
+	ClusterTime   primitive.Timestamp `bson:"clusterTime"`
+	Ns            struct {
+		DB   string `bson:"db"`
+		Coll string `bson:"coll"`
+	} `bson:"ns"`
+	DocumentKey              bson.D `bson:"documentKey"`
+	FullDocument             bson.D `bson:"fullDocument"`
+	FullDocumentBeforeChange bson.D `bson:"fullDocumentBeforeChange"`
+}
+
+// Canal 一个 change stream 对应的数据源
+type Canal struct {
+	cfg     *MongoSrcConfig
+	handler EventHandler
+	client  *mongo.Client
+	tables  *collections
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	lock sync.Mutex
+	// token 已经交给 handler 的事件的 resume token
+	token bson.Raw
+}
+
+func NewMongoCanal(config string) (*Canal, error) {
+	cfg := new(MongoSrcConfig)
+	if err := json.Unmarshal([]byte(config), cfg); err != nil {
+		return nil, err
+	}
+	if len(cfg.URI) == 0 {
+		return nil, errors.New("mongo uri not configured")
+	}
+	if len(cfg.Database) == 0 && len(cfg.Collections) > 0 {
+		return nil, errors.New("mongo collections configured without database")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(cfg.URI))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if err := client.Ping(ctx, nil); err != nil {
+		cancel()
+		_ = client.Disconnect(context.Background())
+		return nil, err
+	}
+	return &Canal{
+		cfg:    cfg,
+		client: client,
+		tables: &collections{mappings: cfg.Mappings, items: make(map[string]*collection, 8)},
+		ctx:    ctx,
+		cancel: cancel,
+	}, nil
+}
+
+func (c *Canal) SetEventHandler(h EventHandler) {
+	c.handler = h
+}
+
+// SnapshotEnabled 是否配置了全量
+func (c *Canal) SnapshotEnabled() bool {
+	return c.cfg.Snapshot
+}
+
+// ResumeToken 已经交给 handler 的事件的位置
+func (c *Canal) ResumeToken() bson.Raw {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.token
+}
+
+func (c *Canal) setToken(token bson.Raw) {
+	c.lock.Lock()
+	c.token = token
+	c.lock.Unlock()
+}
+
+// Run 从 token 开始消费， token 为空且配置了全量的时候先同步全量， 阻塞直到 Close 或出错
+func (c *Canal) Run(token bson.Raw) error {
+	if c.handler == nil {
+		return errors.New("mongo canal event handler not set")
+	}
+	if token == nil && c.cfg.Snapshot {
+		start, err := c.startToken()
+		if err != nil {
+			return err
+		}
+		if err := c.snapshot(); err != nil {
+			return err
+		}
+		if err := c.handler.OnSnapshotFinish(start); err != nil {
+			return err
+		}
+		token = start
+	}
+	c.setToken(token)
+	return c.stream(token)
+}
+
+// startToken 打开 change stream 取得当前的 resume token， 作为全量之后开始消费的位置
+func (c *Canal) startToken() (bson.Raw, error) {
+	cs, err := c.watch(nil)
+	if err != nil {
+		return nil, err
+	}
+	defer cs.Close(context.Background())
+	token := cs.ResumeToken()
+	if token == nil {
+		return nil, errors.New("mongo change stream resume token not available")
+	}
+	return token, nil
+}
+
+// watch 按配置打开集合、库或者集群级别的 change stream
+func (c *Canal) watch(token bson.Raw) (*mongo.ChangeStream, error) {
+	opts := options.ChangeStream().SetFullDocument(options.UpdateLookup)
+	if c.cfg.BeforeChange {
+		opts.SetFullDocumentBeforeChange(options.WhenAvailable)
+	}
+	if token != nil {
+		opts.SetStartAfter(token)
+	}
+	pipeline := mongo.Pipeline{}
+	switch {
+	case len(c.cfg.Database) == 0:
+		return c.client.Watch(c.ctx, pipeline, opts)
+	case len(c.cfg.Collections) == 1:
+		return c.client.Database(c.cfg.Database).Collection(c.cfg.Collections[0]).Watch(c.ctx, pipeline, opts)
+	case len(c.cfg.Collections) > 1:
+		pipeline = append(pipeline, bson.D{{Key: "$match", Value: bson.D{{Key: "ns.coll", Value: bson.D{{Key: "$in", Value: c.cfg.Collections}}}}}})
+	}
+	return c.client.Database(c.cfg.Database).Watch(c.ctx, pipeline, opts)
+}
+
+// stream 消费 change stream， 每个事件交给 handler 之后记录 resume token
+func (c *Canal) stream(token bson.Raw) error {
+	cs, err := c.watch(token)
+	if err != nil {
+		return err
+	}
+	defer cs.Close(context.Background())
+	log.Infof("mongo change stream started, database: %s, collections: %v\n", c.cfg.Database, c.cfg.Collections)
+	for cs.Next(c.ctx) {
+		ce := new(changeEvent)
+		if err := cs.Decode(ce); err != nil {
+			return err
+		}
+		if err := c.onChange(ce); err != nil {
+			return err
+		}
+		c.setToken(cs.ResumeToken())
+	}
+	if c.ctx.Err() != nil {
+		return nil
+	}
+	return cs.Err()
+}
+
+// onChange 事件的 header 中时间为 clusterTime， 位置为同一秒内的序号
+func (c *Canal) onChange(ce *changeEvent) error {
+	coll := c.tables.get(ce.Ns.DB, ce.Ns.Coll)
+	var action string
+	var rows [][]interface{}
+	switch ce.OperationType {
+	case "insert":
+		action, rows = canal.InsertAction, [][]interface{}{coll.row(ce.FullDocument)}
+	case "update", "replace":
+		if ce.FullDocument == nil {
+			// 查询完整文档之前文档已经被删除， 之后的 delete 事件会处理
+			log.Warnf("mongo update without full document, skipped, ns: %s.%s, key: %v\n", ce.Ns.DB, ce.Ns.Coll, ce.DocumentKey)
+			return nil
+		}
+		after := coll.row(ce.FullDocument)
+		before := coll.row(ce.FullDocumentBeforeChange)
+		if before == nil {
+			before = append([]interface{}{}, after...)
+		}
+		action, rows = canal.UpdateAction, [][]interface{}{before, after}
+	case "delete":
+		doc := ce.FullDocumentBeforeChange
+		if doc == nil {
+			doc = ce.DocumentKey
+		}
+		action, rows = canal.DeleteAction, [][]interface{}{coll.row(doc)}
+	case "invalidate":
+		return fmt.Errorf("mongo change stream invalidated, ns: %s.%s", ce.Ns.DB, ce.Ns.Coll)
+	default:
+		log.Infof("mongo change stream event ignored, type: %s, ns: %s.%s\n", ce.OperationType, ce.Ns.DB, ce.Ns.Coll)
+		return nil
+	}
+	// 内嵌模式下处理后面的文档的时候可能追加了列， 前面的行补齐
+	for i := range rows {
+		rows[i] = coll.pad(rows[i])
+	}
+	e := &canal.RowsEvent{
+		Table:  coll.table,
+		Action: action,
+		Rows:   rows,
+		Header: &replication.EventHeader{Timestamp: ce.ClusterTime.T, LogPos: ce.ClusterTime.I},
+	}
+	pos := mysql.Position{Name: fmt.Sprintf("%d.%d", ce.ClusterTime.T, ce.ClusterTime.I), Pos: ce.ClusterTime.I}
+	return c.handler.OnRow(e, pos)
+}
+
+// snapshot 扫描需要同步的所有集合， 全量数据与 MySQL 的 dump 一致， 事件没有 header
+func (c *Canal) snapshot() error {
+	targets, err := c.snapshotTargets()
+	if err != nil {
+		return err
+	}
+	for _, t := range targets {
+		count, err := c.scan(t[0], t[1])
+		if err != nil {
+			return err
+		}
+		log.Infof("mongo snapshot collection finished: %s.%s, documents: %d\n", t[0], t[1], count)
+	}
+	return nil
+}
+
+// snapshotTargets 需要全量的 库、集合
+func (c *Canal) snapshotTargets() ([][2]string, error) {
+	databases := []string{c.cfg.Database}
+	if len(c.cfg.Database) == 0 {
+		names, err := c.client.ListDatabaseNames(c.ctx, bson.D{})
+		if err != nil {
+			return nil, err
+		}
+		databases = databases[:0]
+		for _, name := range names {
+			if !systemDatabases[name] {
+				databases = append(databases, name)
+			}
+		}
+	}
+	targets := make([][2]string, 0, 8)
+	for _, db := range databases {
+		names := c.cfg.Collections
+		if len(names) == 0 {
+			var err error
+			names, err = c.client.Database(db).ListCollectionNames(c.ctx, bson.D{{Key: "type", Value: "collection"}})
+			if err != nil {
+				return nil, err
+			}
+		}
+		for _, name := range names {
+			targets = append(targets, [2]string{db, name})
+		}
+	}
+	return targets, nil
+}
+
+func (c *Canal) scan(db, name string) (int, error) {
+	coll := c.tables.get(db, name)
+	cur, err := c.client.Database(db).Collection(name).Find(c.ctx, bson.D{})
+	if err != nil {
+		return 0, err
+	}
+	defer cur.Close(context.Background())
+	count := 0
+	for cur.Next(c.ctx) {
+		var doc bson.D
+		if err := cur.Decode(&doc); err != nil {
+			return count, err
+		}
+		e := &canal.RowsEvent{Table: coll.table, Action: canal.InsertAction, Rows: [][]interface{}{coll.row(doc)}}
+		if err := c.handler.OnRow(e, mysql.Position{}); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, cur.Err()
+}
+
+// Close 停止消费， 关闭连接
+func (c *Canal) Close() {
+	c.cancel()
+	_ = c.client.Disconnect(context.Background())
+}
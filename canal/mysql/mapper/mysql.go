@@ -1,5 +1,7 @@
 package mapper
 
+import "strings"
+
 type TableMapping struct {
 	Database    string       `json:"database,omitempty"`
 	SrcTable    string       `json:"srcTable,omitempty"`
@@ -14,3 +16,21 @@ type ColMapping struct {
 	// 转换所使用的表达式， 没有表达式，则默认一对一转换
 	Expr string `json:"expr,omitempty"`
 }
+
+// Match 判断源库表是否匹配此映射， 不配置 Database 则匹配所有库
+func (m *TableMapping) Match(schema, table string) bool {
+	if len(m.Database) > 0 && !strings.EqualFold(m.Database, schema) {
+		return false
+	}
+	return strings.EqualFold(m.SrcTable, table)
+}
+
+// DstName 源列映射之后的列名， 没有配置映射则保持原名
+func (m *TableMapping) DstName(src string) string {
+	for _, v := range m.ColMappings {
+		if v.Src == src && len(v.Dst) > 0 {
+			return v.Dst
+		}
+	}
+	return src
+}
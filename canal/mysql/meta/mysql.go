@@ -17,6 +17,8 @@ type MySQLServerConfig struct {
 type MySQLSrcConfig struct {
 	Position   *mysql.Position         `json:"position"`
 	DumpConfig *filter.MySQLDumpFilter `json:"dumpConfig"`
+	// Heartbeat 配置之后定时写心跳表， 测量到每个目标的端到端延迟
+	Heartbeat *common.HeartbeatConfig `json:"heartbeat,omitempty"`
 	common.MySQLInstance
 }
 
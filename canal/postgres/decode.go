@@ -0,0 +1,251 @@
+package postgres
+
+// pgoutput 消息转换为 canal.RowsEvent
+// schema.Table 是按 MySQL 的列类型描述的， 这里把 Postgres 的类型映射为对应的 MySQL 类型， 已有的 sinker 不需要区分数据源
+// pgoutput 以文本格式传输列值， 快照中也把列转换为文本读取， 两者使用相同的转换
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-mysql-org/go-mysql/canal"
+	"github.com/go-mysql-org/go-mysql/replication"
+	"github.com/go-mysql-org/go-mysql/schema"
+	"github.com/jackc/pglogrepl"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/siddontang/go-log/log"
+)
+
+const datetimeFormat = "2006-01-02 15:04:05.999999"
+
+// timestamptz 的文本格式， 时区偏移可能只有小时， 也可能带分钟、秒
+var zonedLayouts = []string{
+	"2006-01-02 15:04:05.999999999-07",
+	"2006-01-02 15:04:05.999999999-07:00",
+	"2006-01-02 15:04:05.999999999-07:00:00",
+}
+
+// relation 表结构以及每列的类型 oid
+type relation struct {
+	table *schema.Table
+	oids  []uint32
+}
+
+func newRelation(schemaName, name string) *relation {
+	return &relation{table: &schema.Table{Schema: schemaName, Name: name}}
+}
+
+// addColumn 添加列， Postgres 的类型映射为 MySQL 的类型
+func (r *relation) addColumn(name string, oid uint32, typmod int32, key bool) {
+	col := schema.TableColumn{Name: name}
+	switch oid {
+	case pgtype.BoolOID:
+		col.Type, col.RawType = schema.TYPE_NUMBER, "tinyint(1)"
+	case pgtype.Int2OID:
+		col.Type, col.RawType = schema.TYPE_NUMBER, "smallint"
+	case pgtype.Int4OID:
+		col.Type, col.RawType = schema.TYPE_NUMBER, "int"
+	case pgtype.Int8OID:
+		col.Type, col.RawType = schema.TYPE_NUMBER, "bigint"
+	case pgtype.OIDOID:
+		col.Type, col.RawType, col.IsUnsigned = schema.TYPE_NUMBER, "int unsigned", true
+	case pgtype.Float4OID:
+		col.Type, col.RawType = schema.TYPE_FLOAT, "float"
+	case pgtype.Float8OID:
+		col.Type, col.RawType = schema.TYPE_FLOAT, "double"
+	case pgtype.NumericOID:
+		col.Type, col.RawType = schema.TYPE_DECIMAL, "decimal(65,30)"
+		if typmod >= 4 {
+			col.RawType = fmt.Sprintf("decimal(%d,%d)", ((typmod-4)>>16)&0xffff, (typmod-4)&0xffff)
+		}
+	case pgtype.DateOID:
+		col.Type, col.RawType = schema.TYPE_DATE, "date"
+	case pgtype.TimeOID:
+		col.Type, col.RawType = schema.TYPE_TIME, "time"+fraction(typmod)
+	case pgtype.TimestampOID:
+		col.Type, col.RawType = schema.TYPE_DATETIME, "datetime"+fraction(typmod)
+	case pgtype.TimestamptzOID:
+		col.Type, col.RawType = schema.TYPE_TIMESTAMP, "timestamp"+fraction(typmod)
+	case pgtype.JSONOID, pgtype.JSONBOID:
+		col.Type, col.RawType = schema.TYPE_JSON, "json"
+	case pgtype.ByteaOID:
+		col.Type, col.RawType = schema.TYPE_BINARY, "longblob"
+	case pgtype.VarcharOID, pgtype.BPCharOID:
+		col.Type, col.RawType = schema.TYPE_STRING, "text"
+		if typmod > 4 {
+			col.RawType = fmt.Sprintf("varchar(%d)", typmod-4)
+			col.MaxSize = uint(typmod - 4)
+		}
+	default:
+		col.Type, col.RawType = schema.TYPE_STRING, "text"
+	}
+	if key {
+		r.table.PKColumns = append(r.table.PKColumns, len(r.table.Columns))
+	}
+	if col.IsUnsigned {
+		r.table.UnsignedColumns = append(r.table.UnsignedColumns, len(r.table.Columns))
+	}
+	r.table.Columns = append(r.table.Columns, col)
+	r.oids = append(r.oids, oid)
+}
+
+func (r *relation) isKey(i int) bool {
+	for _, k := range r.table.PKColumns {
+		if k == i {
+			return true
+		}
+	}
+	return false
+}
+
+// fraction 时间类型的小数位， 未指定的时候 Postgres 默认为 6
+func fraction(typmod int32) string {
+	if typmod < 0 {
+		typmod = 6
+	}
+	if typmod == 0 {
+		return ""
+	}
+	return fmt.Sprintf("(%d)", typmod)
+}
+
+// value 文本格式的列值转换为与 binlog 中一致的类型
+func (r *relation) value(i int, text string) interface{} {
+	switch r.oids[i] {
+	case pgtype.BoolOID:
+		if text == "t" || text == "true" {
+			return int64(1)
+		}
+		return int64(0)
+	case pgtype.Int2OID, pgtype.Int4OID, pgtype.Int8OID, pgtype.OIDOID:
+		if n, err := strconv.ParseInt(text, 10, 64); err == nil {
+			return n
+		}
+	case pgtype.Float4OID, pgtype.Float8OID:
+		if f, err := strconv.ParseFloat(text, 64); err == nil {
+			return f
+		}
+	case pgtype.TimestamptzOID:
+		// 与 MySQL 数据源一致， timestamp 按 UTC 格式化
+		for _, layout := range zonedLayouts {
+			if t, err := time.Parse(layout, text); err == nil {
+				return t.UTC().Format(datetimeFormat)
+			}
+		}
+	case pgtype.ByteaOID:
+		if strings.HasPrefix(text, `\x`) {
+			if d, err := hex.DecodeString(text[2:]); err == nil {
+				return d
+			}
+		}
+		return []byte(text)
+	}
+	return text
+}
+
+// row 元组转换为行数据， 没有变化的 TOAST 列不会传输， 从 old 中取
+// 启动时已经检查了 REPLICA IDENTITY FULL， update 总是带有完整的旧值
+func (r *relation) row(tuple *pglogrepl.TupleData, old []interface{}) []interface{} {
+	if tuple == nil {
+		return nil
+	}
+	row := make([]interface{}, len(r.table.Columns))
+	for i, col := range tuple.Columns {
+		if i >= len(row) {
+			break
+		}
+		switch col.DataType {
+		case pglogrepl.TupleDataTypeText:
+			row[i] = r.value(i, string(col.Data))
+		case pglogrepl.TupleDataTypeToast:
+			if i < len(old) {
+				row[i] = old[i]
+			}
+		}
+	}
+	return row
+}
+
+// decode 解析一条 pgoutput 消息， 行变更交给 handler， 事务提交之后推进位置
+func (c *Canal) decode(data []byte) error {
+	msg, err := pglogrepl.Parse(data)
+	if err != nil {
+		return err
+	}
+	switch m := msg.(type) {
+	case *pglogrepl.RelationMessage:
+		rel := newRelation(m.Namespace, m.RelationName)
+		for _, col := range m.Columns {
+			rel.addColumn(col.Name, col.DataType, col.TypeModifier, col.Flags&1 == 1)
+		}
+		c.relations[m.RelationID] = rel
+	case *pglogrepl.BeginMessage:
+		c.inTx = true
+		c.commitTime = m.CommitTime
+		c.commitLSN = m.FinalLSN
+	case *pglogrepl.InsertMessage:
+		rel, err := c.relation(m.RelationID)
+		if err != nil {
+			return err
+		}
+		return c.emit(rel, canal.InsertAction, [][]interface{}{rel.row(m.Tuple, nil)})
+	case *pglogrepl.UpdateMessage:
+		rel, err := c.relation(m.RelationID)
+		if err != nil {
+			return err
+		}
+		// 只有 REPLICA IDENTITY FULL 或者主键变化的时候才有旧值， 主键变化时旧值只有主键列
+		before := rel.row(m.OldTuple, nil)
+		after := rel.row(m.NewTuple, before)
+		if before == nil {
+			before = append([]interface{}{}, after...)
+		} else if m.OldTupleType == pglogrepl.UpdateMessageTupleTypeKey {
+			for i := range before {
+				if !rel.isKey(i) {
+					before[i] = after[i]
+				}
+			}
+		}
+		return c.emit(rel, canal.UpdateAction, [][]interface{}{before, after})
+	case *pglogrepl.DeleteMessage:
+		rel, err := c.relation(m.RelationID)
+		if err != nil {
+			return err
+		}
+		return c.emit(rel, canal.DeleteAction, [][]interface{}{rel.row(m.OldTuple, nil)})
+	case *pglogrepl.TruncateMessage:
+		log.Warnf("postgres truncate not supported, ignored, relations: %v\n", m.RelationIDs)
+	case *pglogrepl.CommitMessage:
+		if err := c.handler.OnCommit(m.CommitLSN); err != nil {
+			return err
+		}
+		c.inTx = false
+		c.advance(m.TransactionEndLSN)
+	}
+	return nil
+}
+
+func (c *Canal) relation(id uint32) (*relation, error) {
+	rel, ok := c.relations[id]
+	if !ok {
+		return nil, fmt.Errorf("postgres relation %d not found", id)
+	}
+	return rel, nil
+}
+
+// emit 事件的 header 中时间为事务提交时间， 位置为提交 LSN 的低32位
+func (c *Canal) emit(rel *relation, action string, rows [][]interface{}) error {
+	e := &canal.RowsEvent{
+		Table:  rel.table,
+		Action: action,
+		Rows:   rows,
+		Header: &replication.EventHeader{
+			Timestamp: uint32(c.commitTime.Unix()),
+			LogPos:    uint32(c.commitLSN),
+		},
+	}
+	return c.handler.OnRow(e, c.commitLSN)
+}
@@ -1 +1,395 @@
 package postgres
+
+// 基于逻辑复制的 Postgres 数据源， 使用 pgoutput 插件解析 WAL， 转换为与 MySQL binlog 相同的 canal.RowsEvent 交给 sinker
+// 复制槽不存在的时候创建并导出快照， 在快照中读取全量数据之后， 从复制槽的一致点开始消费增量
+// LSN 只有在 sinker flush 之后才通过 Confirm 确认给服务端， 服务端据此回收 WAL
+// 发布的表必须是 REPLICA IDENTITY FULL， 否则没有变化的 TOAST 列不会传输， sinker 会把这些列写成 NULL
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-mysql-org/go-mysql/canal"
+	"github.com/jackc/pglogrepl"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgproto3"
+	_ "github.com/lib/pq"
+	"github.com/siddontang/go-log/log"
+)
+
+const (
+	outputPlugin         = "pgoutput"
+	defaultSchema        = "public"
+	standbyTimeout       = time.Second * 10
+	defaultSlotPrefix    = "datagos_"
+	publicationCheckSQL  = `select count(1) from pg_publication where pubname = $1`
+	slotCheckSQL         = `select count(1) from pg_replication_slots where slot_name = $1 and database = current_database()`
+	publicationTablesSQL = `select schemaname, tablename from pg_publication_tables where pubname = $1 order by schemaname, tablename`
+	replicaIdentitySQL   = `select p.schemaname, p.tablename from pg_publication_tables p
+		join pg_namespace n on n.nspname = p.schemaname
+		join pg_class c on c.relnamespace = n.oid and c.relname = p.tablename
+		where p.pubname = $1 and c.relreplident <> 'f' order by p.schemaname, p.tablename`
+)
+
+// PostgresSrcConfig 对应库字段 src 字段， 当src_type 为 SrcPostgres时
+type PostgresSrcConfig struct {
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Database string `json:"database"`
+	SSLMode  string `json:"sslMode,omitempty"`
+	// Slot 复制槽名称， 默认 datagos_{taskId}
+	Slot string `json:"slot,omitempty"`
+	// Publication 发布名称， 默认与复制槽同名， 不存在的时候自动创建
+	Publication string `json:"publication,omitempty"`
+	// Tables 创建发布时包含的表， 格式为 schema.table， 不带 schema 的为 public， 为空则发布所有表（需要超级用户）
+	Tables []string `json:"tables,omitempty"`
+	// Snapshot 新建复制槽的时候是否先同步全量数据
+	Snapshot bool `json:"snapshot"`
+}
+
+// dsn 连接串， replication 为 true 时为逻辑复制连接
+func (c *PostgresSrcConfig) dsn(replication bool) string {
+	sslMode := c.SSLMode
+	if len(sslMode) == 0 {
+		sslMode = "disable"
+	}
+	dsn := fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=%s",
+		quote(c.Host), c.Port, quote(c.Username), quote(c.Password), quote(c.Database), sslMode)
+	if replication {
+		dsn += " replication=database"
+	}
+	return dsn
+}
+
+// quote 连接串中的值用单引号包裹， 值中的 \ 和 ' 需要转义
+func quote(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(s) + "'"
+}
+
+// EventHandler 接收解析之后的事件
+type EventHandler interface {
+	// OnRow 行变更， lsn 为事件所在事务提交的位置， 全量数据为0
+	OnRow(e *canal.RowsEvent, lsn pglogrepl.LSN) error
+	// OnCommit 事务提交， 之后 ReceivedLSN 会前进到 lsn
+	OnCommit(lsn pglogrepl.LSN) error
+	// OnSnapshotFinish 全量数据同步完成
+	OnSnapshotFinish() error
+}
+
+// Canal 一个复制槽对应的数据源
+type Canal struct {
+	cfg     *PostgresSrcConfig
+	handler EventHandler
+	// snapshotDone 之前的任务已经完成了全量， 复制槽已经存在的时候不再需要全量
+	snapshotDone bool
+
+	db   *sql.DB
+	conn *pgconn.PgConn
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	lock   sync.Mutex
+
+	relations map[uint32]*relation
+	// tx 当前事务， 事务提交之后才把 LSN 推进
+	commitTime time.Time
+	commitLSN  pglogrepl.LSN
+	inTx       bool
+
+	// received 已经交给 handler 的位置， confirmed 已经落地可以确认给服务端的位置
+	received  uint64
+	confirmed uint64
+}
+
+// NewPostgresCanal 创建数据源， name 用于生成默认的复制槽名称
+func NewPostgresCanal(config string, name string) (*Canal, error) {
+	cfg := new(PostgresSrcConfig)
+	if err := json.Unmarshal([]byte(config), cfg); err != nil {
+		return nil, err
+	}
+	if cfg.Port == 0 {
+		cfg.Port = 5432
+	}
+	if len(cfg.Slot) == 0 {
+		cfg.Slot = defaultSlotPrefix + name
+	}
+	if len(cfg.Publication) == 0 {
+		cfg.Publication = cfg.Slot
+	}
+	db, err := sql.Open("postgres", cfg.dsn(false))
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(2)
+	if err := db.Ping(); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Canal{
+		cfg:       cfg,
+		db:        db,
+		ctx:       ctx,
+		cancel:    cancel,
+		relations: make(map[uint32]*relation, 16),
+	}, nil
+}
+
+func (c *Canal) SetEventHandler(h EventHandler) {
+	c.handler = h
+}
+
+// SetSnapshotDone 全量已经完成， 复制槽存在的时候直接从复制槽继续
+func (c *Canal) SetSnapshotDone(done bool) {
+	c.snapshotDone = done
+}
+
+// SnapshotEnabled 是否配置了全量
+func (c *Canal) SnapshotEnabled() bool {
+	return c.cfg.Snapshot
+}
+
+// ReceivedLSN 已经交给 handler 的事务的结束位置
+func (c *Canal) ReceivedLSN() pglogrepl.LSN {
+	return pglogrepl.LSN(atomic.LoadUint64(&c.received))
+}
+
+// Confirm 确认 lsn 之前的数据都已经落地， 下次向服务端发送状态的时候带上
+func (c *Canal) Confirm(lsn pglogrepl.LSN) {
+	for {
+		old := atomic.LoadUint64(&c.confirmed)
+		if uint64(lsn) <= old || atomic.CompareAndSwapUint64(&c.confirmed, old, uint64(lsn)) {
+			return
+		}
+	}
+}
+
+// Run 准备发布和复制槽， 需要的时候先同步全量， 之后从 startLSN 开始消费增量， 阻塞直到 Close 或出错
+// startLSN 小于复制槽已确认的位置的时候， 服务端从复制槽已确认的位置开始
+func (c *Canal) Run(startLSN pglogrepl.LSN) error {
+	if c.handler == nil {
+		return errors.New("postgres canal event handler not set")
+	}
+	if err := c.ensurePublication(); err != nil {
+		return err
+	}
+	if err := c.checkReplicaIdentity(); err != nil {
+		return err
+	}
+	conn, err := pgconn.Connect(c.ctx, c.cfg.dsn(true))
+	if err != nil {
+		return err
+	}
+	c.lock.Lock()
+	c.conn = conn
+	c.lock.Unlock()
+
+	start, err := c.ensureSlot(startLSN)
+	if err != nil {
+		return err
+	}
+	err = pglogrepl.StartReplication(c.ctx, conn, c.cfg.Slot, start, pglogrepl.StartReplicationOptions{
+		PluginArgs: []string{"proto_version '1'", fmt.Sprintf("publication_names '%s'", c.cfg.Publication)},
+	})
+	if err != nil {
+		return err
+	}
+	log.Infof("postgres replication started, slot: %s, publication: %s, lsn: %s\n", c.cfg.Slot, c.cfg.Publication, start)
+	return c.receive()
+}
+
+// checkReplicaIdentity 发布的表都要是 REPLICA IDENTITY FULL， update 才会带上旧的元组， 没有变化的 TOAST 列从旧的元组中取
+func (c *Canal) checkReplicaIdentity() error {
+	rows, err := c.db.Query(replicaIdentitySQL, c.cfg.Publication)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	var tables []string
+	for rows.Next() {
+		var schemaName, table string
+		if err := rows.Scan(&schemaName, &table); err != nil {
+			return err
+		}
+		tables = append(tables, quoteIdent(schemaName)+"."+quoteIdent(table))
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(tables) > 0 {
+		return fmt.Errorf("postgres tables in publication %s must use REPLICA IDENTITY FULL, run ALTER TABLE ... REPLICA IDENTITY FULL on: %s",
+			c.cfg.Publication, strings.Join(tables, ", "))
+	}
+	return nil
+}
+
+// ensurePublication 发布不存在则创建
+func (c *Canal) ensurePublication() error {
+	var count int
+	if err := c.db.QueryRow(publicationCheckSQL, c.cfg.Publication).Scan(&count); err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+	target := "ALL TABLES"
+	if len(c.cfg.Tables) > 0 {
+		names := make([]string, 0, len(c.cfg.Tables))
+		for _, t := range c.cfg.Tables {
+			schemaName, table := splitTable(t)
+			names = append(names, quoteIdent(schemaName)+"."+quoteIdent(table))
+		}
+		target = "TABLE " + strings.Join(names, ", ")
+	}
+	if _, err := c.db.Exec(fmt.Sprintf("CREATE PUBLICATION %s FOR %s", quoteIdent(c.cfg.Publication), target)); err != nil {
+		return err
+	}
+	log.Infof("postgres publication created: %s, for %s\n", c.cfg.Publication, target)
+	return nil
+}
+
+// ensureSlot 复制槽不存在则创建， 需要全量的时候导出快照并在快照中读取全量数据， 返回开始消费的位置
+// 复制槽存在但全量没有完成（上次全量中途停止）， 快照已经无法再导出， 只能删除复制槽重新开始
+func (c *Canal) ensureSlot(startLSN pglogrepl.LSN) (pglogrepl.LSN, error) {
+	var count int
+	if err := c.db.QueryRow(slotCheckSQL, c.cfg.Slot).Scan(&count); err != nil {
+		return 0, err
+	}
+	needSnapshot := c.cfg.Snapshot && !c.snapshotDone
+	if count > 0 {
+		if !needSnapshot {
+			return startLSN, nil
+		}
+		log.Warnf("postgres slot %s exists but snapshot not finished, drop and recreate it\n", c.cfg.Slot)
+		if err := pglogrepl.DropReplicationSlot(c.ctx, c.conn, c.cfg.Slot, pglogrepl.DropReplicationSlotOptions{Wait: true}); err != nil {
+			return 0, err
+		}
+	}
+	action := "NOEXPORT_SNAPSHOT"
+	if needSnapshot {
+		action = "EXPORT_SNAPSHOT"
+	}
+	result, err := pglogrepl.CreateReplicationSlot(c.ctx, c.conn, c.cfg.Slot, outputPlugin,
+		pglogrepl.CreateReplicationSlotOptions{SnapshotAction: action, Mode: pglogrepl.LogicalReplication})
+	if err != nil {
+		return 0, err
+	}
+	consistent, err := pglogrepl.ParseLSN(result.ConsistentPoint)
+	if err != nil {
+		return 0, err
+	}
+	log.Infof("postgres slot created: %s, consistent point: %s\n", c.cfg.Slot, consistent)
+	if needSnapshot {
+		// 导出的快照在复制连接执行下一个命令之前一直有效
+		if err := c.snapshot(result.SnapshotName); err != nil {
+			return 0, err
+		}
+		if err := c.handler.OnSnapshotFinish(); err != nil {
+			return 0, err
+		}
+		c.snapshotDone = true
+	}
+	return consistent, nil
+}
+
+// receive 接收复制消息， 定期向服务端发送已确认的位置
+func (c *Canal) receive() error {
+	deadline := time.Now().Add(standbyTimeout)
+	for {
+		if time.Now().After(deadline) {
+			if err := c.sendStatus(); err != nil {
+				return err
+			}
+			deadline = time.Now().Add(standbyTimeout)
+		}
+		ctx, cancel := context.WithDeadline(c.ctx, deadline)
+		raw, err := c.conn.ReceiveMessage(ctx)
+		cancel()
+		if err != nil {
+			if c.ctx.Err() != nil {
+				return nil
+			}
+			if pgconn.Timeout(err) {
+				continue
+			}
+			return err
+		}
+		if errMsg, ok := raw.(*pgproto3.ErrorResponse); ok {
+			return fmt.Errorf("postgres replication error: %s, %s", errMsg.Code, errMsg.Message)
+		}
+		msg, ok := raw.(*pgproto3.CopyData)
+		if !ok {
+			continue
+		}
+		switch msg.Data[0] {
+		case pglogrepl.PrimaryKeepaliveMessageByteID:
+			pkm, err := pglogrepl.ParsePrimaryKeepaliveMessage(msg.Data[1:])
+			if err != nil {
+				return err
+			}
+			// 没有未提交的事务时， 服务端发送过来的位置之前的数据都已经处理
+			if !c.inTx {
+				c.advance(pkm.ServerWALEnd)
+			}
+			if pkm.ReplyRequested {
+				deadline = time.Time{}
+			}
+		case pglogrepl.XLogDataByteID:
+			xld, err := pglogrepl.ParseXLogData(msg.Data[1:])
+			if err != nil {
+				return err
+			}
+			if err := c.decode(xld.WALData); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (c *Canal) advance(lsn pglogrepl.LSN) {
+	if uint64(lsn) > atomic.LoadUint64(&c.received) {
+		atomic.StoreUint64(&c.received, uint64(lsn))
+	}
+}
+
+// sendStatus 向服务端发送已确认的位置， 还没有确认过则只发送心跳
+func (c *Canal) sendStatus() error {
+	lsn := pglogrepl.LSN(atomic.LoadUint64(&c.confirmed))
+	return pglogrepl.SendStandbyStatusUpdate(c.ctx, c.conn, pglogrepl.StandbyStatusUpdate{
+		WALWritePosition: lsn,
+		WALFlushPosition: lsn,
+		WALApplyPosition: lsn,
+	})
+}
+
+// Close 停止消费， 关闭连接
+func (c *Canal) Close() {
+	c.cancel()
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.conn != nil {
+		_ = c.conn.Close(context.Background())
+	}
+	_ = c.db.Close()
+}
+
+// splitTable schema.table 拆分， 不带 schema 的为 public
+func splitTable(name string) (string, string) {
+	if idx := strings.Index(name, "."); idx > 0 {
+		return name[:idx], name[idx+1:]
+	}
+	return defaultSchema, name
+}
+
+func quoteIdent(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
@@ -0,0 +1,122 @@
+package postgres
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/go-mysql-org/go-mysql/canal"
+	"github.com/siddontang/go-log/log"
+)
+
+// 表的列以及是否为主键， attrelid 为 regclass 表名
+const tableColumnsSQL = `select a.attname, a.atttypid, a.atttypmod, coalesce(i.indisprimary, false)
+from pg_attribute a left join pg_index i on i.indrelid = a.attrelid and i.indisprimary and a.attnum = any(i.indkey)
+where a.attrelid = $1::regclass and a.attnum > 0 and not a.attisdropped order by a.attnum`
+
+// snapshot 在复制槽导出的快照中读取发布的所有表， 快照之后的变更从复制槽的一致点开始消费， 数据不会重复也不会丢失
+// 全量数据与 MySQL 的 dump 一致， 事件没有 header
+func (c *Canal) snapshot(name string) error {
+	tx, err := c.db.BeginTx(c.ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(fmt.Sprintf("SET TRANSACTION SNAPSHOT '%s'", name)); err != nil {
+		return err
+	}
+	tables, err := publicationTables(tx, c.cfg.Publication)
+	if err != nil {
+		return err
+	}
+	for _, t := range tables {
+		rel, err := loadRelation(tx, t[0], t[1])
+		if err != nil {
+			return err
+		}
+		count, err := c.snapshotTable(tx, rel)
+		if err != nil {
+			return err
+		}
+		log.Infof("postgres snapshot table finished: %s, rows: %d\n", rel.table.String(), count)
+	}
+	return tx.Commit()
+}
+
+func publicationTables(tx *sql.Tx, publication string) ([][2]string, error) {
+	rows, err := tx.Query(publicationTablesSQL, publication)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	tables := make([][2]string, 0, 8)
+	for rows.Next() {
+		var t [2]string
+		if err := rows.Scan(&t[0], &t[1]); err != nil {
+			return nil, err
+		}
+		tables = append(tables, t)
+	}
+	return tables, rows.Err()
+}
+
+// loadRelation 从系统表读取表结构， 与复制消息中的表结构使用相同的类型映射
+func loadRelation(tx *sql.Tx, schemaName, table string) (*relation, error) {
+	rows, err := tx.Query(tableColumnsSQL, quoteIdent(schemaName)+"."+quoteIdent(table))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	rel := newRelation(schemaName, table)
+	for rows.Next() {
+		var (
+			name   string
+			oid    uint32
+			typmod int32
+			key    bool
+		)
+		if err := rows.Scan(&name, &oid, &typmod, &key); err != nil {
+			return nil, err
+		}
+		rel.addColumn(name, oid, typmod, key)
+	}
+	return rel, rows.Err()
+}
+
+// snapshotTable 所有列转换为文本读取， 每行一个事件
+func (c *Canal) snapshotTable(tx *sql.Tx, rel *relation) (int, error) {
+	columns := make([]string, 0, len(rel.table.Columns))
+	for _, col := range rel.table.Columns {
+		columns = append(columns, quoteIdent(col.Name)+"::text")
+	}
+	query := fmt.Sprintf("SELECT %s FROM %s.%s", strings.Join(columns, ", "),
+		quoteIdent(rel.table.Schema), quoteIdent(rel.table.Name))
+	rows, err := tx.QueryContext(c.ctx, query)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	values := make([]sql.NullString, len(columns))
+	dest := make([]interface{}, len(columns))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	count := 0
+	for rows.Next() {
+		if err := rows.Scan(dest...); err != nil {
+			return count, err
+		}
+		row := make([]interface{}, len(values))
+		for i, v := range values {
+			if v.Valid {
+				row[i] = rel.value(i, v.String)
+			}
+		}
+		e := &canal.RowsEvent{Table: rel.table, Action: canal.InsertAction, Rows: [][]interface{}{row}}
+		if err := c.handler.OnRow(e, 0); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, rows.Err()
+}
@@ -0,0 +1,249 @@
+package redis
+
+// 复制流中的写命令按 key 拆分为变更事件
+// 带完整值的命令（SET 系列、RESTORE）直接得到 key 的值， 删除 key 的命令为 delete，
+// 其他命令（INCR、HSET、EXPIRE 等）只知道修改了哪个 key， 值由 lookup 从源库读取
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	typeString = "string"
+	typeList   = "list"
+	typeSet    = "set"
+	typeZSet   = "zset"
+	typeHash   = "hash"
+	typeStream = "stream"
+	typeModule = "module"
+)
+
+// keyChange 一条命令对一个 key 的修改
+type keyChange struct {
+	key   string
+	typ   string
+	value interface{}
+	// expireAt 毫秒， 0 为没有设置
+	expireAt int64
+	deleted  bool
+	// full 是否带有完整的值
+	full bool
+}
+
+// 命令对应的数据类型， 不在其中的命令类型未知
+var commandTypes = map[string]string{}
+
+func init() {
+	families := map[string][]string{
+		typeString: {"set", "setnx", "setex", "psetex", "getset", "mset", "msetnx", "append", "setrange", "setbit",
+			"incr", "decr", "incrby", "decrby", "incrbyfloat", "getex", "bitop", "bitfield"},
+		typeList: {"lpush", "rpush", "lpushx", "rpushx", "lpop", "rpop", "blpop", "brpop", "lset", "lrem", "ltrim",
+			"linsert", "lmove", "blmove", "rpoplpush", "brpoplpush", "lmpop", "blmpop"},
+		typeSet: {"sadd", "srem", "spop", "smove", "sinterstore", "sunionstore", "sdiffstore"},
+		typeZSet: {"zadd", "zincrby", "zrem", "zremrangebyscore", "zremrangebyrank", "zremrangebylex", "zpopmin",
+			"zpopmax", "bzpopmin", "bzpopmax", "zunionstore", "zinterstore", "zdiffstore", "zrangestore", "zmpop", "bzmpop"},
+		typeHash:   {"hset", "hsetnx", "hmset", "hdel", "hincrby", "hincrbyfloat"},
+		typeStream: {"xadd", "xdel", "xtrim", "xsetid", "xgroup", "xack", "xclaim", "xautoclaim"},
+	}
+	for typ, commands := range families {
+		for _, cmd := range commands {
+			commandTypes[cmd] = typ
+		}
+	}
+}
+
+// changes 命令修改的 key， 不修改 key 的命令返回 nil
+func changes(args []string, now time.Time) []*keyChange {
+	if len(args) < 2 {
+		return nil
+	}
+	cmd := strings.ToLower(args[0])
+	typ := commandTypes[cmd]
+	switch cmd {
+	case "del", "unlink":
+		result := make([]*keyChange, 0, len(args)-1)
+		for _, key := range args[1:] {
+			result = append(result, &keyChange{key: key, deleted: true})
+		}
+		return result
+	case "getdel":
+		return []*keyChange{{key: args[1], deleted: true}}
+	case "mset", "msetnx":
+		result := make([]*keyChange, 0, len(args)/2)
+		for i := 1; i+1 < len(args); i += 2 {
+			result = append(result, &keyChange{key: args[i], typ: typeString, value: args[i+1], full: true})
+		}
+		return result
+	case "set", "getset", "setnx":
+		if len(args) < 3 {
+			return nil
+		}
+		return []*keyChange{{key: args[1], typ: typeString, value: args[2], full: true, expireAt: setExpire(args[3:], now)}}
+	case "setex", "psetex":
+		if len(args) < 4 {
+			return nil
+		}
+		ttl, _ := strconv.ParseInt(args[2], 10, 64)
+		if cmd == "setex" {
+			ttl *= 1000
+		}
+		return []*keyChange{{key: args[1], typ: typeString, value: args[3], full: true, expireAt: now.UnixMilli() + ttl}}
+	case "restore":
+		return restore(args, now)
+	case "rename", "renamenx":
+		if len(args) < 3 {
+			return nil
+		}
+		return []*keyChange{{key: args[1], deleted: true}, {key: args[2]}}
+	case "smove", "lmove", "blmove", "rpoplpush", "brpoplpush", "copy":
+		if len(args) < 3 {
+			return nil
+		}
+		return []*keyChange{{key: args[1], typ: typ}, {key: args[2], typ: typ}}
+	case "bitop":
+		if len(args) < 3 {
+			return nil
+		}
+		return []*keyChange{{key: args[2], typ: typ}}
+	case "expire", "pexpire", "expireat", "pexpireat":
+		if len(args) < 3 {
+			return nil
+		}
+		n, _ := strconv.ParseInt(args[2], 10, 64)
+		var expireAt int64
+		switch cmd {
+		case "expire":
+			expireAt = now.UnixMilli() + n*1000
+		case "pexpire":
+			expireAt = now.UnixMilli() + n
+		case "expireat":
+			expireAt = n * 1000
+		default:
+			expireAt = n
+		}
+		return []*keyChange{{key: args[1], expireAt: expireAt}}
+	}
+	return []*keyChange{{key: args[1], typ: typ}}
+}
+
+// setExpire SET 命令的过期参数， EX、PX 为相对时间， EXAT、PXAT 为绝对时间
+func setExpire(options []string, now time.Time) int64 {
+	for i := 0; i+1 < len(options); i++ {
+		n, err := strconv.ParseInt(options[i+1], 10, 64)
+		if err != nil {
+			continue
+		}
+		switch strings.ToLower(options[i]) {
+		case "ex":
+			return now.UnixMilli() + n*1000
+		case "px":
+			return now.UnixMilli() + n
+		case "exat":
+			return n * 1000
+		case "pxat":
+			return n
+		}
+	}
+	return 0
+}
+
+// restore RESTORE key ttl payload [REPLACE] [ABSTTL]， payload 为类型、RDB 编码的值、2字节版本、8字节校验，
+// 无法解析的值与其他命令一样由 lookup 读取
+func restore(args []string, now time.Time) []*keyChange {
+	if len(args) < 4 {
+		return nil
+	}
+	change := &keyChange{key: args[1]}
+	if typ, value, err := dumpValue([]byte(args[3])); err == nil {
+		change.typ, change.value, change.full = typ, value, true
+	}
+	ttl, _ := strconv.ParseInt(args[2], 10, 64)
+	if ttl > 0 {
+		change.expireAt = now.UnixMilli() + ttl
+		for _, opt := range args[4:] {
+			if strings.EqualFold(opt, "absttl") {
+				change.expireAt = ttl
+			}
+		}
+	}
+	return []*keyChange{change}
+}
+
+// dumpValue 解析 DUMP 的结果以及 RESTORE 的参数
+func dumpValue(payload []byte) (string, interface{}, error) {
+	if len(payload) < 11 {
+		return "", nil, errors.New("redis dump payload too short")
+	}
+	r := &rdbReader{r: bytes.NewReader(payload[1 : len(payload)-10])}
+	return r.readValue(payload[0])
+}
+
+// globMatch 与 Redis 的 KEYS 一致的通配符， 支持 * ? [abc] [^a] [a-z] 以及 \ 转义
+func globMatch(pattern, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 1 && pattern[1] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 1 {
+				return true
+			}
+			for i := 0; i <= len(s); i++ {
+				if globMatch(pattern[1:], s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+			s = s[1:]
+		case '[':
+			if len(s) == 0 {
+				return false
+			}
+			end := strings.IndexByte(pattern[1:], ']')
+			if end < 0 {
+				return pattern == s
+			}
+			class := pattern[1 : end+1]
+			not := strings.HasPrefix(class, "^")
+			if not {
+				class = class[1:]
+			}
+			matched := false
+			for i := 0; i < len(class); i++ {
+				if i+2 < len(class) && class[i+1] == '-' {
+					if class[i] <= s[0] && s[0] <= class[i+2] {
+						matched = true
+					}
+					i += 2
+				} else if class[i] == s[0] {
+					matched = true
+				}
+			}
+			if matched == not {
+				return false
+			}
+			pattern, s = pattern[end+1:], s[1:]
+		case '\\':
+			if len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if len(s) == 0 || pattern[0] != s[0] {
+				return false
+			}
+			s = s[1:]
+		}
+		pattern = pattern[1:]
+	}
+	return len(s) == 0
+}
@@ -0,0 +1,115 @@
+package redis
+
+// 命令流中不带值的命令（INCR、HSET、EXPIRE、RENAME 的目标 key 等）无法从命令本身得到 key 的值，
+// 通过另外一个普通连接用 DUMP、PTTL 读取 key 当前的值补全整行， 不会把空值写到目标
+// 读到的值可能比命令流的位置新， 之后修改同一个 key 的命令会再次读取， 最终与源库一致
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type lookup struct {
+	cfg *RedisSrcConfig
+
+	lock   sync.Mutex
+	conn   net.Conn
+	reader *respReader
+	db     int
+}
+
+// get key 当前的值和过期时间， key 已经不存在的时候返回删除
+func (l *lookup) get(db int, key string, now time.Time) (*keyChange, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.conn == nil {
+		if err := l.connect(); err != nil {
+			return nil, err
+		}
+	}
+	change, err := l.query(db, key, now)
+	if err != nil {
+		// 连接的状态不确定， 下次重新连接
+		_ = l.conn.Close()
+		l.conn = nil
+	}
+	return change, err
+}
+
+func (l *lookup) connect() error {
+	conn, err := net.DialTimeout("tcp", l.cfg.Addr, time.Duration(l.cfg.DialTimeoutMs)*time.Millisecond)
+	if err != nil {
+		return err
+	}
+	l.conn, l.reader, l.db = conn, newRespReader(conn), 0
+	if len(l.cfg.Password) == 0 {
+		return nil
+	}
+	args := []string{"AUTH", l.cfg.Password}
+	if len(l.cfg.Username) > 0 {
+		args = []string{"AUTH", l.cfg.Username, l.cfg.Password}
+	}
+	if _, err = conn.Write(encodeCommand(args...)); err == nil {
+		_, err = l.reader.reply()
+	}
+	if err != nil {
+		_ = conn.Close()
+		l.conn = nil
+		return fmt.Errorf("redis lookup auth error: %w", err)
+	}
+	return nil
+}
+
+// query SELECT、DUMP、PTTL 一次发送
+func (l *lookup) query(db int, key string, now time.Time) (*keyChange, error) {
+	buf := bytes.Buffer{}
+	if db != l.db {
+		buf.Write(encodeCommand("SELECT", strconv.Itoa(db)))
+	}
+	buf.Write(encodeCommand("DUMP", key))
+	buf.Write(encodeCommand("PTTL", key))
+	if _, err := l.conn.Write(buf.Bytes()); err != nil {
+		return nil, err
+	}
+	if db != l.db {
+		if _, err := l.reader.reply(); err != nil {
+			return nil, err
+		}
+		l.db = db
+	}
+	payload, err := l.reader.bulk()
+	if err != nil {
+		return nil, err
+	}
+	ttl, err := l.reader.reply()
+	if err != nil {
+		return nil, err
+	}
+	change := &keyChange{key: key}
+	if len(payload) == 0 {
+		change.deleted = true
+		return change, nil
+	}
+	if change.typ, change.value, err = dumpValue([]byte(payload)); err != nil {
+		return nil, fmt.Errorf("redis dump of key %s can not be decoded: %w", key, err)
+	}
+	change.full = true
+	if n, _ := strconv.ParseInt(strings.TrimPrefix(ttl, ":"), 10, 64); n > 0 {
+		change.expireAt = now.UnixMilli() + n
+	}
+	return change, nil
+}
+
+func (l *lookup) close() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.conn != nil {
+		_ = l.conn.Close()
+		l.conn = nil
+	}
+}
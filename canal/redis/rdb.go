@@ -0,0 +1,811 @@
+package redis
+
+// RDB 快照解析， 全量同步的时候主库发送的 RDB 按 key 解析为值
+// 字符串为 string， list、set 为 []string， hash 为 map[string]string， zset 为 map[string]float64
+// stream 和 module 的数据只跳过， 值为 nil
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+)
+
+const (
+	rdbOpSlotInfo      = 244
+	rdbOpFunction2     = 245
+	rdbOpFunctionPreGA = 246
+	rdbOpModuleAux     = 247
+	rdbOpIdle          = 248
+	rdbOpFreq          = 249
+	rdbOpAux           = 250
+	rdbOpResizeDB      = 251
+	rdbOpExpireTimeMs  = 252
+	rdbOpExpireTime    = 253
+	rdbOpSelectDB      = 254
+	rdbOpEOF           = 255
+
+	rdbTypeString          = 0
+	rdbTypeList            = 1
+	rdbTypeSet             = 2
+	rdbTypeZSet            = 3
+	rdbTypeHash            = 4
+	rdbTypeZSet2           = 5
+	rdbTypeModulePreGA     = 6
+	rdbTypeModule2         = 7
+	rdbTypeHashZipmap      = 9
+	rdbTypeListZiplist     = 10
+	rdbTypeSetIntset       = 11
+	rdbTypeZSetZiplist     = 12
+	rdbTypeHashZiplist     = 13
+	rdbTypeListQuicklist   = 14
+	rdbTypeStreamListpacks = 15
+	rdbTypeHashListpack    = 16
+	rdbTypeZSetListpack    = 17
+	rdbTypeListQuicklist2  = 18
+	rdbTypeStream2         = 19
+	rdbTypeSetListpack     = 20
+	rdbTypeStream3         = 21
+
+	rdbEncInt8  = 0
+	rdbEncInt16 = 1
+	rdbEncInt32 = 2
+	rdbEncLZF   = 3
+
+	// module 数据的序列化格式
+	rdbModuleOpEOF    = 0
+	rdbModuleOpSint   = 1
+	rdbModuleOpUint   = 2
+	rdbModuleOpFloat  = 3
+	rdbModuleOpDouble = 4
+	rdbModuleOpString = 5
+
+	quicklistNodePlain = 1
+)
+
+// rdbEntry RDB 中的一个 key
+type rdbEntry struct {
+	db  int
+	key string
+	typ string
+	// value 按类型解析之后的值
+	value interface{}
+	// expireAt 过期时间， 毫秒， 0 为不过期
+	expireAt int64
+}
+
+type rdbReader struct {
+	r   io.Reader
+	buf [8]byte
+}
+
+func (r *rdbReader) readByte() (byte, error) {
+	if _, err := io.ReadFull(r.r, r.buf[:1]); err != nil {
+		return 0, err
+	}
+	return r.buf[0], nil
+}
+
+func (r *rdbReader) readBytes(n int) ([]byte, error) {
+	b := make([]byte, n)
+	_, err := io.ReadFull(r.r, b)
+	return b, err
+}
+
+func (r *rdbReader) readUint32() (uint32, error) {
+	if _, err := io.ReadFull(r.r, r.buf[:4]); err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint32(r.buf[:4]), nil
+}
+
+func (r *rdbReader) readUint64() (uint64, error) {
+	if _, err := io.ReadFull(r.r, r.buf[:8]); err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint64(r.buf[:8]), nil
+}
+
+// readLength 长度编码， encoded 为 true 时返回的是特殊编码的类型
+func (r *rdbReader) readLength() (uint64, bool, error) {
+	b, err := r.readByte()
+	if err != nil {
+		return 0, false, err
+	}
+	switch b >> 6 {
+	case 0:
+		return uint64(b & 0x3f), false, nil
+	case 1:
+		b2, err := r.readByte()
+		return uint64(b&0x3f)<<8 | uint64(b2), false, err
+	case 2:
+		switch b {
+		case 0x80:
+			if _, err := io.ReadFull(r.r, r.buf[:4]); err != nil {
+				return 0, false, err
+			}
+			return uint64(binary.BigEndian.Uint32(r.buf[:4])), false, nil
+		case 0x81:
+			if _, err := io.ReadFull(r.r, r.buf[:8]); err != nil {
+				return 0, false, err
+			}
+			return binary.BigEndian.Uint64(r.buf[:8]), false, nil
+		}
+		return 0, false, fmt.Errorf("rdb invalid length encoding: %x", b)
+	default:
+		return uint64(b & 0x3f), true, nil
+	}
+}
+
+func (r *rdbReader) readLen() (int, error) {
+	l, _, err := r.readLength()
+	return int(l), err
+}
+
+// readString 字符串可能编码为整数或者 LZF 压缩
+func (r *rdbReader) readString() ([]byte, error) {
+	l, encoded, err := r.readLength()
+	if err != nil {
+		return nil, err
+	}
+	if !encoded {
+		return r.readBytes(int(l))
+	}
+	switch l {
+	case rdbEncInt8:
+		b, err := r.readByte()
+		return []byte(strconv.Itoa(int(int8(b)))), err
+	case rdbEncInt16:
+		if _, err := io.ReadFull(r.r, r.buf[:2]); err != nil {
+			return nil, err
+		}
+		return []byte(strconv.Itoa(int(int16(binary.LittleEndian.Uint16(r.buf[:2]))))), nil
+	case rdbEncInt32:
+		v, err := r.readUint32()
+		return []byte(strconv.Itoa(int(int32(v)))), err
+	case rdbEncLZF:
+		clen, err := r.readLen()
+		if err != nil {
+			return nil, err
+		}
+		ulen, err := r.readLen()
+		if err != nil {
+			return nil, err
+		}
+		data, err := r.readBytes(clen)
+		if err != nil {
+			return nil, err
+		}
+		return lzfDecompress(data, ulen)
+	}
+	return nil, fmt.Errorf("rdb invalid string encoding: %d", l)
+}
+
+// readScore zset 旧格式的分数以字符串保存， 253、254、255 分别为 NaN、+inf、-inf
+func (r *rdbReader) readScore() (float64, error) {
+	l, err := r.readByte()
+	if err != nil {
+		return 0, err
+	}
+	switch l {
+	case 253:
+		return math.NaN(), nil
+	case 254:
+		return math.Inf(1), nil
+	case 255:
+		return math.Inf(-1), nil
+	}
+	b, err := r.readBytes(int(l))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseFloat(string(b), 64)
+}
+
+// parseRDB 解析完整的 RDB， 每个 key 调用一次 fn
+func parseRDB(in io.Reader, fn func(e *rdbEntry) error) error {
+	r := &rdbReader{r: in}
+	header, err := r.readBytes(9)
+	if err != nil {
+		return err
+	}
+	if string(header[:5]) != "REDIS" {
+		return errors.New("rdb invalid header")
+	}
+	version, err := strconv.Atoi(string(header[5:]))
+	if err != nil {
+		return fmt.Errorf("rdb invalid version: %s", string(header[5:]))
+	}
+	db := 0
+	var expireAt int64
+	for {
+		op, err := r.readByte()
+		if err != nil {
+			return err
+		}
+		switch op {
+		case rdbOpEOF:
+			if version >= 5 {
+				_, err = r.readUint64()
+			}
+			return err
+		case rdbOpSelectDB:
+			if db, err = r.readLen(); err != nil {
+				return err
+			}
+		case rdbOpResizeDB:
+			if _, err = r.readLen(); err == nil {
+				_, err = r.readLen()
+			}
+		case rdbOpSlotInfo:
+			for i := 0; i < 3 && err == nil; i++ {
+				_, err = r.readLen()
+			}
+		case rdbOpAux:
+			if _, err = r.readString(); err == nil {
+				_, err = r.readString()
+			}
+		case rdbOpExpireTime:
+			var v uint32
+			v, err = r.readUint32()
+			expireAt = int64(v) * 1000
+		case rdbOpExpireTimeMs:
+			var v uint64
+			v, err = r.readUint64()
+			expireAt = int64(v)
+		case rdbOpIdle:
+			_, err = r.readLen()
+		case rdbOpFreq:
+			_, err = r.readByte()
+		case rdbOpFunction2:
+			_, err = r.readString()
+		case rdbOpModuleAux:
+			err = r.skipModule()
+		case rdbOpFunctionPreGA:
+			return errors.New("rdb function pre GA not supported")
+		default:
+			key, err := r.readString()
+			if err != nil {
+				return err
+			}
+			typ, value, err := r.readValue(op)
+			if err != nil {
+				return fmt.Errorf("rdb parse key %s error: %w", string(key), err)
+			}
+			if err := fn(&rdbEntry{db: db, key: string(key), typ: typ, value: value, expireAt: expireAt}); err != nil {
+				return err
+			}
+			expireAt = 0
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// readValue 按类型读取值， 返回类型名称以及值
+func (r *rdbReader) readValue(t byte) (string, interface{}, error) {
+	switch t {
+	case rdbTypeString:
+		v, err := r.readString()
+		return typeString, string(v), err
+	case rdbTypeList, rdbTypeSet:
+		n, err := r.readLen()
+		if err != nil {
+			return "", nil, err
+		}
+		values := make([]string, 0, n)
+		for i := 0; i < n; i++ {
+			v, err := r.readString()
+			if err != nil {
+				return "", nil, err
+			}
+			values = append(values, string(v))
+		}
+		if t == rdbTypeList {
+			return typeList, values, nil
+		}
+		return typeSet, values, nil
+	case rdbTypeZSet, rdbTypeZSet2:
+		n, err := r.readLen()
+		if err != nil {
+			return "", nil, err
+		}
+		values := make(map[string]float64, n)
+		for i := 0; i < n; i++ {
+			member, err := r.readString()
+			if err != nil {
+				return "", nil, err
+			}
+			var score float64
+			if t == rdbTypeZSet {
+				score, err = r.readScore()
+			} else {
+				var bits uint64
+				bits, err = r.readUint64()
+				score = math.Float64frombits(bits)
+			}
+			if err != nil {
+				return "", nil, err
+			}
+			values[string(member)] = score
+		}
+		return typeZSet, values, nil
+	case rdbTypeHash:
+		n, err := r.readLen()
+		if err != nil {
+			return "", nil, err
+		}
+		values := make(map[string]string, n)
+		for i := 0; i < n; i++ {
+			field, err := r.readString()
+			if err != nil {
+				return "", nil, err
+			}
+			v, err := r.readString()
+			if err != nil {
+				return "", nil, err
+			}
+			values[string(field)] = string(v)
+		}
+		return typeHash, values, nil
+	case rdbTypeHashZipmap:
+		b, err := r.readString()
+		if err != nil {
+			return "", nil, err
+		}
+		values, err := parseZipmap(b)
+		return typeHash, values, err
+	case rdbTypeListZiplist, rdbTypeZSetZiplist, rdbTypeHashZiplist:
+		b, err := r.readString()
+		if err != nil {
+			return "", nil, err
+		}
+		items, err := parseZiplist(b)
+		if err != nil {
+			return "", nil, err
+		}
+		return packedValue(t, items)
+	case rdbTypeHashListpack, rdbTypeZSetListpack, rdbTypeSetListpack:
+		b, err := r.readString()
+		if err != nil {
+			return "", nil, err
+		}
+		items, err := parseListpack(b)
+		if err != nil {
+			return "", nil, err
+		}
+		return packedValue(t, items)
+	case rdbTypeSetIntset:
+		b, err := r.readString()
+		if err != nil {
+			return "", nil, err
+		}
+		values, err := parseIntset(b)
+		return typeSet, values, err
+	case rdbTypeListQuicklist, rdbTypeListQuicklist2:
+		n, err := r.readLen()
+		if err != nil {
+			return "", nil, err
+		}
+		values := make([]string, 0, n)
+		for i := 0; i < n; i++ {
+			container := 2
+			if t == rdbTypeListQuicklist2 {
+				if container, err = r.readLen(); err != nil {
+					return "", nil, err
+				}
+			}
+			b, err := r.readString()
+			if err != nil {
+				return "", nil, err
+			}
+			var items []string
+			switch {
+			case container == quicklistNodePlain:
+				items = []string{string(b)}
+			case t == rdbTypeListQuicklist:
+				items, err = parseZiplist(b)
+			default:
+				items, err = parseListpack(b)
+			}
+			if err != nil {
+				return "", nil, err
+			}
+			values = append(values, items...)
+		}
+		return typeList, values, nil
+	case rdbTypeStreamListpacks, rdbTypeStream2, rdbTypeStream3:
+		return typeStream, nil, r.skipStream(t)
+	case rdbTypeModule2:
+		return typeModule, nil, r.skipModule()
+	}
+	return "", nil, fmt.Errorf("rdb type %d not supported", t)
+}
+
+// packedValue ziplist、listpack 编码的 hash、zset 为键值交替， 其他为元素列表
+func packedValue(t byte, items []string) (string, interface{}, error) {
+	switch t {
+	case rdbTypeHashZiplist, rdbTypeHashListpack:
+		values := make(map[string]string, len(items)/2)
+		for i := 0; i+1 < len(items); i += 2 {
+			values[items[i]] = items[i+1]
+		}
+		return typeHash, values, nil
+	case rdbTypeZSetZiplist, rdbTypeZSetListpack:
+		values := make(map[string]float64, len(items)/2)
+		for i := 0; i+1 < len(items); i += 2 {
+			score, err := strconv.ParseFloat(items[i+1], 64)
+			if err != nil {
+				return "", nil, err
+			}
+			values[items[i]] = score
+		}
+		return typeZSet, values, nil
+	case rdbTypeSetListpack:
+		return typeSet, items, nil
+	}
+	return typeList, items, nil
+}
+
+// skipStream stream 的结构只读取不解析
+func (r *rdbReader) skipStream(t byte) error {
+	n, err := r.readLen()
+	if err != nil {
+		return err
+	}
+	for i := 0; i < n; i++ {
+		if _, err := r.readString(); err != nil {
+			return err
+		}
+		if _, err := r.readString(); err != nil {
+			return err
+		}
+	}
+	// length、last id， v2 之后多了 first id、max deleted id、entries added
+	lengths := 3
+	if t >= rdbTypeStream2 {
+		lengths += 5
+	}
+	if err := r.skipLengths(lengths); err != nil {
+		return err
+	}
+	groups, err := r.readLen()
+	if err != nil {
+		return err
+	}
+	for i := 0; i < groups; i++ {
+		if _, err := r.readString(); err != nil {
+			return err
+		}
+		lengths = 2
+		if t >= rdbTypeStream2 {
+			lengths++
+		}
+		if err := r.skipLengths(lengths); err != nil {
+			return err
+		}
+		pel, err := r.readLen()
+		if err != nil {
+			return err
+		}
+		for j := 0; j < pel; j++ {
+			// 16 字节 id， 8 字节投递时间， 投递次数
+			if _, err := r.readBytes(24); err != nil {
+				return err
+			}
+			if _, err := r.readLen(); err != nil {
+				return err
+			}
+		}
+		consumers, err := r.readLen()
+		if err != nil {
+			return err
+		}
+		for j := 0; j < consumers; j++ {
+			if _, err := r.readString(); err != nil {
+				return err
+			}
+			times := 8
+			if t >= rdbTypeStream3 {
+				times += 8
+			}
+			if _, err := r.readBytes(times); err != nil {
+				return err
+			}
+			pel, err := r.readLen()
+			if err != nil {
+				return err
+			}
+			if _, err := r.readBytes(16 * pel); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (r *rdbReader) skipLengths(n int) error {
+	for i := 0; i < n; i++ {
+		if _, err := r.readLen(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// skipModule module 的数据按操作码序列化， 以 EOF 结束
+func (r *rdbReader) skipModule() error {
+	if _, err := r.readLen(); err != nil {
+		return err
+	}
+	for {
+		op, err := r.readLen()
+		if err != nil {
+			return err
+		}
+		switch op {
+		case rdbModuleOpEOF:
+			return nil
+		case rdbModuleOpSint, rdbModuleOpUint:
+			_, err = r.readLen()
+		case rdbModuleOpFloat:
+			_, err = r.readBytes(4)
+		case rdbModuleOpDouble:
+			_, err = r.readBytes(8)
+		case rdbModuleOpString:
+			_, err = r.readString()
+		default:
+			return fmt.Errorf("rdb invalid module opcode: %d", op)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+var errCorrupted = errors.New("rdb corrupted encoded value")
+
+// parseZiplist ziplist： zlbytes(4) zltail(4) zllen(2) entries 0xff
+func parseZiplist(b []byte) ([]string, error) {
+	if len(b) < 11 {
+		return nil, errCorrupted
+	}
+	items := make([]string, 0, binary.LittleEndian.Uint16(b[8:10]))
+	i := 10
+	for i < len(b) && b[i] != 0xff {
+		// prevlen
+		if b[i] == 0xfe {
+			i += 5
+		} else {
+			i++
+		}
+		if i >= len(b) {
+			return nil, errCorrupted
+		}
+		enc := b[i]
+		var item string
+		switch {
+		case enc>>6 == 0:
+			l := int(enc & 0x3f)
+			i++
+			if i+l > len(b) {
+				return nil, errCorrupted
+			}
+			item, i = string(b[i:i+l]), i+l
+		case enc>>6 == 1:
+			if i+1 >= len(b) {
+				return nil, errCorrupted
+			}
+			l := int(enc&0x3f)<<8 | int(b[i+1])
+			i += 2
+			if i+l > len(b) {
+				return nil, errCorrupted
+			}
+			item, i = string(b[i:i+l]), i+l
+		case enc == 0x80:
+			if i+5 > len(b) {
+				return nil, errCorrupted
+			}
+			l := int(binary.BigEndian.Uint32(b[i+1 : i+5]))
+			i += 5
+			if i+l > len(b) {
+				return nil, errCorrupted
+			}
+			item, i = string(b[i:i+l]), i+l
+		default:
+			size := map[byte]int{0xc0: 2, 0xd0: 4, 0xe0: 8, 0xf0: 3, 0xfe: 1}[enc]
+			i++
+			if enc >= 0xf1 && enc <= 0xfd {
+				item = strconv.Itoa(int(enc&0x0f) - 1)
+				break
+			}
+			if size == 0 || i+size > len(b) {
+				return nil, errCorrupted
+			}
+			item, i = strconv.FormatInt(signedLE(b[i:i+size]), 10), i+size
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// parseListpack listpack： total bytes(4) num elements(2) entries 0xff， 每个元素之后是 backlen
+func parseListpack(b []byte) ([]string, error) {
+	if len(b) < 7 {
+		return nil, errCorrupted
+	}
+	items := make([]string, 0, binary.LittleEndian.Uint16(b[4:6]))
+	i := 6
+	for i < len(b) && b[i] != 0xff {
+		enc := b[i]
+		start := i
+		var item string
+		// l 为字符串的长度， 整数编码的元素为 -1
+		l := -1
+		switch {
+		case enc>>7 == 0:
+			item, i = strconv.Itoa(int(enc&0x7f)), i+1
+		case enc>>6 == 2:
+			l, i = int(enc&0x3f), i+1
+		case enc>>5 == 6:
+			if i+1 >= len(b) {
+				return nil, errCorrupted
+			}
+			v := int64(enc&0x1f)<<8 | int64(b[i+1])
+			if v >= 1<<12 {
+				v -= 1 << 13
+			}
+			item, i = strconv.FormatInt(v, 10), i+2
+		case enc>>4 == 0xe:
+			if i+1 >= len(b) {
+				return nil, errCorrupted
+			}
+			l, i = int(enc&0x0f)<<8|int(b[i+1]), i+2
+		case enc == 0xf0:
+			if i+5 > len(b) {
+				return nil, errCorrupted
+			}
+			l, i = int(binary.LittleEndian.Uint32(b[i+1:i+5])), i+5
+		default:
+			size := map[byte]int{0xf1: 2, 0xf2: 3, 0xf3: 4, 0xf4: 8}[enc]
+			if size == 0 || i+1+size > len(b) {
+				return nil, errCorrupted
+			}
+			item, i = strconv.FormatInt(signedLE(b[i+1:i+1+size]), 10), i+1+size
+		}
+		if l >= 0 {
+			if i+l > len(b) {
+				return nil, errCorrupted
+			}
+			item, i = string(b[i:i+l]), i+l
+		}
+		i += backlenSize(i - start)
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// backlenSize listpack 元素之后记录元素长度的字节数
+func backlenSize(l int) int {
+	switch {
+	case l <= 127:
+		return 1
+	case l < 16383:
+		return 2
+	case l < 2097151:
+		return 3
+	case l < 268435455:
+		return 4
+	default:
+		return 5
+	}
+}
+
+// signedLE 小端的有符号整数
+func signedLE(b []byte) int64 {
+	var v uint64
+	for i := len(b) - 1; i >= 0; i-- {
+		v = v<<8 | uint64(b[i])
+	}
+	shift := uint(64 - 8*len(b))
+	return int64(v<<shift) >> shift
+}
+
+// parseIntset intset： encoding(4) length(4) 整数
+func parseIntset(b []byte) ([]string, error) {
+	if len(b) < 8 {
+		return nil, errCorrupted
+	}
+	size := int(binary.LittleEndian.Uint32(b[:4]))
+	n := int(binary.LittleEndian.Uint32(b[4:8]))
+	if size != 2 && size != 4 && size != 8 || 8+size*n > len(b) {
+		return nil, errCorrupted
+	}
+	values := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		values = append(values, strconv.FormatInt(signedLE(b[8+i*size:8+(i+1)*size]), 10))
+	}
+	return values, nil
+}
+
+// parseZipmap 旧版本的 hash 编码： zmlen(1) (len key len free value)... 0xff
+func parseZipmap(b []byte) (map[string]string, error) {
+	values := make(map[string]string)
+	i := 1
+	readLen := func() (int, bool) {
+		if i >= len(b) || b[i] == 0xff {
+			return 0, false
+		}
+		if b[i] < 254 {
+			i++
+			return int(b[i-1]), true
+		}
+		if i+5 > len(b) {
+			return 0, false
+		}
+		l := int(binary.LittleEndian.Uint32(b[i+1 : i+5]))
+		i += 5
+		return l, true
+	}
+	for {
+		kl, ok := readLen()
+		if !ok || i+kl > len(b) {
+			return values, nil
+		}
+		key := string(b[i : i+kl])
+		i += kl
+		vl, ok := readLen()
+		if !ok || i+1+vl > len(b) {
+			return nil, errCorrupted
+		}
+		free := int(b[i])
+		i++
+		values[key] = string(b[i : i+vl])
+		i += vl + free
+	}
+}
+
+// lzfDecompress LZF 解压
+func lzfDecompress(in []byte, outLen int) ([]byte, error) {
+	out := make([]byte, 0, outLen)
+	i := 0
+	for i < len(in) {
+		ctrl := int(in[i])
+		i++
+		if ctrl < 32 {
+			ctrl++
+			if i+ctrl > len(in) {
+				return nil, errCorrupted
+			}
+			out = append(out, in[i:i+ctrl]...)
+			i += ctrl
+			continue
+		}
+		length := ctrl >> 5
+		if length == 7 {
+			if i >= len(in) {
+				return nil, errCorrupted
+			}
+			length += int(in[i])
+			i++
+		}
+		if i >= len(in) {
+			return nil, errCorrupted
+		}
+		ref := len(out) - (ctrl&0x1f)<<8 - int(in[i]) - 1
+		i++
+		if ref < 0 {
+			return nil, errCorrupted
+		}
+		for j := 0; j < length+2; j++ {
+			out = append(out, out[ref+j])
+		}
+	}
+	if len(out) != outLen {
+		return nil, errCorrupted
+	}
+	return out, nil
+}
@@ -1 +1,504 @@
 package redis
+
+// 以从库的身份连接 Redis， 通过 PSYNC 同步数据
+// 全量同步的时候解析主库发送的 RDB， 之后解析命令流， 按 key 转换为与 MySQL binlog 相同的 canal.RowsEvent
+// 每个库对应一张表， 表名为 db{n}， 列为 key、type、command、args、value、expire_at， 事件总是带有 key 完整的值
+// FLUSHDB、FLUSHALL、SWAPDB 无法知道影响了哪些 key， 同步的库被清空或者交换的时候任务失败， 需要重新全量同步
+// 位点为 replid 和复制偏移量， 重启的时候从保存的偏移量部分同步， 主库的积压缓冲区已经覆盖的时候主库会改为全量同步
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-mysql-org/go-mysql/canal"
+	"github.com/go-mysql-org/go-mysql/mysql"
+	"github.com/go-mysql-org/go-mysql/replication"
+	"github.com/go-mysql-org/go-mysql/schema"
+	"github.com/siddontang/go-log/log"
+)
+
+const (
+	defaultDialTimeoutMs = 5000
+	ackInterval          = time.Second
+	// 无盘复制的时候 RDB 以 40 字节的随机标记结束
+	eofMarkLength = 40
+)
+
+// ErrFlushed 源库清空或者交换了同步的库， 目标无法逐个 key 删除， 需要清空目标、清除任务位点之后重新全量同步
+var ErrFlushed = errors.New("redis database flushed or swapped at source")
+
+// RedisSrcConfig 对应库字段 src 字段， 当src_type 为 SrcRedis时
+type RedisSrcConfig struct {
+	Addr     string `json:"addr"`
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	// Databases 需要同步的库， 为空则同步所有库
+	Databases []int `json:"databases,omitempty"`
+	// KeyPatterns 需要同步的 key， 通配符与 KEYS 命令一致， 为空则同步所有 key
+	KeyPatterns []string `json:"keyPatterns,omitempty"`
+	// ExcludePatterns 不需要同步的 key
+	ExcludePatterns []string `json:"excludePatterns,omitempty"`
+	// Snapshot 全量同步的时候是否把 RDB 中的 key 作为全量数据交给 sinker
+	Snapshot      bool `json:"snapshot"`
+	DialTimeoutMs int  `json:"dialTimeoutMs,omitempty"`
+}
+
+// EventHandler 接收解析之后的事件
+type EventHandler interface {
+	// OnRow key 的变更， 全量数据的 pos 为空
+	OnRow(e *canal.RowsEvent, pos mysql.Position) error
+	// OnCommit 一条命令或者一个 MULTI/EXEC 事务处理完成
+	OnCommit() error
+	// OnFullSync 全量同步完成， replID、offset 为之后命令流开始的位置
+	OnFullSync(replID string, offset int64) error
+}
+
+// Canal 一个从库连接对应的数据源
+type Canal struct {
+	cfg     *RedisSrcConfig
+	handler EventHandler
+
+	conn   net.Conn
+	reader *respReader
+	wlock  sync.Mutex
+	closed int32
+
+	lock   sync.Mutex
+	replID string
+	// offset 已经处理的复制偏移量
+	offset int64
+	// db 命令流当前选择的库， 部分同步的时候主库不会重新发送 SELECT， 需要与偏移量一起保存
+	db int
+
+	inTx   bool
+	tables map[int]*schema.Table
+	lookup *lookup
+}
+
+func NewRedisCanal(config string) (*Canal, error) {
+	cfg := new(RedisSrcConfig)
+	if err := json.Unmarshal([]byte(config), cfg); err != nil {
+		return nil, err
+	}
+	if len(cfg.Addr) == 0 {
+		return nil, errors.New("redis addr not configured")
+	}
+	if cfg.DialTimeoutMs <= 0 {
+		cfg.DialTimeoutMs = defaultDialTimeoutMs
+	}
+	return &Canal{cfg: cfg, tables: make(map[int]*schema.Table, 4), lookup: &lookup{cfg: cfg}}, nil
+}
+
+func (c *Canal) SetEventHandler(h EventHandler) {
+	c.handler = h
+}
+
+// Position 已经处理的位置， 以及这个位置上选择的库
+func (c *Canal) Position() (string, int64, int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.replID, c.offset, c.db
+}
+
+func (c *Canal) setPosition(replID string, offset int64) {
+	c.lock.Lock()
+	c.replID, c.offset = replID, offset
+	c.lock.Unlock()
+}
+
+func (c *Canal) setDB(db int) {
+	c.lock.Lock()
+	c.db = db
+	c.lock.Unlock()
+}
+
+// Run 从 replID、offset 之后开始同步， db 为 offset 处选择的库， replID 为空则全量同步， 阻塞直到 Close 或出错
+func (c *Canal) Run(replID string, offset int64, db int) error {
+	if c.handler == nil {
+		return errors.New("redis canal event handler not set")
+	}
+	conn, err := net.DialTimeout("tcp", c.cfg.Addr, time.Duration(c.cfg.DialTimeoutMs)*time.Millisecond)
+	if err != nil {
+		return err
+	}
+	c.conn = conn
+	c.reader = newRespReader(conn)
+	if atomic.LoadInt32(&c.closed) == 1 {
+		_ = conn.Close()
+		return nil
+	}
+	if err := c.handshake(); err != nil {
+		return c.exitError(err)
+	}
+	if err := c.psync(replID, offset, db); err != nil {
+		return c.exitError(err)
+	}
+	go c.ack()
+	return c.exitError(c.stream())
+}
+
+// exitError Close 导致的错误不再返回
+func (c *Canal) exitError(err error) error {
+	if atomic.LoadInt32(&c.closed) == 1 {
+		return nil
+	}
+	return err
+}
+
+func (c *Canal) send(args ...string) error {
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+	_, err := c.conn.Write(encodeCommand(args...))
+	return err
+}
+
+// handshake 认证并声明支持无盘复制和 psync2
+func (c *Canal) handshake() error {
+	if len(c.cfg.Password) > 0 {
+		args := []string{"AUTH", c.cfg.Password}
+		if len(c.cfg.Username) > 0 {
+			args = []string{"AUTH", c.cfg.Username, c.cfg.Password}
+		}
+		if err := c.send(args...); err != nil {
+			return err
+		}
+		if _, err := c.reader.reply(); err != nil {
+			return fmt.Errorf("redis auth error: %w", err)
+		}
+	}
+	if err := c.send("REPLCONF", "capa", "eof", "capa", "psync2"); err != nil {
+		return err
+	}
+	_, err := c.reader.reply()
+	return err
+}
+
+// psync 部分同步失败的时候主库回复 FULLRESYNC 并发送 RDB
+func (c *Canal) psync(replID string, offset int64, db int) error {
+	args := []string{"PSYNC", "?", "-1"}
+	if len(replID) > 0 {
+		args = []string{"PSYNC", replID, strconv.FormatInt(offset+1, 10)}
+	}
+	if err := c.send(args...); err != nil {
+		return err
+	}
+	var reply string
+	var err error
+	// 主库准备 RDB 的时候会发送空行保持连接
+	for len(reply) == 0 {
+		if reply, err = c.reader.reply(); err != nil {
+			return fmt.Errorf("redis psync error: %w", err)
+		}
+	}
+	fields := strings.Fields(reply)
+	switch strings.ToUpper(fields[0]) {
+	case "CONTINUE":
+		// psync2 主从切换之后 replid 会变化， 偏移量保持连续
+		if len(fields) > 1 {
+			replID = fields[1]
+		}
+		c.setPosition(replID, offset)
+		c.setDB(db)
+		log.Infof("redis partial resync, replid: %s, offset: %d, db: %d\n", replID, offset, db)
+		return nil
+	case "FULLRESYNC":
+		if len(fields) < 3 {
+			return fmt.Errorf("redis invalid fullresync reply: %s", reply)
+		}
+		if len(replID) > 0 {
+			log.Warnf("redis partial resync rejected, full resync from replid: %s, offset: %s\n", fields[1], fields[2])
+		}
+		fullOffset, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return err
+		}
+		// 全量同步之后主库在第一条命令之前发送 SELECT
+		c.setDB(0)
+		if err := c.loadRDB(); err != nil {
+			return err
+		}
+		c.setPosition(fields[1], fullOffset)
+		log.Infof("redis full resync finished, replid: %s, offset: %d\n", fields[1], fullOffset)
+		return c.handler.OnFullSync(fields[1], fullOffset)
+	}
+	return fmt.Errorf("redis unexpected psync reply: %s", reply)
+}
+
+// loadRDB 有盘复制的时候 RDB 以 $len 开头， 无盘复制的时候以 $EOF:mark 开头并以 mark 结束
+func (c *Canal) loadRDB() error {
+	var head string
+	var err error
+	for len(head) == 0 {
+		if head, err = c.reader.line(); err != nil {
+			return err
+		}
+	}
+	if !strings.HasPrefix(head, "$") {
+		return fmt.Errorf("redis invalid rdb header: %s", head)
+	}
+	if strings.HasPrefix(head, "$EOF:") {
+		mark := head[5:]
+		if err := parseRDB(c.reader.r, c.onRDBEntry); err != nil {
+			return err
+		}
+		end := make([]byte, eofMarkLength)
+		if _, err := io.ReadFull(c.reader.r, end); err != nil {
+			return err
+		}
+		if string(end) != mark {
+			return errors.New("redis rdb eof mark mismatch")
+		}
+		return nil
+	}
+	size, err := strconv.ParseInt(head[1:], 10, 64)
+	if err != nil {
+		return fmt.Errorf("redis invalid rdb length: %s", head)
+	}
+	payload := io.LimitReader(c.reader.r, size)
+	if err := parseRDB(payload, c.onRDBEntry); err != nil {
+		return err
+	}
+	_, err = io.Copy(io.Discard, payload)
+	return err
+}
+
+// onRDBEntry RDB 中的 key 作为全量数据， 已经过期的 key 跳过
+func (c *Canal) onRDBEntry(entry *rdbEntry) error {
+	if !c.cfg.Snapshot || !c.accept(entry.db, entry.key) {
+		return nil
+	}
+	if entry.expireAt > 0 && entry.expireAt <= time.Now().UnixMilli() {
+		return nil
+	}
+	row := c.row(&keyChange{key: entry.key, typ: entry.typ, value: entry.value, expireAt: entry.expireAt, full: true}, nil)
+	e := &canal.RowsEvent{Table: c.table(entry.db), Action: canal.InsertAction, Rows: [][]interface{}{row}}
+	return c.handler.OnRow(e, mysql.Position{})
+}
+
+// stream 处理命令流， 每条命令处理完之后推进偏移量
+func (c *Canal) stream() error {
+	for {
+		args, n, err := c.reader.command()
+		if err != nil {
+			return err
+		}
+		replID, offset, _ := c.Position()
+		if err := c.onCommand(args, mysql.Position{Name: replID, Pos: uint32(offset + n)}); err != nil {
+			return err
+		}
+		c.setPosition(replID, offset+n)
+	}
+}
+
+// onCommand pos 为命令结束的位置， 偏移量超过32位之后 Pos 只保留低32位
+func (c *Canal) onCommand(args []string, pos mysql.Position) error {
+	if len(args) == 0 {
+		return nil
+	}
+	switch cmd := strings.ToLower(args[0]); cmd {
+	case "ping", "publish", "spublish", "script", "function":
+		return nil
+	case "replconf":
+		if len(args) > 1 && strings.EqualFold(args[1], "getack") {
+			go c.sendAck()
+		}
+		return nil
+	case "select":
+		if len(args) > 1 {
+			db, _ := strconv.Atoi(args[1])
+			c.setDB(db)
+		}
+		return nil
+	case "multi":
+		c.inTx = true
+		return nil
+	case "exec":
+		c.inTx = false
+		return c.handler.OnCommit()
+	case "flushdb", "flushall", "swapdb":
+		if c.clears(cmd, args) {
+			return fmt.Errorf("%w: %s", ErrFlushed, strings.Join(args, " "))
+		}
+		return nil
+	}
+	if !c.acceptDB(c.db) {
+		return nil
+	}
+	now := time.Now()
+	for _, change := range changes(args, now) {
+		if !c.accept(c.db, change.key) {
+			continue
+		}
+		if !change.full && !change.deleted {
+			current, err := c.lookup.get(c.db, change.key, now)
+			if err != nil {
+				return fmt.Errorf("redis lookup key %s error: %w", change.key, err)
+			}
+			change = current
+		}
+		action := canal.InsertAction
+		if change.deleted {
+			action = canal.DeleteAction
+		}
+		e := &canal.RowsEvent{
+			Table:  c.table(c.db),
+			Action: action,
+			Rows:   [][]interface{}{c.row(change, args)},
+			Header: &replication.EventHeader{Timestamp: uint32(now.Unix()), LogPos: pos.Pos},
+		}
+		if err := c.handler.OnRow(e, pos); err != nil {
+			return err
+		}
+	}
+	if c.inTx {
+		return nil
+	}
+	return c.handler.OnCommit()
+}
+
+// clears 命令是否清空或者交换了需要同步的库
+func (c *Canal) clears(cmd string, args []string) bool {
+	switch cmd {
+	case "flushdb":
+		return c.acceptDB(c.db)
+	case "swapdb":
+		for _, arg := range args[1:] {
+			if db, err := strconv.Atoi(arg); err == nil && c.acceptDB(db) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// row 列为 key、type、command、args、value、expire_at
+func (c *Canal) row(change *keyChange, args []string) []interface{} {
+	row := make([]interface{}, 6)
+	row[0] = change.key
+	if len(change.typ) > 0 {
+		row[1] = change.typ
+	}
+	if len(args) > 0 {
+		row[2] = strings.ToLower(args[0])
+		if d, err := json.Marshal(args[1:]); err == nil {
+			row[3] = string(d)
+		}
+	}
+	if change.full {
+		row[4] = encodeValue(change.value)
+	}
+	if change.expireAt > 0 {
+		row[5] = change.expireAt
+	}
+	return row
+}
+
+// encodeValue 字符串保持原样， 其他类型序列化为 json， zset 中非有限的分数以字符串表示
+func encodeValue(v interface{}) interface{} {
+	switch val := v.(type) {
+	case nil:
+		return nil
+	case string:
+		return val
+	case map[string]float64:
+		m := make(map[string]interface{}, len(val))
+		for k, score := range val {
+			if math.IsInf(score, 0) || math.IsNaN(score) {
+				m[k] = strconv.FormatFloat(score, 'g', -1, 64)
+			} else {
+				m[k] = score
+			}
+		}
+		v = m
+	}
+	d, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(d)
+}
+
+// table 每个库一张表
+func (c *Canal) table(db int) *schema.Table {
+	if t, ok := c.tables[db]; ok {
+		return t
+	}
+	t := &schema.Table{Schema: "redis", Name: fmt.Sprintf("db%d", db), PKColumns: []int{0}}
+	t.Columns = []schema.TableColumn{
+		{Name: "key", Type: schema.TYPE_STRING, RawType: "varchar(512)"},
+		{Name: "type", Type: schema.TYPE_STRING, RawType: "varchar(16)"},
+		{Name: "command", Type: schema.TYPE_STRING, RawType: "varchar(32)"},
+		{Name: "args", Type: schema.TYPE_JSON, RawType: "json"},
+		{Name: "value", Type: schema.TYPE_STRING, RawType: "longtext"},
+		{Name: "expire_at", Type: schema.TYPE_NUMBER, RawType: "bigint"},
+	}
+	c.tables[db] = t
+	return t
+}
+
+func (c *Canal) acceptDB(db int) bool {
+	if len(c.cfg.Databases) == 0 {
+		return true
+	}
+	for _, v := range c.cfg.Databases {
+		if v == db {
+			return true
+		}
+	}
+	return false
+}
+
+// accept 库和 key 是否需要同步
+func (c *Canal) accept(db int, key string) bool {
+	if !c.acceptDB(db) {
+		return false
+	}
+	for _, p := range c.cfg.ExcludePatterns {
+		if globMatch(p, key) {
+			return false
+		}
+	}
+	if len(c.cfg.KeyPatterns) == 0 {
+		return true
+	}
+	for _, p := range c.cfg.KeyPatterns {
+		if globMatch(p, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// ack 定期向主库报告已经处理的偏移量
+func (c *Canal) ack() {
+	for atomic.LoadInt32(&c.closed) == 0 {
+		if err := c.sendAck(); err != nil {
+			return
+		}
+		time.Sleep(ackInterval)
+	}
+}
+
+func (c *Canal) sendAck() error {
+	_, offset, _ := c.Position()
+	return c.send("REPLCONF", "ACK", strconv.FormatInt(offset, 10))
+}
+
+// Close 断开与主库的连接
+func (c *Canal) Close() {
+	atomic.StoreInt32(&c.closed, 1)
+	if c.conn != nil {
+		_ = c.conn.Close()
+	}
+	c.lookup.close()
+}
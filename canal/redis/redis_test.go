@@ -0,0 +1,337 @@
+package redis
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/go-mysql-org/go-mysql/canal"
+	"github.com/go-mysql-org/go-mysql/mysql"
+)
+
+const testReplID = "8de1d6d8a61a0e6f6a2cfc0d2c1f0b35d2a4a1b1"
+
+// standIn 进程内的 RESP 主库， 复制连接回复 psync 之后发送 rdb 和命令流， 其他连接回复 DUMP、PTTL
+type standIn struct {
+	t        *testing.T
+	ln       net.Listener
+	psync    func(args []string) string
+	rdb      []byte
+	diskless bool
+	stream   [][]string
+	// dumps 普通连接读取到的 key， 不在其中的 key 不存在
+	dumps map[string][]byte
+
+	lock     sync.Mutex
+	received [][]string
+}
+
+func newStandIn(t *testing.T) *standIn {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &standIn{t: t, ln: ln, dumps: map[string][]byte{}}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *standIn) addr() string {
+	return s.ln.Addr().String()
+}
+
+func (s *standIn) serve(conn net.Conn) {
+	defer conn.Close()
+	r := newRespReader(conn)
+	db := 0
+	for {
+		args, _, err := r.command()
+		if err != nil {
+			return
+		}
+		s.lock.Lock()
+		s.received = append(s.received, args)
+		s.lock.Unlock()
+		switch strings.ToUpper(args[0]) {
+		case "PSYNC":
+			s.replicate(conn, args)
+			return
+		case "SELECT":
+			db, _ = strconv.Atoi(args[1])
+			_, _ = conn.Write([]byte("+OK\r\n"))
+		case "DUMP":
+			payload, ok := s.dumps[fmt.Sprintf("%d:%s", db, args[1])]
+			if !ok {
+				_, _ = conn.Write([]byte("$-1\r\n"))
+				continue
+			}
+			_, _ = conn.Write([]byte("$" + strconv.Itoa(len(payload)) + "\r\n" + string(payload) + "\r\n"))
+		case "PTTL":
+			_, _ = conn.Write([]byte(":-1\r\n"))
+		default:
+			_, _ = conn.Write([]byte("+OK\r\n"))
+		}
+	}
+}
+
+// replicate 发送完命令流之后关闭连接
+func (s *standIn) replicate(conn net.Conn, args []string) {
+	reply := s.psync(args)
+	_, _ = conn.Write([]byte("\n+" + reply + "\r\n"))
+	if strings.HasPrefix(reply, "FULLRESYNC") {
+		if s.diskless {
+			mark := strings.Repeat("m", eofMarkLength)
+			_, _ = conn.Write([]byte("$EOF:" + mark + "\r\n" + string(s.rdb) + mark))
+		} else {
+			_, _ = conn.Write([]byte("$" + strconv.Itoa(len(s.rdb)) + "\r\n" + string(s.rdb)))
+		}
+	}
+	for _, cmd := range s.stream {
+		_, _ = conn.Write(encodeCommand(cmd...))
+	}
+}
+
+func (s *standIn) commands(name string) [][]string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var result [][]string
+	for _, args := range s.received {
+		if strings.EqualFold(args[0], name) {
+			result = append(result, args)
+		}
+	}
+	return result
+}
+
+// streamBytes 命令流占用的字节数， 即复制偏移量的增量
+func (s *standIn) streamBytes() int64 {
+	var n int64
+	for _, cmd := range s.stream {
+		n += int64(len(encodeCommand(cmd...)))
+	}
+	return n
+}
+
+type testHandler struct {
+	rows     []*canal.RowsEvent
+	commits  int
+	replID   string
+	offset   int64
+	fullSync bool
+}
+
+func (h *testHandler) OnRow(e *canal.RowsEvent, pos mysql.Position) error {
+	h.rows = append(h.rows, e)
+	return nil
+}
+
+func (h *testHandler) OnCommit() error {
+	h.commits++
+	return nil
+}
+
+func (h *testHandler) OnFullSync(replID string, offset int64) error {
+	h.replID, h.offset, h.fullSync = replID, offset, true
+	return nil
+}
+
+// rdbString RDB 中长度小于 64 的字符串
+func rdbString(s string) []byte {
+	return append([]byte{byte(len(s))}, s...)
+}
+
+// testRDB db0: k1=v1 带过期时间， list1=[a b]； db1: k2=v2
+func testRDB(expireAt uint64) []byte {
+	b := []byte("REDIS0009")
+	b = append(b, rdbOpAux)
+	b = append(b, rdbString("redis-ver")...)
+	b = append(b, rdbString("7.0.0")...)
+	b = append(b, rdbOpSelectDB, 0, rdbOpResizeDB, 2, 1)
+	ts := make([]byte, 8)
+	binary.LittleEndian.PutUint64(ts, expireAt)
+	b = append(b, rdbOpExpireTimeMs)
+	b = append(b, ts...)
+	b = append(b, rdbTypeString)
+	b = append(b, rdbString("k1")...)
+	b = append(b, rdbString("v1")...)
+	b = append(b, rdbTypeList)
+	b = append(b, rdbString("list1")...)
+	b = append(b, 2)
+	b = append(b, rdbString("a")...)
+	b = append(b, rdbString("b")...)
+	b = append(b, rdbOpSelectDB, 1, rdbTypeString)
+	b = append(b, rdbString("k2")...)
+	b = append(b, rdbString("v2")...)
+	b = append(b, rdbOpEOF)
+	return append(b, make([]byte, 8)...)
+}
+
+// dumpPayload DUMP 的结果： 类型、值、2字节版本、8字节校验
+func dumpPayload(typ byte, value []byte) []byte {
+	b := append([]byte{typ}, value...)
+	return append(b, make([]byte, 10)...)
+}
+
+func newTestCanal(t *testing.T, s *standIn, config string) (*Canal, *testHandler) {
+	c, err := NewRedisCanal(fmt.Sprintf(`{"addr":"%s","snapshot":true%s}`, s.addr(), config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &testHandler{}
+	c.SetEventHandler(h)
+	return c, h
+}
+
+func TestFullSyncAndStream(t *testing.T) {
+	for _, diskless := range []bool{false, true} {
+		s := newStandIn(t)
+		s.psync = func(args []string) string { return "FULLRESYNC " + testReplID + " 100" }
+		s.rdb = testRDB(1 << 62)
+		s.diskless = diskless
+		s.stream = [][]string{
+			{"SELECT", "0"},
+			{"SET", "k3", "v3", "PX", "60000"},
+			{"MULTI"},
+			{"INCR", "counter"},
+			{"HSET", "h", "f", "v"},
+			{"EXEC"},
+			{"DEL", "k1"},
+			{"EXPIRE", "gone", "10"},
+			{"SET", "skipped:1", "x"},
+			{"PING"},
+		}
+		s.dumps["0:counter"] = dumpPayload(rdbTypeString, rdbString("5"))
+		s.dumps["0:h"] = dumpPayload(rdbTypeHash, append([]byte{1}, append(rdbString("f"), rdbString("v")...)...))
+
+		c, h := newTestCanal(t, s, `,"databases":[0],"excludePatterns":["skipped:*"]`)
+		if err := c.Run("", 0, 0); !errors.Is(err, io.EOF) {
+			t.Fatalf("run: %v", err)
+		}
+		c.Close()
+		s.ln.Close()
+
+		if !h.fullSync || h.replID != testReplID || h.offset != 100 {
+			t.Fatalf("full sync: %v %s %d", h.fullSync, h.replID, h.offset)
+		}
+		if replID, offset, _ := c.Position(); replID != testReplID || offset != 100+s.streamBytes() {
+			t.Fatalf("position: %s %d, expected offset %d", replID, offset, 100+s.streamBytes())
+		}
+		expected := []struct {
+			action, key string
+			value       interface{}
+		}{
+			{canal.InsertAction, "k1", "v1"},
+			{canal.InsertAction, "list1", `["a","b"]`},
+			{canal.InsertAction, "k3", "v3"},
+			{canal.InsertAction, "counter", "5"},
+			{canal.InsertAction, "h", `{"f":"v"}`},
+			{canal.DeleteAction, "k1", nil},
+			{canal.DeleteAction, "gone", nil},
+		}
+		if len(h.rows) != len(expected) {
+			t.Fatalf("rows: %d, expected %d", len(h.rows), len(expected))
+		}
+		for i, e := range expected {
+			row := h.rows[i].Rows[0]
+			if h.rows[i].Action != e.action || len(h.rows[i].Rows) != 1 || row[0] != e.key || row[4] != e.value {
+				t.Fatalf("row %d: %s %v, expected %v", i, h.rows[i].Action, row, e)
+			}
+		}
+		if h.rows[0].Rows[0][5] != int64(1<<62) || h.rows[2].Rows[0][5] == nil {
+			t.Fatalf("expire_at not kept: %v %v", h.rows[0].Rows[0][5], h.rows[2].Rows[0][5])
+		}
+		// SET、MULTI/EXEC、DEL、EXPIRE、被排除的 SET 各提交一次
+		if h.commits != 5 {
+			t.Fatalf("commits: %d", h.commits)
+		}
+		if dumps := s.commands("DUMP"); len(dumps) != 3 {
+			t.Fatalf("lookups: %v", dumps)
+		}
+	}
+}
+
+func TestPartialResync(t *testing.T) {
+	s := newStandIn(t)
+	defer s.ln.Close()
+	s.psync = func(args []string) string {
+		if args[1] != testReplID || args[2] != "1001" {
+			return "FULLRESYNC " + testReplID + " 0"
+		}
+		return "CONTINUE " + testReplID
+	}
+	s.stream = [][]string{{"SELECT", "2"}, {"SET", "k", "v"}, {"REPLCONF", "GETACK", "*"}}
+
+	c, h := newTestCanal(t, s, "")
+	if err := c.Run(testReplID, 1000, 0); !errors.Is(err, io.EOF) {
+		t.Fatalf("run: %v", err)
+	}
+	c.Close()
+	if h.fullSync {
+		t.Fatal("partial resync fell back to full resync")
+	}
+	if _, offset, db := c.Position(); offset != 1000+s.streamBytes() || db != 2 {
+		t.Fatalf("offset: %d, expected %d, db: %d", offset, 1000+s.streamBytes(), db)
+	}
+	if len(h.rows) != 1 || h.rows[0].Table.Name != "db2" || h.rows[0].Rows[0][0] != "k" {
+		t.Fatalf("rows: %v", h.rows)
+	}
+	if len(s.commands("REPLCONF")) == 0 {
+		t.Fatal("replconf not sent")
+	}
+}
+
+// 部分同步的时候主库不会重新发送 SELECT， 从保存的库继续
+func TestPartialResyncKeepsDB(t *testing.T) {
+	s := newStandIn(t)
+	defer s.ln.Close()
+	s.psync = func(args []string) string { return "CONTINUE" }
+	s.stream = [][]string{{"SET", "k", "v"}}
+
+	c, h := newTestCanal(t, s, "")
+	if err := c.Run(testReplID, 1000, 3); !errors.Is(err, io.EOF) {
+		t.Fatalf("run: %v", err)
+	}
+	c.Close()
+	if len(h.rows) != 1 || h.rows[0].Table.Name != "db3" {
+		t.Fatalf("rows: %v", h.rows)
+	}
+	if _, _, db := c.Position(); db != 3 {
+		t.Fatalf("db: %d", db)
+	}
+}
+
+// 同步的库被清空之后任务失败， 位点停在清空之前
+func TestFlushFails(t *testing.T) {
+	s := newStandIn(t)
+	defer s.ln.Close()
+	s.psync = func(args []string) string { return "CONTINUE" }
+	s.stream = [][]string{{"SELECT", "1"}, {"FLUSHDB"}, {"SELECT", "0"}, {"SET", "k", "v"}, {"FLUSHDB"}}
+	before := int64(len(encodeCommand("SELECT", "1")) + len(encodeCommand("FLUSHDB")) +
+		len(encodeCommand("SELECT", "0")) + len(encodeCommand("SET", "k", "v")))
+
+	c, h := newTestCanal(t, s, `,"databases":[0]`)
+	if err := c.Run(testReplID, 0, 0); !errors.Is(err, ErrFlushed) {
+		t.Fatalf("run: %v", err)
+	}
+	c.Close()
+	if _, offset, _ := c.Position(); offset != before {
+		t.Fatalf("offset: %d, expected %d", offset, before)
+	}
+	if len(h.rows) != 1 {
+		t.Fatalf("rows: %d", len(h.rows))
+	}
+}
@@ -0,0 +1,105 @@
+package redis
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// respReader 读取主库发送的 RESP 数据， n 记录读取的字节数， 用于计算复制偏移量
+type respReader struct {
+	r *bufio.Reader
+	n int64
+}
+
+func newRespReader(r io.Reader) *respReader {
+	return &respReader{r: bufio.NewReaderSize(r, 64*1024)}
+}
+
+// line 读取一行， 去掉结尾的 \r\n
+func (r *respReader) line() (string, error) {
+	s, err := r.r.ReadString('\n')
+	r.n += int64(len(s))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(s, "\r\n"), nil
+}
+
+// reply 读取一个简单回复， 错误回复转换为 error
+func (r *respReader) reply() (string, error) {
+	s, err := r.line()
+	if err != nil {
+		return "", err
+	}
+	if strings.HasPrefix(s, "-") {
+		return "", errors.New(s[1:])
+	}
+	return strings.TrimPrefix(s, "+"), nil
+}
+
+// command 读取一条命令， 返回命令参数以及命令占用的字节数
+func (r *respReader) command() ([]string, int64, error) {
+	start := r.n
+	s, err := r.line()
+	if err != nil {
+		return nil, 0, err
+	}
+	if !strings.HasPrefix(s, "*") {
+		// inline 命令， 主库只会发送空行作为心跳
+		return strings.Fields(s), r.n - start, nil
+	}
+	n, err := strconv.Atoi(s[1:])
+	if err != nil {
+		return nil, 0, fmt.Errorf("resp invalid array length: %s", s)
+	}
+	args := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		arg, err := r.bulk()
+		if err != nil {
+			return nil, 0, err
+		}
+		args = append(args, arg)
+	}
+	return args, r.n - start, nil
+}
+
+// bulk 读取一个字符串， 空回复（$-1）返回空字符串
+func (r *respReader) bulk() (string, error) {
+	s, err := r.line()
+	if err != nil {
+		return "", err
+	}
+	if strings.HasPrefix(s, "-") {
+		return "", errors.New(s[1:])
+	}
+	if !strings.HasPrefix(s, "$") {
+		return "", fmt.Errorf("resp bulk string expected: %s", s)
+	}
+	l, err := strconv.Atoi(s[1:])
+	if err != nil {
+		return "", fmt.Errorf("resp invalid bulk length: %s", s)
+	}
+	if l < 0 {
+		return "", nil
+	}
+	b := make([]byte, l+2)
+	if _, err := io.ReadFull(r.r, b); err != nil {
+		return "", err
+	}
+	r.n += int64(len(b))
+	return string(b[:l]), nil
+}
+
+// encodeCommand 命令编码为 RESP 数组
+func encodeCommand(args ...string) []byte {
+	var sb strings.Builder
+	sb.WriteString("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, arg := range args {
+		sb.WriteString("$" + strconv.Itoa(len(arg)) + "\r\n" + arg + "\r\n")
+	}
+	return []byte(sb.String())
+}
@@ -0,0 +1,87 @@
+package common
+
+// 任务和 sinker 的健康状态
+// sinker 出错且不允许继续时暂停（paused-on-error）， 暂停期间不再保存位点， 按退避时间用出错的事件尝试恢复，
+// 恢复成功之后任务从保存的位点重启， 重放暂停期间的事件， 恢复次数用完则失败（failed）并停止任务
+
+import (
+	"sync"
+	"time"
+
+	"github.com/go-mysql-org/go-mysql/canal"
+	"github.com/go-mysql-org/go-mysql/mysql"
+)
+
+const (
+	HealthRunning = "running"
+	// HealthDegraded 最近出现过错误或重试， 仍然在处理事件
+	HealthDegraded = "degraded"
+	HealthPaused   = "paused-on-error"
+	HealthFailed   = "failed"
+
+	// degradedWindow 出错之后保持 degraded 的时间
+	degradedWindow = time.Minute
+)
+
+// healthRank 任务的状态取所有 sinker 中最差的
+var healthRank = map[string]int{HealthRunning: 0, HealthDegraded: 1, HealthPaused: 2, HealthFailed: 3}
+
+// WorseHealth 两个状态中较差的
+func WorseHealth(a, b string) string {
+	if healthRank[b] > healthRank[a] {
+		return b
+	}
+	return a
+}
+
+// sinkerHealth 一个 sinker 的健康状态， 由 pipeline 维护
+type sinkerHealth struct {
+	lock      sync.Mutex
+	state     string
+	lastError string
+	errorAt   time.Time
+	// failedEvent 导致暂停的事件， 用于尝试恢复， 事务提交出错时为 nil
+	failedEvent *canal.RowsEvent
+	// failedPos、failedGtid 出错事件的位置， 恢复时按同样的位置生成版本号
+	failedPos    mysql.Position
+	failedGtid   string
+	recoveries   int
+	nextRecovery time.Time
+}
+
+// onError 记录错误， 重试和跳过的错误也会让 sinker 在一段时间内处于 degraded
+func (h *sinkerHealth) onError(err error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.lastError = err.Error()
+	h.errorAt = time.Now()
+}
+
+// active 是否继续处理事件
+func (h *sinkerHealth) active() bool {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.state != HealthPaused && h.state != HealthFailed
+}
+
+func (h *sinkerHealth) pause(e *canal.RowsEvent, pos mysql.Position, gtid string, delay time.Duration) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.state = HealthPaused
+	h.failedEvent, h.failedPos, h.failedGtid = e, pos, gtid
+	h.nextRecovery = time.Now().Add(delay)
+}
+
+// health 当前的状态以及最近的错误
+func (h *sinkerHealth) health() (string, string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	state := h.state
+	if len(state) == 0 || state == HealthRunning {
+		state = HealthRunning
+		if !h.errorAt.IsZero() && time.Since(h.errorAt) < degradedWindow {
+			state = HealthDegraded
+		}
+	}
+	return state, h.lastError
+}
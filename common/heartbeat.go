@@ -0,0 +1,138 @@
+package common
+
+// 心跳表测量端到端延迟
+// 任务定时向源库的心跳表写入当前时间， 心跳行经过复制到达 pipeline 后不交给 sinker， 只记录每个 sinker 处理到心跳的时间，
+// 需要 flush 的 sinker 在心跳之后的第一次 flush 成功时才算落地， 其他 sinker 在处理完心跳之前的事件时即算落地
+
+import (
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-mysql-org/go-mysql/canal"
+)
+
+const (
+	defaultHeartbeatTable    = "datagos.heartbeat"
+	defaultHeartbeatInterval = 1
+
+	HeartbeatTaskColumn = "task_id"
+	HeartbeatTsColumn   = "ts"
+)
+
+// HeartbeatConfig 源库配置中的心跳， 心跳表有 task_id 和 ts（毫秒）两列， 多个任务可以共用一张表
+type HeartbeatConfig struct {
+	// Table 库名.表名， 默认 datagos.heartbeat
+	Table       string `json:"table,omitempty"`
+	IntervalSec int    `json:"intervalSec,omitempty"`
+}
+
+func (c *HeartbeatConfig) Schema() (string, string) {
+	table := c.Table
+	if len(table) == 0 {
+		table = defaultHeartbeatTable
+	}
+	if i := strings.IndexByte(table, '.'); i > 0 {
+		return table[:i], table[i+1:]
+	}
+	return "datagos", table
+}
+
+func (c *HeartbeatConfig) Interval() time.Duration {
+	if c.IntervalSec <= 0 {
+		return defaultHeartbeatInterval * time.Second
+	}
+	return time.Duration(c.IntervalSec) * time.Second
+}
+
+// HeartbeatLag sinker 的端到端延迟
+type HeartbeatLag struct {
+	// Lag 秒， 心跳停止到达时随时间增长
+	Lag float64 `json:"lag"`
+	// At 最近一个落地的心跳写入源库的时间
+	At time.Time `json:"at"`
+}
+
+// heartbeat pipeline 中心跳的匹配， 未设置时为 nil
+type heartbeat struct {
+	schema   string
+	table    string
+	taskId   int64
+	interval time.Duration
+}
+
+// SetHeartbeat 开启心跳， 在收到事件之前调用
+func (p *Pipeline) SetHeartbeat(c *HeartbeatConfig, taskId int) {
+	schema, table := c.Schema()
+	p.heartbeat = &heartbeat{schema: schema, table: table, taskId: int64(taskId), interval: c.Interval()}
+}
+
+// heartbeatTs 本任务心跳行的写入时间， 毫秒， 不是心跳返回 false
+// 全量中的心跳行时间是旧的， 同样不交给 sinker， 但不记录
+func (h *heartbeat) heartbeatTs(e *canal.RowsEvent) (int64, bool) {
+	if h == nil || e.Table.Schema != h.schema || e.Table.Name != h.table {
+		return 0, false
+	}
+	if e.Header == nil || e.Action == canal.DeleteAction || len(e.Rows) == 0 {
+		return 0, true
+	}
+	taskIdx, tsIdx := e.Table.FindColumn(HeartbeatTaskColumn), e.Table.FindColumn(HeartbeatTsColumn)
+	if taskIdx < 0 || tsIdx < 0 {
+		return 0, true
+	}
+	// 更新事件为修改前后两行， 取最后一行
+	row := e.Rows[len(e.Rows)-1]
+	if len(row) <= taskIdx || len(row) <= tsIdx || toInt64(row[taskIdx]) != h.taskId {
+		return 0, true
+	}
+	return toInt64(row[tsIdx]), true
+}
+
+func toInt64(v interface{}) int64 {
+	switch n := v.(type) {
+	case int64:
+		return n
+	case int32:
+		return int64(n)
+	case int:
+		return int64(n)
+	case uint64:
+		return int64(n)
+	case uint32:
+		return int64(n)
+	}
+	return 0
+}
+
+// onHeartbeat 心跳到达 sinker， 需要 flush 的 sinker 等到 flush 成功
+func (s *pipelineSinker) onHeartbeat(ts int64) {
+	if _, ok := s.Sinker.(Flusher); ok {
+		atomic.StoreInt64(&s.pendingHeartbeat, ts)
+		return
+	}
+	s.applyHeartbeat(ts, time.Now())
+}
+
+func (s *pipelineSinker) applyHeartbeat(ts int64, now time.Time) {
+	if ts <= 0 {
+		return
+	}
+	atomic.StoreInt64(&s.heartbeatLatency, now.UnixMilli()-ts)
+	atomic.StoreInt64(&s.heartbeatTs, ts)
+}
+
+// heartbeatLag 取落地时测得的延迟， 心跳迟迟不到时按最近一个心跳的时间估算， 减去一个心跳间隔避免锯齿
+func (s *pipelineSinker) heartbeatLag(interval time.Duration) *HeartbeatLag {
+	ts := atomic.LoadInt64(&s.heartbeatTs)
+	if ts <= 0 {
+		return nil
+	}
+	lag := time.Duration(atomic.LoadInt64(&s.heartbeatLatency)) * time.Millisecond
+	if stale := time.Since(time.UnixMilli(ts)) - interval; stale > lag {
+		lag = stale
+	}
+	if lag < 0 {
+		lag = 0
+	}
+	return &HeartbeatLag{Lag: lag.Seconds(), At: time.UnixMilli(ts)}
+}
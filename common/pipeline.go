@@ -0,0 +1,460 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-mysql-org/go-mysql/canal"
+	"github.com/go-mysql-org/go-mysql/mysql"
+	"github.com/gridsx/datagos/metrics"
+	"github.com/siddontang/go-log/log"
+)
+
+// RetryReporter 内部有重试的 sinker 上报累计重试次数
+type RetryReporter interface {
+	Retries() uint64
+}
+
+// DeadLetterWriter 保存 sinker 处理失败的事件， 保存成功之后 sinker 继续处理后面的事件
+type DeadLetterWriter interface {
+	Write(sinker string, e *canal.RowsEvent, pos mysql.Position, gtid string, cause error) error
+}
+
+// SinkerState sinker 的运行状态
+type SinkerState struct {
+	Name string `json:"name"`
+	// Enabled 是否在处理事件， 暂停和失败时为 false
+	Enabled bool   `json:"enabled"`
+	Health  string `json:"health"`
+	Error   string `json:"error,omitempty"`
+	Retries uint64 `json:"retries"`
+	// Heartbeat 开启心跳并且收到过心跳之后才有
+	Heartbeat *HeartbeatLag `json:"heartbeat,omitempty"`
+}
+
+// Pipeline 一个任务的所有 sinker， 事件依次交给每个 sinker， 同时记录指标
+type Pipeline struct {
+	events uint64
+	// buffered 上次 flush 成功之后收到的行数据大小， 估算 sinker 缓冲占用的内存
+	buffered  int64
+	task      string
+	sinkers   []*pipelineSinker
+	heartbeat *heartbeat
+	// deadLetter 没有配置时为 nil， 失败的事件按 ContinueOnError 跳过或者禁用 sinker
+	deadLetter DeadLetterWriter
+	// failed 按策略需要停止任务的错误， 之后不再处理事件也不再保存位点
+	lock   sync.Mutex
+	failed error
+	onFail func(err error)
+	// restarting 暂停的 sinker 已经恢复， 等待任务从保存的位点重启
+	restarting bool
+	onRestart  func()
+}
+
+type pipelineSinker struct {
+	retries uint64
+	// 心跳的写入时间以及落地时测得的延迟， 毫秒
+	pendingHeartbeat int64
+	heartbeatTs      int64
+	heartbeatLatency int64
+	Sinker
+	name   string
+	policy *RetryPolicy
+	health sinkerHealth
+}
+
+func NewPipeline(task string) *Pipeline {
+	return &Pipeline{task: task}
+}
+
+// Add 添加 sinker， name 为目标的名称， 用作指标的标签， policy 为 nil 时使用默认的重试策略
+func (p *Pipeline) Add(name string, s Sinker, policy *RetryPolicy) {
+	if policy == nil {
+		policy = ParseRetryPolicy("")
+	}
+	p.sinkers = append(p.sinkers, &pipelineSinker{Sinker: s, name: name, policy: policy})
+}
+
+// SetOnFail 按策略需要停止任务时回调， 在处理事件的协程中调用， 回调中不能同步等待任务停止
+func (p *Pipeline) SetOnFail(f func(err error)) {
+	p.onFail = f
+}
+
+// SetOnRestart 暂停的 sinker 恢复之后回调， 任务需要停止并从保存的位点重新开始
+func (p *Pipeline) SetOnRestart(f func()) {
+	p.onRestart = f
+}
+
+// Restarting 是否在等待重启
+func (p *Pipeline) Restarting() bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.restarting
+}
+
+// Health 任务的状态， 取所有 sinker 中最差的
+func (p *Pipeline) Health() string {
+	if p.Failed() != nil {
+		return HealthFailed
+	}
+	health := HealthRunning
+	for _, s := range p.sinkers {
+		state, _ := s.health.health()
+		health = WorseHealth(health, state)
+	}
+	return health
+}
+
+// Failed 导致任务停止的错误， 没有时为 nil
+func (p *Pipeline) Failed() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.failed
+}
+
+func (p *Pipeline) SetDeadLetter(w DeadLetterWriter) {
+	p.deadLetter = w
+}
+
+func (p *Pipeline) Len() int {
+	return len(p.sinkers)
+}
+
+// Events 收到的行事件数
+func (p *Pipeline) Events() uint64 {
+	return atomic.LoadUint64(&p.events)
+}
+
+// Buffered 上次 flush 成功之后收到的行数据大小， 字节， 即任务缓冲占用内存的估算
+func (p *Pipeline) Buffered() uint64 {
+	if n := atomic.LoadInt64(&p.buffered); n > 0 {
+		return uint64(n)
+	}
+	return 0
+}
+
+// rowsSize 行数据的大约大小， 字符串和字节按长度， 其他类型按8字节
+func rowsSize(e *canal.RowsEvent) int64 {
+	var n int64
+	for _, row := range e.Rows {
+		for _, v := range row {
+			switch v := v.(type) {
+			case string:
+				n += int64(len(v))
+			case []byte:
+				n += int64(len(v))
+			default:
+				n += 8
+			}
+		}
+	}
+	return n
+}
+
+// OnRow 先告知位点再交给 sinker， 可重试的错误按策略重试， 仍然失败的按 OnFatal 处理
+func (p *Pipeline) OnRow(e *canal.RowsEvent, pos mysql.Position, gtid string) {
+	if p.stopped() {
+		return
+	}
+	if ts, ok := p.heartbeat.heartbeatTs(e); ok {
+		for _, s := range p.sinkers {
+			if s.active() {
+				s.onHeartbeat(ts)
+			}
+		}
+		return
+	}
+	atomic.AddUint64(&p.events, 1)
+	atomic.AddInt64(&p.buffered, rowsSize(e))
+	table := e.Table.Schema + "." + e.Table.Name
+	metrics.EventsReceived.WithLabelValues(p.task, table, e.Action).Inc()
+	if e.Header == nil {
+		metrics.SnapshotRows.WithLabelValues(p.task).Inc()
+	}
+	for _, s := range p.sinkers {
+		if !s.active() {
+			continue
+		}
+		if aware, ok := s.Sinker.(PositionAware); ok {
+			aware.SetPosition(pos, gtid)
+		}
+		start := time.Now()
+		err := p.retry(s, func() error { return s.OnEvent(e) })
+		metrics.ApplyLatency.WithLabelValues(p.task, s.name).Observe(time.Since(start).Seconds())
+		if err != nil {
+			metrics.SinkerErrors.WithLabelValues(p.task, s.name).Inc()
+			var buffered *BufferedError
+			if errors.As(err, &buffered) {
+				p.hold(s, err)
+			} else {
+				p.onError(s, e, pos, gtid, err)
+			}
+			if p.Failed() != nil {
+				return
+			}
+			continue
+		}
+		metrics.EventsApplied.WithLabelValues(p.task, s.name, table, e.Action).Inc()
+	}
+}
+
+// retry 可重试的错误按退避时间重试， 重新执行整个事件， sinker 的写入需要可以重复执行
+func (p *Pipeline) retry(s *pipelineSinker, f func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := f()
+		if err == nil || attempt >= s.policy.MaxAttempts || !IsRetryable(err) {
+			return err
+		}
+		// 事件已经缓冲， 重试会重复写入
+		var buffered *BufferedError
+		if errors.As(err, &buffered) {
+			return err
+		}
+		s.health.onError(err)
+		atomic.AddUint64(&s.retries, 1)
+		d := s.policy.backoff(attempt)
+		log.Warnf("sinker %s error, retry in %v, attempt: %d, err: %v\n", s.name, d, attempt, err)
+		time.Sleep(d)
+	}
+}
+
+// onError 处理不可重试或者重试用完的错误， e 为 nil 表示事务提交出错， 无法保存为死信
+func (p *Pipeline) onError(s *pipelineSinker, e *canal.RowsEvent, pos mysql.Position, gtid string, err error) {
+	s.health.onError(err)
+	switch s.policy.OnFatal {
+	case ActionSkip:
+		log.Warnf("sinker %s error, event skipped: %v\n", s.name, err)
+	case ActionDeadLetter:
+		if e == nil || !p.toDeadLetter(s, e, pos, gtid, err) {
+			p.fail(s, err)
+		}
+	case ActionStop:
+		p.fail(s, err)
+	default:
+		if e != nil && p.toDeadLetter(s, e, pos, gtid, err) {
+			return
+		}
+		if !s.ContinueOnError() {
+			p.pause(s, e, pos, gtid, err)
+		}
+	}
+}
+
+// hold 处理缓冲的数据写入失败， 数据还在 sinker 中， 不能跳过也不能保存为死信， 按事务提交出错一样暂停或者停止
+func (p *Pipeline) hold(s *pipelineSinker, err error) {
+	s.health.onError(err)
+	if s.policy.OnFatal == ActionStop || s.policy.OnFatal == ActionDeadLetter {
+		p.fail(s, err)
+		return
+	}
+	p.pause(s, nil, mysql.Position{}, "", err)
+}
+
+// pause 暂停 sinker， 之后不再保存位点， 直到恢复之后任务重启
+func (p *Pipeline) pause(s *pipelineSinker, e *canal.RowsEvent, pos mysql.Position, gtid string, err error) {
+	delay := s.policy.recoverBackoff(1)
+	s.health.pause(e, pos, gtid, delay)
+	log.Errorf("sinker %s paused on error, checkpoint held, recover in %v: %v\n", s.name, delay, err)
+}
+
+// recover 到时间的暂停的 sinker 用出错的事件尝试恢复， 成功之后等待任务重启重放暂停期间的事件
+func (p *Pipeline) recover() {
+	for _, s := range p.sinkers {
+		h := &s.health
+		h.lock.Lock()
+		due := h.state == HealthPaused && !time.Now().Before(h.nextRecovery)
+		e, pos, gtid := h.failedEvent, h.failedPos, h.failedGtid
+		h.lock.Unlock()
+		if !due {
+			continue
+		}
+		err := s.probe(e, pos, gtid)
+		h.lock.Lock()
+		h.recoveries++
+		if err == nil {
+			h.state, h.failedEvent = HealthRunning, nil
+			h.lock.Unlock()
+			log.Infof("sinker %s recovered, restarting task from checkpoint, task: %s\n", s.name, p.task)
+			p.restart()
+			return
+		}
+		h.lastError, h.errorAt = err.Error(), time.Now()
+		attempts := h.recoveries
+		exhausted := attempts >= s.policy.MaxRecoveries
+		if !exhausted {
+			h.nextRecovery = time.Now().Add(s.policy.recoverBackoff(h.recoveries + 1))
+		}
+		h.lock.Unlock()
+		if exhausted {
+			p.fail(s, fmt.Errorf("recovery failed after %d attempts: %w", s.policy.MaxRecoveries, err))
+			return
+		}
+		log.Warnf("sinker %s recovery failed, attempt: %d, err: %v\n", s.name, attempts, err)
+	}
+}
+
+func (p *Pipeline) restart() {
+	p.lock.Lock()
+	if p.restarting {
+		p.lock.Unlock()
+		return
+	}
+	p.restarting = true
+	p.lock.Unlock()
+	if p.onRestart != nil {
+		p.onRestart()
+	}
+}
+
+// stopped 失败或者等待重启时不再处理事件
+func (p *Pipeline) stopped() bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.failed != nil || p.restarting
+}
+
+// fail 停止处理事件并通知任务停止， 只有第一个错误生效
+func (p *Pipeline) fail(s *pipelineSinker, err error) {
+	p.lock.Lock()
+	if p.failed != nil {
+		p.lock.Unlock()
+		return
+	}
+	p.failed = fmt.Errorf("sinker %s: %w", s.name, err)
+	failed := p.failed
+	p.lock.Unlock()
+	s.health.lock.Lock()
+	s.health.state = HealthFailed
+	s.health.lock.Unlock()
+	log.Errorf("pipeline failed, task: %s, err: %v\n", p.task, failed)
+	if p.onFail != nil {
+		p.onFail(failed)
+	}
+}
+
+// toDeadLetter 保存失败的事件， 保存失败时返回 false
+func (p *Pipeline) toDeadLetter(s *pipelineSinker, e *canal.RowsEvent, pos mysql.Position, gtid string, cause error) bool {
+	if p.deadLetter == nil {
+		return false
+	}
+	if err := p.deadLetter.Write(s.name, e, pos, gtid, cause); err != nil {
+		log.Errorf("error writing dead letter, sinker: %s, err: %v\n", s.name, err)
+		return false
+	}
+	metrics.DeadLetters.WithLabelValues(p.task, s.name).Inc()
+	log.Warnf("On Row, sinker %s error, event saved to dead letter: %v\n", s.name, cause)
+	return true
+}
+
+// OnCommit 源库事务提交， 通知需要感知事务边界的sinker
+func (p *Pipeline) OnCommit() {
+	if p.stopped() {
+		return
+	}
+	for _, s := range p.sinkers {
+		if !s.active() {
+			continue
+		}
+		txSinker, ok := s.Sinker.(TxSinker)
+		if !ok {
+			continue
+		}
+		if err := p.retry(s, txSinker.OnCommit); err != nil {
+			metrics.SinkerErrors.WithLabelValues(p.task, s.name).Inc()
+			p.onError(s, nil, mysql.Position{}, "", err)
+			if p.Failed() != nil {
+				return
+			}
+		}
+	}
+}
+
+// Flush 等待所有sinker把已经收到的数据落地， 任意一个失败、暂停或者已经按策略停止， 则本次不保存位点
+// 暂停的 sinker 在这里按退避时间尝试恢复
+func (p *Pipeline) Flush() error {
+	p.recover()
+	if err := p.Failed(); err != nil {
+		return err
+	}
+	if p.Restarting() {
+		return errors.New("restarting to replay from checkpoint")
+	}
+	// flush 期间收到的数据留到下次
+	buffered := atomic.LoadInt64(&p.buffered)
+	for _, s := range p.sinkers {
+		if !s.Enable() {
+			continue
+		}
+		if state, _ := s.health.health(); state == HealthPaused {
+			return fmt.Errorf("sinker %s paused on error", s.name)
+		}
+		if flusher, ok := s.Sinker.(Flusher); ok {
+			// 先取走心跳， flush 期间到达的心跳留到下次
+			ts := atomic.SwapInt64(&s.pendingHeartbeat, 0)
+			if err := flusher.Flush(); err != nil {
+				atomic.CompareAndSwapInt64(&s.pendingHeartbeat, 0, ts)
+				var buffered *BufferedError
+				if errors.As(err, &buffered) {
+					p.hold(s, err)
+				}
+				return err
+			}
+			s.applyHeartbeat(ts, time.Now())
+		}
+	}
+	atomic.AddInt64(&p.buffered, -buffered)
+	return nil
+}
+
+func (p *Pipeline) Close() {
+	for _, s := range p.sinkers {
+		if closer, ok := s.Sinker.(Closer); ok {
+			if err := closer.Close(); err != nil {
+				log.Errorf("error closing sinker %s: %v\n", s.name, err)
+			}
+		}
+	}
+}
+
+// States 各 sinker 的状态， 重试次数包括 sinker 内部的重试
+func (p *Pipeline) States() []SinkerState {
+	states := make([]SinkerState, 0, len(p.sinkers))
+	for _, s := range p.sinkers {
+		health, lastError := s.health.health()
+		state := SinkerState{Name: s.name, Enabled: s.active(), Health: health, Error: lastError,
+			Retries: atomic.LoadUint64(&s.retries)}
+		if p.heartbeat != nil {
+			state.Heartbeat = s.heartbeatLag(p.heartbeat.interval)
+		}
+		if r, ok := s.Sinker.(RetryReporter); ok {
+			state.Retries += r.Retries()
+		}
+		states = append(states, state)
+	}
+	return states
+}
+
+// active sinker 开启并且没有暂停或者失败
+func (s *pipelineSinker) active() bool {
+	return s.Enable() && s.health.active()
+}
+
+// probe 重新处理导致暂停的事件并落地， 事务提交出错时只 flush
+// 先设置出错事件的位置， 按位置生成版本号的 sinker 才不会使用之后事件的版本
+func (s *pipelineSinker) probe(e *canal.RowsEvent, pos mysql.Position, gtid string) error {
+	if e != nil {
+		if aware, ok := s.Sinker.(PositionAware); ok {
+			aware.SetPosition(pos, gtid)
+		}
+		if err := s.OnEvent(e); err != nil {
+			return err
+		}
+	}
+	if flusher, ok := s.Sinker.(Flusher); ok {
+		return flusher.Flush()
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package common
+
+// sinker 出错之后的重试策略
+// 可重试的错误（死锁、锁等待超时、连接断开、连接数过多）按指数退避加随机抖动重试， 其他错误以及重试用完之后按 OnFatal 处理
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+const (
+	// ActionStop 停止任务， 位点停在出错的事件之前
+	ActionStop = "stop"
+	// ActionSkip 跳过出错的事件
+	ActionSkip = "skip"
+	// ActionDeadLetter 保存为死信， 没有配置死信或者保存失败时停止任务
+	ActionDeadLetter = "dlq"
+
+	defaultMaxAttempts  = 3
+	defaultBackoffMs    = 100
+	defaultMaxBackoffMs = 5000
+	defaultJitter       = 0.2
+
+	defaultRecoverBackoffSec    = 5
+	defaultMaxRecoverBackoffSec = 300
+	defaultMaxRecoveries        = 10
+)
+
+// 可以重试的 MySQL 错误码
+var retryableCodes = map[uint16]bool{
+	1040: true, // too many connections
+	1205: true, // lock wait timeout
+	1213: true, // deadlock
+	2006: true, // server has gone away
+	2013: true, // lost connection
+}
+
+// RetryPolicy 目标配置中的 retry 字段， 与 sinker 自己的配置在同一个 JSON 中
+type RetryPolicy struct {
+	// MaxAttempts 包括第一次在内最多执行的次数
+	MaxAttempts  int `json:"maxAttempts,omitempty"`
+	BackoffMs    int `json:"backoffMs,omitempty"`
+	MaxBackoffMs int `json:"maxBackoffMs,omitempty"`
+	// Jitter 退避时间随机浮动的比例， 0 到 1
+	Jitter float64 `json:"jitter,omitempty"`
+	// OnFatal 不可重试或者重试用完之后的处理， 为空时有死信则保存为死信， 否则按 ContinueOnError 跳过或者暂停 sinker
+	OnFatal string `json:"onFatal,omitempty"`
+	// 暂停之后尝试恢复的退避时间和次数， 次数用完之后任务失败
+	RecoverBackoffSec    int `json:"recoverBackoffSec,omitempty"`
+	MaxRecoverBackoffSec int `json:"maxRecoverBackoffSec,omitempty"`
+	MaxRecoveries        int `json:"maxRecoveries,omitempty"`
+}
+
+// ParseRetryPolicy 从目标的配置中读取重试策略， 没有配置的字段使用默认值
+func ParseRetryPolicy(config string) *RetryPolicy {
+	c := struct {
+		Retry *RetryPolicy `json:"retry"`
+	}{}
+	_ = json.Unmarshal([]byte(config), &c)
+	p := c.Retry
+	if p == nil {
+		p = new(RetryPolicy)
+	}
+	if p.MaxAttempts <= 0 {
+		p.MaxAttempts = defaultMaxAttempts
+	}
+	if p.BackoffMs <= 0 {
+		p.BackoffMs = defaultBackoffMs
+	}
+	if p.MaxBackoffMs < p.BackoffMs {
+		p.MaxBackoffMs = defaultMaxBackoffMs
+	}
+	if p.Jitter <= 0 || p.Jitter > 1 {
+		p.Jitter = defaultJitter
+	}
+	if p.RecoverBackoffSec <= 0 {
+		p.RecoverBackoffSec = defaultRecoverBackoffSec
+	}
+	if p.MaxRecoverBackoffSec < p.RecoverBackoffSec {
+		p.MaxRecoverBackoffSec = defaultMaxRecoverBackoffSec
+	}
+	if p.MaxRecoveries <= 0 {
+		p.MaxRecoveries = defaultMaxRecoveries
+	}
+	return p
+}
+
+// backoff 第 attempt 次失败之后等待的时间
+func (p *RetryPolicy) backoff(attempt int) time.Duration {
+	return p.exponential(attempt, time.Duration(p.BackoffMs)*time.Millisecond, time.Duration(p.MaxBackoffMs)*time.Millisecond)
+}
+
+// recoverBackoff 第 attempt 次尝试恢复之前等待的时间
+func (p *RetryPolicy) recoverBackoff(attempt int) time.Duration {
+	return p.exponential(attempt, time.Duration(p.RecoverBackoffSec)*time.Second, time.Duration(p.MaxRecoverBackoffSec)*time.Second)
+}
+
+func (p *RetryPolicy) exponential(attempt int, d, max time.Duration) time.Duration {
+	for i := 1; i < attempt && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return d + time.Duration((rand.Float64()*2-1)*p.Jitter*float64(d))
+}
+
+// IsRetryable 错误是否可以重试， 其他错误重试也不会成功， 如数据过长、列不存在
+func IsRetryable(err error) bool {
+	var me *mysql.MySQLError
+	if errors.As(err, &me) {
+		return retryableCodes[me.Number]
+	}
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, mysql.ErrInvalidConn) ||
+		errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) {
+		return true
+	}
+	var ne net.Error
+	return errors.As(err, &ne)
+}
@@ -2,6 +2,7 @@ package common
 
 import (
 	"github.com/go-mysql-org/go-mysql/canal"
+	"github.com/go-mysql-org/go-mysql/mysql"
 )
 
 // Sinker 对应了binlog 的整体处理器
@@ -20,6 +21,44 @@ type Sinker interface {
 	ContinueOnError() bool
 }
 
+// Flusher 带缓冲或异步发送的Sinker需要实现
+// 保存位点之前会调用 Flush， 只有 Flush 成功， 位点才会前进， 保证位点之前的数据都已经确认落地
+type Flusher interface {
+	Flush() error
+}
+
+// TxSinker 需要感知源库事务边界的Sinker实现， 源库事务提交（XID）的时候调用
+type TxSinker interface {
+	OnCommit() error
+}
+
+// PositionAware 需要记录事件binlog位点的Sinker实现， 每个事件交给 OnEvent 之前调用
+// Pos 为事件结束的位置， gtid 为事件所在事务的 GTID， 没有开启 GTID 则为空
+// dump 的数据没有位点， 传入空的 Position
+type PositionAware interface {
+	SetPosition(pos mysql.Position, gtid string)
+}
+
+// BufferedError 带缓冲的 sinker 之前缓冲的数据写入失败， 数据仍然保留在 sinker 中， 与当前的事件无关，
+// 所以不能保存为死信也不能跳过， pipeline 暂停 sinker 或者按策略停止任务
+// OnEvent 返回 BufferedError 时 pipeline 不会重试、跳过这个事件， 当前事件已经缓冲或者在 sinker 恢复、任务从位点重启之后重放
+type BufferedError struct {
+	Err error
+}
+
+func (e *BufferedError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *BufferedError) Unwrap() error {
+	return e.Err
+}
+
+// Closer 持有连接等资源的Sinker需要实现， 任务停止的时候调用
+type Closer interface {
+	Close() error
+}
+
 // Consumer , 是最小单元， 一个Sinker对应多个Consumer
 type Consumer interface {
 	Accept(e *canal.RowsEvent) error
@@ -0,0 +1,104 @@
+package common
+
+import (
+	"strings"
+	"time"
+)
+
+// RenderTemplate 渲染形如 ${schema}.${table} 的模板
+// 变量不存在的时候保持原样， 方便排查配置问题
+func RenderTemplate(tpl string, vars map[string]string) string {
+	if !strings.Contains(tpl, "${") {
+		return tpl
+	}
+	sb := strings.Builder{}
+	for {
+		start := strings.Index(tpl, "${")
+		if start < 0 {
+			break
+		}
+		end := strings.Index(tpl[start:], "}")
+		if end < 0 {
+			break
+		}
+		end += start
+		sb.WriteString(tpl[:start])
+		name := tpl[start+2 : end]
+		if v, ok := vars[name]; ok {
+			sb.WriteString(v)
+		} else {
+			sb.WriteString(tpl[start : end+1])
+		}
+		tpl = tpl[end+1:]
+	}
+	sb.WriteString(tpl)
+	return sb.String()
+}
+
+// 日期格式的模板变量， 如 ${yyyy.MM}， ${yyyyMMdd}
+var datePatterns = []struct {
+	pattern string
+	layout  string
+}{
+	{"yyyy", "2006"},
+	{"yy", "06"},
+	{"MM", "01"},
+	{"dd", "02"},
+	{"HH", "15"},
+	{"mm", "04"},
+	{"ss", "05"},
+}
+
+// RenderTemplateAt 渲染模板， 除了 vars 中的变量之外， 还支持 ${yyyy.MM} 形式的日期变量
+func RenderTemplateAt(tpl string, vars map[string]string, t time.Time) string {
+	all := make(map[string]string, len(vars)+2)
+	for k, v := range vars {
+		all[k] = v
+	}
+	rest := tpl
+	for {
+		start := strings.Index(rest, "${")
+		if start < 0 {
+			break
+		}
+		end := strings.Index(rest[start:], "}")
+		if end < 0 {
+			break
+		}
+		name := rest[start+2 : start+end]
+		if _, ok := all[name]; !ok {
+			if layout, ok := toTimeLayout(name); ok {
+				all[name] = t.Format(layout)
+			}
+		}
+		rest = rest[start+end+1:]
+	}
+	return RenderTemplate(tpl, all)
+}
+
+// toTimeLayout 把 yyyy.MM.dd 这种格式转换为 go 的时间格式， 不是日期格式则返回 false
+func toTimeLayout(pattern string) (string, bool) {
+	sb := strings.Builder{}
+	matched := false
+	for i := 0; i < len(pattern); {
+		found := false
+		for _, p := range datePatterns {
+			if strings.HasPrefix(pattern[i:], p.pattern) {
+				sb.WriteString(p.layout)
+				i += len(p.pattern)
+				found, matched = true, true
+				break
+			}
+		}
+		if !found {
+			// 只允许日期占位符和分隔符， 避免把普通变量当成日期
+			c := pattern[i]
+			if (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') {
+				return "", false
+			}
+			sb.WriteByte(c)
+			i++
+		}
+	}
+	return sb.String(), matched
+}
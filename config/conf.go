@@ -32,9 +32,30 @@ type ServerConfig struct {
 	Port int `json:"port" yaml:"port"`
 }
 
+// ClusterConfig 集群调度配置， mode 为空时单机运行
+type ClusterConfig struct {
+	Mode      string   `json:"mode" yaml:"mode"` // etcd 或 db
+	NodeId    string   `json:"nodeId" yaml:"nodeId"`
+	Endpoints []string `json:"endpoints" yaml:"endpoints"`
+	Username  string   `json:"username" yaml:"username"`
+	Password  string   `json:"password" yaml:"password"`
+	Prefix    string   `json:"prefix" yaml:"prefix"`
+	TTL       int      `json:"ttl" yaml:"ttl"` // 节点租约， 秒
+	// Labels 节点标签， 任务可以指定只运行在标签匹配的节点上， 如 region: cn-east
+	Labels map[string]string `json:"labels" yaml:"labels"`
+}
+
+// DeadLetterConfig sinker 处理失败的事件的保存位置， mode 为空时不保存
+type DeadLetterConfig struct {
+	Mode string `json:"mode" yaml:"mode"` // db 或 file
+	Dir  string `json:"dir" yaml:"dir"`   // file 模式下的目录
+}
+
 type Config struct {
-	Mysql  MysqlConfig  `json:"mysql", yaml:"mysql"`
-	Server ServerConfig `json:"server" yaml:"server"`
+	Mysql      MysqlConfig      `json:"mysql" yaml:"mysql"`
+	Server     ServerConfig     `json:"server" yaml:"server"`
+	Cluster    ClusterConfig    `json:"cluster" yaml:"cluster"`
+	DeadLetter DeadLetterConfig `json:"deadLetter" yaml:"deadLetter"`
 }
 
 const configFile = "conf.yaml"
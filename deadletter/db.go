@@ -0,0 +1,106 @@
+package deadletter
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+
+	"github.com/gridsx/datagos/store"
+)
+
+const (
+	insertLetterSql = `INSERT INTO dead_letters (task_id, sinker, event, error, position, gtid, retries, created, updated)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	listLettersSql = `SELECT id, task_id, sinker, event, error, position, gtid, retries, created, updated
+		FROM dead_letters WHERE task_id = ? ORDER BY id LIMIT ?, ?`
+	getLetterSql = `SELECT id, task_id, sinker, event, error, position, gtid, retries, created, updated
+		FROM dead_letters WHERE id = ?`
+	updateLetterSql = `UPDATE dead_letters SET event = ?, error = ?, retries = ?, updated = ? WHERE id = ?`
+	deleteLetterSql = `DELETE FROM dead_letters WHERE id = ?`
+)
+
+// dbStore 保存到元数据库的 dead_letters 表
+type dbStore struct {
+	db *sql.DB
+}
+
+func newDbStore() *dbStore {
+	return &dbStore{db: store.GetDb()}
+}
+
+func (s *dbStore) Put(l *Letter) error {
+	event, err := json.Marshal(l.Event)
+	if err != nil {
+		return err
+	}
+	r, err := s.db.Exec(insertLetterSql, l.TaskId, l.Sinker, string(event), l.Error, l.Position, l.Gtid,
+		l.Retries, l.Created, l.Updated)
+	if err != nil {
+		return err
+	}
+	l.Id, err = r.LastInsertId()
+	return err
+}
+
+func (s *dbStore) List(taskId int, offset, limit int) ([]*Letter, error) {
+	rows, err := s.db.Query(listLettersSql, taskId, offset, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	result := make([]*Letter, 0)
+	for rows.Next() {
+		l, err := scanLetter(rows)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, l)
+	}
+	return result, rows.Err()
+}
+
+func (s *dbStore) Get(id int64) (*Letter, error) {
+	l, err := scanLetter(s.db.QueryRow(getLetterSql, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	return l, err
+}
+
+func (s *dbStore) Update(l *Letter) error {
+	event, err := json.Marshal(l.Event)
+	if err != nil {
+		return err
+	}
+	r, err := s.db.Exec(updateLetterSql, string(event), l.Error, l.Retries, l.Updated, l.Id)
+	if err != nil {
+		return err
+	}
+	if n, _ := r.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *dbStore) Delete(id int64) error {
+	_, err := s.db.Exec(deleteLetterSql, id)
+	return err
+}
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanLetter(s scanner) (*Letter, error) {
+	l := new(Letter)
+	var event string
+	if err := s.Scan(&l.Id, &l.TaskId, &l.Sinker, &event, &l.Error, &l.Position, &l.Gtid, &l.Retries,
+		&l.Created, &l.Updated); err != nil {
+		return nil, err
+	}
+	l.Event = new(Event)
+	if err := json.Unmarshal([]byte(event), l.Event); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
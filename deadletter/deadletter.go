@@ -0,0 +1,238 @@
+package deadletter
+
+// 死信， sinker 处理失败的事件连同错误和位点一起保存， 之后可以查看、修改之后重试或者丢弃
+// 事件按 JSON 保存， 整数读回为 int64， 无符号列和超出 int64 的整数为 uint64， 浮点列和小数为 float64，
+// 非 UTF-8 的二进制值保存为 {"$binary": base64}， 读回为 []byte
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/go-mysql-org/go-mysql/canal"
+	"github.com/go-mysql-org/go-mysql/mysql"
+	"github.com/go-mysql-org/go-mysql/replication"
+	"github.com/go-mysql-org/go-mysql/schema"
+	"github.com/gridsx/datagos/config"
+	"github.com/siddontang/go-log/log"
+)
+
+const (
+	ModeDB   = "db"
+	ModeFile = "file"
+
+	defaultDir = "./deadletters"
+)
+
+var ErrNotFound = errors.New("dead letter not found")
+
+// binaryKey 非 UTF-8 二进制值的标记， 与 MongoDB extended JSON 一致
+const binaryKey = "$binary"
+
+// Event 失败的事件， 重试之前可以修改
+type Event struct {
+	Table     *schema.Table   `json:"table"`
+	Action    string          `json:"action"`
+	Rows      [][]interface{} `json:"rows"`
+	Timestamp uint32          `json:"timestamp"`
+}
+
+// Letter 一条死信
+type Letter struct {
+	Id       int64     `json:"id"`
+	TaskId   int       `json:"taskId"`
+	Sinker   string    `json:"sinker"`
+	Event    *Event    `json:"event"`
+	Error    string    `json:"error"`
+	Position string    `json:"position"`
+	Gtid     string    `json:"gtid,omitempty"`
+	Retries  int       `json:"retries"`
+	Created  time.Time `json:"created"`
+	Updated  time.Time `json:"updated"`
+}
+
+// Store 死信的保存， 列表按 id 升序， 即失败的先后顺序
+type Store interface {
+	// Put 保存并设置 Id
+	Put(l *Letter) error
+	List(taskId int, offset, limit int) ([]*Letter, error)
+	Get(id int64) (*Letter, error)
+	Update(l *Letter) error
+	Delete(id int64) error
+}
+
+var (
+	defaultStore Store
+	once         sync.Once
+)
+
+// Default 按配置创建的 store， 没有配置时为 nil
+func Default() Store {
+	once.Do(func() {
+		s, err := New(config.GetConf().DeadLetter)
+		if err != nil {
+			log.Errorf("error creating dead letter store: %v\n", err)
+			return
+		}
+		defaultStore = s
+	})
+	return defaultStore
+}
+
+func New(c config.DeadLetterConfig) (Store, error) {
+	switch c.Mode {
+	case "":
+		return nil, nil
+	case ModeDB:
+		return newDbStore(), nil
+	case ModeFile:
+		dir := c.Dir
+		if len(dir) == 0 {
+			dir = defaultDir
+		}
+		return newFileStore(dir)
+	default:
+		return nil, errors.New("unknown dead letter mode: " + c.Mode)
+	}
+}
+
+// NewEvent 复制事件， 字符串值按 string 保存， 其他二进制值带上类型标记
+func NewEvent(e *canal.RowsEvent) *Event {
+	rows := make([][]interface{}, len(e.Rows))
+	for i, row := range e.Rows {
+		rows[i] = make([]interface{}, len(row))
+		for j, v := range row {
+			if b, ok := v.([]byte); ok {
+				if utf8.Valid(b) {
+					v = string(b)
+				} else {
+					v = map[string]interface{}{binaryKey: base64.StdEncoding.EncodeToString(b)}
+				}
+			}
+			rows[i][j] = v
+		}
+	}
+	event := &Event{Table: e.Table, Action: e.Action, Rows: rows}
+	if e.Header != nil {
+		event.Timestamp = e.Header.Timestamp
+	}
+	return event
+}
+
+// RowsEvent 还原为 sinker 处理的事件， 没有时间戳的按全量事件处理
+func (e *Event) RowsEvent() *canal.RowsEvent {
+	re := &canal.RowsEvent{Table: e.Table, Action: e.Action, Rows: e.Rows}
+	if e.Timestamp > 0 {
+		re.Header = &replication.EventHeader{Timestamp: e.Timestamp}
+	}
+	return re
+}
+
+// UnmarshalJSON 按表的列还原为 binlog 中的类型， 无符号列为 uint64， 浮点列为 float64
+func (e *Event) UnmarshalJSON(b []byte) error {
+	type event Event
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	if err := d.Decode((*event)(e)); err != nil {
+		return err
+	}
+	unsigned, floats := make(map[int]bool), make(map[int]bool)
+	if e.Table != nil {
+		for _, i := range e.Table.UnsignedColumns {
+			unsigned[i] = true
+		}
+		for i, c := range e.Table.Columns {
+			floats[i] = c.Type == schema.TYPE_FLOAT
+		}
+	}
+	for _, row := range e.Rows {
+		for i, v := range row {
+			switch v := v.(type) {
+			case json.Number:
+				row[i] = number(v, unsigned[i], floats[i])
+			case map[string]interface{}:
+				if bv, ok := binary(v); ok {
+					row[i] = bv
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func number(n json.Number, unsigned, float bool) interface{} {
+	if float {
+		if fv, err := n.Float64(); err == nil {
+			return fv
+		}
+	}
+	if unsigned {
+		if uv, err := strconv.ParseUint(n.String(), 10, 64); err == nil {
+			return uv
+		}
+	}
+	if iv, err := n.Int64(); err == nil {
+		return iv
+	}
+	if uv, err := strconv.ParseUint(n.String(), 10, 64); err == nil {
+		return uv
+	}
+	if fv, err := n.Float64(); err == nil {
+		return fv
+	}
+	return n
+}
+
+// binary 带类型标记的二进制值， 不是标记的对象原样保留
+func binary(m map[string]interface{}) ([]byte, bool) {
+	s, ok := m[binaryKey].(string)
+	if !ok || len(m) != 1 {
+		return nil, false
+	}
+	b, err := base64.StdEncoding.DecodeString(s)
+	return b, err == nil
+}
+
+// Pos 解析保存的位点， 格式为 mysql.Position.String()， 解析失败为空
+func (l *Letter) Pos() mysql.Position {
+	s := strings.TrimSuffix(strings.TrimPrefix(l.Position, "("), ")")
+	i := strings.LastIndex(s, ", ")
+	if i < 0 {
+		return mysql.Position{}
+	}
+	pos, err := strconv.ParseUint(s[i+2:], 10, 32)
+	if err != nil {
+		return mysql.Position{}
+	}
+	return mysql.Position{Name: s[:i], Pos: uint32(pos)}
+}
+
+// Writer 一个任务的死信写入， 由 pipeline 在 sinker 处理失败时调用
+type Writer struct {
+	store  Store
+	taskId int
+}
+
+func NewWriter(s Store, taskId int) *Writer {
+	return &Writer{store: s, taskId: taskId}
+}
+
+func (w *Writer) Write(sinker string, e *canal.RowsEvent, pos mysql.Position, gtid string, cause error) error {
+	now := time.Now()
+	return w.store.Put(&Letter{
+		TaskId:   w.taskId,
+		Sinker:   sinker,
+		Event:    NewEvent(e),
+		Error:    cause.Error(),
+		Position: pos.String(),
+		Gtid:     gtid,
+		Created:  now,
+		Updated:  now,
+	})
+}
@@ -0,0 +1,50 @@
+package deadletter
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"testing"
+
+	"github.com/go-mysql-org/go-mysql/canal"
+	"github.com/go-mysql-org/go-mysql/schema"
+)
+
+// 保存之后读回的值与 binlog 中的类型一致
+func TestEventRoundTrip(t *testing.T) {
+	table := &schema.Table{Schema: "db", Name: "t", UnsignedColumns: []int{1}}
+	table.AddColumn("id", "bigint", "", "")
+	table.AddColumn("big", "bigint unsigned", "", "")
+	table.AddColumn("data", "blob", "", "")
+	table.AddColumn("name", "varchar(16)", "", "")
+	table.AddColumn("score", "double", "", "")
+	table.AddColumn("doc", "json", "", "")
+	bin := []byte{0xff, 0x00, 0xfe}
+	e := &canal.RowsEvent{Table: table, Action: canal.InsertAction, Rows: [][]interface{}{
+		{int64(-1), uint64(math.MaxUint64), bin, []byte("abc"), 1.5, map[string]interface{}{"$binary": 1}},
+		{int64(2), uint64(7), nil, "x", float64(2), nil},
+	}}
+
+	d, err := json.Marshal(NewEvent(e))
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded := &Event{}
+	if err := json.Unmarshal(d, loaded); err != nil {
+		t.Fatal(err)
+	}
+	row := loaded.Rows[0]
+	if row[0] != int64(-1) || row[1] != uint64(math.MaxUint64) || row[3] != "abc" || row[4] != 1.5 {
+		t.Fatalf("row: %#v", row)
+	}
+	if b, ok := row[2].([]byte); !ok || !bytes.Equal(b, bin) {
+		t.Fatalf("binary value: %#v", row[2])
+	}
+	if m, ok := row[5].(map[string]interface{}); !ok || len(m) != 1 {
+		t.Fatalf("object value: %#v", row[5])
+	}
+	row = loaded.Rows[1]
+	if row[0] != int64(2) || row[1] != uint64(7) || row[2] != nil || row[4] != float64(2) {
+		t.Fatalf("row: %#v", row)
+	}
+}
@@ -0,0 +1,127 @@
+package deadletter
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fileStore 每条死信一个 JSON 文件， 文件名为 id， id 取纳秒时间戳保证递增
+type fileStore struct {
+	dir    string
+	lock   sync.Mutex
+	lastId int64
+}
+
+func newFileStore(dir string) (*fileStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &fileStore{dir: dir}, nil
+}
+
+func (s *fileStore) path(id int64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%d.json", id))
+}
+
+func (s *fileStore) Put(l *Letter) error {
+	s.lock.Lock()
+	id := time.Now().UnixNano()
+	if id <= s.lastId {
+		id = s.lastId + 1
+	}
+	s.lastId = id
+	s.lock.Unlock()
+	l.Id = id
+	return s.write(l)
+}
+
+// write 先写临时文件再改名， 避免读到写了一半的文件
+func (s *fileStore) write(l *Letter) error {
+	d, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+	tmp := s.path(l.Id) + ".tmp"
+	if err := os.WriteFile(tmp, d, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path(l.Id))
+}
+
+func (s *fileStore) List(taskId int, offset, limit int) ([]*Letter, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]int64, 0, len(entries))
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		if id, err := strconv.ParseInt(strings.TrimSuffix(name, ".json"), 10, 64); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	result := make([]*Letter, 0)
+	for _, id := range ids {
+		l, err := s.Get(id)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if l.TaskId != taskId {
+			continue
+		}
+		if offset > 0 {
+			offset--
+			continue
+		}
+		if len(result) >= limit {
+			break
+		}
+		result = append(result, l)
+	}
+	return result, nil
+}
+
+func (s *fileStore) Get(id int64) (*Letter, error) {
+	d, err := os.ReadFile(s.path(id))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	l := new(Letter)
+	if err := json.Unmarshal(d, l); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (s *fileStore) Update(l *Letter) error {
+	if _, err := os.Stat(s.path(l.Id)); errors.Is(err, os.ErrNotExist) {
+		return ErrNotFound
+	}
+	return s.write(l)
+}
+
+func (s *fileStore) Delete(id int64) error {
+	err := os.Remove(s.path(id))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
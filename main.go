@@ -10,7 +10,7 @@ import (
 
 func main() {
 
-	c := make(chan os.Signal)
+	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, os.Kill)
 
 	server.Serve()
@@ -0,0 +1,59 @@
+package metrics
+
+// prometheus 指标， 由 server 在 /metrics 暴露
+// 事件相关的指标在分发事件时记录， 延迟、位点、全量以及 sinker 状态由 server 在采集时从运行中的任务读取
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const namespace = "datagos"
+
+var (
+	// EventsReceived 任务从源端收到的行事件
+	EventsReceived = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "events_received_total",
+		Help:      "Row events received from the source.",
+	}, []string{"task", "table", "action"})
+
+	// EventsApplied sinker 成功处理的行事件
+	EventsApplied = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "events_applied_total",
+		Help:      "Row events applied by a sinker.",
+	}, []string{"task", "sinker", "table", "action"})
+
+	// SinkerErrors sinker 处理事件出错的次数
+	SinkerErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "sinker_errors_total",
+		Help:      "Errors returned by a sinker.",
+	}, []string{"task", "sinker"})
+
+	// ApplyLatency sinker 处理一个事件的耗时
+	ApplyLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "apply_latency_seconds",
+		Help:      "Time a sinker takes to apply one row event.",
+		Buckets:   prometheus.ExponentialBuckets(0.0001, 4, 10),
+	}, []string{"task", "sinker"})
+
+	// SnapshotRows 全量阶段收到的行
+	SnapshotRows = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "snapshot_rows_total",
+		Help:      "Rows received during the initial snapshot.",
+	}, []string{"task"})
+
+	// DeadLetters 处理失败保存为死信的事件
+	DeadLetters = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "dead_letters_total",
+		Help:      "Failed row events saved to the dead letter store.",
+	}, []string{"task", "sinker"})
+)
+
+func init() {
+	prometheus.MustRegister(EventsReceived, EventsApplied, SinkerErrors, ApplyLatency, SnapshotRows, DeadLetters)
+}
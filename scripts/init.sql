@@ -44,3 +44,94 @@ INSERT INTO `datagos`.`mysql_tasks`(`id`, `name`, `description`, `instance_id`,
 VALUES (2, '内存表同步', '不同实例同步', 2, '', '', '[{\"srcTable\":\"mem_tb\",\"dstTable\":\"mem_tb\"}]',
         '{\"host\":\"127.0.0.1\",\"port\":3306,\"username\":\"tuser\",\"password\":\"1234zxcv\",\"database\":\"test\"}',
         0, 1, '2022-11-14 08:39:24', '2022-11-14 11:34:24');
+
+
+-- 同步任务， info 为任务保存的位点， 有位点时从位点继续， 不再全量
+CREATE TABLE `tasks`
+(
+    `id`       int unsigned NOT NULL AUTO_INCREMENT,
+    `title`    varchar(255) CHARACTER SET utf8mb3 COLLATE utf8mb3_general_ci NOT NULL DEFAULT '',
+    `src_type` int unsigned NOT NULL COMMENT '1 mysql 2 postgres 3 mongo 4 redis',
+    `src`      text CHARACTER SET utf8mb3 COLLATE utf8mb3_general_ci         NOT NULL,
+    `dest`     varchar(255) CHARACTER SET utf8mb3 COLLATE utf8mb3_general_ci NOT NULL DEFAULT '' COMMENT 'task_dests 的 id， 逗号分隔',
+    `state`    int unsigned NOT NULL DEFAULT '0' COMMENT '0 创建 1 同步中 2 停止 3 失败， 按重试策略停止， 位点停在出错的事件之前',
+    `info`     text CHARACTER SET utf8mb3 COLLATE utf8mb3_general_ci,
+    `created`  timestamp                                                     NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    `updated`  timestamp                                                     NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+    PRIMARY KEY (`id`) USING BTREE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb3;
+
+
+-- 集群调度， 数据库后端， 过期时间均以数据库时间为准
+CREATE TABLE `cluster_nodes`
+(
+    `node_id`   varchar(128) CHARACTER SET utf8mb3 COLLATE utf8mb3_general_ci NOT NULL,
+    `state`     text CHARACTER SET utf8mb3 COLLATE utf8mb3_general_ci         NOT NULL COMMENT '节点上报的标签和负载',
+    `draining`  tinyint unsigned NOT NULL DEFAULT '0' COMMENT '是否摘除',
+    `expire_at` timestamp(3)                                                  NOT NULL,
+    `created`   timestamp                                                     NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (`node_id`) USING BTREE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb3;
+
+
+CREATE TABLE `cluster_leader`
+(
+    `id`        int unsigned NOT NULL,
+    `node_id`   varchar(128) CHARACTER SET utf8mb3 COLLATE utf8mb3_general_ci NOT NULL DEFAULT '',
+    `token`     bigint unsigned NOT NULL DEFAULT '0' COMMENT '每次换主加一',
+    `expire_at` timestamp(3)                                                  NOT NULL DEFAULT '1970-01-02 00:00:00.000',
+    PRIMARY KEY (`id`) USING BTREE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb3;
+
+
+CREATE TABLE `cluster_tasks`
+(
+    `task_id`   int unsigned NOT NULL,
+    `enabled`   tinyint unsigned NOT NULL DEFAULT '1' COMMENT '是否参与调度',
+    `selector`  varchar(1024) CHARACTER SET utf8mb3 COLLATE utf8mb3_general_ci NOT NULL DEFAULT '' COMMENT '节点标签选择器',
+    `node_id`   varchar(128) CHARACTER SET utf8mb3 COLLATE utf8mb3_general_ci NOT NULL DEFAULT '' COMMENT '主节点分配的节点',
+    `owner`     varchar(128) CHARACTER SET utf8mb3 COLLATE utf8mb3_general_ci NOT NULL DEFAULT '' COMMENT '持有任务锁的节点',
+    `token`     bigint unsigned NOT NULL DEFAULT '0' COMMENT 'fencing token， 每次获取锁加一',
+    `expire_at` timestamp(3)                                                  NOT NULL DEFAULT '1970-01-02 00:00:00.000',
+    `created`   timestamp                                                     NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    `updated`   timestamp                                                     NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+    PRIMARY KEY (`task_id`) USING BTREE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb3;
+
+
+-- 校验差异的修复记录， dry_run 为只生成 SQL 未执行
+CREATE TABLE `repair_audit`
+(
+    `id`         bigint unsigned NOT NULL AUTO_INCREMENT,
+    `task_id`    int unsigned NOT NULL,
+    `dest`       varchar(128) CHARACTER SET utf8mb3 COLLATE utf8mb3_general_ci  NOT NULL DEFAULT '',
+    `src_table`  varchar(255) CHARACTER SET utf8mb3 COLLATE utf8mb3_general_ci  NOT NULL DEFAULT '',
+    `row_key`    varchar(1024) CHARACTER SET utf8mb3 COLLATE utf8mb3_general_ci NOT NULL DEFAULT '' COMMENT '主键， JSON',
+    `kind`       varchar(16) CHARACTER SET utf8mb3 COLLATE utf8mb3_general_ci   NOT NULL DEFAULT '' COMMENT 'missing extra changed',
+    `action`     varchar(16) CHARACTER SET utf8mb3 COLLATE utf8mb3_general_ci   NOT NULL DEFAULT '' COMMENT 'update delete',
+    `statements` text CHARACTER SET utf8mb3 COLLATE utf8mb3_general_ci          NOT NULL,
+    `dry_run`    tinyint unsigned NOT NULL DEFAULT '0',
+    `fixed`      tinyint unsigned NOT NULL DEFAULT '0' COMMENT '修复之后重新对比是否一致',
+    `error`      text CHARACTER SET utf8mb3 COLLATE utf8mb3_general_ci          NOT NULL,
+    `created`    timestamp                                                      NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (`id`) USING BTREE,
+    KEY `idx_task` (`task_id`, `created`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb3;
+
+
+-- 死信， sinker 处理失败的事件， 配置 deadLetter.mode 为 db 时使用
+CREATE TABLE `dead_letters`
+(
+    `id`       bigint unsigned NOT NULL AUTO_INCREMENT,
+    `task_id`  int unsigned NOT NULL,
+    `sinker`   varchar(128) CHARACTER SET utf8mb3 COLLATE utf8mb3_general_ci NOT NULL DEFAULT '' COMMENT '目标名称',
+    `event`    mediumtext CHARACTER SET utf8mb4 COLLATE utf8mb4_general_ci   NOT NULL COMMENT '事件， JSON',
+    `error`    text CHARACTER SET utf8mb4 COLLATE utf8mb4_general_ci         NOT NULL,
+    `position` varchar(255) CHARACTER SET utf8mb3 COLLATE utf8mb3_general_ci NOT NULL DEFAULT '',
+    `gtid`     varchar(1024) CHARACTER SET utf8mb3 COLLATE utf8mb3_general_ci NOT NULL DEFAULT '',
+    `retries`  int unsigned NOT NULL DEFAULT '0',
+    `created`  timestamp(3)                                                  NOT NULL DEFAULT CURRENT_TIMESTAMP(3),
+    `updated`  timestamp(3)                                                  NOT NULL DEFAULT CURRENT_TIMESTAMP(3),
+    PRIMARY KEY (`id`) USING BTREE,
+    KEY `idx_task` (`task_id`, `id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb3;
@@ -0,0 +1,182 @@
+package server
+
+import (
+	"errors"
+	"time"
+
+	"github.com/gridsx/datagos/blender"
+	"github.com/gridsx/datagos/common"
+	"github.com/gridsx/datagos/deadletter"
+	"github.com/gridsx/datagos/task"
+	"github.com/kataras/iris/v12"
+	"github.com/siddontang/go-log/log"
+	"github.com/winjeg/irisword/ret"
+)
+
+const defaultLetterLimit = 20
+
+func listLetters(ctx iris.Context) {
+	s := deadletter.Default()
+	if s == nil {
+		ret.BadRequest(ctx, "dead letter not enabled")
+		return
+	}
+	taskId, _ := ctx.URLParamInt("id")
+	limit := ctx.URLParamIntDefault("limit", defaultLetterLimit)
+	letters, err := s.List(taskId, ctx.URLParamIntDefault("offset", 0), limit)
+	if err != nil {
+		ret.ServerError(ctx, err.Error())
+		return
+	}
+	ret.Ok(ctx, letters)
+}
+
+func getLetter(ctx iris.Context) {
+	s, l := loadLetter(ctx)
+	if s == nil {
+		return
+	}
+	ret.Ok(ctx, l)
+}
+
+func retryLetter(ctx iris.Context) {
+	s, l := loadLetter(ctx)
+	if s == nil {
+		return
+	}
+	if err := retry(s, l); err != nil {
+		ret.ServerError(ctx, err.Error())
+		return
+	}
+	ret.Ok(ctx)
+}
+
+// editLetter 请求体为修改之后的事件， 一般只需要 rows， 没有的字段保持原样， 保存之后重试
+func editLetter(ctx iris.Context) {
+	s, l := loadLetter(ctx)
+	if s == nil {
+		return
+	}
+	event := new(deadletter.Event)
+	if err := ctx.ReadJSON(event); err != nil {
+		ret.BadRequest(ctx, err.Error())
+		return
+	}
+	if event.Table == nil {
+		event.Table = l.Event.Table
+	}
+	if len(event.Action) == 0 {
+		event.Action = l.Event.Action
+	}
+	if event.Timestamp == 0 {
+		event.Timestamp = l.Event.Timestamp
+	}
+	l.Event = event
+	l.Updated = time.Now()
+	if err := s.Update(l); err != nil {
+		ret.ServerError(ctx, err.Error())
+		return
+	}
+	if err := retry(s, l); err != nil {
+		ret.ServerError(ctx, err.Error())
+		return
+	}
+	ret.Ok(ctx)
+}
+
+func discardLetter(ctx iris.Context) {
+	s, l := loadLetter(ctx)
+	if s == nil {
+		return
+	}
+	if err := s.Delete(l.Id); err != nil {
+		ret.ServerError(ctx, err.Error())
+		return
+	}
+	log.Infof("dead letter discarded, task: %d, sinker: %s, id: %d\n", l.TaskId, l.Sinker, l.Id)
+	ret.Ok(ctx)
+}
+
+// loadLetter 按参数 letter 读取死信， 出错时已经写入响应， 返回的 store 为 nil
+func loadLetter(ctx iris.Context) (deadletter.Store, *deadletter.Letter) {
+	s := deadletter.Default()
+	if s == nil {
+		ret.BadRequest(ctx, "dead letter not enabled")
+		return nil, nil
+	}
+	id, err := ctx.URLParamInt64("letter")
+	if err != nil {
+		ret.BadRequest(ctx, "letter required")
+		return nil, nil
+	}
+	l, err := s.Get(id)
+	if errors.Is(err, deadletter.ErrNotFound) {
+		ret.BadRequest(ctx, err.Error())
+		return nil, nil
+	}
+	if err != nil {
+		ret.ServerError(ctx, err.Error())
+		return nil, nil
+	}
+	return s, l
+}
+
+// retry 用新建的 sinker 重新处理事件， 成功之后删除死信， 失败则记录错误和重试次数
+func retry(s deadletter.Store, l *deadletter.Letter) error {
+	err := apply(l)
+	if err == nil {
+		log.Infof("dead letter retried, task: %d, sinker: %s, id: %d\n", l.TaskId, l.Sinker, l.Id)
+		return s.Delete(l.Id)
+	}
+	l.Retries++
+	l.Error = err.Error()
+	l.Updated = time.Now()
+	if uerr := s.Update(l); uerr != nil {
+		log.Errorf("error updating dead letter, id: %d, err: %v\n", l.Id, uerr)
+	}
+	return err
+}
+
+func apply(l *deadletter.Letter) error {
+	t, err := task.Manager.GetTask(l.TaskId)
+	if err != nil {
+		return err
+	}
+	dests, err := t.GetDest()
+	if err != nil {
+		return err
+	}
+	for _, d := range dests {
+		if d.Name != l.Sinker {
+			continue
+		}
+		sinker, err := blender.BuildSinker(d)
+		if err != nil {
+			return err
+		}
+		if sinker == nil {
+			return errors.New("unknown dest type")
+		}
+		defer closeSinker(sinker)
+		// 与同步时相同的位点， 按位点生成版本号的 sinker 才不会把旧数据当作新的
+		if aware, ok := sinker.(common.PositionAware); ok {
+			aware.SetPosition(l.Pos(), l.Gtid)
+		}
+		if err := sinker.OnEvent(l.Event.RowsEvent()); err != nil {
+			return err
+		}
+		if flusher, ok := sinker.(common.Flusher); ok {
+			return flusher.Flush()
+		}
+		return nil
+	}
+	return errors.New("dest not found: " + l.Sinker)
+}
+
+func closeSinker(s common.Sinker) {
+	if closer, ok := s.(common.Closer); ok {
+		if err := closer.Close(); err != nil {
+			log.Errorf("error closing sinker: %v\n", err)
+		}
+	}
+}
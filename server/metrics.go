@@ -0,0 +1,102 @@
+package server
+
+// 任务级别的指标在采集时从运行中的任务读取， 事件、错误、耗时等计数见 metrics 包
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/gridsx/datagos/common"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	taskLagDesc = prometheus.NewDesc("datagos_task_lag_seconds",
+		"Replication lag of the latest event.", []string{"task"}, nil)
+	checkpointAgeDesc = prometheus.NewDesc("datagos_task_checkpoint_age_seconds",
+		"Seconds since the last saved checkpoint.", []string{"task"}, nil)
+	snapshotDoneDesc = prometheus.NewDesc("datagos_task_snapshot_done",
+		"Whether the snapshot has finished, 1 when no snapshot is needed.", []string{"task"}, nil)
+	sinkerEnabledDesc = prometheus.NewDesc("datagos_sinker_enabled",
+		"Whether the sinker is applying events, 0 when it is paused or failed on error.", []string{"task", "sinker"}, nil)
+	sinkerRetriesDesc = prometheus.NewDesc("datagos_sinker_retries_total",
+		"Retries made by the sinker.", []string{"task", "sinker"}, nil)
+	heartbeatLagDesc = prometheus.NewDesc("datagos_sinker_heartbeat_lag_seconds",
+		"End-to-end lag measured by the heartbeat table.", []string{"task", "sinker"}, nil)
+	taskHealthDesc = prometheus.NewDesc("datagos_task_health",
+		"Health state of the task, 1 for the current state.", []string{"task", "state"}, nil)
+	sinkerHealthDesc = prometheus.NewDesc("datagos_sinker_health",
+		"Health state of the sinker, 1 for the current state.", []string{"task", "sinker", "state"}, nil)
+)
+
+var healthStates = []string{common.HealthRunning, common.HealthDegraded, common.HealthPaused, common.HealthFailed}
+
+// taskCollector 本节点运行中的任务
+type taskCollector struct{}
+
+func init() {
+	prometheus.MustRegister(taskCollector{})
+}
+
+func (taskCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- taskLagDesc
+	ch <- checkpointAgeDesc
+	ch <- snapshotDoneDesc
+	ch <- sinkerEnabledDesc
+	ch <- sinkerRetriesDesc
+	ch <- heartbeatLagDesc
+	ch <- taskHealthDesc
+	ch <- sinkerHealthDesc
+}
+
+func (taskCollector) Collect(ch chan<- prometheus.Metric) {
+	registry.Lock()
+	tasks := make(map[int]runningTask, len(registry.tasks))
+	for id, t := range registry.tasks {
+		tasks[id] = t
+	}
+	// 失败停止的任务只上报状态
+	failed := make([]*taskStatus, 0, len(registry.failed))
+	for _, status := range registry.failed {
+		failed = append(failed, status)
+	}
+	registry.Unlock()
+
+	for _, status := range failed {
+		collectHealth(ch, taskHealthDesc, status.Health, strconv.Itoa(status.Id))
+	}
+
+	for id, t := range tasks {
+		task := strconv.Itoa(id)
+		stats := t.Stats()
+		ch <- prometheus.MustNewConstMetric(taskLagDesc, prometheus.GaugeValue, float64(stats.Delay), task)
+		if !stats.Checkpoint.IsZero() {
+			ch <- prometheus.MustNewConstMetric(checkpointAgeDesc, prometheus.GaugeValue,
+				time.Since(stats.Checkpoint).Seconds(), task)
+		}
+		ch <- prometheus.MustNewConstMetric(snapshotDoneDesc, prometheus.GaugeValue, boolValue(stats.SnapshotDone), task)
+		collectHealth(ch, taskHealthDesc, stats.Health, task)
+		for _, s := range stats.Sinkers {
+			collectHealth(ch, sinkerHealthDesc, s.Health, task, s.Name)
+			ch <- prometheus.MustNewConstMetric(sinkerEnabledDesc, prometheus.GaugeValue, boolValue(s.Enabled), task, s.Name)
+			ch <- prometheus.MustNewConstMetric(sinkerRetriesDesc, prometheus.CounterValue, float64(s.Retries), task, s.Name)
+			if s.Heartbeat != nil {
+				ch <- prometheus.MustNewConstMetric(heartbeatLagDesc, prometheus.GaugeValue, s.Heartbeat.Lag, task, s.Name)
+			}
+		}
+	}
+}
+
+// collectHealth 每个状态一个序列， 当前状态为 1
+func collectHealth(ch chan<- prometheus.Metric, desc *prometheus.Desc, health string, labels ...string) {
+	for _, state := range healthStates {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, boolValue(state == health), append(labels, state)...)
+	}
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
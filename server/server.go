@@ -3,24 +3,58 @@ package server
 import (
 	"fmt"
 
+	"github.com/gridsx/datagos/balancer"
 	"github.com/gridsx/datagos/config"
 	"github.com/kataras/iris/v12"
 	"github.com/kataras/iris/v12/middleware/recover"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/siddontang/go-log/log"
 )
 
 var conf = config.GetConf()
 
+// cluster 集群调度， 单机运行时为 nil
+var cluster balancer.Balancer
+
 func Serve() {
+	b, err := balancer.New(localRunner{})
+	if err != nil {
+		log.Errorf("Serve create balancer error :%v\n", err)
+		return
+	}
+	if b != nil {
+		if err := b.Start(); err != nil {
+			log.Errorf("Serve start balancer error :%v\n", err)
+			return
+		}
+		cluster = b
+		// 退出前停止本节点的任务， 以便其他节点尽快接管
+		iris.RegisterOnInterrupt(b.Stop)
+	}
+
 	app := iris.New()
 	app.Use(recover.New())
+	app.Get("/metrics", iris.FromStd(promhttp.Handler()))
 
 	api := app.Party("/api")
 	{
 		api.Get("/task/start", startTask)
+		api.Get("/task/stop", stopTask)
+		api.Get("/task/status", getTaskStatus)
+		api.Get("/cluster/nodes", clusterNodes)
+		api.Get("/cluster/drain", drainNode)
+		api.Get("/verify/start", startVerify)
+		api.Get("/verify/report", verifyReport)
+		api.Get("/verify/cancel", cancelVerify)
+		api.Get("/verify/repair", repairVerify)
+		api.Get("/deadletter/list", listLetters)
+		api.Get("/deadletter/get", getLetter)
+		api.Get("/deadletter/retry", retryLetter)
+		api.Post("/deadletter/edit", editLetter)
+		api.Get("/deadletter/discard", discardLetter)
 	}
 
-	err := app.Listen(fmt.Sprintf(":%d", conf.Server.Port))
+	err = app.Listen(fmt.Sprintf(":%d", conf.Server.Port))
 	if err != nil {
 		log.Errorf("Serve error :%v\n", err)
 	}
@@ -1,12 +1,24 @@
 package server
 
 import (
+	"strings"
+
 	"github.com/kataras/iris/v12"
 	"github.com/winjeg/irisword/ret"
 )
 
+// startTask 集群模式下只提交调度， 由主节点分配到某个节点运行
+// selector 指定节点标签， 如 region=cn-east,zone=a
 func startTask(ctx iris.Context) {
 	taskId, _ := ctx.URLParamInt("id")
+	if cluster != nil {
+		if err := cluster.Submit(taskId, parseSelector(ctx.URLParam("selector"))); err != nil {
+			ret.ServerError(ctx, err.Error())
+			return
+		}
+		ret.Ok(ctx)
+		return
+	}
 	t := NewTask(taskId)
 	if err := t.Start(); err != nil {
 		ret.ServerError(ctx, err.Error())
@@ -14,3 +26,66 @@ func startTask(ctx iris.Context) {
 	}
 	ret.Ok(ctx)
 }
+
+func stopTask(ctx iris.Context) {
+	taskId, _ := ctx.URLParamInt("id")
+	if cluster != nil {
+		if err := cluster.Remove(taskId); err != nil {
+			ret.ServerError(ctx, err.Error())
+			return
+		}
+		ret.Ok(ctx)
+		return
+	}
+	NewTask(taskId).Stop()
+	ret.Ok(ctx)
+}
+
+func getTaskStatus(ctx iris.Context) {
+	taskId, _ := ctx.URLParamInt("id")
+	ret.Ok(ctx, NewTask(taskId).Status())
+}
+
+func clusterNodes(ctx iris.Context) {
+	if cluster == nil {
+		ret.BadRequest(ctx, "cluster mode not enabled")
+		return
+	}
+	nodes, err := cluster.Nodes()
+	if err != nil {
+		ret.ServerError(ctx, err.Error())
+		return
+	}
+	ret.Ok(ctx, nodes)
+}
+
+// drainNode 摘除节点， 其上的任务迁移到其他节点， drain=false 时恢复
+func drainNode(ctx iris.Context) {
+	if cluster == nil {
+		ret.BadRequest(ctx, "cluster mode not enabled")
+		return
+	}
+	nodeId := ctx.URLParam("node")
+	if len(nodeId) == 0 {
+		ret.BadRequest(ctx, "node required")
+		return
+	}
+	if err := cluster.Drain(nodeId, ctx.URLParamDefault("drain", "true") != "false"); err != nil {
+		ret.ServerError(ctx, err.Error())
+		return
+	}
+	ret.Ok(ctx)
+}
+
+func parseSelector(s string) map[string]string {
+	if len(s) == 0 {
+		return nil
+	}
+	selector := make(map[string]string)
+	for _, kv := range strings.Split(s, ",") {
+		if k, v, ok := strings.Cut(kv, "="); ok {
+			selector[strings.TrimSpace(k)] = strings.TrimSpace(v)
+		}
+	}
+	return selector
+}
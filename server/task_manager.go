@@ -2,12 +2,35 @@ package server
 
 import (
 	"errors"
+	"sync"
+
+	"github.com/gridsx/datagos/balancer"
 	"github.com/gridsx/datagos/blender"
+	"github.com/gridsx/datagos/common"
 	"github.com/gridsx/datagos/task"
+	"github.com/siddontang/go-log/log"
 )
 
+// runningTask 各类型源的同步任务
+type runningTask interface {
+	Start() error
+	Stop()
+	Running() bool
+	Restarting() bool
+	Stats() blender.TaskStats
+}
+
+// registry 本节点上运行中的任务， 任务的 Start 返回后移除， 失败停止的任务保留最后的状态直到再次启动
+var registry = struct {
+	sync.Mutex
+	tasks  map[int]runningTask
+	failed map[int]*taskStatus
+}{tasks: make(map[int]runningTask), failed: make(map[int]*taskStatus)}
+
 type manager struct {
 	Id int `json:"id"` // taskId
+	// fence 集群模式下持有的任务锁， 原地重建任务时沿用
+	fence *task.Fence
 }
 
 func NewTask(id int) *manager {
@@ -16,32 +39,187 @@ func NewTask(id int) *manager {
 
 // Start 异步
 func (m *manager) Start() error {
-	tsk, err := task.Manager.GetTask(m.Id)
+	if m.get() != nil {
+		return errors.New("task already running")
+	}
+	t, err := m.create()
 	if err != nil {
 		return err
 	}
+	registry.Lock()
+	if _, ok := registry.tasks[m.Id]; ok {
+		registry.Unlock()
+		return errors.New("task already running")
+	}
+	registry.tasks[m.Id] = t
+	delete(registry.failed, m.Id)
+	registry.Unlock()
+
+	go m.run(t)
+	return nil
+}
+
+func (m *manager) create() (runningTask, error) {
+	tsk, err := task.Manager.GetTask(m.Id)
+	if err != nil {
+		return nil, err
+	}
+	tsk.Fence = m.fence
+	return newRunningTask(tsk)
+}
 
+// run 运行直到任务停止， 暂停的 sinker 恢复之后原地重建任务， 从保存的位点重放， 期间任务一直在 registry 中
+func (m *manager) run(t runningTask) {
+	for {
+		err := t.Start()
+		if err != nil {
+			log.Errorf("task exited with error, task: %d, err: %v\n", m.Id, err)
+		}
+		if !t.Restarting() {
+			registry.Lock()
+			if registry.tasks[m.Id] == t {
+				delete(registry.tasks, m.Id)
+				if stats := t.Stats(); err != nil || stats.Health == common.HealthFailed {
+					status := &taskStatus{Id: m.Id, Health: common.HealthFailed, Sinkers: stats.Sinkers}
+					if err != nil {
+						status.Error = err.Error()
+					}
+					registry.failed[m.Id] = status
+				}
+			}
+			registry.Unlock()
+			return
+		}
+		log.Infof("task restarting from checkpoint, task: %d\n", m.Id)
+		next, err := m.create()
+		registry.Lock()
+		if registry.tasks[m.Id] != t {
+			registry.Unlock()
+			return
+		}
+		if err != nil {
+			delete(registry.tasks, m.Id)
+			registry.failed[m.Id] = &taskStatus{Id: m.Id, Health: common.HealthFailed, Error: err.Error()}
+			registry.Unlock()
+			log.Errorf("error restarting task: %d, err: %v\n", m.Id, err)
+			return
+		}
+		registry.tasks[m.Id] = next
+		registry.Unlock()
+		t = next
+	}
+}
+
+func newRunningTask(tsk *task.Task) (runningTask, error) {
 	switch tsk.SrcType {
 	case int(task.SrcMySQL):
 		canal := blender.NewMySQLCanalTask(tsk)
 		if canal == nil {
-			return errors.New("error creating mysql canal")
+			return nil, errors.New("error creating mysql canal")
+		}
+		return canal, nil
+	case int(task.SrcPostgres):
+		pg := blender.NewPostgresTask(tsk)
+		if pg == nil {
+			return nil, errors.New("error creating postgres task")
 		}
-		go canal.Start()
-		return nil
-	case int(task.SrcMongo), int(task.SrcPostgres), int(task.SrcRedis):
-		return errors.New("not supported yet")
+		return pg, nil
+	case int(task.SrcMongo):
+		mt := blender.NewMongoTask(tsk)
+		if mt == nil {
+			return nil, errors.New("error creating mongo task")
+		}
+		return mt, nil
+	case int(task.SrcRedis):
+		rt := blender.NewRedisTask(tsk)
+		if rt == nil {
+			return nil, errors.New("error creating redis task")
+		}
+		return rt, nil
 	default:
-		return errors.New("unknown src type")
+		return nil, errors.New("unknown src type")
 	}
 }
 
-// Stop 停止
-// TODO 停止后，记录position
+func (m *manager) get() runningTask {
+	registry.Lock()
+	defer registry.Unlock()
+	return registry.tasks[m.Id]
+}
+
+// Stop 停止， 任务停止时会记录position
 func (m *manager) Stop() {
+	if t := m.get(); t != nil {
+		t.Stop()
+	}
+}
+
+// taskStatus 任务在本节点上的运行状态
+type taskStatus struct {
+	Id      int    `json:"id"`
+	Running bool   `json:"running"`
+	Health  string `json:"health,omitempty"`
+	// Error 失败停止的原因
+	Error   string               `json:"error,omitempty"`
+	Sinkers []common.SinkerState `json:"sinkers,omitempty"`
+}
+
+// Status 运行中的任务取当前状态， 失败停止的任务取最后的状态， 重启节点之后按任务表中的状态
+func (m *manager) Status() *taskStatus {
+	if t := m.get(); t != nil {
+		stats := t.Stats()
+		return &taskStatus{Id: m.Id, Running: t.Running(), Health: stats.Health, Sinkers: stats.Sinkers}
+	}
+	registry.Lock()
+	failed := registry.failed[m.Id]
+	registry.Unlock()
+	if failed != nil {
+		return failed
+	}
+	status := &taskStatus{Id: m.Id}
+	if tsk, err := task.Manager.GetTask(m.Id); err == nil && tsk.State == task.Failed {
+		status.Health = common.HealthFailed
+	}
+	return status
+}
+
+// localRunner 集群模式下由调度器启停本节点的任务
+type localRunner struct{}
 
+// StartTask 数据库任务锁带 fencing token， 任务的位点和状态写入都要校验
+func (localRunner) StartTask(id int, lease balancer.Lease) error {
+	m := NewTask(id)
+	if lease.Token > 0 {
+		m.fence = &task.Fence{Owner: lease.Owner, Token: lease.Token}
+	}
+	return m.Start()
 }
 
-func (m *manager) Status() {
+func (localRunner) StopTask(id int) {
+	NewTask(id).Stop()
+}
 
+func (localRunner) RunningTasks() []int {
+	registry.Lock()
+	defer registry.Unlock()
+	ids := make([]int, 0, len(registry.tasks))
+	for id := range registry.tasks {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// TaskFailed 按策略失败停止的任务在任务表中记录为失败， 其他错误退出的任务为停止
+func (localRunner) TaskFailed(id int) bool {
+	tsk, err := task.Manager.GetTask(id)
+	return err == nil && tsk.State == task.Failed
+}
+
+func (localRunner) TaskStats(id int) (balancer.TaskStats, bool) {
+	t := NewTask(id).get()
+	if t == nil {
+		return balancer.TaskStats{}, false
+	}
+	stats := t.Stats()
+	return balancer.TaskStats{Events: stats.Events, Delay: stats.Delay, Memory: stats.Buffered}, true
 }
@@ -0,0 +1,103 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/gridsx/datagos/task"
+	"github.com/gridsx/datagos/verify"
+	"github.com/kataras/iris/v12"
+	"github.com/siddontang/go-log/log"
+	"github.com/winjeg/irisword/ret"
+)
+
+const repairStopTimeout = 30 * time.Second
+
+// startVerify 后台校验任务的源表与目标表， 通过 verifyReport 查看进度和结果
+func startVerify(ctx iris.Context) {
+	taskId, _ := ctx.URLParamInt("id")
+	opts := verify.Options{
+		Table:         ctx.URLParam("table"),
+		ChunkSize:     ctx.URLParamIntDefault("chunkSize", 0),
+		RowsPerSecond: ctx.URLParamIntDefault("rowsPerSecond", 0),
+		Algorithm:     ctx.URLParam("algorithm"),
+		Rechecks:      ctx.URLParamIntDefault("rechecks", 0),
+		RecheckDelay:  time.Duration(ctx.URLParamIntDefault("recheckDelaySec", 0)) * time.Second,
+		MaxDiffs:      ctx.URLParamIntDefault("maxDiffs", 0),
+	}
+	if _, err := verify.Start(taskId, opts); err != nil {
+		ret.ServerError(ctx, err.Error())
+		return
+	}
+	ret.Ok(ctx)
+}
+
+func verifyReport(ctx iris.Context) {
+	taskId, _ := ctx.URLParamInt("id")
+	job := verify.Get(taskId)
+	if job == nil {
+		ret.BadRequest(ctx, "no verification for task")
+		return
+	}
+	ret.Ok(ctx, job.Report())
+}
+
+func cancelVerify(ctx iris.Context) {
+	taskId, _ := ctx.URLParamInt("id")
+	if job := verify.Get(taskId); job != nil {
+		job.Cancel()
+	}
+	ret.Ok(ctx)
+}
+
+// repairVerify 修复最近一次校验的差异， 默认 dryRun 只返回 SQL， dryRun=false 时执行
+func repairVerify(ctx iris.Context) {
+	taskId, _ := ctx.URLParamInt("id")
+	var repairs []*verify.Repair
+	var err error
+	if ctx.URLParamDefault("dryRun", "true") != "false" {
+		repairs, err = verify.RepairTask(taskId, true)
+	} else {
+		repairs, err = repairStopped(taskId)
+	}
+	if err != nil {
+		ret.ServerError(ctx, err.Error())
+		return
+	}
+	ret.Ok(ctx, repairs)
+}
+
+// repairStopped 修复期间停止本节点上运行的任务， 修复与同步不会同时写目标， 修复之后从保存的位点重启
+// 重启之后重放的事件按顺序写到最新的状态， 目标最终与源表一致
+func repairStopped(taskId int) ([]*verify.Repair, error) {
+	tsk, err := task.Manager.GetTask(taskId)
+	if err != nil {
+		return nil, err
+	}
+	// 集群模式下任务可能在其他节点上运行， 停止之后也会被重新调度
+	if cluster != nil && tsk.State == task.Running {
+		return nil, errors.New("task is running, stop it before repairing")
+	}
+	m := NewTask(taskId)
+	if m.get() == nil {
+		return verify.RepairTask(taskId, false)
+	}
+	log.Infof("task stopped for repair, task: %d\n", taskId)
+	m.Stop()
+	deadline := time.Now().Add(repairStopTimeout)
+	for m.get() != nil {
+		if time.Now().After(deadline) {
+			return nil, errors.New("timeout waiting for task to stop")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	repairs, err := verify.RepairTask(taskId, false)
+	if serr := m.Start(); serr != nil {
+		log.Errorf("error restarting task after repair, task: %d, err: %v\n", taskId, serr)
+		if err == nil {
+			err = fmt.Errorf("rows repaired, error restarting task: %w", serr)
+		}
+	}
+	return repairs, err
+}
@@ -0,0 +1,417 @@
+package clickhouse
+
+// 通过 ClickHouse 的 HTTP 接口以 JSONEachRow 格式批量写入
+// update 和 delete 都转换为带版本的行： _version 取自binlog位点， delete 的 _is_deleted 为1
+// 配合 ReplacingMergeTree 使用的时候按 _version 取最新的行， CollapsingMergeTree 则额外写入 _sign
+// 按条数或者时间批量写入， 保存位点之前也会写入
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-mysql-org/go-mysql/canal"
+	"github.com/go-mysql-org/go-mysql/mysql"
+	"github.com/go-mysql-org/go-mysql/schema"
+	"github.com/gridsx/datagos/canal/mysql/filter"
+	"github.com/gridsx/datagos/canal/mysql/mapper"
+	"github.com/gridsx/datagos/common"
+	"github.com/gridsx/datagos/sinker/format"
+	"github.com/siddontang/go-log/log"
+)
+
+const (
+	EngineReplacing        = "replacing"
+	EngineReplacingDeleted = "replacing_deleted"
+	EngineCollapsing       = "collapsing"
+
+	versionColumn = "_version"
+	deletedColumn = "_is_deleted"
+	signColumn    = "_sign"
+
+	defaultBatchSize       = 10000
+	defaultFlushIntervalMs = 1000
+	defaultTimeoutMs       = 30000
+)
+
+// ClickHouseSinkerConfig 对应 task_dests 的 config 字段
+type ClickHouseSinkerConfig struct {
+	// Addresses HTTP 接口地址， 如 http://127.0.0.1:8123
+	Addresses []string `json:"addresses"`
+	Database  string   `json:"database"`
+	Username  string   `json:"username,omitempty"`
+	Password  string   `json:"password,omitempty"`
+	TimeoutMs int      `json:"timeoutMs,omitempty"`
+
+	// Engine 自动建表的引擎： replacing（默认）， replacing_deleted（23.2 以上）， collapsing
+	Engine     string                `json:"engine,omitempty"`
+	AutoCreate bool                  `json:"autoCreate,omitempty"`
+	Mappings   []mapper.TableMapping `json:"mappings"`
+
+	// 批量写入， 满足条数或者时间任意一个即写入
+	BatchSize       int `json:"batchSize,omitempty"`
+	FlushIntervalMs int `json:"flushIntervalMs,omitempty"`
+
+	Filter        *filter.TableFilter `json:"filter,omitempty"`
+	ErrorContinue bool                `json:"errorContinue"`
+}
+
+type batch struct {
+	table string
+	cols  []string
+	rows  []map[string]interface{}
+}
+
+type ClickHouseSinker struct {
+	disabled      bool
+	ErrorContinue bool
+	Filter        *filter.TableFilter
+	Mappings      []mapper.TableMapping
+
+	addresses  []string
+	database   string
+	username   string
+	password   string
+	engine     string
+	autoCreate bool
+	batchSize  int
+	client     *http.Client
+
+	lock    sync.Mutex
+	created map[string]bool
+	order   []string
+	batches map[string]*batch
+	queued  int
+	// 定时写入发生的错误， 下次处理事件的时候作为 BufferedError 返回
+	err  error
+	stop chan struct{}
+	// pos 当前事件的位置， 用于生成版本号
+	pos mysql.Position
+}
+
+func (s *ClickHouseSinker) Enable() bool {
+	return !s.disabled
+}
+
+func (s *ClickHouseSinker) Disable() {
+	s.disabled = true
+}
+
+func (s *ClickHouseSinker) ContinueOnError() bool {
+	return s.ErrorContinue
+}
+
+// SetPosition 与 OnEvent 在同一个协程中调用
+func (s *ClickHouseSinker) SetPosition(pos mysql.Position, gtid string) {
+	s.pos = pos
+}
+
+func (s *ClickHouseSinker) OnEvent(e *canal.RowsEvent) error {
+	if e == nil || e.Table == nil {
+		return nil
+	}
+	if s.Filter != nil && s.Filter.Match(e) {
+		return nil
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for i := range s.Mappings {
+		m := &s.Mappings[i]
+		if !m.Match(e.Table.Schema, e.Table.Name) {
+			continue
+		}
+		if err := s.ensureTable(m, e.Table); err != nil {
+			return err
+		}
+		s.addRows(m, e)
+	}
+	// 当前事件已经缓存， 定时写入的错误与当前事件无关， 由 Flush 决定是否恢复
+	if s.err != nil {
+		err := s.err
+		s.err = nil
+		return &common.BufferedError{Err: err}
+	}
+	if s.queued >= s.batchSize {
+		if err := s.flush(); err != nil {
+			return &common.BufferedError{Err: err}
+		}
+	}
+	return nil
+}
+
+// Flush 写入缓存的所有行
+func (s *ClickHouseSinker) Flush() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.flush()
+}
+
+func (s *ClickHouseSinker) Close() error {
+	close(s.stop)
+	return s.Flush()
+}
+
+// 定时写入
+func (s *ClickHouseSinker) tick(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			s.lock.Lock()
+			if err := s.flush(); err != nil && s.err == nil {
+				log.Errorf("clickhouse sinker flush error: %s\n", err.Error())
+				s.err = err
+			}
+			s.lock.Unlock()
+		}
+	}
+}
+
+func (s *ClickHouseSinker) flush() error {
+	for len(s.order) > 0 {
+		b := s.batches[s.order[0]]
+		if err := s.insert(b); err != nil {
+			return err
+		}
+		s.queued -= len(b.rows)
+		delete(s.batches, s.order[0])
+		s.order = s.order[1:]
+	}
+	s.queued = 0
+	return nil
+}
+
+func dstTable(m *mapper.TableMapping) string {
+	if len(m.DstTable) > 0 {
+		return m.DstTable
+	}
+	return m.SrcTable
+}
+
+// columns 需要写入的源表列位置， 以及对应的目标列名
+func columns(m *mapper.TableMapping, t *schema.Table) ([]int, []string) {
+	idx := make([]int, 0, len(t.Columns))
+	names := make([]string, 0, len(t.Columns))
+	if len(m.ColMappings) == 0 {
+		for i, col := range t.Columns {
+			idx = append(idx, i)
+			names = append(names, col.Name)
+		}
+		return idx, names
+	}
+	for _, cm := range m.ColMappings {
+		if i := t.FindColumn(cm.Src); i >= 0 {
+			idx = append(idx, i)
+			names = append(names, m.DstName(cm.Src))
+		}
+	}
+	return idx, names
+}
+
+func (s *ClickHouseSinker) addRows(m *mapper.TableMapping, e *canal.RowsEvent) {
+	table := dstTable(m)
+	idx, names := columns(m, e.Table)
+	b, ok := s.batches[table]
+	if !ok {
+		cols := append(append([]string{}, names...), versionColumn, deletedColumn)
+		if s.engine == EngineCollapsing {
+			cols = append(cols, signColumn)
+		}
+		b = &batch{table: table, cols: cols}
+		s.batches[table] = b
+		s.order = append(s.order, table)
+	}
+	version := format.EventVersion(e, s.pos)
+	toRow := func(row []interface{}, deleted bool, sign int) map[string]interface{} {
+		r := make(map[string]interface{}, len(names)+3)
+		for i, pos := range idx {
+			if pos < len(row) {
+				r[names[i]] = chValue(&e.Table.Columns[pos], row[pos])
+			}
+		}
+		r[versionColumn] = version
+		r[deletedColumn] = 0
+		if deleted {
+			r[deletedColumn] = 1
+		}
+		if s.engine == EngineCollapsing {
+			r[signColumn] = sign
+		}
+		return r
+	}
+	before := len(b.rows)
+	for _, change := range format.Changes(e) {
+		switch {
+		case change.Before == nil:
+			b.rows = append(b.rows, toRow(change.After, false, 1))
+		case change.After == nil:
+			b.rows = append(b.rows, toRow(change.Before, true, -1))
+		default:
+			// 主键变化， 或者使用 collapsing 引擎， 需要先取消旧的行
+			if s.engine == EngineCollapsing || format.RowKey(e.Table, change.Before) != format.RowKey(e.Table, change.After) {
+				b.rows = append(b.rows, toRow(change.Before, true, -1))
+			}
+			b.rows = append(b.rows, toRow(change.After, false, 1))
+		}
+	}
+	s.queued += len(b.rows) - before
+}
+
+func (s *ClickHouseSinker) insert(b *batch) error {
+	if len(b.rows) == 0 {
+		return nil
+	}
+	body := bytes.Buffer{}
+	enc := json.NewEncoder(&body)
+	for _, r := range b.rows {
+		if err := enc.Encode(r); err != nil {
+			return err
+		}
+	}
+	quoted := make([]string, 0, len(b.cols))
+	for _, c := range b.cols {
+		quoted = append(quoted, quote(c))
+	}
+	query := fmt.Sprintf("INSERT INTO %s.%s (%s) FORMAT JSONEachRow",
+		quote(s.database), quote(b.table), strings.Join(quoted, ", "))
+	return s.exec(query, &body)
+}
+
+// ensureTable 按源表结构自动建表， 主键作为排序键
+func (s *ClickHouseSinker) ensureTable(m *mapper.TableMapping, t *schema.Table) error {
+	table := dstTable(m)
+	if !s.autoCreate || s.created[table] {
+		return nil
+	}
+	idx, names := columns(m, t)
+	isPK := make(map[int]bool, len(t.PKColumns))
+	orderBy := make([]string, 0, len(t.PKColumns))
+	for _, pk := range t.PKColumns {
+		isPK[pk] = true
+		orderBy = append(orderBy, quote(m.DstName(t.Columns[pk].Name)))
+	}
+	if len(orderBy) == 0 {
+		orderBy = append(orderBy, "tuple()")
+	}
+	defs := make([]string, 0, len(idx)+3)
+	for i, pos := range idx {
+		typ := chType(&t.Columns[pos])
+		if !isPK[pos] {
+			typ = "Nullable(" + typ + ")"
+		}
+		defs = append(defs, fmt.Sprintf("%s %s", quote(names[i]), typ))
+	}
+	defs = append(defs, quote(versionColumn)+" UInt64", quote(deletedColumn)+" UInt8")
+	engine := "ReplacingMergeTree(" + versionColumn + ")"
+	switch s.engine {
+	case EngineReplacingDeleted:
+		engine = "ReplacingMergeTree(" + versionColumn + ", " + deletedColumn + ")"
+	case EngineCollapsing:
+		defs = append(defs, quote(signColumn)+" Int8")
+		engine = "CollapsingMergeTree(" + signColumn + ")"
+	}
+	ddl := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s.%s (%s) ENGINE = %s ORDER BY (%s)",
+		quote(s.database), quote(table), strings.Join(defs, ", "), engine, strings.Join(orderBy, ", "))
+	if err := s.exec(ddl, nil); err != nil {
+		log.Errorf("error creating table: %s, err: %s\n", ddl, err.Error())
+		return err
+	}
+	s.created[table] = true
+	return nil
+}
+
+func quote(name string) string {
+	return "`" + strings.ReplaceAll(name, "`", "\\`") + "`"
+}
+
+// exec 依次尝试每个地址， 有 body 的时候 query 放在 url 参数中
+func (s *ClickHouseSinker) exec(query string, body *bytes.Buffer) error {
+	var lastErr error
+	for _, addr := range s.addresses {
+		params := url.Values{}
+		params.Set("date_time_input_format", "best_effort")
+		params.Set("input_format_skip_unknown_fields", "1")
+		var reader io.Reader
+		if body != nil {
+			params.Set("query", query)
+			reader = bytes.NewReader(body.Bytes())
+		} else {
+			reader = strings.NewReader(query)
+		}
+		req, err := http.NewRequest(http.MethodPost, strings.TrimRight(addr, "/")+"/?"+params.Encode(), reader)
+		if err != nil {
+			return err
+		}
+		if len(s.username) > 0 {
+			req.Header.Set("X-ClickHouse-User", s.username)
+			req.Header.Set("X-ClickHouse-Key", s.password)
+		}
+		resp, err := s.client.Do(req)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		data, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("clickhouse status: %d, %s", resp.StatusCode, strings.TrimSpace(string(data)))
+		}
+		return nil
+	}
+	return lastErr
+}
+
+func Build(c string) (*ClickHouseSinker, error) {
+	cfg := new(ClickHouseSinkerConfig)
+	if err := json.Unmarshal([]byte(c), cfg); err != nil {
+		return nil, err
+	}
+	if len(cfg.Addresses) == 0 || len(cfg.Database) == 0 {
+		return nil, errors.New("clickhouse sinker: addresses or database not configured")
+	}
+	if len(cfg.Mappings) == 0 {
+		return nil, errors.New("clickhouse sinker: mappings not configured")
+	}
+	timeout := cfg.TimeoutMs
+	if timeout <= 0 {
+		timeout = defaultTimeoutMs
+	}
+	interval := cfg.FlushIntervalMs
+	if interval <= 0 {
+		interval = defaultFlushIntervalMs
+	}
+	s := &ClickHouseSinker{
+		ErrorContinue: cfg.ErrorContinue,
+		Filter:        cfg.Filter,
+		Mappings:      cfg.Mappings,
+		addresses:     cfg.Addresses,
+		database:      cfg.Database,
+		username:      cfg.Username,
+		password:      cfg.Password,
+		engine:        cfg.Engine,
+		autoCreate:    cfg.AutoCreate,
+		batchSize:     cfg.BatchSize,
+		client:        &http.Client{Timeout: time.Duration(timeout) * time.Millisecond},
+		created:       make(map[string]bool, 8),
+		batches:       make(map[string]*batch, 8),
+		stop:          make(chan struct{}),
+	}
+	if len(s.engine) == 0 {
+		s.engine = EngineReplacing
+	}
+	if s.batchSize <= 0 {
+		s.batchSize = defaultBatchSize
+	}
+	go s.tick(time.Duration(interval) * time.Millisecond)
+	return s, nil
+}
@@ -0,0 +1,86 @@
+package clickhouse
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/go-mysql-org/go-mysql/schema"
+	"github.com/gridsx/datagos/sinker/format"
+)
+
+// chType MySQL 列类型对应的 ClickHouse 类型， 自动建表的时候使用
+func chType(col *schema.TableColumn) string {
+	raw := strings.ToLower(col.RawType)
+	unsigned := ""
+	if col.IsUnsigned {
+		unsigned = "U"
+	}
+	switch col.Type {
+	case schema.TYPE_NUMBER:
+		switch {
+		case strings.HasPrefix(raw, "tinyint(1)"):
+			return "UInt8"
+		case strings.HasPrefix(raw, "tinyint"):
+			return unsigned + "Int8"
+		case strings.HasPrefix(raw, "smallint"):
+			return unsigned + "Int16"
+		case strings.HasPrefix(raw, "year"):
+			return "UInt16"
+		case strings.HasPrefix(raw, "bigint"):
+			return unsigned + "Int64"
+		default:
+			return unsigned + "Int32"
+		}
+	case schema.TYPE_MEDIUM_INT:
+		return unsigned + "Int32"
+	case schema.TYPE_FLOAT:
+		if strings.HasPrefix(raw, "float") {
+			return "Float32"
+		}
+		return "Float64"
+	case schema.TYPE_DECIMAL:
+		start, end := strings.Index(raw, "("), strings.Index(raw, ")")
+		if start > 0 && end > start {
+			return "Decimal" + raw[start:end+1]
+		}
+		return "Decimal(10, 0)"
+	case schema.TYPE_DATETIME, schema.TYPE_TIMESTAMP:
+		return "DateTime64(6)"
+	case schema.TYPE_DATE:
+		return "Date32"
+	case schema.TYPE_BIT:
+		return "UInt64"
+	default:
+		// 字符串， enum， set， json， time， 二进制等都作为 String
+		return "String"
+	}
+}
+
+// chValue 把 binlog 中的值转换为 JSONEachRow 可以接受的值
+func chValue(col *schema.TableColumn, v interface{}) interface{} {
+	if v == nil {
+		return nil
+	}
+	switch col.Type {
+	case schema.TYPE_ENUM:
+		return format.EnumName(col, v)
+	case schema.TYPE_SET:
+		return strings.Join(format.SetNames(col, v), ",")
+	case schema.TYPE_DECIMAL:
+		return fmt.Sprint(format.Value(v))
+	case schema.TYPE_DATETIME, schema.TYPE_TIMESTAMP, schema.TYPE_DATE:
+		s := fmt.Sprint(format.Value(v))
+		if strings.HasPrefix(s, "0000-00-00") {
+			return nil
+		}
+		return s
+	case schema.TYPE_NUMBER:
+		if b, ok := v.(bool); ok {
+			if b {
+				return 1
+			}
+			return 0
+		}
+	}
+	return format.Value(v)
+}
@@ -0,0 +1,132 @@
+package es
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// bulkAction 对应 _bulk 请求中的一个操作， delete 没有 body
+type bulkAction struct {
+	op   string
+	meta map[string]interface{}
+	body interface{}
+}
+
+type bulkItem struct {
+	Index  string `json:"_index"`
+	Id     string `json:"_id"`
+	Status int    `json:"status"`
+	Result string `json:"result"`
+	Error  *struct {
+		Type   string `json:"type"`
+		Reason string `json:"reason"`
+	} `json:"error"`
+}
+
+type bulkResponse struct {
+	Errors bool                  `json:"errors"`
+	Items  []map[string]bulkItem `json:"items"`
+}
+
+// bulkClient 只使用 _bulk 接口， 多个地址轮流使用， 请求失败则换下一个
+type bulkClient struct {
+	addresses []string
+	next      uint32
+	username  string
+	password  string
+	client    *http.Client
+}
+
+func newBulkClient(addresses []string, username, password string, timeout time.Duration) *bulkClient {
+	trimmed := make([]string, 0, len(addresses))
+	for _, v := range addresses {
+		trimmed = append(trimmed, strings.TrimRight(v, "/"))
+	}
+	return &bulkClient{
+		addresses: trimmed,
+		username:  username,
+		password:  password,
+		client:    &http.Client{Timeout: timeout},
+	}
+}
+
+func encodeBulk(actions []*bulkAction) ([]byte, error) {
+	buf := bytes.Buffer{}
+	enc := json.NewEncoder(&buf)
+	for _, a := range actions {
+		if err := enc.Encode(map[string]interface{}{a.op: a.meta}); err != nil {
+			return nil, err
+		}
+		if a.body != nil {
+			if err := enc.Encode(a.body); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// do 发送一次 bulk 请求， 返回每个操作的结果， 顺序与 actions 一致
+func (c *bulkClient) do(actions []*bulkAction) ([]bulkItem, error) {
+	body, err := encodeBulk(actions)
+	if err != nil {
+		return nil, err
+	}
+	var lastErr error
+	for i := 0; i < len(c.addresses); i++ {
+		addr := c.addresses[int(atomic.AddUint32(&c.next, 1))%len(c.addresses)]
+		items, err := c.doOne(addr, body)
+		if err == nil {
+			if len(items) != len(actions) {
+				return nil, fmt.Errorf("bulk response items %d, expected %d", len(items), len(actions))
+			}
+			return items, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+func (c *bulkClient) doOne(addr string, body []byte) ([]bulkItem, error) {
+	req, err := http.NewRequest(http.MethodPost, addr+"/_bulk", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	if len(c.username) > 0 {
+		req.SetBasicAuth(c.username, c.password)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("bulk request status: %d, body: %s", resp.StatusCode, string(data))
+	}
+	result := new(bulkResponse)
+	if err := json.Unmarshal(data, result); err != nil {
+		return nil, err
+	}
+	items := make([]bulkItem, 0, len(result.Items))
+	for _, m := range result.Items {
+		if len(m) != 1 {
+			return nil, errors.New("unexpected bulk response item")
+		}
+		for _, v := range m {
+			items = append(items, v)
+		}
+	}
+	return items, nil
+}
@@ -0,0 +1,134 @@
+package es
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/go-mysql-org/go-mysql/canal"
+	"github.com/go-mysql-org/go-mysql/schema"
+	"github.com/gridsx/datagos/canal/mysql/mapper"
+	"github.com/gridsx/datagos/common"
+	"github.com/gridsx/datagos/sinker/format"
+)
+
+// 维护嵌套文档的脚本， 先按子文档的键移除， 再追加新的子文档， doc 为空则只移除
+const nestedScript = `if (ctx._source[params.field] == null) { ctx._source[params.field] = new ArrayList(); }
+ctx._source[params.field].removeIf(item -> String.valueOf(item[params.key]) == params.id);
+if (params.doc != null) { ctx._source[params.field].add(params.doc); }`
+
+// IndexConfig 源表到索引的映射， DstTable 为索引名模板， 如 orders-${yyyy.MM}
+// 配置了 ColMappings 则只同步映射的列， 并按映射重命名字段
+type IndexConfig struct {
+	mapper.TableMapping
+	// IdColumns 组成文档 _id 的列， 默认为主键， 多列以 _ 连接
+	IdColumns []string `json:"idColumns,omitempty"`
+	// TimeColumn 索引名中日期取值的列， 默认为事件时间
+	TimeColumn string `json:"timeColumn,omitempty"`
+	// Partial update 的时候只更新变化的列
+	Partial bool `json:"partial,omitempty"`
+}
+
+// NestedConfig 子表的行作为嵌套文档， 写入父文档的数组字段中
+type NestedConfig struct {
+	mapper.TableMapping
+	// ParentColumn 子表中指向父文档 _id 的列
+	ParentColumn string `json:"parentColumn"`
+	// Field 父文档中的嵌套字段名
+	Field string `json:"field"`
+	// KeyColumn 子文档在数组中的唯一键， 默认为子表第一个主键
+	KeyColumn string `json:"keyColumn,omitempty"`
+}
+
+// buildDoc 行数据转换为文档
+func buildDoc(m *mapper.TableMapping, t *schema.Table, row []interface{}) map[string]interface{} {
+	return format.MappedRowMap(m, t, row)
+}
+
+// changedDoc 只包含变化了的列
+func changedDoc(m *mapper.TableMapping, t *schema.Table, before, after []interface{}) map[string]interface{} {
+	full := buildDoc(m, t, after)
+	old := buildDoc(m, t, before)
+	for k, v := range full {
+		if reflect.DeepEqual(old[k], v) {
+			delete(full, k)
+		}
+	}
+	return full
+}
+
+func columnValue(t *schema.Table, row []interface{}, col string) (interface{}, bool) {
+	idx := t.FindColumn(col)
+	if idx < 0 || idx >= len(row) {
+		return nil, false
+	}
+	return format.Value(row[idx]), true
+}
+
+// docId 文档 _id， 默认为主键的值
+func (c *IndexConfig) docId(t *schema.Table, row []interface{}) string {
+	if len(c.IdColumns) == 0 {
+		return strings.ReplaceAll(format.RowKey(t, row), ",", "_")
+	}
+	values := make([]string, 0, len(c.IdColumns))
+	for _, col := range c.IdColumns {
+		v, _ := columnValue(t, row, col)
+		values = append(values, fmt.Sprint(v))
+	}
+	return strings.Join(values, "_")
+}
+
+func (c *IndexConfig) index(e *canal.RowsEvent, row []interface{}) string {
+	t := format.EventTime(e)
+	if len(c.TimeColumn) > 0 {
+		if v, ok := columnValue(e.Table, row, c.TimeColumn); ok {
+			t = toTime(v, t)
+		}
+	}
+	return renderIndex(c.DstTable, e, t)
+}
+
+func (c *NestedConfig) key(t *schema.Table, row []interface{}) string {
+	if len(c.KeyColumn) > 0 {
+		v, _ := columnValue(t, row, c.KeyColumn)
+		return fmt.Sprint(v)
+	}
+	if len(t.PKColumns) > 0 && t.PKColumns[0] < len(row) {
+		return fmt.Sprint(format.Value(row[t.PKColumns[0]]))
+	}
+	return ""
+}
+
+// keyField 子文档唯一键在嵌套文档中的字段名
+func (c *NestedConfig) keyField(t *schema.Table) string {
+	col := c.KeyColumn
+	if len(col) == 0 && len(t.PKColumns) > 0 {
+		col = t.Columns[t.PKColumns[0]].Name
+	}
+	return c.DstName(col)
+}
+
+func renderIndex(tpl string, e *canal.RowsEvent, t time.Time) string {
+	return strings.ToLower(common.RenderTemplateAt(tpl, map[string]string{
+		"schema": e.Table.Schema,
+		"table":  e.Table.Name,
+	}, t))
+}
+
+// toTime 日期类型的列在 binlog 中是字符串
+func toTime(v interface{}, def time.Time) time.Time {
+	switch val := v.(type) {
+	case time.Time:
+		return val
+	case string:
+		for _, layout := range []string{"2006-01-02 15:04:05", "2006-01-02 15:04:05.999999", "2006-01-02"} {
+			if t, err := time.ParseInLocation(layout, val, time.Local); err == nil {
+				return t
+			}
+		}
+	case int64:
+		return time.Unix(val, 0)
+	}
+	return def
+}
@@ -0,0 +1,318 @@
+package es
+
+// 行变更转换为 _bulk 的 index/update/delete 操作， 缓冲到一定数量， 或者保存位点之前批量写入
+// index/delete 使用 external_gte 版本， 版本号取自binlog位点， 重放旧数据的时候不会覆盖新数据
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-mysql-org/go-mysql/canal"
+	"github.com/go-mysql-org/go-mysql/mysql"
+	"github.com/gridsx/datagos/canal/mysql/filter"
+	"github.com/gridsx/datagos/common"
+	"github.com/gridsx/datagos/sinker/format"
+	"github.com/siddontang/go-log/log"
+)
+
+const (
+	defaultBulkActions = 500
+	defaultTimeoutMs   = 10000
+	defaultMaxRetries  = 3
+
+	ConflictSkip  = "skip"
+	ConflictError = "error"
+)
+
+// EsSinkerConfig 对应 task_dests 的 config 字段， 同时支持 Elasticsearch 和 OpenSearch
+type EsSinkerConfig struct {
+	Addresses []string `json:"addresses"`
+	Username  string   `json:"username,omitempty"`
+	Password  string   `json:"password,omitempty"`
+	TimeoutMs int      `json:"timeoutMs,omitempty"`
+	// BulkActions 缓冲多少个操作发送一次 bulk 请求
+	BulkActions int `json:"bulkActions,omitempty"`
+	MaxRetries  int `json:"maxRetries,omitempty"`
+	// VersionConflict 版本冲突的处理方式： skip 忽略（默认）， error 报错
+	VersionConflict string `json:"versionConflict,omitempty"`
+
+	Indices []IndexConfig  `json:"indices"`
+	Nested  []NestedConfig `json:"nested,omitempty"`
+
+	Filter        *filter.TableFilter `json:"filter,omitempty"`
+	ErrorContinue bool                `json:"errorContinue"`
+}
+
+type EsSinker struct {
+	disabled      bool
+	ErrorContinue bool
+	Filter        *filter.TableFilter
+	Indices       []IndexConfig
+	Nested        []NestedConfig
+
+	client          *bulkClient
+	bulkActions     int
+	maxRetries      int
+	versionConflict string
+
+	lock    sync.Mutex
+	actions []*bulkAction
+	// pos 当前事件的位置， 用于生成版本号
+	pos mysql.Position
+}
+
+func (s *EsSinker) Enable() bool {
+	return !s.disabled
+}
+
+func (s *EsSinker) Disable() {
+	s.disabled = true
+}
+
+func (s *EsSinker) ContinueOnError() bool {
+	return s.ErrorContinue
+}
+
+// SetPosition 与 OnEvent 在同一个协程中调用
+func (s *EsSinker) SetPosition(pos mysql.Position, gtid string) {
+	s.pos = pos
+}
+
+func (s *EsSinker) OnEvent(e *canal.RowsEvent) error {
+	if e == nil || e.Table == nil {
+		return nil
+	}
+	if s.Filter != nil && s.Filter.Match(e) {
+		return nil
+	}
+	actions := make([]*bulkAction, 0, len(e.Rows))
+	for i := range s.Indices {
+		if s.Indices[i].Match(e.Table.Schema, e.Table.Name) {
+			actions = append(actions, s.indexActions(&s.Indices[i], e)...)
+		}
+	}
+	for i := range s.Nested {
+		if s.Nested[i].Match(e.Table.Schema, e.Table.Name) {
+			actions = append(actions, s.nestedActions(&s.Nested[i], e)...)
+		}
+	}
+	if len(actions) == 0 {
+		return nil
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.actions = append(s.actions, actions...)
+	if len(s.actions) >= s.bulkActions {
+		// 当前事件的操作已经缓冲， 写入失败的操作保留到下次， 不能让 pipeline 重复处理或者跳过当前事件
+		if err := s.flush(); err != nil {
+			return &common.BufferedError{Err: err}
+		}
+	}
+	return nil
+}
+
+// Flush 保存位点之前把缓冲的操作全部写入
+func (s *EsSinker) Flush() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.flush()
+}
+
+func (s *EsSinker) flush() error {
+	if len(s.actions) == 0 {
+		return nil
+	}
+	pending := s.actions
+	for i := 0; ; i++ {
+		items, err := s.client.do(pending)
+		if err == nil {
+			pending, err = s.checkItems(pending, items)
+		}
+		if err != nil {
+			// 请求整体失败或者有不可忽略的错误， 保留没有成功的操作， 下次继续
+			s.actions = pending
+			return err
+		}
+		if len(pending) == 0 {
+			s.actions = s.actions[:0]
+			return nil
+		}
+		if i >= s.maxRetries {
+			s.actions = pending
+			return fmt.Errorf("es sinker: %d bulk actions rejected after %d retries", len(pending), s.maxRetries)
+		}
+		time.Sleep(time.Duration(1<<i) * 100 * time.Millisecond)
+	}
+}
+
+// checkItems 检查每个操作的结果， 返回没有成功的操作， 429 之外不可忽略的错误返回第一个
+func (s *EsSinker) checkItems(actions []*bulkAction, items []bulkItem) ([]*bulkAction, error) {
+	retry := make([]*bulkAction, 0)
+	var firstErr error
+	for i, item := range items {
+		switch {
+		case item.Status >= 200 && item.Status < 300:
+		case item.Status == http.StatusConflict:
+			if s.versionConflict == ConflictError {
+				retry = append(retry, actions[i])
+				if firstErr == nil {
+					firstErr = fmt.Errorf("es version conflict, index: %s, id: %s", item.Index, item.Id)
+				}
+				continue
+			}
+			log.Debugf("es version conflict skipped, index: %s, id: %s\n", item.Index, item.Id)
+		case item.Status == http.StatusNotFound && actions[i].op == "delete":
+			// 删除不存在的文档， 忽略
+		case item.Status == http.StatusTooManyRequests:
+			retry = append(retry, actions[i])
+		default:
+			retry = append(retry, actions[i])
+			if firstErr == nil {
+				reason := ""
+				if item.Error != nil {
+					reason = item.Error.Type + ": " + item.Error.Reason
+				}
+				firstErr = fmt.Errorf("es bulk %s error, index: %s, id: %s, status: %d, %s",
+					actions[i].op, item.Index, item.Id, item.Status, reason)
+			}
+		}
+	}
+	return retry, firstErr
+}
+
+func (s *EsSinker) indexActions(c *IndexConfig, e *canal.RowsEvent) []*bulkAction {
+	version := format.EventVersion(e, s.pos)
+	actions := make([]*bulkAction, 0, len(e.Rows))
+	for _, change := range format.Changes(e) {
+		row := change.Row()
+		index, id := c.index(e, row), c.docId(e.Table, row)
+		switch e.Action {
+		case canal.DeleteAction:
+			actions = append(actions, deleteAction(index, id, version))
+		case canal.UpdateAction:
+			oldIndex, oldId := c.index(e, change.Before), c.docId(e.Table, change.Before)
+			moved := oldIndex != index || oldId != id
+			if moved {
+				actions = append(actions, deleteAction(oldIndex, oldId, version))
+			}
+			if c.Partial && !moved {
+				doc := changedDoc(&c.TableMapping, e.Table, change.Before, change.After)
+				if len(doc) == 0 {
+					continue
+				}
+				actions = append(actions, &bulkAction{
+					op:   "update",
+					meta: map[string]interface{}{"_index": index, "_id": id, "retry_on_conflict": 3},
+					body: map[string]interface{}{"doc": doc, "upsert": buildDoc(&c.TableMapping, e.Table, row)},
+				})
+				continue
+			}
+			actions = append(actions, indexAction(index, id, version, buildDoc(&c.TableMapping, e.Table, row)))
+		default:
+			actions = append(actions, indexAction(index, id, version, buildDoc(&c.TableMapping, e.Table, row)))
+		}
+	}
+	return actions
+}
+
+// nestedActions 子表的变更转换为父文档上的脚本更新
+func (s *EsSinker) nestedActions(c *NestedConfig, e *canal.RowsEvent) []*bulkAction {
+	index := renderIndex(c.DstTable, e, format.EventTime(e))
+	keyField := c.keyField(e.Table)
+	actions := make([]*bulkAction, 0, len(e.Rows))
+	for _, change := range format.Changes(e) {
+		if change.Before != nil {
+			parent, ok := columnValue(e.Table, change.Before, c.ParentColumn)
+			if ok && parent != nil {
+				// update 的时候如果父文档没变， 只需要一次替换
+				sameParent := false
+				if change.After != nil {
+					newParent, _ := columnValue(e.Table, change.After, c.ParentColumn)
+					sameParent = fmt.Sprint(newParent) == fmt.Sprint(parent)
+				}
+				if !sameParent {
+					actions = append(actions, nestedAction(index, fmt.Sprint(parent), c.Field, keyField,
+						c.key(e.Table, change.Before), nil))
+				}
+			}
+		}
+		if change.After != nil {
+			parent, ok := columnValue(e.Table, change.After, c.ParentColumn)
+			if !ok || parent == nil {
+				continue
+			}
+			actions = append(actions, nestedAction(index, fmt.Sprint(parent), c.Field, keyField,
+				c.key(e.Table, change.After), buildDoc(&c.TableMapping, e.Table, change.After)))
+		}
+	}
+	return actions
+}
+
+func indexAction(index, id string, version int64, doc map[string]interface{}) *bulkAction {
+	return &bulkAction{
+		op:   "index",
+		meta: map[string]interface{}{"_index": index, "_id": id, "version": version, "version_type": "external_gte"},
+		body: doc,
+	}
+}
+
+func deleteAction(index, id string, version int64) *bulkAction {
+	return &bulkAction{
+		op:   "delete",
+		meta: map[string]interface{}{"_index": index, "_id": id, "version": version, "version_type": "external_gte"},
+	}
+}
+
+func nestedAction(index, parentId, field, keyField, key string, doc map[string]interface{}) *bulkAction {
+	return &bulkAction{
+		op:   "update",
+		meta: map[string]interface{}{"_index": index, "_id": parentId, "retry_on_conflict": 3},
+		body: map[string]interface{}{
+			"scripted_upsert": true,
+			"upsert":          map[string]interface{}{},
+			"script": map[string]interface{}{
+				"lang":   "painless",
+				"source": nestedScript,
+				"params": map[string]interface{}{"field": field, "key": keyField, "id": key, "doc": doc},
+			},
+		},
+	}
+}
+
+func Build(c string) (*EsSinker, error) {
+	cfg := new(EsSinkerConfig)
+	if err := json.Unmarshal([]byte(c), cfg); err != nil {
+		return nil, err
+	}
+	if len(cfg.Addresses) == 0 {
+		return nil, errors.New("es sinker: addresses not configured")
+	}
+	timeout := cfg.TimeoutMs
+	if timeout <= 0 {
+		timeout = defaultTimeoutMs
+	}
+	s := &EsSinker{
+		ErrorContinue:   cfg.ErrorContinue,
+		Filter:          cfg.Filter,
+		Indices:         cfg.Indices,
+		Nested:          cfg.Nested,
+		client:          newBulkClient(cfg.Addresses, cfg.Username, cfg.Password, time.Duration(timeout)*time.Millisecond),
+		bulkActions:     cfg.BulkActions,
+		maxRetries:      cfg.MaxRetries,
+		versionConflict: cfg.VersionConflict,
+	}
+	if s.bulkActions <= 0 {
+		s.bulkActions = defaultBulkActions
+	}
+	if s.maxRetries <= 0 {
+		s.maxRetries = defaultMaxRetries
+	}
+	if len(s.versionConflict) == 0 {
+		s.versionConflict = ConflictSkip
+	}
+	return s, nil
+}
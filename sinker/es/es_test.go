@@ -0,0 +1,229 @@
+package es
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/go-mysql-org/go-mysql/canal"
+	"github.com/go-mysql-org/go-mysql/mysql"
+	"github.com/go-mysql-org/go-mysql/replication"
+	"github.com/go-mysql-org/go-mysql/schema"
+	"github.com/gridsx/datagos/canal/mysql/mapper"
+	"github.com/gridsx/datagos/common"
+)
+
+// bulkStandIn 本地的 _bulk 接口， status 决定每个操作的结果， 默认成功
+type bulkStandIn struct {
+	*httptest.Server
+	lock   sync.Mutex
+	status func(op, id string) int
+	// received 每次请求中的操作， 如 index:1
+	received [][]string
+	versions map[string]float64
+}
+
+func newBulkStandIn(t *testing.T) *bulkStandIn {
+	b := &bulkStandIn{versions: map[string]float64{}}
+	b.Server = httptest.NewServer(http.HandlerFunc(b.handle))
+	t.Cleanup(b.Close)
+	return b
+}
+
+func (b *bulkStandIn) handle(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/_bulk" {
+		http.NotFound(w, r)
+		return
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	var ops []string
+	var items []map[string]bulkItem
+	scanner := bufio.NewScanner(r.Body)
+	for scanner.Scan() {
+		line := map[string]map[string]interface{}{}
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			continue
+		}
+		for op, meta := range line {
+			id, ok := meta["_id"].(string)
+			if !ok {
+				// 文档行
+				continue
+			}
+			if v, ok := meta["version"].(float64); ok {
+				b.versions[id] = v
+			}
+			status := http.StatusOK
+			if b.status != nil {
+				status = b.status(op, id)
+			}
+			item := bulkItem{Index: fmt.Sprint(meta["_index"]), Id: id, Status: status}
+			if status >= 300 {
+				item.Error = &struct {
+					Type   string `json:"type"`
+					Reason string `json:"reason"`
+				}{Type: "test_exception", Reason: "rejected"}
+			}
+			ops = append(ops, op+":"+id)
+			items = append(items, map[string]bulkItem{op: item})
+		}
+	}
+	b.received = append(b.received, ops)
+	_ = json.NewEncoder(w).Encode(&bulkResponse{Errors: true, Items: items})
+}
+
+func (b *bulkStandIn) requests() [][]string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return append([][]string(nil), b.received...)
+}
+
+func newTestSinker(t *testing.T, b *bulkStandIn, bulkActions int, conflict string) *EsSinker {
+	cfg, _ := json.Marshal(&EsSinkerConfig{
+		Addresses:       []string{b.URL},
+		BulkActions:     bulkActions,
+		MaxRetries:      1,
+		VersionConflict: conflict,
+		Indices:         []IndexConfig{{TableMapping: mapper.TableMapping{SrcTable: "users", DstTable: "users"}}},
+	})
+	s, err := Build(string(cfg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func testEvent(ids ...int64) *canal.RowsEvent {
+	table := &schema.Table{Schema: "db", Name: "users", PKColumns: []int{0}}
+	table.AddColumn("id", "bigint", "", "")
+	table.AddColumn("name", "varchar(32)", "", "")
+	rows := make([][]interface{}, 0, len(ids))
+	for _, id := range ids {
+		rows = append(rows, []interface{}{id, "n"})
+	}
+	return &canal.RowsEvent{Table: table, Action: canal.InsertAction, Rows: rows,
+		Header: &replication.EventHeader{Timestamp: 1}}
+}
+
+// 部分操作失败时只保留失败的操作， 下次 flush 只重新发送这些
+func TestPartialBulkFailure(t *testing.T) {
+	b := newBulkStandIn(t)
+	b.status = func(op, id string) int {
+		if id == "2" {
+			return http.StatusBadRequest
+		}
+		return http.StatusOK
+	}
+	s := newTestSinker(t, b, 100, "")
+	if err := s.OnEvent(testEvent(1, 2, 3)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Flush(); err == nil || !strings.Contains(err.Error(), "id: 2") {
+		t.Fatalf("flush: %v", err)
+	}
+	b.status = nil
+	if err := s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	reqs := b.requests()
+	if len(reqs) != 2 || len(reqs[0]) != 3 || strings.Join(reqs[1], ",") != "index:2" {
+		t.Fatalf("requests: %v", reqs)
+	}
+}
+
+// 429 的操作在同一次 flush 中退避重试
+func TestTooManyRequestsRetried(t *testing.T) {
+	b := newBulkStandIn(t)
+	calls := 0
+	b.status = func(op, id string) int {
+		calls++
+		if calls == 1 {
+			return http.StatusTooManyRequests
+		}
+		return http.StatusOK
+	}
+	s := newTestSinker(t, b, 100, "")
+	if err := s.OnEvent(testEvent(1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if reqs := b.requests(); len(reqs) != 2 {
+		t.Fatalf("requests: %v", reqs)
+	}
+}
+
+// 版本冲突默认忽略， 配置为 error 时保留并报错
+func TestVersionConflict(t *testing.T) {
+	b := newBulkStandIn(t)
+	b.status = func(op, id string) int { return http.StatusConflict }
+	s := newTestSinker(t, b, 100, "")
+	if err := s.OnEvent(testEvent(1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Flush(); err != nil {
+		t.Fatalf("skip conflict: %v", err)
+	}
+	if len(s.actions) != 0 {
+		t.Fatalf("conflicting action kept: %d", len(s.actions))
+	}
+
+	s = newTestSinker(t, b, 100, ConflictError)
+	if err := s.OnEvent(testEvent(1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Flush(); err == nil || !strings.Contains(err.Error(), "version conflict") {
+		t.Fatalf("error on conflict: %v", err)
+	}
+	if len(s.actions) != 1 {
+		t.Fatalf("conflicting action not kept: %d", len(s.actions))
+	}
+}
+
+// 版本号取自 binlog 文件序号和位置
+func TestVersionFromPosition(t *testing.T) {
+	b := newBulkStandIn(t)
+	s := newTestSinker(t, b, 100, "")
+	s.SetPosition(mysql.Position{Name: "mysql-bin.000003", Pos: 120}, "")
+	if err := s.OnEvent(testEvent(1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if v := b.versions["1"]; v != float64(3<<32|120) {
+		t.Fatalf("version: %v", v)
+	}
+}
+
+// 缓冲满时写入失败， 当前事件已经缓冲， 返回 BufferedError
+func TestFullBufferFailureKeepsEvent(t *testing.T) {
+	b := newBulkStandIn(t)
+	b.status = func(op, id string) int { return http.StatusInternalServerError }
+	s := newTestSinker(t, b, 2, "")
+	if err := s.OnEvent(testEvent(1)); err != nil {
+		t.Fatal(err)
+	}
+	var buffered *common.BufferedError
+	if err := s.OnEvent(testEvent(2)); !errors.As(err, &buffered) {
+		t.Fatalf("full buffer: %v", err)
+	}
+	if len(s.actions) != 2 {
+		t.Fatalf("buffered actions: %d", len(s.actions))
+	}
+	b.status = nil
+	if err := s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if reqs := b.requests(); strings.Join(reqs[len(reqs)-1], ",") != "index:1,index:2" {
+		t.Fatalf("requests: %v", reqs)
+	}
+}
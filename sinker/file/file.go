@@ -0,0 +1,406 @@
+package file
+
+// 变更事件按表写入本地文件， 支持 jsonl、csv、parquet， 用于审计或者数据湖导入
+// 目录由模板生成， 如 /data/${schema}/${table}/dt=${date}/， 文件按大小、时间滚动， 目录变化或者表结构变化的时候也会滚动
+// 每个文件对应一个 <文件名>.manifest.json， 记录行数以及binlog位点范围， 方便重放或者导入其他系统
+// 保存位点之前会刷盘并更新 manifest， manifest 中的行数即为已经确认的行数， parquet 缓存的行写成一个 row group；
+// parquet 写完文件尾才能读取， 异常退出时没有 closed 的文件可以按 manifest 中的位点范围重放
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/go-mysql-org/go-mysql/canal"
+	"github.com/go-mysql-org/go-mysql/mysql"
+	"github.com/go-mysql-org/go-mysql/schema"
+	"github.com/gridsx/datagos/canal/mysql/filter"
+	"github.com/gridsx/datagos/common"
+	"github.com/gridsx/datagos/sinker/format"
+	"github.com/siddontang/go-log/log"
+)
+
+const (
+	FormatJSONL   = "jsonl"
+	FormatCSV     = "csv"
+	FormatParquet = "parquet"
+
+	defaultMaxBytes  = 128 * 1024 * 1024
+	defaultMaxAgeSec = 3600
+
+	manifestSuffix = ".manifest.json"
+)
+
+// FileSinkerConfig 对应 task_dests 的 config 字段
+type FileSinkerConfig struct {
+	// Path 目录模板， 变量为 schema、table、date(yyyy-MM-dd)、hour， 也支持 ${yyyyMMdd} 形式的日期， 时间取自事件时间
+	Path   string `json:"path"`
+	Format string `json:"format,omitempty"`
+	// Message jsonl 每一行的消息格式， 默认为 json
+	Message *format.Config `json:"message,omitempty"`
+	// MaxBytes 单个文件的最大字节数， MaxAgeSec 单个文件最长写入时间
+	MaxBytes  int64 `json:"maxBytes,omitempty"`
+	MaxAgeSec int   `json:"maxAgeSec,omitempty"`
+
+	Filter        *filter.TableFilter `json:"filter,omitempty"`
+	ErrorContinue bool                `json:"errorContinue"`
+}
+
+// Manifest 文件的描述信息， Closed 为空说明文件还在写入， 或者任务异常退出，
+// 这时文件中 Rows 之后的行没有经过确认， 重放的时候需要忽略
+type Manifest struct {
+	File          string          `json:"file"`
+	Format        string          `json:"format"`
+	Schema        string          `json:"schema"`
+	Table         string          `json:"table"`
+	Columns       []string        `json:"columns"`
+	Rows          int64           `json:"rows"`
+	SnapshotRows  int64           `json:"snapshotRows,omitempty"`
+	Bytes         int64           `json:"bytes"`
+	StartPosition *mysql.Position `json:"startPosition,omitempty"`
+	EndPosition   *mysql.Position `json:"endPosition,omitempty"`
+	StartTs       int64           `json:"startTs,omitempty"`
+	EndTs         int64           `json:"endTs,omitempty"`
+	Created       time.Time       `json:"created"`
+	Closed        *time.Time      `json:"closed,omitempty"`
+}
+
+type FileSinker struct {
+	disabled      bool
+	ErrorContinue bool
+	Filter        *filter.TableFilter
+
+	path     string
+	format   string
+	encoder  format.Encoder
+	maxBytes int64
+	maxAge   time.Duration
+
+	lock  sync.Mutex
+	pos   mysql.Position
+	gtid  string
+	files map[string]*tableFile
+	seq   int
+}
+
+// tableFile 一张表当前正在写入的文件
+type tableFile struct {
+	dir      string
+	path     string
+	table    *schema.Table
+	file     *os.File
+	w        rowWriter
+	manifest *Manifest
+}
+
+func (s *FileSinker) Enable() bool {
+	return !s.disabled
+}
+
+func (s *FileSinker) Disable() {
+	s.disabled = true
+}
+
+func (s *FileSinker) ContinueOnError() bool {
+	return s.ErrorContinue
+}
+
+func (s *FileSinker) SetPosition(pos mysql.Position, gtid string) {
+	s.lock.Lock()
+	s.pos, s.gtid = pos, gtid
+	s.lock.Unlock()
+}
+
+func (s *FileSinker) OnEvent(e *canal.RowsEvent) error {
+	if e == nil || e.Table == nil {
+		return nil
+	}
+	if s.Filter != nil && s.Filter.Match(e) {
+		return nil
+	}
+	eventTime := format.EventTime(e)
+	dir := s.dir(e.Table, eventTime)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var messages []*format.Message
+	if s.format == FormatJSONL {
+		var err error
+		if messages, err = s.encoder.Encode(e, &format.Source{Position: s.pos, GTID: s.gtid}); err != nil {
+			return err
+		}
+	}
+	f, err := s.current(e.Table, dir)
+	if err != nil {
+		return err
+	}
+	snapshot := format.IsSnapshot(e)
+	for i, change := range format.Changes(e) {
+		r := &record{action: e.Action, ts: eventTime.UnixMilli(), pos: s.pos, row: change.Row()}
+		if i < len(messages) {
+			r.value = messages[i].Value
+		}
+		if err := f.write(r, snapshot); err != nil {
+			return fmt.Errorf("file sinker write %s error: %w", f.path, err)
+		}
+	}
+	if f.w.size() >= s.maxBytes {
+		return s.rotate(e.Table.String())
+	}
+	return nil
+}
+
+// Flush 保存位点之前刷盘， 到期的文件滚动
+func (s *FileSinker) Flush() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for key, f := range s.files {
+		if time.Since(f.manifest.Created) >= s.maxAge {
+			if err := s.rotate(key); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := f.sync(); err != nil {
+			return fmt.Errorf("file sinker flush %s error: %w", f.path, err)
+		}
+	}
+	return nil
+}
+
+func (s *FileSinker) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var lastErr error
+	for key := range s.files {
+		if err := s.rotate(key); err != nil {
+			log.Errorf("error closing file: %v\n", err)
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+// current 返回表当前写入的文件， 目录、表结构变化或者文件到期的时候滚动到新文件
+func (s *FileSinker) current(t *schema.Table, dir string) (*tableFile, error) {
+	key := t.String()
+	if f, ok := s.files[key]; ok {
+		if f.dir == dir && sameColumns(f.table, t) && time.Since(f.manifest.Created) < s.maxAge {
+			return f, nil
+		}
+		if err := s.rotate(key); err != nil {
+			return nil, err
+		}
+	}
+	f, err := s.create(t, dir)
+	if err != nil {
+		return nil, err
+	}
+	s.files[key] = f
+	return f, nil
+}
+
+// rotate 关闭文件， 写入最终的 manifest
+func (s *FileSinker) rotate(key string) error {
+	f, ok := s.files[key]
+	if !ok {
+		return nil
+	}
+	delete(s.files, key)
+	if err := f.close(); err != nil {
+		return fmt.Errorf("file sinker close %s error: %w", f.path, err)
+	}
+	log.Infof("file sinker closed file: %s, rows: %d\n", f.path, f.manifest.Rows)
+	return nil
+}
+
+func (s *FileSinker) create(t *schema.Table, dir string) (*tableFile, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	var file *os.File
+	var path string
+	// 同一秒内重启或者滚动的时候文件名可能重复， 不覆盖已有的文件
+	for {
+		s.seq++
+		path = filepath.Join(dir, fmt.Sprintf("%s-%s-%d.%s", t.Name, now.Format("20060102150405"), s.seq, s.format))
+		var err error
+		file, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			break
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+	}
+	var w rowWriter
+	switch s.format {
+	case FormatCSV:
+		w = newCSVWriter(file, t)
+	case FormatParquet:
+		pw, err := newParquetWriter(file, t)
+		if err != nil {
+			_ = file.Close()
+			_ = os.Remove(path)
+			return nil, err
+		}
+		w = pw
+	default:
+		w = newJSONLWriter(file)
+	}
+	columns := make([]string, 0, len(t.Columns))
+	for _, col := range t.Columns {
+		columns = append(columns, col.Name)
+	}
+	return &tableFile{
+		dir:   dir,
+		path:  path,
+		table: t,
+		file:  file,
+		w:     w,
+		manifest: &Manifest{
+			File:    filepath.Base(path),
+			Format:  s.format,
+			Schema:  t.Schema,
+			Table:   t.Name,
+			Columns: columns,
+			Created: now,
+		},
+	}, nil
+}
+
+func (s *FileSinker) dir(t *schema.Table, eventTime time.Time) string {
+	return common.RenderTemplateAt(s.path, map[string]string{
+		"schema": t.Schema,
+		"table":  t.Name,
+		"date":   eventTime.Format("2006-01-02"),
+		"hour":   eventTime.Format("15"),
+	}, eventTime)
+}
+
+func (f *tableFile) write(r *record, snapshot bool) error {
+	if err := f.w.write(r); err != nil {
+		return err
+	}
+	m := f.manifest
+	m.Rows++
+	if snapshot {
+		m.SnapshotRows++
+	} else if len(r.pos.Name) > 0 {
+		pos := r.pos
+		if m.StartPosition == nil {
+			m.StartPosition = &pos
+		}
+		m.EndPosition = &pos
+	}
+	if m.StartTs == 0 {
+		m.StartTs = r.ts
+	}
+	m.EndTs = r.ts
+	return nil
+}
+
+// sync 数据刷盘之后再更新 manifest， manifest 中的行数一定已经落盘
+func (f *tableFile) sync() error {
+	if err := f.w.flush(); err != nil {
+		return err
+	}
+	if err := f.file.Sync(); err != nil {
+		return err
+	}
+	f.manifest.Bytes = f.w.size()
+	return f.writeManifest()
+}
+
+func (f *tableFile) close() error {
+	if err := f.w.close(); err != nil {
+		_ = f.file.Close()
+		return err
+	}
+	if err := f.file.Sync(); err != nil {
+		_ = f.file.Close()
+		return err
+	}
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	if info, err := os.Stat(f.path); err == nil {
+		f.manifest.Bytes = info.Size()
+	}
+	now := time.Now()
+	f.manifest.Closed = &now
+	return f.writeManifest()
+}
+
+// writeManifest 先写临时文件再重命名， 避免读到写了一半的 manifest
+func (f *tableFile) writeManifest() error {
+	d, err := json.MarshalIndent(f.manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := f.path + manifestSuffix + ".tmp"
+	if err := os.WriteFile(tmp, d, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, f.path+manifestSuffix)
+}
+
+func sameColumns(a, b *schema.Table) bool {
+	if a == b {
+		return true
+	}
+	if len(a.Columns) != len(b.Columns) {
+		return false
+	}
+	for i := range a.Columns {
+		if a.Columns[i].Name != b.Columns[i].Name || a.Columns[i].RawType != b.Columns[i].RawType {
+			return false
+		}
+	}
+	return true
+}
+
+func Build(c string) (*FileSinker, error) {
+	cfg := new(FileSinkerConfig)
+	if err := json.Unmarshal([]byte(c), cfg); err != nil {
+		return nil, err
+	}
+	if len(cfg.Path) == 0 {
+		return nil, errors.New("file sinker: path not configured")
+	}
+	if len(cfg.Format) == 0 {
+		cfg.Format = FormatJSONL
+	}
+	if cfg.Format != FormatJSONL && cfg.Format != FormatCSV && cfg.Format != FormatParquet {
+		return nil, fmt.Errorf("file sinker: unknown format %s", cfg.Format)
+	}
+	encoder, err := format.NewEncoder(cfg.Message)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Message.IsBinary() {
+		return nil, errors.New("file sinker: binary message format not supported by jsonl")
+	}
+	s := &FileSinker{
+		ErrorContinue: cfg.ErrorContinue,
+		Filter:        cfg.Filter,
+		path:          cfg.Path,
+		format:        cfg.Format,
+		encoder:       encoder,
+		maxBytes:      cfg.MaxBytes,
+		maxAge:        time.Duration(cfg.MaxAgeSec) * time.Second,
+		files:         make(map[string]*tableFile, 8),
+	}
+	if s.maxBytes <= 0 {
+		s.maxBytes = defaultMaxBytes
+	}
+	if s.maxAge <= 0 {
+		s.maxAge = defaultMaxAgeSec * time.Second
+	}
+	return s, nil
+}
@@ -0,0 +1,282 @@
+package file
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/go-mysql-org/go-mysql/mysql"
+	"github.com/go-mysql-org/go-mysql/schema"
+	"github.com/gridsx/datagos/sinker/format"
+	"github.com/xitongsys/parquet-go/writer"
+)
+
+// 每一行都带上的元数据列
+const (
+	colAction = "_action"
+	colTs     = "_ts"
+	colFile   = "_binlog_file"
+	colPos    = "_binlog_pos"
+)
+
+// record 写入文件的一行， update 写变更后的行， delete 写变更前的行
+type record struct {
+	action string
+	ts     int64
+	pos    mysql.Position
+	row    []interface{}
+	// value jsonl 格式下已经序列化好的消息
+	value []byte
+}
+
+// rowWriter 不同文件格式的写入实现
+type rowWriter interface {
+	write(r *record) error
+	// flush 把缓冲写入文件
+	flush() error
+	// close 写入文件尾， 不关闭底层文件
+	close() error
+	// size 已写入的字节数， parquet 为未压缩数据的估算值
+	size() int64
+}
+
+// countingWriter 记录写入底层文件的字节数
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+type jsonlWriter struct {
+	counter *countingWriter
+	buf     *bufio.Writer
+}
+
+func newJSONLWriter(w io.Writer) *jsonlWriter {
+	counter := &countingWriter{w: w}
+	return &jsonlWriter{counter: counter, buf: bufio.NewWriterSize(counter, 64*1024)}
+}
+
+func (j *jsonlWriter) write(r *record) error {
+	if _, err := j.buf.Write(r.value); err != nil {
+		return err
+	}
+	return j.buf.WriteByte('\n')
+}
+
+func (j *jsonlWriter) flush() error {
+	return j.buf.Flush()
+}
+
+func (j *jsonlWriter) close() error {
+	return j.buf.Flush()
+}
+
+func (j *jsonlWriter) size() int64 {
+	return j.counter.n + int64(j.buf.Buffered())
+}
+
+// csvWriter 第一行为表头， 元数据列在前， 之后是表的所有列
+type csvWriter struct {
+	counter *countingWriter
+	w       *csv.Writer
+	table   *schema.Table
+	header  bool
+}
+
+func newCSVWriter(w io.Writer, t *schema.Table) *csvWriter {
+	counter := &countingWriter{w: w}
+	return &csvWriter{counter: counter, w: csv.NewWriter(counter), table: t}
+}
+
+func (c *csvWriter) write(r *record) error {
+	if !c.header {
+		header := []string{colAction, colTs, colFile, colPos}
+		for _, col := range c.table.Columns {
+			header = append(header, col.Name)
+		}
+		if err := c.w.Write(header); err != nil {
+			return err
+		}
+		c.header = true
+	}
+	line := make([]string, 0, len(c.table.Columns)+4)
+	line = append(line, r.action, strconv.FormatInt(r.ts, 10), r.pos.Name, "")
+	if r.pos.Pos > 0 {
+		line[3] = strconv.FormatUint(uint64(r.pos.Pos), 10)
+	}
+	for i := range c.table.Columns {
+		var v interface{}
+		if i < len(r.row) {
+			v = cellValue(&c.table.Columns[i], r.row[i])
+		}
+		if v == nil {
+			line = append(line, "")
+		} else {
+			line = append(line, fmt.Sprint(v))
+		}
+	}
+	return c.w.Write(line)
+}
+
+func (c *csvWriter) flush() error {
+	c.w.Flush()
+	return c.w.Error()
+}
+
+func (c *csvWriter) close() error {
+	return c.flush()
+}
+
+func (c *csvWriter) size() int64 {
+	return c.counter.n
+}
+
+// parquetWriter 表结构根据表的列生成， 所有列都是 OPTIONAL
+type parquetWriter struct {
+	pw    *writer.JSONWriter
+	table *schema.Table
+	types []string
+	bytes int64
+}
+
+const (
+	parquetInt64  = "INT64"
+	parquetDouble = "DOUBLE"
+	parquetString = "UTF8"
+
+	parquetRowGroupSize = 64 * 1024 * 1024
+)
+
+func newParquetWriter(w io.Writer, t *schema.Table) (*parquetWriter, error) {
+	p := &parquetWriter{table: t, types: make([]string, len(t.Columns))}
+	fields := []string{
+		fmt.Sprintf(`{"Tag":"name=%s, type=BYTE_ARRAY, convertedtype=UTF8, repetitiontype=REQUIRED"}`, colAction),
+		fmt.Sprintf(`{"Tag":"name=%s, type=INT64, convertedtype=TIMESTAMP_MILLIS, repetitiontype=REQUIRED"}`, colTs),
+		fmt.Sprintf(`{"Tag":"name=%s, type=BYTE_ARRAY, convertedtype=UTF8, repetitiontype=OPTIONAL"}`, colFile),
+		fmt.Sprintf(`{"Tag":"name=%s, type=INT64, repetitiontype=OPTIONAL"}`, colPos),
+	}
+	for i := range t.Columns {
+		col := &t.Columns[i]
+		if strings.ContainsAny(col.Name, ",=") {
+			return nil, fmt.Errorf("column name %s not supported by parquet", col.Name)
+		}
+		p.types[i] = parquetType(col)
+		switch p.types[i] {
+		case parquetInt64, parquetDouble:
+			fields = append(fields, fmt.Sprintf(`{"Tag":"name=%s, type=%s, repetitiontype=OPTIONAL"}`, col.Name, p.types[i]))
+		default:
+			fields = append(fields, fmt.Sprintf(`{"Tag":"name=%s, type=BYTE_ARRAY, convertedtype=UTF8, repetitiontype=OPTIONAL"}`, col.Name))
+		}
+	}
+	jsonSchema := `{"Tag":"name=datagos_root, repetitiontype=REQUIRED","Fields":[` + strings.Join(fields, ",") + `]}`
+	pw, err := writer.NewJSONWriterFromWriter(jsonSchema, w, 1)
+	if err != nil {
+		return nil, err
+	}
+	pw.RowGroupSize = parquetRowGroupSize
+	p.pw = pw
+	return p, nil
+}
+
+// parquetType 整数、浮点数保留数值类型， 其他的（包括 decimal、时间）都以字符串保存， 不丢失精度
+func parquetType(col *schema.TableColumn) string {
+	switch col.Type {
+	case schema.TYPE_NUMBER, schema.TYPE_MEDIUM_INT:
+		// unsigned bigint 超出了 INT64 的范围
+		if col.IsUnsigned && strings.HasPrefix(col.RawType, "bigint") {
+			return parquetString
+		}
+		return parquetInt64
+	case schema.TYPE_BIT:
+		return parquetInt64
+	case schema.TYPE_FLOAT:
+		return parquetDouble
+	default:
+		return parquetString
+	}
+}
+
+func (p *parquetWriter) write(r *record) error {
+	m := make(map[string]interface{}, len(p.table.Columns)+4)
+	m[colAction] = r.action
+	m[colTs] = r.ts
+	if len(r.pos.Name) > 0 {
+		m[colFile] = r.pos.Name
+		m[colPos] = r.pos.Pos
+	}
+	for i := range p.table.Columns {
+		if i >= len(r.row) || r.row[i] == nil {
+			continue
+		}
+		v, err := parquetValue(p.types[i], cellValue(&p.table.Columns[i], r.row[i]))
+		if err != nil {
+			return fmt.Errorf("column %s: %w", p.table.Columns[i].Name, err)
+		}
+		m[p.table.Columns[i].Name] = v
+	}
+	d, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	p.bytes += int64(len(d))
+	return p.pw.Write(string(d))
+}
+
+// flush 把缓存的行写成一个 row group， 不关闭文件
+func (p *parquetWriter) flush() error {
+	return p.pw.Flush(true)
+}
+
+func (p *parquetWriter) close() error {
+	return p.pw.WriteStop()
+}
+
+func (p *parquetWriter) size() int64 {
+	return p.bytes
+}
+
+// parquetValue dump 的数据可能是字符串， 数值类型的列需要转换
+func parquetValue(typ string, v interface{}) (interface{}, error) {
+	s, ok := v.(string)
+	switch {
+	case typ == parquetString:
+		if ok {
+			return s, nil
+		}
+		return fmt.Sprint(v), nil
+	case !ok:
+		return v, nil
+	case typ == parquetInt64:
+		return strconv.ParseInt(s, 10, 64)
+	default:
+		return strconv.ParseFloat(s, 64)
+	}
+}
+
+// cellValue 转换为文件中保存的值， enum、set 转换为名称， 二进制内容以 base64 保存
+func cellValue(col *schema.TableColumn, v interface{}) interface{} {
+	if v == nil {
+		return nil
+	}
+	switch col.Type {
+	case schema.TYPE_ENUM:
+		return format.EnumName(col, v)
+	case schema.TYPE_SET:
+		return strings.Join(format.SetNames(col, v), ",")
+	}
+	if format.IsBinary(col) {
+		return base64.StdEncoding.EncodeToString(format.Bytes(v))
+	}
+	return format.Value(v)
+}
@@ -0,0 +1,246 @@
+package format
+
+// Avro 格式， 按 Confluent 的格式编码： 0x00 + 4字节 schema id + avro 二进制
+// schema 根据表的列生成并注册到 schema registry， 表结构变化之后重新生成， 由 registry 生成新的版本
+// 列的类型转换与 debezium 格式一致， 时间类型使用 avro 的逻辑类型， decimal 以字符串保存
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/go-mysql-org/go-mysql/canal"
+	"github.com/go-mysql-org/go-mysql/schema"
+	"github.com/gridsx/datagos/common"
+	"github.com/linkedin/goavro/v2"
+	"github.com/siddontang/go-log/log"
+)
+
+const (
+	avroMagicByte      = 0
+	defaultAvroSubject = "${schema}.${table}-value"
+)
+
+// avroTable 表结构对应的 avro schema 以及注册得到的 id
+type avroTable struct {
+	table     *schema.Table
+	namespace string
+	columns   []*debeziumColumn
+	branches  []string
+	codec     *goavro.Codec
+	id        int
+}
+
+type avroEncoder struct {
+	serverName string
+	subject    string
+	registry   *registryClient
+
+	lock   sync.Mutex
+	tables map[string]*avroTable
+}
+
+func newAvroEncoder(cfg *Config) (*avroEncoder, error) {
+	registry, err := newRegistryClient(cfg.Registry)
+	if err != nil {
+		return nil, err
+	}
+	a := &avroEncoder{
+		serverName: cfg.ServerName,
+		subject:    cfg.Registry.Subject,
+		registry:   registry,
+		tables:     make(map[string]*avroTable, 8),
+	}
+	if len(a.serverName) == 0 {
+		a.serverName = defaultServerName
+	}
+	if len(a.subject) == 0 {
+		a.subject = defaultAvroSubject
+	}
+	return a, nil
+}
+
+func (a *avroEncoder) Encode(e *canal.RowsEvent, src *Source) ([]*Message, error) {
+	at, err := a.table(e.Table)
+	if err != nil {
+		return nil, err
+	}
+	var file, gtid, pos interface{}
+	if src != nil && len(src.Position.Name) > 0 {
+		file = goavro.Union("string", src.Position.Name)
+		pos = goavro.Union("long", int64(src.Position.Pos))
+	}
+	if src != nil && len(src.GTID) > 0 {
+		gtid = goavro.Union("string", src.GTID)
+	}
+	header := make([]byte, 5)
+	header[0] = avroMagicByte
+	binary.BigEndian.PutUint32(header[1:], uint32(at.id))
+
+	changes := Changes(e)
+	messages := make([]*Message, 0, len(changes))
+	for _, c := range changes {
+		before, err := at.row(c.Before)
+		if err != nil {
+			return nil, err
+		}
+		after, err := at.row(c.After)
+		if err != nil {
+			return nil, err
+		}
+		record := map[string]interface{}{
+			"before":   before,
+			"after":    after,
+			"action":   e.Action,
+			"snapshot": IsSnapshot(e),
+			"ts":       EventTime(e).UnixMilli(),
+			"file":     file,
+			"pos":      pos,
+			"gtid":     gtid,
+		}
+		value, err := at.codec.BinaryFromNative(append([]byte{}, header...), record)
+		if err != nil {
+			return nil, fmt.Errorf("avro encode %s error: %w", e.Table.String(), err)
+		}
+		messages = append(messages, &Message{
+			Schema: e.Table.Schema,
+			Table:  e.Table.Name,
+			Action: e.Action,
+			Key:    []byte(RowKey(e.Table, c.Row())),
+			Value:  value,
+		})
+	}
+	return messages, nil
+}
+
+// table 表结构变化之后 canal 会重新生成 schema.Table， 这时重新生成并注册 schema
+func (a *avroEncoder) table(t *schema.Table) (*avroTable, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	key := t.String()
+	if at, ok := a.tables[key]; ok && at.table == t {
+		return at, nil
+	}
+	at, spec, err := newAvroTable(a.serverName, t)
+	if err != nil {
+		return nil, err
+	}
+	subject := common.RenderTemplate(a.subject, map[string]string{"schema": t.Schema, "table": t.Name})
+	if at.id, err = a.registry.register(subject, spec); err != nil {
+		return nil, err
+	}
+	log.Infof("avro schema registered, subject: %s, id: %d\n", subject, at.id)
+	a.tables[key] = at
+	return at, nil
+}
+
+func newAvroTable(serverName string, t *schema.Table) (*avroTable, string, error) {
+	at := &avroTable{table: t, namespace: avroName(serverName) + "." + avroName(t.Schema) + "." + avroName(t.Name)}
+	fields := make([]map[string]interface{}, 0, len(t.Columns))
+	for i := range t.Columns {
+		c := newDebeziumColumn(&t.Columns[i])
+		typ, branch := avroType(c.field)
+		at.columns = append(at.columns, c)
+		at.branches = append(at.branches, branch)
+		fields = append(fields, map[string]interface{}{
+			"name":    avroName(t.Columns[i].Name),
+			"type":    []interface{}{"null", typ},
+			"default": nil,
+		})
+	}
+	value := map[string]interface{}{
+		"type":   "record",
+		"name":   "Value",
+		"fields": fields,
+	}
+	spec := map[string]interface{}{
+		"type":      "record",
+		"name":      "Envelope",
+		"namespace": at.namespace,
+		"fields": []interface{}{
+			map[string]interface{}{"name": "before", "type": []interface{}{"null", value}, "default": nil},
+			map[string]interface{}{"name": "after", "type": []interface{}{"null", "Value"}, "default": nil},
+			map[string]interface{}{"name": "action", "type": "string"},
+			map[string]interface{}{"name": "snapshot", "type": "boolean"},
+			map[string]interface{}{"name": "ts", "type": map[string]interface{}{"type": "long", "logicalType": "timestamp-millis"}},
+			map[string]interface{}{"name": "file", "type": []interface{}{"null", "string"}, "default": nil},
+			map[string]interface{}{"name": "pos", "type": []interface{}{"null", "long"}, "default": nil},
+			map[string]interface{}{"name": "gtid", "type": []interface{}{"null", "string"}, "default": nil},
+		},
+	}
+	d, err := json.Marshal(spec)
+	if err != nil {
+		return nil, "", err
+	}
+	codec, err := goavro.NewCodec(string(d))
+	if err != nil {
+		return nil, "", fmt.Errorf("avro schema of %s error: %w", t.String(), err)
+	}
+	at.codec = codec
+	// 规范形式（CanonicalSchema）会去掉 logicalType， 注册完整的 schema， 消费者才能按逻辑类型解码
+	return at, string(d), nil
+}
+
+// row 行数据转换为 avro 的 union 值
+func (at *avroTable) row(row []interface{}) (interface{}, error) {
+	if row == nil {
+		return nil, nil
+	}
+	m := make(map[string]interface{}, len(at.columns))
+	for i, c := range at.columns {
+		name := avroName(at.table.Columns[i].Name)
+		if i >= len(row) || row[i] == nil {
+			m[name] = nil
+			continue
+		}
+		v, err := c.convert(row[i])
+		if err != nil {
+			return nil, fmt.Errorf("avro convert column %s.%s error: %w", at.table.String(), c.field.Field, err)
+		}
+		if v == nil {
+			m[name] = nil
+			continue
+		}
+		m[name] = goavro.Union(at.branches[i], v)
+	}
+	return goavro.Union(at.namespace+".Value", m), nil
+}
+
+// avroType 由 debezium 的列类型转换为 avro 类型， 返回类型以及 union 中的分支名称
+func avroType(f *debeziumField) (interface{}, string) {
+	switch f.Name {
+	case "io.debezium.time.Date":
+		return map[string]interface{}{"type": "int", "logicalType": "date"}, "int.date"
+	case "io.debezium.time.Timestamp":
+		return map[string]interface{}{"type": "long", "logicalType": "timestamp-millis"}, "long.timestamp-millis"
+	case "io.debezium.time.MicroTimestamp":
+		return map[string]interface{}{"type": "long", "logicalType": "timestamp-micros"}, "long.timestamp-micros"
+	case "io.debezium.time.MicroTime":
+		return map[string]interface{}{"type": "long", "logicalType": "time-micros"}, "long.time-micros"
+	}
+	switch f.Type {
+	case "int16", "int32":
+		return "int", "int"
+	case "int64":
+		return "long", "long"
+	case "float", "double", "boolean", "bytes":
+		return f.Type, f.Type
+	default:
+		return "string", "string"
+	}
+}
+
+// avroName avro 的名称只能包含字母、数字和下划线， 且不能以数字开头
+func avroName(name string) string {
+	b := []byte(name)
+	for i, c := range b {
+		if !(c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (i > 0 && c >= '0' && c <= '9')) {
+			b[i] = '_'
+		}
+	}
+	if len(b) == 0 {
+		return "_"
+	}
+	return string(b)
+}
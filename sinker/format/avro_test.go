@@ -0,0 +1,198 @@
+package format
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-mysql-org/go-mysql/canal"
+	"github.com/go-mysql-org/go-mysql/mysql"
+	"github.com/go-mysql-org/go-mysql/replication"
+	"github.com/go-mysql-org/go-mysql/schema"
+	"github.com/linkedin/goavro/v2"
+)
+
+// registryStandIn 本地的 schema registry， 同一个 subject 下相同的 schema 返回相同的 id
+type registryStandIn struct {
+	*httptest.Server
+	lock     sync.Mutex
+	ids      map[string]int
+	schemas  map[int]string
+	subjects []string
+	auth     []string
+}
+
+func newRegistryStandIn(t *testing.T) *registryStandIn {
+	r := &registryStandIn{ids: map[string]int{}, schemas: map[int]string{}}
+	r.Server = httptest.NewServer(http.HandlerFunc(r.handle))
+	t.Cleanup(r.Close)
+	return r
+}
+
+func (r *registryStandIn) handle(w http.ResponseWriter, req *http.Request) {
+	subject := strings.TrimSuffix(strings.TrimPrefix(req.URL.Path, "/subjects/"), "/versions")
+	if req.Method != http.MethodPost || subject == req.URL.Path {
+		http.NotFound(w, req)
+		return
+	}
+	body := struct {
+		Schema string `json:"schema"`
+	}{}
+	d, _ := io.ReadAll(req.Body)
+	if err := json.Unmarshal(d, &body); err != nil || len(body.Schema) == 0 {
+		http.Error(w, `{"error_code":42201,"message":"Invalid schema"}`, http.StatusUnprocessableEntity)
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	user, pass, _ := req.BasicAuth()
+	r.auth = append(r.auth, user+":"+pass)
+	r.subjects = append(r.subjects, subject)
+	key := subject + "\n" + body.Schema
+	id, ok := r.ids[key]
+	if !ok {
+		id = len(r.ids) + 1
+		r.ids[key] = id
+		r.schemas[id] = body.Schema
+	}
+	_ = json.NewEncoder(w).Encode(map[string]int{"id": id})
+}
+
+func newTypesTable() *schema.Table {
+	t := &schema.Table{Schema: "shop", Name: "orders", PKColumns: []int{0}}
+	t.AddColumn("id", "bigint", "", "")
+	t.AddColumn("day", "date", "", "")
+	t.AddColumn("created", "datetime", "", "")
+	t.AddColumn("updated", "datetime(6)", "", "")
+	t.AddColumn("dur", "time", "", "")
+	t.AddColumn("price", "decimal(10,2)", "", "")
+	return t
+}
+
+func newTestAvroEncoder(t *testing.T, r *registryStandIn) *avroEncoder {
+	encoder, err := NewEncoder(&Config{Type: TypeAvro, ServerName: "dbz",
+		Registry: &RegistryConfig{URL: r.URL + "/", Username: "u", Password: "p"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return encoder.(*avroEncoder)
+}
+
+// 消息为 0x00 + schema id + avro 二进制， 按 registry 中注册的 schema 可以解码， 时间类型为逻辑类型
+func TestAvroEncode(t *testing.T) {
+	r := newRegistryStandIn(t)
+	a := newTestAvroEncoder(t, r)
+	table := newTypesTable()
+	e := &canal.RowsEvent{Table: table, Action: canal.InsertAction,
+		Rows:   [][]interface{}{{int64(7), "2024-03-02", "2024-03-02 10:20:30", "2024-03-02 10:20:30.123456", "-01:02:03.5", "12.50"}},
+		Header: &replication.EventHeader{Timestamp: 1700000000}}
+	messages, err := a.Encode(e, &Source{Position: mysql.Position{Name: "mysql-bin.000001", Pos: 4}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 1 || string(messages[0].Key) != "7" {
+		t.Fatalf("messages: %v", messages)
+	}
+	value := messages[0].Value
+	if value[0] != avroMagicByte || binary.BigEndian.Uint32(value[1:5]) != 1 {
+		t.Fatalf("header: %v", value[:5])
+	}
+	if len(r.subjects) != 1 || r.subjects[0] != "shop.orders-value" || r.auth[0] != "u:p" {
+		t.Fatalf("subjects: %v, auth: %v", r.subjects, r.auth)
+	}
+	codec, err := goavro.NewCodec(r.schemas[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	native, rest, err := codec.NativeFromBinary(value[5:])
+	if err != nil || len(rest) != 0 {
+		t.Fatalf("decode: %v, rest: %d", err, len(rest))
+	}
+	record := native.(map[string]interface{})
+	if record["action"] != canal.InsertAction || record["before"] != nil {
+		t.Fatalf("record: %v", record)
+	}
+	if file := record["file"].(map[string]interface{})["string"]; file != "mysql-bin.000001" {
+		t.Fatalf("file: %v", file)
+	}
+	after := record["after"].(map[string]interface{})["dbz.shop.orders.Value"].(map[string]interface{})
+	field := func(name, branch string) interface{} {
+		return after[name].(map[string]interface{})[branch]
+	}
+	if v := field("id", "long"); v != int64(7) {
+		t.Fatalf("id: %v", v)
+	}
+	if v := field("day", "int.date").(time.Time); !v.Equal(time.Date(2024, 3, 2, 0, 0, 0, 0, time.UTC)) {
+		t.Fatalf("day: %v", v)
+	}
+	if v := field("created", "long.timestamp-millis").(time.Time); !v.Equal(time.Date(2024, 3, 2, 10, 20, 30, 0, time.UTC)) {
+		t.Fatalf("created: %v", v)
+	}
+	if v := field("updated", "long.timestamp-micros").(time.Time); !v.Equal(time.Date(2024, 3, 2, 10, 20, 30, 123456000, time.UTC)) {
+		t.Fatalf("updated: %v", v)
+	}
+	if v := field("dur", "long.time-micros").(time.Duration); v != -(time.Hour + 2*time.Minute + 3500*time.Millisecond) {
+		t.Fatalf("dur: %v", v)
+	}
+	if v := field("price", "string"); v != "12.50" {
+		t.Fatalf("price: %v", v)
+	}
+}
+
+// 同一个表只注册一次， 表结构变化之后重新注册， registry 生成新的 id
+func TestAvroRegistryCache(t *testing.T) {
+	r := newRegistryStandIn(t)
+	a := newTestAvroEncoder(t, r)
+	table := newTypesTable()
+	e := &canal.RowsEvent{Table: table, Action: canal.InsertAction,
+		Rows:   [][]interface{}{{int64(1), nil, nil, nil, nil, nil}},
+		Header: &replication.EventHeader{Timestamp: 1}}
+	for i := 0; i < 3; i++ {
+		if _, err := a.Encode(e, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(r.subjects) != 1 {
+		t.Fatalf("registrations: %d", len(r.subjects))
+	}
+	// canal 重新生成表结构， schema 相同时使用缓存的 id， 不再请求 registry
+	same := newTypesTable()
+	if _, err := a.Encode(&canal.RowsEvent{Table: same, Action: canal.InsertAction, Rows: e.Rows, Header: e.Header}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(r.subjects) != 1 || a.tables[same.String()].id != 1 {
+		t.Fatalf("registrations: %d, id: %d", len(r.subjects), a.tables[same.String()].id)
+	}
+	changed := newTypesTable()
+	changed.AddColumn("note", "varchar(32)", "", "")
+	messages, err := a.Encode(&canal.RowsEvent{Table: changed, Action: canal.InsertAction,
+		Rows: [][]interface{}{{int64(1), nil, nil, nil, nil, nil, "n"}}, Header: e.Header}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id := binary.BigEndian.Uint32(messages[0].Value[1:5]); id != 2 {
+		t.Fatalf("id after schema change: %d", id)
+	}
+}
+
+// registry 返回错误时编码失败， 不会缓存
+func TestAvroRegistryError(t *testing.T) {
+	r := newRegistryStandIn(t)
+	r.Close()
+	a := newTestAvroEncoder(t, r)
+	e := &canal.RowsEvent{Table: newTypesTable(), Action: canal.InsertAction,
+		Rows:   [][]interface{}{{int64(1), nil, nil, nil, nil, nil}},
+		Header: &replication.EventHeader{Timestamp: 1}}
+	if _, err := a.Encode(e, nil); err == nil {
+		t.Fatal("encode succeeded without registry")
+	}
+	if len(a.tables) != 0 || len(a.registry.ids) != 0 {
+		t.Fatal("failed registration cached")
+	}
+}
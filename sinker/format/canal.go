@@ -0,0 +1,360 @@
+package format
+
+// 阿里 canal 兼容的消息格式， 方便从 canal 迁移的时候不修改消费端
+// canal: FlatMessage 格式的 JSON， 值统一为字符串
+// canal-protobuf: 与 canal 非 flat 模式一致， Packet(Messages(Entry))， 消费端使用 CanalMessageDeserializer 解析
+// 与 canal 按主键分区的模式一致， 每一行变更对应一条消息
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-mysql-org/go-mysql/canal"
+	"github.com/go-mysql-org/go-mysql/schema"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// java.sql.Types
+const (
+	sqlTypeBit       = -7
+	sqlTypeTinyInt   = -6
+	sqlTypeSmallInt  = 5
+	sqlTypeInteger   = 4
+	sqlTypeBigInt    = -5
+	sqlTypeReal      = 7
+	sqlTypeDouble    = 8
+	sqlTypeDecimal   = 3
+	sqlTypeChar      = 1
+	sqlTypeVarchar   = 12
+	sqlTypeDate      = 91
+	sqlTypeTime      = 92
+	sqlTypeTimestamp = 93
+	sqlTypeBinary    = -2
+	sqlTypeVarBinary = -3
+	sqlTypeBlob      = 2004
+	sqlTypeClob      = 2005
+)
+
+// flatMessage canal 的 FlatMessage
+type flatMessage struct {
+	Id        int64                `json:"id"`
+	Database  string               `json:"database"`
+	Table     string               `json:"table"`
+	PKNames   []string             `json:"pkNames"`
+	IsDdl     bool                 `json:"isDdl"`
+	Type      string               `json:"type"`
+	Es        int64                `json:"es"`
+	Ts        int64                `json:"ts"`
+	Sql       string               `json:"sql"`
+	SqlType   map[string]int       `json:"sqlType"`
+	MysqlType map[string]string    `json:"mysqlType"`
+	Data      []map[string]*string `json:"data"`
+	Old       []map[string]*string `json:"old"`
+}
+
+type canalFlatEncoder struct {
+	id int64
+}
+
+func (c *canalFlatEncoder) Encode(e *canal.RowsEvent, _ *Source) ([]*Message, error) {
+	t := e.Table
+	sqlTypes := make(map[string]int, len(t.Columns))
+	mysqlTypes := make(map[string]string, len(t.Columns))
+	for i := range t.Columns {
+		sqlTypes[t.Columns[i].Name] = canalSQLType(&t.Columns[i])
+		mysqlTypes[t.Columns[i].Name] = t.Columns[i].RawType
+	}
+	changes := Changes(e)
+	messages := make([]*Message, 0, len(changes))
+	for _, change := range changes {
+		m := &flatMessage{
+			Id:        atomic.AddInt64(&c.id, 1),
+			Database:  t.Schema,
+			Table:     t.Name,
+			PKNames:   PKNames(t),
+			Type:      strings.ToUpper(e.Action),
+			Es:        EventTime(e).UnixMilli(),
+			Ts:        time.Now().UnixMilli(),
+			SqlType:   sqlTypes,
+			MysqlType: mysqlTypes,
+			Data:      []map[string]*string{canalRow(t, change.Row(), nil)},
+		}
+		if change.Before != nil && change.After != nil {
+			// old 只包含变化了的列
+			m.Old = []map[string]*string{canalRow(t, change.Before, change.After)}
+		}
+		d, err := json.Marshal(m)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, &Message{
+			Schema: t.Schema,
+			Table:  t.Name,
+			Action: e.Action,
+			Key:    []byte(RowKey(t, change.Row())),
+			Value:  d,
+		})
+	}
+	return messages, nil
+}
+
+// canalRow 行数据转换为字符串， compare 不为空的时候只保留与 compare 不同的列
+func canalRow(t *schema.Table, row []interface{}, compare []interface{}) map[string]*string {
+	m := make(map[string]*string, len(t.Columns))
+	for i := range t.Columns {
+		if i >= len(row) {
+			continue
+		}
+		v, isNull := canalValue(&t.Columns[i], row[i])
+		if compare != nil && i < len(compare) {
+			cv, cNull := canalValue(&t.Columns[i], compare[i])
+			if cv == v && cNull == isNull {
+				continue
+			}
+		}
+		if isNull {
+			m[t.Columns[i].Name] = nil
+		} else {
+			m[t.Columns[i].Name] = &v
+		}
+	}
+	return m
+}
+
+// canalValue 与 canal 一致， 值转换为字符串， enum、set 为名称， 二进制按 ISO-8859-1 转换
+func canalValue(col *schema.TableColumn, v interface{}) (string, bool) {
+	if v == nil {
+		return "", true
+	}
+	switch col.Type {
+	case schema.TYPE_ENUM:
+		return fmt.Sprint(EnumName(col, v)), false
+	case schema.TYPE_SET:
+		return strings.Join(SetNames(col, v), ","), false
+	}
+	if IsBinary(col) {
+		b := Bytes(v)
+		runes := make([]rune, len(b))
+		for i, c := range b {
+			runes[i] = rune(c)
+		}
+		return string(runes), false
+	}
+	return fmt.Sprint(Value(v)), false
+}
+
+// canalSQLType 与 canal 的映射一致， 无符号整数使用更大的类型
+func canalSQLType(col *schema.TableColumn) int {
+	raw := strings.ToLower(col.RawType)
+	switch col.Type {
+	case schema.TYPE_NUMBER, schema.TYPE_MEDIUM_INT:
+		switch {
+		case strings.HasPrefix(raw, "year"):
+			return sqlTypeVarchar
+		case strings.HasPrefix(raw, "tinyint"):
+			if col.IsUnsigned {
+				return sqlTypeSmallInt
+			}
+			return sqlTypeTinyInt
+		case strings.HasPrefix(raw, "smallint"):
+			if col.IsUnsigned {
+				return sqlTypeInteger
+			}
+			return sqlTypeSmallInt
+		case strings.HasPrefix(raw, "bigint"):
+			if col.IsUnsigned {
+				return sqlTypeDecimal
+			}
+			return sqlTypeBigInt
+		default:
+			if col.IsUnsigned {
+				return sqlTypeBigInt
+			}
+			return sqlTypeInteger
+		}
+	case schema.TYPE_FLOAT:
+		if strings.HasPrefix(raw, "float") {
+			return sqlTypeReal
+		}
+		return sqlTypeDouble
+	case schema.TYPE_DECIMAL:
+		return sqlTypeDecimal
+	case schema.TYPE_DATE:
+		return sqlTypeDate
+	case schema.TYPE_TIME:
+		return sqlTypeTime
+	case schema.TYPE_DATETIME, schema.TYPE_TIMESTAMP:
+		return sqlTypeTimestamp
+	case schema.TYPE_BIT:
+		return sqlTypeBit
+	case schema.TYPE_ENUM, schema.TYPE_SET:
+		return sqlTypeChar
+	case schema.TYPE_BINARY:
+		if strings.HasPrefix(raw, "varbinary") {
+			return sqlTypeVarBinary
+		}
+		return sqlTypeBinary
+	}
+	switch {
+	case strings.Contains(raw, "blob"):
+		return sqlTypeBlob
+	case strings.Contains(raw, "text"):
+		return sqlTypeClob
+	case strings.HasPrefix(raw, "char"):
+		return sqlTypeChar
+	default:
+		return sqlTypeVarchar
+	}
+}
+
+// canal protocol 中的枚举值以及字段编号， 见 EntryProtocol.proto、CanalProtocol.proto
+const (
+	canalEntryRowData    = 2
+	canalSourceMySQL     = 1
+	canalEventInsert     = 1
+	canalEventUpdate     = 2
+	canalEventDelete     = 3
+	canalPacketMessages  = 7
+	canalCompressionNone = 1
+	canalPacketMagic     = 17
+	canalProtocolVersion = 1
+	canalServerEncoding  = "UTF-8"
+)
+
+type canalProtobufEncoder struct {
+	id int64
+}
+
+func (c *canalProtobufEncoder) Encode(e *canal.RowsEvent, src *Source) ([]*Message, error) {
+	t := e.Table
+	eventType := canalEventType(e.Action)
+	changes := Changes(e)
+	messages := make([]*Message, 0, len(changes))
+	for _, change := range changes {
+		rowData := make([]byte, 0, 256)
+		if change.Before != nil {
+			for i := range t.Columns {
+				rowData = protowire.AppendTag(rowData, 1, protowire.BytesType)
+				rowData = protowire.AppendBytes(rowData, canalColumn(t, i, change.Before, nil, false))
+			}
+		}
+		if change.After != nil {
+			for i := range t.Columns {
+				rowData = protowire.AppendTag(rowData, 2, protowire.BytesType)
+				rowData = protowire.AppendBytes(rowData, canalColumn(t, i, change.After, change.Before, true))
+			}
+		}
+
+		rowChange := make([]byte, 0, len(rowData)+16)
+		rowChange = appendVarint(rowChange, 2, uint64(eventType))
+		rowChange = appendVarint(rowChange, 10, 0)
+		rowChange = protowire.AppendTag(rowChange, 12, protowire.BytesType)
+		rowChange = protowire.AppendBytes(rowChange, rowData)
+
+		entry := make([]byte, 0, len(rowChange)+128)
+		entry = protowire.AppendTag(entry, 1, protowire.BytesType)
+		entry = protowire.AppendBytes(entry, canalHeader(e, src, eventType))
+		entry = appendVarint(entry, 2, canalEntryRowData)
+		entry = protowire.AppendTag(entry, 3, protowire.BytesType)
+		entry = protowire.AppendBytes(entry, rowChange)
+
+		body := appendVarint(nil, 1, uint64(atomic.AddInt64(&c.id, 1)))
+		body = protowire.AppendTag(body, 2, protowire.BytesType)
+		body = protowire.AppendBytes(body, entry)
+
+		packet := appendVarint(nil, 1, canalPacketMagic)
+		packet = appendVarint(packet, 2, canalProtocolVersion)
+		packet = appendVarint(packet, 3, canalPacketMessages)
+		packet = appendVarint(packet, 4, canalCompressionNone)
+		packet = protowire.AppendTag(packet, 5, protowire.BytesType)
+		packet = protowire.AppendBytes(packet, body)
+
+		messages = append(messages, &Message{
+			Schema: t.Schema,
+			Table:  t.Name,
+			Action: e.Action,
+			Key:    []byte(RowKey(t, change.Row())),
+			Value:  packet,
+		})
+	}
+	return messages, nil
+}
+
+func canalHeader(e *canal.RowsEvent, src *Source, eventType int) []byte {
+	h := appendVarint(nil, 1, canalProtocolVersion)
+	if src != nil && len(src.Position.Name) > 0 {
+		h = appendString(h, 2, src.Position.Name)
+		h = appendVarint(h, 3, uint64(src.Position.Pos))
+	}
+	if e.Header != nil {
+		h = appendVarint(h, 4, uint64(e.Header.ServerID))
+	}
+	h = appendString(h, 5, canalServerEncoding)
+	h = appendVarint(h, 6, uint64(EventTime(e).UnixMilli()))
+	h = appendVarint(h, 7, canalSourceMySQL)
+	h = appendString(h, 8, e.Table.Schema)
+	h = appendString(h, 9, e.Table.Name)
+	if e.Header != nil {
+		h = appendVarint(h, 10, uint64(e.Header.EventSize))
+	}
+	h = appendVarint(h, 11, uint64(eventType))
+	if src != nil && len(src.GTID) > 0 {
+		h = appendString(h, 13, src.GTID)
+	}
+	return h
+}
+
+// canalColumn 编码 Column， after 的列与 before 比较标记 updated， insert 的列都是 updated
+func canalColumn(t *schema.Table, idx int, row, before []interface{}, after bool) []byte {
+	col := &t.Columns[idx]
+	var v interface{}
+	if idx < len(row) {
+		v = row[idx]
+	}
+	value, isNull := canalValue(col, v)
+	updated := after
+	if after && before != nil && idx < len(before) {
+		old, oldNull := canalValue(col, before[idx])
+		updated = old != value || oldNull != isNull
+	}
+	b := appendVarint(nil, 1, uint64(idx))
+	b = appendVarint(b, 2, uint64(int64(canalSQLType(col))))
+	b = appendString(b, 3, col.Name)
+	if isPK(t, idx) {
+		b = appendVarint(b, 4, 1)
+	}
+	if updated {
+		b = appendVarint(b, 5, 1)
+	}
+	if isNull {
+		b = appendVarint(b, 6, 1)
+	} else {
+		b = appendString(b, 8, value)
+	}
+	b = appendString(b, 10, col.RawType)
+	return b
+}
+
+func canalEventType(action string) int {
+	switch action {
+	case canal.UpdateAction:
+		return canalEventUpdate
+	case canal.DeleteAction:
+		return canalEventDelete
+	default:
+		return canalEventInsert
+	}
+}
+
+func appendVarint(b []byte, num protowire.Number, v uint64) []byte {
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, v)
+}
+
+func appendString(b []byte, num protowire.Number, s string) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
@@ -0,0 +1,526 @@
+package format
+
+// Debezium MySQL connector 兼容的消息格式， 默认的 JsonConverter 输出
+// 值的转换与 Debezium 的默认配置一致， decimal 对应 decimal.handling.mode=string
+// 时间类型： date 为天数， datetime 为毫秒（精度大于3为微秒）， timestamp 为 UTC 的 ISO-8601 字符串， time 为微秒
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-mysql-org/go-mysql/canal"
+	"github.com/go-mysql-org/go-mysql/schema"
+)
+
+const (
+	debeziumVersion   = "datagos"
+	debeziumConnector = "mysql"
+	defaultServerName = "datagos"
+
+	zeroDate = "0000-00-00"
+)
+
+// debeziumField Kafka Connect 的 schema 描述
+type debeziumField struct {
+	Type       string            `json:"type"`
+	Optional   bool              `json:"optional"`
+	Name       string            `json:"name,omitempty"`
+	Version    int               `json:"version,omitempty"`
+	Parameters map[string]string `json:"parameters,omitempty"`
+	Fields     []*debeziumField  `json:"fields,omitempty"`
+	Field      string            `json:"field,omitempty"`
+}
+
+type debeziumSource struct {
+	Version   string `json:"version"`
+	Connector string `json:"connector"`
+	Name      string `json:"name"`
+	TsMs      int64  `json:"ts_ms"`
+	Snapshot  string `json:"snapshot"`
+	Db        string `json:"db"`
+	Table     string `json:"table"`
+	ServerId  uint32 `json:"server_id"`
+	GTID      string `json:"gtid"`
+	File      string `json:"file"`
+	Pos       uint32 `json:"pos"`
+	Row       int    `json:"row"`
+}
+
+type debeziumPayload struct {
+	Before map[string]interface{} `json:"before"`
+	After  map[string]interface{} `json:"after"`
+	Source *debeziumSource        `json:"source"`
+	Op     string                 `json:"op"`
+	TsMs   int64                  `json:"ts_ms"`
+}
+
+type debeziumMessage struct {
+	Schema  *debeziumField `json:"schema"`
+	Payload interface{}    `json:"payload"`
+}
+
+// debeziumColumn 列的 schema 以及值的转换
+type debeziumColumn struct {
+	field   *debeziumField
+	convert func(v interface{}) (interface{}, error)
+}
+
+// debeziumTable 表结构对应的 schema， 表结构变化之后重新生成
+type debeziumTable struct {
+	table    *schema.Table
+	columns  []*debeziumColumn
+	envelope *debeziumField
+	key      *debeziumField
+}
+
+type debeziumEncoder struct {
+	withSchema bool
+	serverName string
+
+	lock   sync.Mutex
+	tables map[string]*debeziumTable
+}
+
+func newDebeziumEncoder(cfg *Config) *debeziumEncoder {
+	name := cfg.ServerName
+	if len(name) == 0 {
+		name = defaultServerName
+	}
+	return &debeziumEncoder{withSchema: cfg.WithSchema, serverName: name, tables: make(map[string]*debeziumTable, 8)}
+}
+
+func (d *debeziumEncoder) Encode(e *canal.RowsEvent, src *Source) ([]*Message, error) {
+	dt := d.table(e.Table)
+	snapshot := IsSnapshot(e)
+	source := &debeziumSource{
+		Version:   debeziumVersion,
+		Connector: debeziumConnector,
+		Name:      d.serverName,
+		TsMs:      EventTime(e).UnixMilli(),
+		Snapshot:  strconv.FormatBool(snapshot),
+		Db:        e.Table.Schema,
+		Table:     e.Table.Name,
+	}
+	if e.Header != nil {
+		source.ServerId = e.Header.ServerID
+	}
+	if src != nil {
+		source.GTID = src.GTID
+		source.File = src.Position.Name
+		source.Pos = src.Position.Pos
+	}
+	op := debeziumOp(e.Action, snapshot)
+	now := time.Now().UnixMilli()
+
+	changes := Changes(e)
+	messages := make([]*Message, 0, len(changes))
+	for i, c := range changes {
+		rowSource := *source
+		rowSource.Row = i
+		payload := &debeziumPayload{Source: &rowSource, Op: op, TsMs: now}
+		var err error
+		if payload.Before, err = dt.values(c.Before); err != nil {
+			return nil, err
+		}
+		if payload.After, err = dt.values(c.After); err != nil {
+			return nil, err
+		}
+		value, err := d.marshal(dt.envelope, payload)
+		if err != nil {
+			return nil, err
+		}
+		key, err := d.key(dt, c.Row())
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, &Message{
+			Schema: e.Table.Schema,
+			Table:  e.Table.Name,
+			Action: e.Action,
+			Key:    key,
+			Value:  value,
+		})
+	}
+	return messages, nil
+}
+
+// key 主键组成的 key， 与 Debezium 一致， 没有主键的表退化为表名
+func (d *debeziumEncoder) key(dt *debeziumTable, row []interface{}) ([]byte, error) {
+	t := dt.table
+	if len(t.PKColumns) == 0 {
+		return []byte(RowKey(t, row)), nil
+	}
+	payload := make(map[string]interface{}, len(t.PKColumns))
+	for _, idx := range t.PKColumns {
+		if idx >= len(row) {
+			continue
+		}
+		v, err := dt.columns[idx].convert(row[idx])
+		if err != nil {
+			return nil, err
+		}
+		payload[t.Columns[idx].Name] = v
+	}
+	return d.marshal(dt.key, payload)
+}
+
+func (d *debeziumEncoder) marshal(s *debeziumField, payload interface{}) ([]byte, error) {
+	if d.withSchema {
+		return json.Marshal(&debeziumMessage{Schema: s, Payload: payload})
+	}
+	return json.Marshal(payload)
+}
+
+func (d *debeziumEncoder) table(t *schema.Table) *debeziumTable {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	key := t.String()
+	if dt, ok := d.tables[key]; ok && dt.table == t {
+		return dt
+	}
+	dt := newDebeziumTable(d.serverName, t)
+	d.tables[key] = dt
+	return dt
+}
+
+func newDebeziumTable(serverName string, t *schema.Table) *debeziumTable {
+	prefix := serverName + "." + t.Schema + "." + t.Name
+	dt := &debeziumTable{table: t, columns: make([]*debeziumColumn, 0, len(t.Columns))}
+	fields := make([]*debeziumField, 0, len(t.Columns))
+	for i := range t.Columns {
+		c := newDebeziumColumn(&t.Columns[i])
+		c.field.Optional = !isPK(t, i)
+		dt.columns = append(dt.columns, c)
+		fields = append(fields, c.field)
+	}
+	keyFields := make([]*debeziumField, 0, len(t.PKColumns))
+	for _, idx := range t.PKColumns {
+		keyFields = append(keyFields, dt.columns[idx].field)
+	}
+	dt.key = &debeziumField{Type: "struct", Name: prefix + ".Key", Fields: keyFields}
+
+	value := func(field string) *debeziumField {
+		return &debeziumField{Type: "struct", Optional: true, Name: prefix + ".Value", Fields: fields, Field: field}
+	}
+	dt.envelope = &debeziumField{
+		Type: "struct",
+		Name: prefix + ".Envelope",
+		Fields: []*debeziumField{
+			value("before"),
+			value("after"),
+			{Type: "struct", Name: "io.debezium.connector.mysql.Source", Field: "source", Fields: []*debeziumField{
+				{Type: "string", Field: "version"},
+				{Type: "string", Field: "connector"},
+				{Type: "string", Field: "name"},
+				{Type: "int64", Field: "ts_ms"},
+				{Type: "string", Optional: true, Name: "io.debezium.data.Enum", Version: 1,
+					Parameters: map[string]string{"allowed": "true,last,false"}, Field: "snapshot"},
+				{Type: "string", Field: "db"},
+				{Type: "string", Optional: true, Field: "table"},
+				{Type: "int64", Field: "server_id"},
+				{Type: "string", Optional: true, Field: "gtid"},
+				{Type: "string", Field: "file"},
+				{Type: "int64", Field: "pos"},
+				{Type: "int32", Field: "row"},
+			}},
+			{Type: "string", Field: "op"},
+			{Type: "int64", Optional: true, Field: "ts_ms"},
+		},
+	}
+	return dt
+}
+
+func (dt *debeziumTable) values(row []interface{}) (map[string]interface{}, error) {
+	if row == nil {
+		return nil, nil
+	}
+	m := make(map[string]interface{}, len(dt.columns))
+	for i, c := range dt.columns {
+		var v interface{}
+		if i < len(row) && row[i] != nil {
+			var err error
+			if v, err = c.convert(row[i]); err != nil {
+				return nil, fmt.Errorf("debezium convert column %s.%s error: %w", dt.table.String(), c.field.Field, err)
+			}
+		}
+		m[c.field.Field] = v
+	}
+	return m, nil
+}
+
+func debeziumOp(action string, snapshot bool) string {
+	if snapshot {
+		return "r"
+	}
+	switch action {
+	case canal.UpdateAction:
+		return "u"
+	case canal.DeleteAction:
+		return "d"
+	default:
+		return "c"
+	}
+}
+
+func isPK(t *schema.Table, idx int) bool {
+	for _, v := range t.PKColumns {
+		if v == idx {
+			return true
+		}
+	}
+	return false
+}
+
+// newDebeziumColumn 根据列的类型生成 schema 以及值的转换， 与 Debezium MySQL connector 的默认映射一致
+func newDebeziumColumn(col *schema.TableColumn) *debeziumColumn {
+	f := &debeziumField{Field: col.Name}
+	c := &debeziumColumn{field: f}
+	raw := strings.ToLower(col.RawType)
+	switch {
+	case col.Type == schema.TYPE_NUMBER && strings.HasPrefix(raw, "year"):
+		f.Type, f.Name, f.Version = "int32", "io.debezium.time.Year", 1
+		c.convert = toInt64
+	case col.Type == schema.TYPE_NUMBER && (strings.HasPrefix(raw, "tinyint") || strings.HasPrefix(raw, "smallint")):
+		f.Type = "int16"
+		c.convert = toInt64
+	case col.Type == schema.TYPE_NUMBER && strings.HasPrefix(raw, "bigint"):
+		f.Type = "int64"
+		c.convert = toInt64
+	case col.Type == schema.TYPE_NUMBER || col.Type == schema.TYPE_MEDIUM_INT:
+		f.Type = "int32"
+		if col.IsUnsigned && col.Type == schema.TYPE_NUMBER {
+			f.Type = "int64"
+		}
+		c.convert = toInt64
+	case col.Type == schema.TYPE_FLOAT:
+		f.Type = "double"
+		if strings.HasPrefix(raw, "float") {
+			f.Type = "float"
+		}
+		c.convert = toFloat64
+	case col.Type == schema.TYPE_DECIMAL:
+		f.Type = "string"
+		c.convert = toString
+	case col.Type == schema.TYPE_DATE:
+		f.Type, f.Name, f.Version = "int32", "io.debezium.time.Date", 1
+		c.convert = dateDays
+	case col.Type == schema.TYPE_DATETIME:
+		if precision(raw) > 3 {
+			f.Type, f.Name, f.Version = "int64", "io.debezium.time.MicroTimestamp", 1
+			c.convert = func(v interface{}) (interface{}, error) { return datetime(v, time.Microsecond) }
+		} else {
+			f.Type, f.Name, f.Version = "int64", "io.debezium.time.Timestamp", 1
+			c.convert = func(v interface{}) (interface{}, error) { return datetime(v, time.Millisecond) }
+		}
+	case col.Type == schema.TYPE_TIMESTAMP:
+		f.Type, f.Name, f.Version = "string", "io.debezium.time.ZonedTimestamp", 1
+		c.convert = zonedTimestamp
+	case col.Type == schema.TYPE_TIME:
+		f.Type, f.Name, f.Version = "int64", "io.debezium.time.MicroTime", 1
+		c.convert = microTime
+	case col.Type == schema.TYPE_BIT && (raw == "bit" || raw == "bit(1)"):
+		f.Type = "boolean"
+		c.convert = func(v interface{}) (interface{}, error) {
+			n, err := toInt64(v)
+			return n != 0, err
+		}
+	case col.Type == schema.TYPE_BIT:
+		length := precision(raw)
+		f.Type, f.Name, f.Version = "bytes", "io.debezium.data.Bits", 1
+		f.Parameters = map[string]string{"length": strconv.Itoa(length)}
+		c.convert = func(v interface{}) (interface{}, error) { return bits(v, length) }
+	case col.Type == schema.TYPE_JSON:
+		f.Type, f.Name, f.Version = "string", "io.debezium.data.Json", 1
+		c.convert = toString
+	case col.Type == schema.TYPE_ENUM:
+		f.Type, f.Name, f.Version = "string", "io.debezium.data.Enum", 1
+		f.Parameters = map[string]string{"allowed": strings.Join(col.EnumValues, ",")}
+		c.convert = func(v interface{}) (interface{}, error) { return toString(EnumName(col, v)) }
+	case col.Type == schema.TYPE_SET:
+		f.Type, f.Name, f.Version = "string", "io.debezium.data.EnumSet", 1
+		f.Parameters = map[string]string{"allowed": strings.Join(col.SetValues, ",")}
+		c.convert = func(v interface{}) (interface{}, error) { return strings.Join(SetNames(col, v), ","), nil }
+	case IsBinary(col) || col.Type == schema.TYPE_POINT:
+		// []byte 序列化为 JSON 的时候是 base64， 与 JsonConverter 一致
+		f.Type = "bytes"
+		c.convert = func(v interface{}) (interface{}, error) { return Bytes(v), nil }
+	default:
+		f.Type = "string"
+		c.convert = toString
+	}
+	return c
+}
+
+// precision 取类型中括号里的数字， 如 datetime(6)、bit(8)
+func precision(raw string) int {
+	start, end := strings.Index(raw, "("), strings.Index(raw, ")")
+	if start < 0 || end < start {
+		return 0
+	}
+	n, _ := strconv.Atoi(raw[start+1 : end])
+	return n
+}
+
+// toInt64 binlog 中是各种长度的整数， dump 的时候可能是字符串
+func toInt64(v interface{}) (interface{}, error) {
+	switch val := v.(type) {
+	case int8:
+		return int64(val), nil
+	case int16:
+		return int64(val), nil
+	case int32:
+		return int64(val), nil
+	case int64:
+		return val, nil
+	case int:
+		return int64(val), nil
+	case uint8:
+		return int64(val), nil
+	case uint16:
+		return int64(val), nil
+	case uint32:
+		return int64(val), nil
+	case uint64:
+		// 与 Debezium 一致， unsigned bigint 超出范围的时候溢出
+		return int64(val), nil
+	case uint:
+		return int64(val), nil
+	case []byte:
+		return parseInt(string(val))
+	case string:
+		return parseInt(val)
+	default:
+		return nil, fmt.Errorf("unexpected integer value %v (%T)", v, v)
+	}
+}
+
+func parseInt(s string) (interface{}, error) {
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return n, nil
+	}
+	n, err := strconv.ParseUint(s, 10, 64)
+	return int64(n), err
+}
+
+func toFloat64(v interface{}) (interface{}, error) {
+	switch val := v.(type) {
+	case float32:
+		return float64(val), nil
+	case float64:
+		return val, nil
+	case []byte:
+		return strconv.ParseFloat(string(val), 64)
+	case string:
+		return strconv.ParseFloat(val, 64)
+	default:
+		return nil, fmt.Errorf("unexpected float value %v (%T)", v, v)
+	}
+}
+
+func toString(v interface{}) (interface{}, error) {
+	switch val := v.(type) {
+	case string:
+		return val, nil
+	case []byte:
+		return string(val), nil
+	default:
+		return fmt.Sprint(val), nil
+	}
+}
+
+// parseTime 解析 binlog 中的时间字符串， 0000-00-00 这类零值返回 false
+func parseTime(v interface{}, layout string, loc *time.Location) (time.Time, bool, error) {
+	if t, ok := v.(time.Time); ok {
+		return t, !t.IsZero(), nil
+	}
+	s, _ := toString(v)
+	str := s.(string)
+	if len(str) == 0 || strings.HasPrefix(str, zeroDate) {
+		return time.Time{}, false, nil
+	}
+	if len(str) > len(layout) && strings.Contains(str, ".") {
+		layout += ".999999"
+	}
+	t, err := time.ParseInLocation(layout, str, loc)
+	return t, err == nil, err
+}
+
+func dateDays(v interface{}) (interface{}, error) {
+	t, ok, err := parseTime(v, "2006-01-02", time.UTC)
+	if !ok {
+		return nil, err
+	}
+	return int32(t.Unix() / 86400), nil
+}
+
+// datetime 没有时区， 按 UTC 计算， 与 Debezium 一致
+func datetime(v interface{}, unit time.Duration) (interface{}, error) {
+	t, ok, err := parseTime(v, "2006-01-02 15:04:05", time.UTC)
+	if !ok {
+		return nil, err
+	}
+	return t.UnixNano() / int64(unit), nil
+}
+
+// zonedTimestamp canal 配置了 TimestampStringLocation 为 UTC， binlog 中的 timestamp 按 UTC 格式化
+func zonedTimestamp(v interface{}) (interface{}, error) {
+	t, ok, err := parseTime(v, "2006-01-02 15:04:05", time.UTC)
+	if !ok {
+		return nil, err
+	}
+	return t.UTC().Format(time.RFC3339Nano), nil
+}
+
+// microTime time 的范围为 -838:59:59 到 838:59:59
+func microTime(v interface{}) (interface{}, error) {
+	s, _ := toString(v)
+	str := s.(string)
+	negative := strings.HasPrefix(str, "-")
+	str = strings.TrimPrefix(str, "-")
+	var frac int64
+	if idx := strings.Index(str, "."); idx >= 0 {
+		f := (str[idx+1:] + "000000")[:6]
+		n, err := strconv.ParseInt(f, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		frac, str = n, str[:idx]
+	}
+	parts := strings.Split(str, ":")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("unexpected time value %s", str)
+	}
+	var total int64
+	for _, p := range parts {
+		n, err := strconv.ParseInt(p, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		total = total*60 + n
+	}
+	micros := total*int64(time.Second/time.Microsecond) + frac
+	if negative {
+		micros = -micros
+	}
+	return micros, nil
+}
+
+// bits bit(n) 转换为小端字节数组
+func bits(v interface{}, length int) (interface{}, error) {
+	n, err := toInt64(v)
+	if err != nil {
+		return nil, err
+	}
+	size := (length + 7) / 8
+	if size <= 0 || size > 8 {
+		size = 8
+	}
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, uint64(n.(int64)))
+	return buf[:size], nil
+}
@@ -0,0 +1,75 @@
+package format
+
+import (
+	"fmt"
+
+	"github.com/go-mysql-org/go-mysql/canal"
+	"github.com/go-mysql-org/go-mysql/mysql"
+)
+
+// 消息格式， 面向消息的sinker（MQ， 文件， webhook等）共用
+const (
+	TypeJSON          = "json"
+	TypeDebezium      = "debezium"
+	TypeCanal         = "canal"
+	TypeCanalProtobuf = "canal-protobuf"
+	TypeAvro          = "avro"
+)
+
+// Message 序列化之后的单条消息， 一行变更对应一条消息
+type Message struct {
+	Schema string
+	Table  string
+	Action string
+	// Key 为主键的值， 用于分区、分片， 保证同一主键的顺序
+	Key   []byte
+	Value []byte
+}
+
+// Source 事件在源库中的位置， dump 的数据没有位置
+type Source struct {
+	Position mysql.Position
+	GTID     string
+}
+
+// Encoder 将binlog事件序列化为消息
+type Encoder interface {
+	Encode(e *canal.RowsEvent, src *Source) ([]*Message, error)
+}
+
+// Config 消息格式配置， 不配置则默认为 json
+type Config struct {
+	Type string `json:"type,omitempty"`
+	// WithSchema debezium 格式是否带上 schema， 对应 JsonConverter 的 schemas.enable
+	WithSchema bool `json:"withSchema,omitempty"`
+	// ServerName debezium 格式中的逻辑服务名， 即 source.name 以及 schema 名称的前缀， avro 格式中作为 namespace 的前缀
+	ServerName string `json:"serverName,omitempty"`
+	// Registry avro 格式使用的 schema registry
+	Registry *RegistryConfig `json:"registry,omitempty"`
+}
+
+// NewEncoder 根据配置创建对应的序列化器
+func NewEncoder(cfg *Config) (Encoder, error) {
+	if cfg == nil || len(cfg.Type) == 0 {
+		return &jsonEncoder{}, nil
+	}
+	switch cfg.Type {
+	case TypeJSON:
+		return &jsonEncoder{}, nil
+	case TypeDebezium:
+		return newDebeziumEncoder(cfg), nil
+	case TypeCanal:
+		return &canalFlatEncoder{}, nil
+	case TypeCanalProtobuf:
+		return &canalProtobufEncoder{}, nil
+	case TypeAvro:
+		return newAvroEncoder(cfg)
+	default:
+		return nil, fmt.Errorf("unknown message format: %s", cfg.Type)
+	}
+}
+
+// IsBinary 消息是否为二进制格式， 二进制格式不能拼接为 JSON 数组或者按行写入文本文件
+func (c *Config) IsBinary() bool {
+	return c != nil && (c.Type == TypeCanalProtobuf || c.Type == TypeAvro)
+}
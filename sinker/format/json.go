@@ -0,0 +1,51 @@
+package format
+
+import (
+	"encoding/json"
+
+	"github.com/go-mysql-org/go-mysql/canal"
+)
+
+// jsonEvent datagos 默认的消息格式
+type jsonEvent struct {
+	Schema   string                 `json:"schema"`
+	Table    string                 `json:"table"`
+	Action   string                 `json:"action"`
+	Snapshot bool                   `json:"snapshot,omitempty"`
+	Ts       int64                  `json:"ts"`
+	PKNames  []string               `json:"pkNames,omitempty"`
+	Before   map[string]interface{} `json:"before,omitempty"`
+	After    map[string]interface{} `json:"after,omitempty"`
+}
+
+type jsonEncoder struct{}
+
+func (j *jsonEncoder) Encode(e *canal.RowsEvent, _ *Source) ([]*Message, error) {
+	changes := Changes(e)
+	messages := make([]*Message, 0, len(changes))
+	ts := EventTime(e).UnixMilli()
+	pkNames := PKNames(e.Table)
+	for _, c := range changes {
+		d, err := json.Marshal(&jsonEvent{
+			Schema:   e.Table.Schema,
+			Table:    e.Table.Name,
+			Action:   e.Action,
+			Snapshot: IsSnapshot(e),
+			Ts:       ts,
+			PKNames:  pkNames,
+			Before:   RowMap(e.Table, c.Before),
+			After:    RowMap(e.Table, c.After),
+		})
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, &Message{
+			Schema: e.Table.Schema,
+			Table:  e.Table.Name,
+			Action: e.Action,
+			Key:    []byte(RowKey(e.Table, c.Row())),
+			Value:  d,
+		})
+	}
+	return messages, nil
+}
@@ -0,0 +1,99 @@
+package format
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultRegistryTimeoutMs = 5000
+
+// RegistryConfig Confluent 兼容的 schema registry
+type RegistryConfig struct {
+	URL      string `json:"url"`
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	// Subject 模板， 变量为 schema、table， 默认 ${schema}.${table}-value， 与 kafka sinker 默认的 topic 对应
+	Subject   string `json:"subject,omitempty"`
+	TimeoutMs int    `json:"timeoutMs,omitempty"`
+}
+
+// registryClient 注册 schema， 同一个 subject 下的 schema 变化之后由 registry 生成新的版本
+type registryClient struct {
+	url      string
+	username string
+	password string
+	client   *http.Client
+
+	lock sync.Mutex
+	ids  map[string]int
+}
+
+func newRegistryClient(cfg *RegistryConfig) (*registryClient, error) {
+	if cfg == nil || len(cfg.URL) == 0 {
+		return nil, errors.New("schema registry url not configured")
+	}
+	timeout := cfg.TimeoutMs
+	if timeout <= 0 {
+		timeout = defaultRegistryTimeoutMs
+	}
+	return &registryClient{
+		url:      strings.TrimRight(cfg.URL, "/"),
+		username: cfg.Username,
+		password: cfg.Password,
+		client:   &http.Client{Timeout: time.Duration(timeout) * time.Millisecond},
+		ids:      make(map[string]int, 8),
+	}, nil
+}
+
+// register 注册 schema 并返回 id， schema 已经存在的时候 registry 返回已有的 id
+func (r *registryClient) register(subject, schema string) (int, error) {
+	key := subject + "\n" + schema
+	r.lock.Lock()
+	id, ok := r.ids[key]
+	r.lock.Unlock()
+	if ok {
+		return id, nil
+	}
+	body, err := json.Marshal(map[string]string{"schema": schema})
+	if err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequest(http.MethodPost, r.url+"/subjects/"+url.PathEscape(subject)+"/versions", bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/vnd.schemaregistry.v1+json")
+	if len(r.username) > 0 {
+		req.SetBasicAuth(r.username, r.password)
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	d, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return 0, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("schema registry error, subject: %s, status: %d, body: %s", subject, resp.StatusCode, string(d))
+	}
+	result := struct {
+		Id int `json:"id"`
+	}{}
+	if err := json.Unmarshal(d, &result); err != nil {
+		return 0, err
+	}
+	r.lock.Lock()
+	r.ids[key] = result.Id
+	r.lock.Unlock()
+	return result.Id, nil
+}
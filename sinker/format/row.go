@@ -0,0 +1,195 @@
+package format
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-mysql-org/go-mysql/canal"
+	"github.com/go-mysql-org/go-mysql/mysql"
+	"github.com/go-mysql-org/go-mysql/schema"
+	"github.com/gridsx/datagos/canal/mysql/mapper"
+)
+
+// Change 一行数据的变更， insert 只有 After， delete 只有 Before
+type Change struct {
+	Before []interface{}
+	After  []interface{}
+}
+
+// Row 返回变更后的行， delete 返回变更前的行
+func (c *Change) Row() []interface{} {
+	if c.After != nil {
+		return c.After
+	}
+	return c.Before
+}
+
+// Changes 把事件拆分为逐行的变更， update事件的行是 [before, after] 成对出现的
+func Changes(e *canal.RowsEvent) []*Change {
+	changes := make([]*Change, 0, len(e.Rows))
+	switch e.Action {
+	case canal.UpdateAction:
+		for i := 0; i+1 < len(e.Rows); i += 2 {
+			changes = append(changes, &Change{Before: e.Rows[i], After: e.Rows[i+1]})
+		}
+	case canal.DeleteAction:
+		for _, row := range e.Rows {
+			changes = append(changes, &Change{Before: row})
+		}
+	default:
+		for _, row := range e.Rows {
+			changes = append(changes, &Change{After: row})
+		}
+	}
+	return changes
+}
+
+// IsSnapshot dump 过来的事件没有 header
+func IsSnapshot(e *canal.RowsEvent) bool {
+	return e.Header == nil
+}
+
+// EventTime 事件时间， dump 过来的事件没有时间， 取当前时间
+func EventTime(e *canal.RowsEvent) time.Time {
+	if e.Header == nil || e.Header.Timestamp == 0 {
+		return time.Now()
+	}
+	return time.Unix(int64(e.Header.Timestamp), 0)
+}
+
+// PKNames 主键列名
+func PKNames(t *schema.Table) []string {
+	names := make([]string, 0, len(t.PKColumns))
+	for _, v := range t.PKColumns {
+		names = append(names, t.Columns[v].Name)
+	}
+	return names
+}
+
+// RowKey 主键的值拼成的key， 多个主键以 , 分隔， 没有主键的表以表名为key
+func RowKey(t *schema.Table, row []interface{}) string {
+	if len(t.PKColumns) == 0 {
+		return t.String()
+	}
+	values := make([]string, 0, len(t.PKColumns))
+	for _, v := range t.PKColumns {
+		if v < len(row) {
+			values = append(values, fmt.Sprint(Value(row[v])))
+		}
+	}
+	return strings.Join(values, ",")
+}
+
+// RowMap 行数据转换为 列名 -> 值
+func RowMap(t *schema.Table, row []interface{}) map[string]interface{} {
+	if row == nil {
+		return nil
+	}
+	m := make(map[string]interface{}, len(t.Columns))
+	for i, col := range t.Columns {
+		if i < len(row) {
+			m[col.Name] = Value(row[i])
+		}
+	}
+	return m
+}
+
+// Value binlog中字符串类型的值可能是 []byte， 转成 string 方便序列化
+func Value(v interface{}) interface{} {
+	switch val := v.(type) {
+	case []byte:
+		return string(val)
+	default:
+		return v
+	}
+}
+
+// MappedRowMap 按列映射转换行数据， 只保留映射了的列， 没有配置映射则保留所有列
+func MappedRowMap(m *mapper.TableMapping, t *schema.Table, row []interface{}) map[string]interface{} {
+	if row == nil || m == nil || len(m.ColMappings) == 0 {
+		return RowMap(t, row)
+	}
+	doc := make(map[string]interface{}, len(m.ColMappings))
+	for _, cm := range m.ColMappings {
+		if idx := t.FindColumn(cm.Src); idx >= 0 && idx < len(row) {
+			doc[m.DstName(cm.Src)] = Value(row[idx])
+		}
+	}
+	return doc
+}
+
+// EnumName binlog 中 enum 是从1开始的序号， dump 的时候是字符串
+func EnumName(col *schema.TableColumn, v interface{}) interface{} {
+	if idx, ok := v.(int64); ok {
+		if idx > 0 && int(idx) <= len(col.EnumValues) {
+			return col.EnumValues[idx-1]
+		}
+		return ""
+	}
+	return Value(v)
+}
+
+// SetNames binlog 中 set 是位图， dump 的时候是以 , 分隔的字符串
+func SetNames(col *schema.TableColumn, v interface{}) []string {
+	values := make([]string, 0, len(col.SetValues))
+	if bits, ok := v.(int64); ok {
+		for i, name := range col.SetValues {
+			if bits&(1<<uint(i)) != 0 {
+				values = append(values, name)
+			}
+		}
+		return values
+	}
+	if s := fmt.Sprint(Value(v)); len(s) > 0 {
+		values = strings.Split(s, ",")
+	}
+	return values
+}
+
+// EventVersion 按事件在源库中的位置生成版本号， 同一个源内按事件的先后递增
+// MySQL 为 binlog 文件序号<<32 | 文件内的位置， PostgreSQL 为 LSN，
+// 其他源（MongoDB 的 cluster time 等）为 header 中的时间<<32 | 位置
+// dump 的数据版本为0， 不会覆盖增量数据
+func EventVersion(e *canal.RowsEvent, pos mysql.Position) int64 {
+	if e.Header == nil {
+		return 0
+	}
+	if seq, ok := binlogSeq(pos.Name); ok {
+		return seq<<32 | int64(pos.Pos)
+	}
+	var hi, lo uint32
+	if n, _ := fmt.Sscanf(pos.Name, "%X/%X", &hi, &lo); n == 2 {
+		return int64(hi)<<32 | int64(lo)
+	}
+	return int64(e.Header.Timestamp)<<32 | int64(e.Header.LogPos)
+}
+
+// binlogSeq binlog 文件名中的序号， 如 mysql-bin.000123， MongoDB 的位置（时间.序号）不是文件名
+func binlogSeq(name string) (int64, bool) {
+	i := strings.LastIndexByte(name, '.')
+	if i <= 0 || strings.Trim(name[:i], "0123456789") == "" {
+		return 0, false
+	}
+	seq, err := strconv.ParseInt(name[i+1:], 10, 64)
+	return seq, err == nil
+}
+
+// IsBinary 二进制的列， 序列化为文本的时候需要编码
+func IsBinary(col *schema.TableColumn) bool {
+	return col.Type == schema.TYPE_BINARY ||
+		(col.Type == schema.TYPE_STRING && (strings.Contains(col.RawType, "blob") || strings.Contains(col.RawType, "binary")))
+}
+
+// Bytes 二进制列的值， binlog 中 binary、varbinary 是字符串， blob 是 []byte
+func Bytes(v interface{}) []byte {
+	switch val := v.(type) {
+	case []byte:
+		return val
+	case string:
+		return []byte(val)
+	default:
+		return []byte(fmt.Sprint(val))
+	}
+}
@@ -0,0 +1,322 @@
+package kafka
+
+// 同一主键的消息以主键为 key， 使用hash分区， 同一主键的数据总是落在同一个分区， 保证顺序
+// 消息异步批量发送， 保存位点之前 Flush 等待 broker 确认， 确认之后位点才会前进
+// 确认失败的消息保留下来， 之后的消息排在它们后面暂不发送， Flush 时按顺序重新发送， 全部确认之前 Flush 一直返回错误
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/go-mysql-org/go-mysql/canal"
+	"github.com/go-mysql-org/go-mysql/mysql"
+	"github.com/gridsx/datagos/canal/mysql/filter"
+	"github.com/gridsx/datagos/common"
+	"github.com/gridsx/datagos/sinker/format"
+	"github.com/siddontang/go-log/log"
+)
+
+const defaultTopic = "${schema}.${table}"
+
+// KafkaSinkerConfig 对应 task_dests 的 config 字段
+type KafkaSinkerConfig struct {
+	Brokers []string `json:"brokers"`
+	// Kafka 版本， 如 2.8.0， 幂等生产需要 0.11 以上
+	Version string `json:"version,omitempty"`
+	// Topic 支持模板， 如 ${schema}.${table}， 不配置默认为 ${schema}.${table}
+	Topic  string         `json:"topic,omitempty"`
+	Format *format.Config `json:"format,omitempty"`
+
+	// Acks all/-1: 所有副本确认, 1: leader确认, 0: 不确认
+	Acks        string `json:"acks,omitempty"`
+	Idempotent  bool   `json:"idempotent,omitempty"`
+	Compression string `json:"compression,omitempty"`
+	// 批量相关： 消息条数， 字节数， 等待时长， 满足任意一个就发送
+	BatchSize  int `json:"batchSize,omitempty"`
+	BatchBytes int `json:"batchBytes,omitempty"`
+	LingerMs   int `json:"lingerMs,omitempty"`
+	MaxRetries int `json:"maxRetries,omitempty"`
+
+	Filter        *filter.TableFilter `json:"filter,omitempty"`
+	ErrorContinue bool                `json:"errorContinue"`
+}
+
+type KafkaSinker struct {
+	disabled      bool
+	ErrorContinue bool
+	Filter        *filter.TableFilter
+	Topic         string
+
+	producer sarama.AsyncProducer
+	encoder  format.Encoder
+	source   format.Source
+
+	// 未被确认的消息数量， 以及确认失败的第一个错误， 重新发送成功之前一直保留
+	lock    sync.Mutex
+	cond    *sync.Cond
+	pending int
+	err     error
+	// seq 消息的发送顺序， 记录在 Metadata 中， 重新发送时按它排序
+	seq uint64
+	// unsent 确认失败以及排在它们后面还没有发送的消息
+	unsent    []*sarama.ProducerMessage
+	resending bool
+}
+
+func (s *KafkaSinker) Enable() bool {
+	return !s.disabled
+}
+
+func (s *KafkaSinker) Disable() {
+	s.disabled = true
+}
+
+func (s *KafkaSinker) ContinueOnError() bool {
+	return s.ErrorContinue
+}
+
+// SetPosition 与 OnEvent 在同一个协程中调用
+func (s *KafkaSinker) SetPosition(pos mysql.Position, gtid string) {
+	s.source = format.Source{Position: pos, GTID: gtid}
+}
+
+func (s *KafkaSinker) OnEvent(e *canal.RowsEvent) error {
+	if e == nil || e.Table == nil {
+		return nil
+	}
+	if s.Filter != nil && s.Filter.Match(e) {
+		return nil
+	}
+	messages, err := s.encoder.Encode(e, &s.source)
+	if err != nil {
+		return err
+	}
+	topic := common.RenderTemplate(s.Topic, map[string]string{
+		"schema": e.Table.Schema,
+		"table":  e.Table.Name,
+		"action": e.Action,
+	})
+	batch := make([]*sarama.ProducerMessage, len(messages))
+	s.lock.Lock()
+	for i, m := range messages {
+		s.seq++
+		batch[i] = &sarama.ProducerMessage{
+			Topic: topic,
+			Key:   sarama.ByteEncoder(m.Key),
+			Value: sarama.ByteEncoder(m.Value),
+			Headers: []sarama.RecordHeader{
+				{Key: []byte("action"), Value: []byte(m.Action)},
+			},
+			Metadata: s.seq,
+		}
+	}
+	// 有失败的消息时排在后面， 保证同一主键的顺序
+	if len(s.unsent) > 0 || s.resending {
+		s.unsent = append(s.unsent, batch...)
+		s.lock.Unlock()
+		return nil
+	}
+	s.pending += len(batch)
+	s.lock.Unlock()
+	s.send(batch)
+	return nil
+}
+
+func (s *KafkaSinker) send(batch []*sarama.ProducerMessage) {
+	for _, m := range batch {
+		s.producer.Input() <- m
+	}
+}
+
+// Flush 等待已经发出的消息全部被 broker 确认， 有失败的消息则按顺序重新发送， 再次失败时返回错误
+func (s *KafkaSinker) Flush() error {
+	s.wait()
+	for round := 0; ; round++ {
+		s.lock.Lock()
+		if len(s.unsent) == 0 {
+			s.err, s.resending = nil, false
+			s.lock.Unlock()
+			return nil
+		}
+		if round > 0 && s.err != nil {
+			err := s.err
+			s.resending = false
+			s.lock.Unlock()
+			return err
+		}
+		batch := s.unsent
+		s.unsent, s.err, s.resending = nil, nil, true
+		s.pending += len(batch)
+		s.lock.Unlock()
+
+		sort.Slice(batch, func(i, j int) bool {
+			return batch[i].Metadata.(uint64) < batch[j].Metadata.(uint64)
+		})
+		for i, m := range batch {
+			batch[i] = &sarama.ProducerMessage{Topic: m.Topic, Key: m.Key, Value: m.Value, Headers: m.Headers, Metadata: m.Metadata}
+		}
+		log.Warnf("kafka sinker resending %d messages\n", len(batch))
+		s.send(batch)
+		s.wait()
+	}
+}
+
+func (s *KafkaSinker) wait() {
+	s.lock.Lock()
+	for s.pending > 0 {
+		s.cond.Wait()
+	}
+	s.lock.Unlock()
+}
+
+func (s *KafkaSinker) Close() error {
+	flushErr := s.Flush()
+	if err := s.producer.Close(); err != nil {
+		return err
+	}
+	return flushErr
+}
+
+func (s *KafkaSinker) ack(msg *sarama.ProducerMessage, err error) {
+	s.lock.Lock()
+	s.pending--
+	if err != nil {
+		s.unsent = append(s.unsent, msg)
+		if s.err == nil {
+			s.err = err
+		}
+	}
+	if s.pending <= 0 {
+		s.pending = 0
+		s.cond.Broadcast()
+	}
+	s.lock.Unlock()
+}
+
+// 处理 broker 的确认结果
+func (s *KafkaSinker) watch() {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for m := range s.producer.Successes() {
+			s.ack(m, nil)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for e := range s.producer.Errors() {
+			log.Errorf("kafka sinker send error, topic: %s, err: %s\n", e.Msg.Topic, e.Err.Error())
+			s.ack(e.Msg, e.Err)
+		}
+	}()
+	wg.Wait()
+}
+
+func toSaramaConfig(cfg *KafkaSinkerConfig) (*sarama.Config, error) {
+	sc := sarama.NewConfig()
+	sc.ClientID = "datagos"
+	if len(cfg.Version) > 0 {
+		v, err := sarama.ParseKafkaVersion(cfg.Version)
+		if err != nil {
+			return nil, err
+		}
+		sc.Version = v
+	}
+	sc.Producer.Return.Successes = true
+	sc.Producer.Return.Errors = true
+	sc.Producer.Partitioner = sarama.NewHashPartitioner
+
+	switch strings.ToLower(cfg.Acks) {
+	case "", "all", "-1":
+		sc.Producer.RequiredAcks = sarama.WaitForAll
+	case "1":
+		sc.Producer.RequiredAcks = sarama.WaitForLocal
+	case "0":
+		sc.Producer.RequiredAcks = sarama.NoResponse
+	default:
+		return nil, errors.New("unknown acks: " + cfg.Acks)
+	}
+
+	switch strings.ToLower(cfg.Compression) {
+	case "", "none":
+		sc.Producer.Compression = sarama.CompressionNone
+	case "gzip":
+		sc.Producer.Compression = sarama.CompressionGZIP
+	case "snappy":
+		sc.Producer.Compression = sarama.CompressionSnappy
+	case "lz4":
+		sc.Producer.Compression = sarama.CompressionLZ4
+	case "zstd":
+		sc.Producer.Compression = sarama.CompressionZSTD
+	default:
+		return nil, errors.New("unknown compression: " + cfg.Compression)
+	}
+
+	if cfg.BatchSize > 0 {
+		sc.Producer.Flush.Messages = cfg.BatchSize
+	}
+	if cfg.BatchBytes > 0 {
+		sc.Producer.Flush.Bytes = cfg.BatchBytes
+	}
+	if cfg.LingerMs > 0 {
+		sc.Producer.Flush.Frequency = time.Duration(cfg.LingerMs) * time.Millisecond
+	}
+	if cfg.MaxRetries > 0 {
+		sc.Producer.Retry.Max = cfg.MaxRetries
+	}
+
+	// 幂等生产要求 acks=all， 且同一连接只能有一个在途请求， 这样重试也不会乱序
+	if cfg.Idempotent {
+		if sc.Producer.RequiredAcks != sarama.WaitForAll {
+			return nil, errors.New("idempotent producer requires acks=all")
+		}
+		if !sc.Version.IsAtLeast(sarama.V0_11_0_0) {
+			sc.Version = sarama.V0_11_0_0
+		}
+		sc.Producer.Idempotent = true
+		sc.Net.MaxOpenRequests = 1
+	}
+	return sc, sc.Validate()
+}
+
+func Build(c string) (*KafkaSinker, error) {
+	cfg := new(KafkaSinkerConfig)
+	if err := json.Unmarshal([]byte(c), cfg); err != nil {
+		return nil, err
+	}
+	if len(cfg.Brokers) == 0 {
+		return nil, errors.New("kafka sinker: brokers not configured")
+	}
+	encoder, err := format.NewEncoder(cfg.Format)
+	if err != nil {
+		return nil, err
+	}
+	sc, err := toSaramaConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	producer, err := sarama.NewAsyncProducer(cfg.Brokers, sc)
+	if err != nil {
+		return nil, err
+	}
+	topic := cfg.Topic
+	if len(topic) == 0 {
+		topic = defaultTopic
+	}
+	s := &KafkaSinker{
+		ErrorContinue: cfg.ErrorContinue,
+		Filter:        cfg.Filter,
+		Topic:         topic,
+		producer:      producer,
+		encoder:       encoder,
+	}
+	s.cond = sync.NewCond(&s.lock)
+	go s.watch()
+	return s, nil
+}
@@ -0,0 +1,95 @@
+package kafka
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/go-mysql-org/go-mysql/canal"
+	"github.com/go-mysql-org/go-mysql/schema"
+)
+
+const testTopic = "db.users"
+
+func newTestBroker(t *testing.T, kerr sarama.KError) *sarama.MockBroker {
+	broker := sarama.NewMockBroker(t, 1)
+	setProduceError(t, broker, kerr)
+	return broker
+}
+
+func setProduceError(t *testing.T, broker *sarama.MockBroker, kerr sarama.KError) {
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()).
+			SetLeader(testTopic, 0, broker.BrokerID()),
+		"ProduceRequest": sarama.NewMockProduceResponse(t).SetVersion(3).SetError(testTopic, 0, kerr),
+	})
+}
+
+func newTestSinker(t *testing.T, broker *sarama.MockBroker) *KafkaSinker {
+	cfg, _ := json.Marshal(&KafkaSinkerConfig{Brokers: []string{broker.Addr()}, MaxRetries: 1})
+	s, err := Build(string(cfg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func testEvent(id int64) *canal.RowsEvent {
+	table := &schema.Table{Schema: "db", Name: "users", PKColumns: []int{0}}
+	table.AddColumn("id", "bigint", "", "")
+	table.AddColumn("name", "varchar(32)", "", "")
+	return &canal.RowsEvent{Table: table, Action: canal.InsertAction, Rows: [][]interface{}{{id, "n"}}}
+}
+
+func TestFlushWaitsForAcks(t *testing.T) {
+	broker := newTestBroker(t, sarama.ErrNoError)
+	defer broker.Close()
+	s := newTestSinker(t, broker)
+	defer s.Close()
+
+	for i := int64(1); i <= 10; i++ {
+		if err := s.OnEvent(testEvent(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Flush(); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+	if s.pending != 0 {
+		t.Fatalf("pending after flush: %d", s.pending)
+	}
+}
+
+// 确认失败时 OnEvent 不返回别的消息的错误， Flush 一直返回错误直到重新发送成功
+func TestFailedAcksHoldCheckpoint(t *testing.T) {
+	broker := newTestBroker(t, sarama.ErrMessageSizeTooLarge)
+	defer broker.Close()
+	s := newTestSinker(t, broker)
+	defer s.Close()
+
+	if err := s.OnEvent(testEvent(1)); err != nil {
+		t.Fatal(err)
+	}
+	s.wait()
+	if err := s.OnEvent(testEvent(2)); err != nil {
+		t.Fatalf("ack error of an earlier message reported by OnEvent: %v", err)
+	}
+	if len(s.unsent) != 2 {
+		t.Fatalf("failed and queued messages not kept, unsent: %d", len(s.unsent))
+	}
+	if err := s.Flush(); err == nil {
+		t.Fatal("flush succeeded with unacknowledged messages")
+	}
+	if err := s.Flush(); err == nil {
+		t.Fatal("flush error not sticky")
+	}
+
+	setProduceError(t, broker, sarama.ErrNoError)
+	if err := s.Flush(); err != nil {
+		t.Fatalf("flush after broker recovered: %v", err)
+	}
+	if len(s.unsent) != 0 {
+		t.Fatalf("messages left after resend: %d", len(s.unsent))
+	}
+}
@@ -0,0 +1,143 @@
+package mongo
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/antonmedv/expr"
+	"github.com/antonmedv/expr/vm"
+)
+
+// 列映射表达式中可以使用的类型转换函数， 如 toDate(current)
+var converters = map[string]interface{}{
+	"toInt":     toInt,
+	"toFloat":   toFloat,
+	"toString":  toString,
+	"toBool":    toBool,
+	"toDate":    toDate,
+	"parseJSON": parseJSON,
+}
+
+func toString(v interface{}) string {
+	switch val := v.(type) {
+	case nil:
+		return ""
+	case []byte:
+		return string(val)
+	case string:
+		return val
+	default:
+		return fmt.Sprint(val)
+	}
+}
+
+func toInt(v interface{}) int64 {
+	switch val := v.(type) {
+	case int8:
+		return int64(val)
+	case int16:
+		return int64(val)
+	case int32:
+		return int64(val)
+	case int64:
+		return val
+	case int:
+		return int64(val)
+	case uint8:
+		return int64(val)
+	case uint16:
+		return int64(val)
+	case uint32:
+		return int64(val)
+	case uint64:
+		return int64(val)
+	case float32:
+		return int64(val)
+	case float64:
+		return int64(val)
+	case bool:
+		if val {
+			return 1
+		}
+		return 0
+	default:
+		i, _ := strconv.ParseInt(toString(v), 10, 64)
+		return i
+	}
+}
+
+func toFloat(v interface{}) float64 {
+	switch val := v.(type) {
+	case float32:
+		return float64(val)
+	case float64:
+		return val
+	default:
+		f, err := strconv.ParseFloat(toString(v), 64)
+		if err != nil {
+			return float64(toInt(v))
+		}
+		return f
+	}
+}
+
+func toBool(v interface{}) bool {
+	switch val := v.(type) {
+	case bool:
+		return val
+	case string, []byte:
+		b, _ := strconv.ParseBool(toString(val))
+		return b
+	default:
+		return toInt(v) != 0
+	}
+}
+
+// toDate MySQL 的日期类型在 binlog 中是字符串， 转换为 mongo 的日期类型
+func toDate(v interface{}) interface{} {
+	s := toString(v)
+	for _, layout := range []string{"2006-01-02 15:04:05.999999", "2006-01-02 15:04:05", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t
+		}
+	}
+	return nil
+}
+
+// parseJSON json 列转换为内嵌文档
+func parseJSON(v interface{}) interface{} {
+	var out interface{}
+	if err := json.Unmarshal([]byte(toString(v)), &out); err != nil {
+		return toString(v)
+	}
+	return out
+}
+
+// program 编译后的表达式缓存
+type program struct {
+	source string
+	prog   *vm.Program
+}
+
+// compile 表达式只编译一次， 行与行之间值的类型可能不同， 因此不指定 env 的类型
+func compile(source string) (*program, error) {
+	prog, err := expr.Compile(source)
+	if err != nil {
+		return nil, err
+	}
+	return &program{source: source, prog: prog}, nil
+}
+
+func (p *program) run(env map[string]interface{}) (interface{}, error) {
+	return expr.Run(p.prog, env)
+}
+
+func newEnv(size int) map[string]interface{} {
+	env := make(map[string]interface{}, size+len(converters))
+	for k, v := range converters {
+		env[k] = v
+	}
+	return env
+}
@@ -0,0 +1,404 @@
+package mongo
+
+// 行数据按主键（或者 _id 表达式）写入为文档， 父文档使用 $set 更新， 不会覆盖内嵌的子表数组
+// 子表的行作为数组元素内嵌到父文档， 先 $pull 旧的元素， 再 $push 新的元素
+// insert 也先按键 $pull， 重放的事件不会在数组中留下重复的元素
+// 写操作缓存之后按集合以有序的 bulkWrite 批量执行， 同一主键的操作顺序不变
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/go-mysql-org/go-mysql/canal"
+	"github.com/go-mysql-org/go-mysql/schema"
+	"github.com/gridsx/datagos/canal/mysql/filter"
+	"github.com/gridsx/datagos/canal/mysql/mapper"
+	"github.com/gridsx/datagos/common"
+	"github.com/gridsx/datagos/sinker/format"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const defaultBatchSize = 500
+
+// CollectionConfig 源表到集合的映射， DstTable 为集合名
+// ColMappings 用于重命名字段， Expr 用于类型转换， 如 toDate(current)
+type CollectionConfig struct {
+	mapper.TableMapping
+	// IdExpr _id 的表达式， 变量为源表的列， 如 "order-" + toString(id)， 默认为主键
+	IdExpr string `json:"idExpr,omitempty"`
+}
+
+// EmbedConfig 子表的行内嵌到父文档的数组字段中， DstTable 为父文档所在的集合
+type EmbedConfig struct {
+	mapper.TableMapping
+	// ParentColumn 子表中对应父文档 _id 的列
+	ParentColumn string `json:"parentColumn"`
+	// Field 父文档中的数组字段
+	Field string `json:"field"`
+	// KeyColumn 子文档在数组中的唯一键， 默认为子表第一个主键
+	KeyColumn string `json:"keyColumn,omitempty"`
+}
+
+// MongoSinkerConfig 对应 task_dests 的 config 字段
+type MongoSinkerConfig struct {
+	URI         string             `json:"uri"`
+	Database    string             `json:"database"`
+	BatchSize   int                `json:"batchSize,omitempty"`
+	Collections []CollectionConfig `json:"collections"`
+	Embeds      []EmbedConfig      `json:"embeds,omitempty"`
+
+	Filter        *filter.TableFilter `json:"filter,omitempty"`
+	ErrorContinue bool                `json:"errorContinue"`
+}
+
+type MongoSinker struct {
+	disabled      bool
+	ErrorContinue bool
+	Filter        *filter.TableFilter
+	Collections   []CollectionConfig
+	Embeds        []EmbedConfig
+
+	client    *mongo.Client
+	db        *mongo.Database
+	batchSize int
+	programs  map[string]*program
+
+	lock   sync.Mutex
+	order  []string
+	models map[string][]mongo.WriteModel
+	queued int
+}
+
+func (s *MongoSinker) Enable() bool {
+	return !s.disabled
+}
+
+func (s *MongoSinker) Disable() {
+	s.disabled = true
+}
+
+func (s *MongoSinker) ContinueOnError() bool {
+	return s.ErrorContinue
+}
+
+func (s *MongoSinker) OnEvent(e *canal.RowsEvent) error {
+	if e == nil || e.Table == nil {
+		return nil
+	}
+	if s.Filter != nil && s.Filter.Match(e) {
+		return nil
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for i := range s.Collections {
+		c := &s.Collections[i]
+		if !c.Match(e.Table.Schema, e.Table.Name) {
+			continue
+		}
+		for _, change := range format.Changes(e) {
+			if err := s.collectionModels(c, e.Table, change); err != nil {
+				return err
+			}
+		}
+	}
+	for i := range s.Embeds {
+		c := &s.Embeds[i]
+		if !c.Match(e.Table.Schema, e.Table.Name) {
+			continue
+		}
+		for _, change := range format.Changes(e) {
+			if err := s.embedModels(c, e.Table, change); err != nil {
+				return err
+			}
+		}
+	}
+	if s.queued >= s.batchSize {
+		// 当前事件的写操作已经缓存， 写入失败的保留到下次
+		if err := s.flush(); err != nil {
+			return &common.BufferedError{Err: err}
+		}
+	}
+	return nil
+}
+
+// Flush 保存位点之前执行缓存的写操作
+func (s *MongoSinker) Flush() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.flush()
+}
+
+func (s *MongoSinker) flush() error {
+	ordered := options.BulkWrite().SetOrdered(true)
+	for len(s.order) > 0 {
+		coll := s.order[0]
+		models := s.models[coll]
+		if len(models) > 0 {
+			if _, err := s.db.Collection(coll).BulkWrite(context.Background(), models, ordered); err != nil {
+				// 有序写入在第一个失败处停止， 之前的已经写入， 只保留失败及之后的， 避免 $push 重复执行
+				var bwe mongo.BulkWriteException
+				if errors.As(err, &bwe) && len(bwe.WriteErrors) > 0 {
+					applied := bwe.WriteErrors[0].Index
+					s.models[coll] = models[applied:]
+					s.queued -= applied
+				}
+				return fmt.Errorf("mongo sinker bulk write %s error: %w", coll, err)
+			}
+		}
+		s.queued -= len(models)
+		delete(s.models, coll)
+		s.order = s.order[1:]
+	}
+	s.queued = 0
+	return nil
+}
+
+func (s *MongoSinker) Close() error {
+	flushErr := s.Flush()
+	if err := s.client.Disconnect(context.Background()); err != nil {
+		return err
+	}
+	return flushErr
+}
+
+func (s *MongoSinker) add(coll string, models ...mongo.WriteModel) {
+	if _, ok := s.models[coll]; !ok {
+		s.order = append(s.order, coll)
+	}
+	s.models[coll] = append(s.models[coll], models...)
+	s.queued += len(models)
+}
+
+func (s *MongoSinker) collectionModels(c *CollectionConfig, t *schema.Table, change *format.Change) error {
+	coll := c.DstTable
+	if len(coll) == 0 {
+		coll = c.SrcTable
+	}
+	var oldId, newId interface{}
+	var err error
+	if change.Before != nil {
+		if oldId, err = s.docId(c, t, change.Before); err != nil {
+			return err
+		}
+	}
+	if change.After != nil {
+		if newId, err = s.docId(c, t, change.After); err != nil {
+			return err
+		}
+	}
+	// 删除或者 _id 变化， 删除旧的文档
+	if change.Before != nil && (change.After == nil || !sameId(oldId, newId)) {
+		s.add(coll, mongo.NewDeleteOneModel().SetFilter(bson.D{{Key: "_id", Value: oldId}}))
+	}
+	if change.After == nil {
+		return nil
+	}
+	doc, err := s.doc(&c.TableMapping, t, change.After)
+	if err != nil {
+		return err
+	}
+	s.add(coll, mongo.NewUpdateOneModel().
+		SetFilter(bson.D{{Key: "_id", Value: newId}}).
+		SetUpdate(bson.D{{Key: "$set", Value: doc}}).
+		SetUpsert(true))
+	return nil
+}
+
+func (s *MongoSinker) embedModels(c *EmbedConfig, t *schema.Table, change *format.Change) error {
+	coll := c.DstTable
+	keyField := c.keyField(t)
+	pull := func(parent, key interface{}) {
+		s.add(coll, mongo.NewUpdateOneModel().
+			SetFilter(bson.D{{Key: "_id", Value: parent}}).
+			SetUpdate(bson.D{{Key: "$pull", Value: bson.D{{Key: c.Field, Value: bson.D{{Key: keyField, Value: key}}}}}}))
+	}
+	var oldParent, oldKey interface{}
+	if change.Before != nil {
+		oldParent, oldKey = c.parent(t, change.Before), c.key(t, change.Before)
+		if oldParent != nil {
+			pull(oldParent, oldKey)
+		}
+	}
+	if change.After == nil {
+		return nil
+	}
+	parent, key := c.parent(t, change.After), c.key(t, change.After)
+	if parent == nil {
+		return nil
+	}
+	if key == nil {
+		return fmt.Errorf("mongo sinker: key column of embed %s not found in %s", c.Field, t.String())
+	}
+	// 按新的键 $pull， 重放的 insert 不会重复 $push
+	if !sameId(oldParent, parent) || !sameId(oldKey, key) {
+		pull(parent, key)
+	}
+	doc, err := s.doc(&c.TableMapping, t, change.After)
+	if err != nil {
+		return err
+	}
+	s.add(coll, mongo.NewUpdateOneModel().
+		SetFilter(bson.D{{Key: "_id", Value: parent}}).
+		SetUpdate(bson.D{{Key: "$push", Value: bson.D{{Key: c.Field, Value: doc}}}}).
+		SetUpsert(true))
+	return nil
+}
+
+// doc 按列映射生成文档， 配置了表达式的列先经过表达式转换
+func (s *MongoSinker) doc(m *mapper.TableMapping, t *schema.Table, row []interface{}) (bson.M, error) {
+	if len(m.ColMappings) == 0 {
+		return format.RowMap(t, row), nil
+	}
+	doc := make(bson.M, len(m.ColMappings))
+	for _, cm := range m.ColMappings {
+		idx := t.FindColumn(cm.Src)
+		if idx < 0 || idx >= len(row) {
+			continue
+		}
+		value := format.Value(row[idx])
+		if len(cm.Expr) > 0 {
+			p, err := s.program(cm.Expr)
+			if err != nil {
+				return nil, err
+			}
+			env := newEnv(1)
+			env["current"] = value
+			if value, err = p.run(env); err != nil {
+				return nil, fmt.Errorf("error running expr %s: %w", cm.Expr, err)
+			}
+		}
+		doc[m.DstName(cm.Src)] = value
+	}
+	return doc, nil
+}
+
+// docId 默认单主键直接使用主键的值， 联合主键使用由主键组成的内嵌文档
+func (s *MongoSinker) docId(c *CollectionConfig, t *schema.Table, row []interface{}) (interface{}, error) {
+	if len(c.IdExpr) > 0 {
+		p, err := s.program(c.IdExpr)
+		if err != nil {
+			return nil, err
+		}
+		env := newEnv(len(t.Columns))
+		for k, v := range format.RowMap(t, row) {
+			env[k] = v
+		}
+		return p.run(env)
+	}
+	switch len(t.PKColumns) {
+	case 0:
+		return nil, fmt.Errorf("table %s has no primary key, idExpr required", t.String())
+	case 1:
+		return format.Value(row[t.PKColumns[0]]), nil
+	default:
+		id := bson.D{}
+		for _, idx := range t.PKColumns {
+			id = append(id, bson.E{Key: c.DstName(t.Columns[idx].Name), Value: format.Value(row[idx])})
+		}
+		return id, nil
+	}
+}
+
+func (s *MongoSinker) program(source string) (*program, error) {
+	if p, ok := s.programs[source]; ok {
+		return p, nil
+	}
+	p, err := compile(source)
+	if err != nil {
+		return nil, fmt.Errorf("error compiling expr %s: %w", source, err)
+	}
+	s.programs[source] = p
+	return p, nil
+}
+
+func sameId(a, b interface{}) bool {
+	return fmt.Sprint(a) == fmt.Sprint(b)
+}
+
+func (c *EmbedConfig) parent(t *schema.Table, row []interface{}) interface{} {
+	idx := t.FindColumn(c.ParentColumn)
+	if idx < 0 || idx >= len(row) {
+		return nil
+	}
+	return format.Value(row[idx])
+}
+
+func (c *EmbedConfig) key(t *schema.Table, row []interface{}) interface{} {
+	col := c.KeyColumn
+	if len(col) == 0 && len(t.PKColumns) > 0 {
+		col = t.Columns[t.PKColumns[0]].Name
+	}
+	idx := t.FindColumn(col)
+	if idx < 0 || idx >= len(row) {
+		return nil
+	}
+	return format.Value(row[idx])
+}
+
+// maps 列是否在列映射中
+func (c *EmbedConfig) maps(col string) bool {
+	if len(col) == 0 {
+		return false
+	}
+	for _, cm := range c.ColMappings {
+		if cm.Src == col {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *EmbedConfig) keyField(t *schema.Table) string {
+	col := c.KeyColumn
+	if len(col) == 0 && len(t.PKColumns) > 0 {
+		col = t.Columns[t.PKColumns[0]].Name
+	}
+	return c.DstName(col)
+}
+
+func Build(c string) (*MongoSinker, error) {
+	cfg := new(MongoSinkerConfig)
+	if err := json.Unmarshal([]byte(c), cfg); err != nil {
+		return nil, err
+	}
+	if len(cfg.URI) == 0 || len(cfg.Database) == 0 {
+		return nil, errors.New("mongo sinker: uri or database not configured")
+	}
+	for _, e := range cfg.Embeds {
+		if len(e.DstTable) == 0 || len(e.ParentColumn) == 0 || len(e.Field) == 0 {
+			return nil, fmt.Errorf("mongo sinker: embed of %s not configured correctly", e.SrcTable)
+		}
+		// 子文档中没有键时 $pull 匹配不到旧的元素
+		if len(e.ColMappings) > 0 && !e.maps(e.KeyColumn) {
+			return nil, fmt.Errorf("mongo sinker: embed of %s must set keyColumn and include it in colMappings", e.SrcTable)
+		}
+	}
+	client, err := mongo.Connect(context.Background(), options.Client().ApplyURI(cfg.URI))
+	if err != nil {
+		return nil, err
+	}
+	if err := client.Ping(context.Background(), nil); err != nil {
+		_ = client.Disconnect(context.Background())
+		return nil, err
+	}
+	s := &MongoSinker{
+		ErrorContinue: cfg.ErrorContinue,
+		Filter:        cfg.Filter,
+		Collections:   cfg.Collections,
+		Embeds:        cfg.Embeds,
+		client:        client,
+		db:            client.Database(cfg.Database),
+		batchSize:     cfg.BatchSize,
+		programs:      make(map[string]*program, 8),
+		models:        make(map[string][]mongo.WriteModel, 8),
+	}
+	if s.batchSize <= 0 {
+		s.batchSize = defaultBatchSize
+	}
+	return s, nil
+}
@@ -18,25 +18,41 @@ var (
 
 type MySQLBinlogHandler struct {
 	canal.DummyEventHandler
-	Sinkers []common.Sinker
-	C       *canal.Canal
+	Pipeline *common.Pipeline
+	C        *canal.Canal
+	// gtid 当前事务的 GTID
+	gtid string
 }
 
 // OnRow 对于 DUMP, 此处的区别是 Header是否为空, 可以判断如果header为空用 insert ignore into, 否则用replace into
 func (h *MySQLBinlogHandler) OnRow(e *canal.RowsEvent) error {
-	for _, sinker := range h.Sinkers {
-		if !sinker.Enable() {
-			continue
-		}
-		err := sinker.OnEvent(e)
-		if err != nil && !sinker.ContinueOnError() {
-			log.Errorf("On Row, sinker error: " + err.Error())
-			sinker.Disable()
-		}
+	pos, gtid := h.eventPosition(e)
+	h.Pipeline.OnRow(e, pos, gtid)
+	return nil
+}
+
+// OnGTID 事务开始之前收到 GTID 事件
+func (h *MySQLBinlogHandler) OnGTID(gtid mysql.GTIDSet) error {
+	if gtid != nil {
+		h.gtid = gtid.String()
 	}
 	return nil
 }
 
+// OnXID 源库事务提交， 通知需要感知事务边界的sinker
+func (h *MySQLBinlogHandler) OnXID(nextPos mysql.Position) error {
+	h.Pipeline.OnCommit()
+	return nil
+}
+
+// eventPosition 事件所在的binlog位点以及事务的 GTID， 文件名取自已同步的位点， 滚动的时候会随 rotate 事件更新
+func (h *MySQLBinlogHandler) eventPosition(e *canal.RowsEvent) (mysql.Position, string) {
+	if e.Header == nil || h.C == nil {
+		return mysql.Position{}, ""
+	}
+	return mysql.Position{Name: h.C.SyncedPosition().Name, Pos: e.Header.LogPos}, h.gtid
+}
+
 func (h *MySQLBinlogHandler) savePos() {
 	atomic.AddUint64(&eventCount, 1)
 	if atomic.LoadUint64(&eventCount)%10000 == 0 || time.Now().Unix()-atomic.LoadInt64(&lastNanos) > 5 {
@@ -57,20 +57,39 @@ func (s *MySQLSinker) OnEvent(e *canal.RowsEvent) error {
 	if s.filtered(e) {
 		return nil
 	}
-	// 写入MySQL
+	// 写入MySQL， 返回第一个出错的 consumer 的错误， 交给 pipeline 处理
+	var firstErr error
 	wg := sync.WaitGroup{}
 	for _, v := range s.Consumers {
-		go func() {
-			wg.Add(1)
+		wg.Add(1)
+		go func(v *MySQLConsumer) {
 			err := v.Accept(e)
 			if err != nil {
 				log.Errorf("event execute error: %s\n", err.Error())
+				if firstErr == nil {
+					firstErr = err
+				}
 			}
 			wg.Done()
-		}()
+		}(v)
 		wg.Wait()
 	}
-	return nil
+	return firstErr
+}
+
+// Statements 事件在各个 consumer 上会执行的 SQL， 不执行， 用于预览
+func (s *MySQLSinker) Statements(e *canal.RowsEvent) []*Statement {
+	if s.filtered(e) {
+		return nil
+	}
+	result := make([]*Statement, 0)
+	for _, c := range s.Consumers {
+		if e.Table == nil || e.Table.Name != c.Mapping.SrcTable {
+			continue
+		}
+		result = append(result, c.statements(e)...)
+	}
+	return result
 }
 
 func (s *MySQLSinker) ContinueOnError() bool {
@@ -96,8 +115,25 @@ func (c *MySQLConsumer) Accept(e *canal.RowsEvent) error {
 	return c.exec(e)
 }
 
+// Statement 一条待执行的 SQL
+type Statement struct {
+	SQL  string        `json:"sql"`
+	Args []interface{} `json:"args"`
+}
+
 // 执行落库操作
 func (c *MySQLConsumer) exec(e *canal.RowsEvent) error {
+	for _, st := range c.statements(e) {
+		if _, err := c.DB.Exec(st.SQL, st.Args...); err != nil {
+			log.Errorf("error executing sql: %s, args: %v, err:%s\n", st.SQL, st.Args, err.Error())
+			return err
+		}
+	}
+	return nil
+}
+
+// statements 事件对应的 SQL， update主键的时候先删除更新前的行
+func (c *MySQLConsumer) statements(e *canal.RowsEvent) []*Statement {
 	var resultSql string
 	var deleteSql string
 	var pos []int
@@ -116,22 +152,14 @@ func (c *MySQLConsumer) exec(e *canal.RowsEvent) error {
 	}
 	values, deleteValues := c.prepareValues(e, pos, delPos)
 
-	// update主键的时候删除更新前的行
+	result := make([]*Statement, 0, 2)
 	if len(deleteSql) > 0 {
-		_, delErr := c.DB.Exec(deleteSql, deleteValues...)
-		if delErr != nil {
-			log.Errorf("error executing delete sql: %s, args: %v err:%s\n", deleteSql, deleteValues, delErr.Error())
-			return delErr
-		}
+		result = append(result, &Statement{SQL: deleteSql, Args: deleteValues})
 	}
-
-	// 正常执行
-	_, err := c.DB.Exec(resultSql, values...)
-	if err != nil {
-		log.Errorf("error executing sql: %s, args: %v, err:%s\n", resultSql, values, err.Error())
-		return err
+	if len(resultSql) > 0 {
+		result = append(result, &Statement{SQL: resultSql, Args: values})
 	}
-	return nil
+	return result
 }
 
 func (c *MySQLConsumer) prepareValues(e *canal.RowsEvent, valuePos []int, delPos []int) ([]interface{}, []interface{}) {
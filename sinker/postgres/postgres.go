@@ -0,0 +1,493 @@
+package postgres
+
+// 增量数据使用 INSERT ... ON CONFLICT 写入， dump 过来的全量数据先缓存， 再通过 COPY 批量导入
+// COPY 不支持冲突处理， 因此先 COPY 到临时表， 再从临时表 INSERT ... ON CONFLICT 到目标表
+// 一条 INSERT ... ON CONFLICT 不能两次更新同一行， 同一批中主键相同的行只保留最后一行
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/go-mysql-org/go-mysql/canal"
+	"github.com/go-mysql-org/go-mysql/schema"
+	"github.com/gridsx/datagos/canal/mysql/filter"
+	"github.com/gridsx/datagos/canal/mysql/mapper"
+	"github.com/gridsx/datagos/common"
+	"github.com/gridsx/datagos/sinker/format"
+	"github.com/lib/pq"
+	"github.com/siddontang/go-log/log"
+)
+
+const (
+	defaultSchema    = "public"
+	defaultCopyBatch = 5000
+)
+
+// PostgresInstance 目标库连接信息
+type PostgresInstance struct {
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Database string `json:"database"`
+	SSLMode  string `json:"sslMode,omitempty"`
+}
+
+func (i *PostgresInstance) ToDatasource() (*sql.DB, error) {
+	sslMode := i.SSLMode
+	if len(sslMode) == 0 {
+		sslMode = "disable"
+	}
+	db, err := sql.Open("postgres", fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=%s",
+		i.Host, i.Port, i.Username, i.Password, i.Database, sslMode))
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(5)
+	if err := db.Ping(); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// PostgresSinkerConfig 对应 task_dests 的 config 字段
+type PostgresSinkerConfig struct {
+	DestDatasource PostgresInstance      `json:"destDatasource"`
+	Schema         string                `json:"schema,omitempty"`
+	Mappings       []mapper.TableMapping `json:"mappings"`
+	// AutoCreate 目标表不存在的时候按源表结构自动建表
+	AutoCreate bool `json:"autoCreate,omitempty"`
+	// CopyBatch 全量阶段多少行 COPY 一次
+	CopyBatch     int                 `json:"copyBatch,omitempty"`
+	Filter        *filter.TableFilter `json:"filter,omitempty"`
+	ErrorContinue bool                `json:"errorContinue"`
+}
+
+type PostgresSinker struct {
+	disabled      bool
+	ErrorContinue bool
+	Filter        *filter.TableFilter
+	Consumers     []*PostgresConsumer
+
+	db   *sql.DB
+	lock sync.Mutex
+}
+
+func (s *PostgresSinker) Enable() bool {
+	return !s.disabled
+}
+
+func (s *PostgresSinker) Disable() {
+	s.disabled = true
+}
+
+func (s *PostgresSinker) ContinueOnError() bool {
+	return s.ErrorContinue
+}
+
+func (s *PostgresSinker) OnEvent(e *canal.RowsEvent) error {
+	if e == nil || e.Table == nil {
+		return nil
+	}
+	if s.Filter != nil && s.Filter.Match(e) {
+		return nil
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, c := range s.Consumers {
+		if err := c.Accept(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Flush 把全量阶段缓存的数据 COPY 到目标表
+func (s *PostgresSinker) Flush() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, c := range s.Consumers {
+		if err := c.copySnapshot(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *PostgresSinker) Close() error {
+	flushErr := s.Flush()
+	if err := s.db.Close(); err != nil {
+		return err
+	}
+	return flushErr
+}
+
+// PostgresConsumer 一个表映射对应一个消费者
+type PostgresConsumer struct {
+	DB         *sql.DB
+	Schema     string
+	Mapping    *mapper.TableMapping
+	AutoCreate bool
+	CopyBatch  int
+
+	created  bool
+	table    *schema.Table
+	snapshot [][]interface{}
+	// snapshotKeys 全量缓存中主键所在的位置
+	snapshotKeys map[string]int
+}
+
+type column struct {
+	idx int
+	dst string
+}
+
+func (c *PostgresConsumer) Name() string {
+	return "PostgresConsumer"
+}
+
+func (c *PostgresConsumer) Accept(e *canal.RowsEvent) error {
+	if !c.Mapping.Match(e.Table.Schema, e.Table.Name) {
+		return nil
+	}
+	if err := c.ensureTable(e.Table); err != nil {
+		return err
+	}
+	if format.IsSnapshot(e) {
+		c.table = e.Table
+		cols := c.columns(e.Table)
+		for _, row := range e.Rows {
+			c.addSnapshot(e.Table, c.values(e.Table, cols, row), row)
+		}
+		if len(c.snapshot) >= c.CopyBatch {
+			// 当前事件已经缓存， 写入失败的是缓存的数据
+			if err := c.copySnapshot(); err != nil {
+				return &common.BufferedError{Err: err}
+			}
+		}
+		return nil
+	}
+	// 增量数据之前， 先把全量的数据写完， 保证顺序， 失败的是缓存的数据， 当前事件在恢复之后从位点重放
+	if err := c.copySnapshot(); err != nil {
+		return &common.BufferedError{Err: err}
+	}
+	return c.exec(e)
+}
+
+// addSnapshot 主键相同的行覆盖缓存中之前的行
+func (c *PostgresConsumer) addSnapshot(t *schema.Table, values, row []interface{}) {
+	if len(t.PKColumns) == 0 {
+		c.snapshot = append(c.snapshot, values)
+		return
+	}
+	if c.snapshotKeys == nil {
+		c.snapshotKeys = make(map[string]int)
+	}
+	key := format.RowKey(t, row)
+	if i, ok := c.snapshotKeys[key]; ok {
+		c.snapshot[i] = values
+		return
+	}
+	c.snapshotKeys[key] = len(c.snapshot)
+	c.snapshot = append(c.snapshot, values)
+}
+
+// lastRows 主键相同的行只保留最后一行， 位置为第一次出现的位置
+func lastRows(t *schema.Table, rows [][]interface{}) [][]interface{} {
+	if len(t.PKColumns) == 0 || len(rows) < 2 {
+		return rows
+	}
+	index := make(map[string]int, len(rows))
+	result := make([][]interface{}, 0, len(rows))
+	for _, row := range rows {
+		key := format.RowKey(t, row)
+		if i, ok := index[key]; ok {
+			result[i] = row
+			continue
+		}
+		index[key] = len(result)
+		result = append(result, row)
+	}
+	return result
+}
+
+func (c *PostgresConsumer) qualified() string {
+	return pq.QuoteIdentifier(c.Schema) + "." + pq.QuoteIdentifier(c.dstTable())
+}
+
+func (c *PostgresConsumer) dstTable() string {
+	if len(c.Mapping.DstTable) > 0 {
+		return c.Mapping.DstTable
+	}
+	return c.Mapping.SrcTable
+}
+
+// columns 需要写入的列， 配置了列映射则只写入映射了的列
+func (c *PostgresConsumer) columns(t *schema.Table) []column {
+	cols := make([]column, 0, len(t.Columns))
+	if len(c.Mapping.ColMappings) == 0 {
+		for i, col := range t.Columns {
+			cols = append(cols, column{idx: i, dst: col.Name})
+		}
+		return cols
+	}
+	for _, cm := range c.Mapping.ColMappings {
+		if idx := t.FindColumn(cm.Src); idx >= 0 {
+			cols = append(cols, column{idx: idx, dst: c.Mapping.DstName(cm.Src)})
+		}
+	}
+	return cols
+}
+
+func (c *PostgresConsumer) pkColumns(t *schema.Table) []column {
+	cols := make([]column, 0, len(t.PKColumns))
+	for _, idx := range t.PKColumns {
+		cols = append(cols, column{idx: idx, dst: c.Mapping.DstName(t.Columns[idx].Name)})
+	}
+	return cols
+}
+
+func (c *PostgresConsumer) values(t *schema.Table, cols []column, row []interface{}) []interface{} {
+	values := make([]interface{}, 0, len(cols))
+	for _, col := range cols {
+		var v interface{}
+		if col.idx < len(row) {
+			v = pgValue(&t.Columns[col.idx], row[col.idx])
+		}
+		values = append(values, v)
+	}
+	return values
+}
+
+func quoteColumns(cols []column) string {
+	names := make([]string, 0, len(cols))
+	for _, col := range cols {
+		names = append(names, pq.QuoteIdentifier(col.dst))
+	}
+	return strings.Join(names, ", ")
+}
+
+// onConflict 有主键的时候冲突则更新非主键列
+func (c *PostgresConsumer) onConflict(t *schema.Table, cols []column) string {
+	pks := c.pkColumns(t)
+	if len(pks) == 0 {
+		return ""
+	}
+	isPK := make(map[string]bool, len(pks))
+	for _, pk := range pks {
+		isPK[pk.dst] = true
+	}
+	sets := make([]string, 0, len(cols))
+	for _, col := range cols {
+		if !isPK[col.dst] {
+			name := pq.QuoteIdentifier(col.dst)
+			sets = append(sets, fmt.Sprintf("%s = EXCLUDED.%s", name, name))
+		}
+	}
+	if len(sets) == 0 {
+		return fmt.Sprintf(" ON CONFLICT (%s) DO NOTHING", quoteColumns(pks))
+	}
+	return fmt.Sprintf(" ON CONFLICT (%s) DO UPDATE SET %s", quoteColumns(pks), strings.Join(sets, ", "))
+}
+
+func placeholders(start, n int) string {
+	sb := strings.Builder{}
+	sb.WriteString("(")
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			sb.WriteString(", ")
+		}
+		sb.WriteString(fmt.Sprintf("$%d", start+i))
+	}
+	sb.WriteString(")")
+	return sb.String()
+}
+
+func (c *PostgresConsumer) upsert(t *schema.Table, rows [][]interface{}) error {
+	if len(rows) == 0 {
+		return nil
+	}
+	rows = lastRows(t, rows)
+	cols := c.columns(t)
+	sb := strings.Builder{}
+	sb.WriteString(fmt.Sprintf("INSERT INTO %s (%s) VALUES ", c.qualified(), quoteColumns(cols)))
+	args := make([]interface{}, 0, len(rows)*len(cols))
+	for i, row := range rows {
+		if i > 0 {
+			sb.WriteString(", ")
+		}
+		sb.WriteString(placeholders(len(args)+1, len(cols)))
+		args = append(args, c.values(t, cols, row)...)
+	}
+	sb.WriteString(c.onConflict(t, cols))
+	_, err := c.DB.Exec(sb.String(), args...)
+	if err != nil {
+		log.Errorf("error executing sql: %s, err: %s\n", sb.String(), err.Error())
+	}
+	return err
+}
+
+func (c *PostgresConsumer) delete(t *schema.Table, rows [][]interface{}) error {
+	pks := c.pkColumns(t)
+	if len(rows) == 0 || len(pks) == 0 {
+		return nil
+	}
+	sb := strings.Builder{}
+	sb.WriteString(fmt.Sprintf("DELETE FROM %s WHERE (%s) IN (", c.qualified(), quoteColumns(pks)))
+	args := make([]interface{}, 0, len(rows)*len(pks))
+	for i, row := range rows {
+		if i > 0 {
+			sb.WriteString(", ")
+		}
+		sb.WriteString(placeholders(len(args)+1, len(pks)))
+		args = append(args, c.values(t, pks, row)...)
+	}
+	sb.WriteString(")")
+	_, err := c.DB.Exec(sb.String(), args...)
+	if err != nil {
+		log.Errorf("error executing sql: %s, err: %s\n", sb.String(), err.Error())
+	}
+	return err
+}
+
+func (c *PostgresConsumer) exec(e *canal.RowsEvent) error {
+	switch e.Action {
+	case canal.DeleteAction:
+		return c.delete(e.Table, e.Rows)
+	case canal.UpdateAction:
+		changes := format.Changes(e)
+		deleted := make([][]interface{}, 0)
+		rows := make([][]interface{}, 0, len(changes))
+		for _, change := range changes {
+			// 主键变化的时候先删除旧的行
+			if format.RowKey(e.Table, change.Before) != format.RowKey(e.Table, change.After) {
+				deleted = append(deleted, change.Before)
+			}
+			rows = append(rows, change.After)
+		}
+		if err := c.delete(e.Table, deleted); err != nil {
+			return err
+		}
+		return c.upsert(e.Table, rows)
+	default:
+		return c.upsert(e.Table, e.Rows)
+	}
+}
+
+// copySnapshot 全量数据先 COPY 到临时表， 再合并到目标表
+func (c *PostgresConsumer) copySnapshot() error {
+	if len(c.snapshot) == 0 {
+		return nil
+	}
+	cols := c.columns(c.table)
+	names := make([]string, 0, len(cols))
+	for _, col := range cols {
+		names = append(names, col.dst)
+	}
+	tmp := "datagos_copy_" + c.dstTable()
+
+	tx, err := c.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+	if _, err := tx.Exec(fmt.Sprintf("CREATE TEMP TABLE %s (LIKE %s INCLUDING DEFAULTS) ON COMMIT DROP",
+		pq.QuoteIdentifier(tmp), c.qualified())); err != nil {
+		return err
+	}
+	stmt, err := tx.Prepare(pq.CopyIn(tmp, names...))
+	if err != nil {
+		return err
+	}
+	for _, row := range c.snapshot {
+		if _, err := stmt.Exec(row...); err != nil {
+			_ = stmt.Close()
+			return err
+		}
+	}
+	if _, err := stmt.Exec(); err != nil {
+		_ = stmt.Close()
+		return err
+	}
+	if err := stmt.Close(); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(fmt.Sprintf("INSERT INTO %s (%s) SELECT %s FROM %s%s", c.qualified(), quoteColumns(cols),
+		quoteColumns(cols), pq.QuoteIdentifier(tmp), c.onConflict(c.table, cols))); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	log.Infof("postgres sinker copied %d rows into %s\n", len(c.snapshot), c.qualified())
+	c.snapshot = c.snapshot[:0]
+	c.snapshotKeys = nil
+	return nil
+}
+
+// ensureTable 按源表结构自动建表
+func (c *PostgresConsumer) ensureTable(t *schema.Table) error {
+	if !c.AutoCreate || c.created {
+		return nil
+	}
+	cols := c.columns(t)
+	defs := make([]string, 0, len(cols)+1)
+	for _, col := range cols {
+		defs = append(defs, fmt.Sprintf("%s %s", pq.QuoteIdentifier(col.dst), pgType(&t.Columns[col.idx])))
+	}
+	if pks := c.pkColumns(t); len(pks) > 0 {
+		defs = append(defs, fmt.Sprintf("PRIMARY KEY (%s)", quoteColumns(pks)))
+	}
+	ddl := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (%s)", c.qualified(), strings.Join(defs, ", "))
+	if _, err := c.DB.Exec(ddl); err != nil {
+		log.Errorf("error creating table: %s, err: %s\n", ddl, err.Error())
+		return err
+	}
+	c.created = true
+	return nil
+}
+
+func Build(c string) (*PostgresSinker, error) {
+	cfg := new(PostgresSinkerConfig)
+	if err := json.Unmarshal([]byte(c), cfg); err != nil {
+		return nil, err
+	}
+	if len(cfg.Mappings) == 0 {
+		return nil, errors.New("postgres sinker: mappings not configured")
+	}
+	db, err := cfg.DestDatasource.ToDatasource()
+	if err != nil {
+		return nil, err
+	}
+	pgSchema := cfg.Schema
+	if len(pgSchema) == 0 {
+		pgSchema = defaultSchema
+	}
+	copyBatch := cfg.CopyBatch
+	if copyBatch <= 0 {
+		copyBatch = defaultCopyBatch
+	}
+	consumers := make([]*PostgresConsumer, 0, len(cfg.Mappings))
+	for i := range cfg.Mappings {
+		consumers = append(consumers, &PostgresConsumer{
+			DB:         db,
+			Schema:     pgSchema,
+			Mapping:    &cfg.Mappings[i],
+			AutoCreate: cfg.AutoCreate,
+			CopyBatch:  copyBatch,
+		})
+	}
+	return &PostgresSinker{
+		ErrorContinue: cfg.ErrorContinue,
+		Filter:        cfg.Filter,
+		Consumers:     consumers,
+		db:            db,
+	}, nil
+}
@@ -0,0 +1,194 @@
+package postgres
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/go-mysql-org/go-mysql/schema"
+	"github.com/gridsx/datagos/sinker/format"
+	"github.com/lib/pq"
+)
+
+// pgType MySQL 列类型对应的 Postgres 类型， 自动建表的时候使用
+func pgType(col *schema.TableColumn) string {
+	raw := strings.ToLower(col.RawType)
+	switch col.Type {
+	case schema.TYPE_NUMBER:
+		switch {
+		case isBool(col):
+			return "boolean"
+		case strings.HasPrefix(raw, "tinyint"), strings.HasPrefix(raw, "year"):
+			return "smallint"
+		case strings.HasPrefix(raw, "smallint"):
+			if col.IsUnsigned {
+				return "integer"
+			}
+			return "smallint"
+		case strings.HasPrefix(raw, "bigint"):
+			if col.IsUnsigned {
+				return "numeric(20)"
+			}
+			return "bigint"
+		default:
+			if col.IsUnsigned {
+				return "bigint"
+			}
+			return "integer"
+		}
+	case schema.TYPE_MEDIUM_INT:
+		return "integer"
+	case schema.TYPE_FLOAT:
+		if strings.HasPrefix(raw, "float") {
+			return "real"
+		}
+		return "double precision"
+	case schema.TYPE_DECIMAL:
+		return "numeric" + typeArgs(raw)
+	case schema.TYPE_ENUM:
+		return "text"
+	case schema.TYPE_SET:
+		return "text[]"
+	case schema.TYPE_DATETIME:
+		return "timestamp"
+	case schema.TYPE_TIMESTAMP:
+		return "timestamptz"
+	case schema.TYPE_DATE:
+		return "date"
+	case schema.TYPE_TIME:
+		// MySQL 的 time 可以超过24小时
+		return "interval"
+	case schema.TYPE_BIT:
+		if raw == "bit(1)" {
+			return "boolean"
+		}
+		return "bigint"
+	case schema.TYPE_JSON:
+		return "jsonb"
+	case schema.TYPE_BINARY:
+		return "bytea"
+	case schema.TYPE_POINT:
+		return "text"
+	default:
+		switch {
+		case strings.Contains(raw, "blob"):
+			return "bytea"
+		case strings.HasPrefix(raw, "varchar"):
+			return "varchar" + typeArgs(raw)
+		case strings.HasPrefix(raw, "char"):
+			return "char" + typeArgs(raw)
+		default:
+			return "text"
+		}
+	}
+}
+
+// tinyint(1) 在 MySQL 中通常作为布尔值使用
+func isBool(col *schema.TableColumn) bool {
+	return strings.HasPrefix(strings.ToLower(col.RawType), "tinyint(1)")
+}
+
+func typeArgs(raw string) string {
+	start := strings.Index(raw, "(")
+	end := strings.Index(raw, ")")
+	if start < 0 || end < start {
+		return ""
+	}
+	return raw[start : end+1]
+}
+
+// pgValue 把 binlog 中的值转换为 Postgres 可以接受的值
+func pgValue(col *schema.TableColumn, v interface{}) interface{} {
+	if v == nil {
+		return nil
+	}
+	switch col.Type {
+	case schema.TYPE_NUMBER:
+		if isBool(col) {
+			return toInt(v) != 0
+		}
+		// 超过 int64 范围的 unsigned bigint， database/sql 不支持， 以字符串写入 numeric
+		if u, ok := v.(uint64); ok {
+			return strconv.FormatUint(u, 10)
+		}
+	case schema.TYPE_ENUM:
+		return toString(format.EnumName(col, v))
+	case schema.TYPE_SET:
+		return pq.Array(format.SetNames(col, v))
+	case schema.TYPE_DATETIME, schema.TYPE_TIMESTAMP, schema.TYPE_DATE:
+		s := toString(v)
+		if strings.HasPrefix(s, "0000-00-00") {
+			return nil
+		}
+		return s
+	case schema.TYPE_BIT:
+		if col.RawType == "bit(1)" {
+			return toInt(v) != 0
+		}
+		return toInt(v)
+	case schema.TYPE_JSON:
+		return toString(v)
+	case schema.TYPE_BINARY:
+		return toBytes(v)
+	}
+	if strings.Contains(strings.ToLower(col.RawType), "blob") {
+		return toBytes(v)
+	}
+	if b, ok := v.([]byte); ok {
+		return string(b)
+	}
+	return v
+}
+
+func toInt(v interface{}) int64 {
+	switch val := v.(type) {
+	case int8:
+		return int64(val)
+	case int16:
+		return int64(val)
+	case int32:
+		return int64(val)
+	case int64:
+		return val
+	case int:
+		return int64(val)
+	case uint8:
+		return int64(val)
+	case uint16:
+		return int64(val)
+	case uint32:
+		return int64(val)
+	case uint64:
+		return int64(val)
+	case bool:
+		if val {
+			return 1
+		}
+		return 0
+	default:
+		i, _ := strconv.ParseInt(toString(v), 10, 64)
+		return i
+	}
+}
+
+func toString(v interface{}) string {
+	switch val := v.(type) {
+	case []byte:
+		return string(val)
+	case string:
+		return val
+	default:
+		return fmt.Sprint(val)
+	}
+}
+
+func toBytes(v interface{}) []byte {
+	switch val := v.(type) {
+	case []byte:
+		return val
+	case string:
+		return []byte(val)
+	default:
+		return []byte(fmt.Sprint(val))
+	}
+}
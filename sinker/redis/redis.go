@@ -1 +1,339 @@
 package redis
+
+// 根据 binlog 维护 Redis 缓存， 支持以下几种写法：
+// hash: 每行一个 hash， json: 每行一个 json 字符串， zset: 维护有序集合索引， invalidate: 更新、删除的时候删除缓存
+// 命令通过 pipeline 批量发送， 达到数量或者保存位点之前执行
+// 执行失败时整批命令按原来的顺序放回， 下次重新执行， 命令都可以重复执行；
+// 被 Redis 拒绝、重试也不会成功的命令（如 WRONGTYPE）记录日志之后丢弃， 不会让整批命令一直失败
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-mysql-org/go-mysql/canal"
+	"github.com/go-mysql-org/go-mysql/schema"
+	"github.com/go-redis/redis/v8"
+	"github.com/gridsx/datagos/canal/mysql/filter"
+	"github.com/gridsx/datagos/canal/mysql/mapper"
+	"github.com/gridsx/datagos/common"
+	"github.com/gridsx/datagos/sinker/format"
+	"github.com/siddontang/go-log/log"
+)
+
+const (
+	TypeHash       = "hash"
+	TypeJSON       = "json"
+	TypeZSet       = "zset"
+	TypeInvalidate = "invalidate"
+
+	defaultPipelineSize = 100
+)
+
+// RedisRule 一张源表对应的缓存写法
+// ColMappings 用于选择和重命名写入 hash/json 的字段， 不配置则写入所有列
+type RedisRule struct {
+	mapper.TableMapping
+	Type string `json:"type"`
+	// Key 模板， 变量为列名以及 schema、table， 如 user:${id}
+	Key string `json:"key"`
+	// TTL 过期时间， 单位秒， 0 为不过期
+	TTL int `json:"ttl,omitempty"`
+	// Score zset 的分数列
+	Score string `json:"score,omitempty"`
+	// Member zset 的成员模板， 默认为主键
+	Member string `json:"member,omitempty"`
+}
+
+// RedisSinkerConfig 对应 task_dests 的 config 字段
+type RedisSinkerConfig struct {
+	Addr         string      `json:"addr"`
+	Password     string      `json:"password,omitempty"`
+	DB           int         `json:"db,omitempty"`
+	PoolSize     int         `json:"poolSize,omitempty"`
+	PipelineSize int         `json:"pipelineSize,omitempty"`
+	Rules        []RedisRule `json:"rules"`
+
+	Filter        *filter.TableFilter `json:"filter,omitempty"`
+	ErrorContinue bool                `json:"errorContinue"`
+}
+
+type RedisSinker struct {
+	disabled      bool
+	ErrorContinue bool
+	Filter        *filter.TableFilter
+	Rules         []RedisRule
+
+	client       *redis.Client
+	pipelineSize int
+
+	lock     sync.Mutex
+	pipeline redis.Pipeliner
+	queued   int
+}
+
+func (s *RedisSinker) Enable() bool {
+	return !s.disabled
+}
+
+func (s *RedisSinker) Disable() {
+	s.disabled = true
+}
+
+func (s *RedisSinker) ContinueOnError() bool {
+	return s.ErrorContinue
+}
+
+func (s *RedisSinker) OnEvent(e *canal.RowsEvent) error {
+	if e == nil || e.Table == nil {
+		return nil
+	}
+	if s.Filter != nil && s.Filter.Match(e) {
+		return nil
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	ctx := context.Background()
+	for i := range s.Rules {
+		r := &s.Rules[i]
+		if !r.Match(e.Table.Schema, e.Table.Name) {
+			continue
+		}
+		for _, change := range format.Changes(e) {
+			if err := r.apply(ctx, s.pipeline, e.Table, change); err != nil {
+				return err
+			}
+			s.queued++
+		}
+	}
+	if s.queued >= s.pipelineSize {
+		// 当前事件的命令已经放入 pipeline， 不能让 pipeline 重复处理当前事件
+		if err := s.flush(ctx); err != nil {
+			return &common.BufferedError{Err: err}
+		}
+	}
+	return nil
+}
+
+// Flush 保存位点之前执行 pipeline 中的命令
+func (s *RedisSinker) Flush() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.flush(context.Background())
+}
+
+func (s *RedisSinker) flush(ctx context.Context) error {
+	if s.queued == 0 {
+		return nil
+	}
+	cmds, _ := s.pipeline.Exec(ctx)
+	// Exec 之后 pipeline 已经清空， 被拒绝的命令丢弃， 还有其他失败的命令时其余的按原来的顺序全部放回
+	var failed error
+	requeue := make([]redis.Cmder, 0, len(cmds))
+	for _, cmd := range cmds {
+		err := cmd.Err()
+		if err != nil && err != redis.Nil && rejected(err) {
+			log.Errorf("redis sinker command rejected, dropped: %v, err: %v\n", cmd.Args(), err)
+			continue
+		}
+		if err != nil && err != redis.Nil && failed == nil {
+			failed = fmt.Errorf("redis sinker %s error: %w", cmd.Name(), err)
+		}
+		requeue = append(requeue, cmd)
+	}
+	if failed == nil {
+		s.queued = 0
+		return nil
+	}
+	for _, cmd := range requeue {
+		_ = s.pipeline.Process(ctx, cmd)
+	}
+	s.queued = len(requeue)
+	return failed
+}
+
+// rejected Redis 返回的错误， 除了服务端暂时不可用的几种， 重新执行也会失败
+func rejected(err error) bool {
+	var re redis.Error
+	if !errors.As(err, &re) {
+		return false
+	}
+	for _, prefix := range []string{"LOADING ", "READONLY ", "BUSY ", "TRYAGAIN ", "CLUSTERDOWN ", "MASTERDOWN ", "OOM ", "MOVED ", "ASK "} {
+		if strings.HasPrefix(err.Error(), prefix) {
+			return false
+		}
+	}
+	return err.Error() != "ERR max number of clients reached"
+}
+
+func (s *RedisSinker) Close() error {
+	flushErr := s.Flush()
+	if err := s.client.Close(); err != nil {
+		return err
+	}
+	return flushErr
+}
+
+// apply 把一行的变更转换为 redis 命令放入 pipeline
+func (r *RedisRule) apply(ctx context.Context, p redis.Pipeliner, t *schema.Table, c *format.Change) error {
+	var oldKey, newKey string
+	if c.Before != nil {
+		oldKey = r.render(r.Key, t, c.Before)
+	}
+	if c.After != nil {
+		newKey = r.render(r.Key, t, c.After)
+	}
+	if r.Type == TypeInvalidate {
+		// 插入的数据不会有缓存， 只需要处理更新和删除
+		if len(oldKey) > 0 {
+			p.Del(ctx, oldKey)
+		}
+		if len(newKey) > 0 && len(oldKey) > 0 && newKey != oldKey {
+			p.Del(ctx, newKey)
+		}
+		return nil
+	}
+	if r.Type == TypeZSet {
+		return r.applyZSet(ctx, p, t, c, oldKey, newKey)
+	}
+
+	// key 变化或者删除， 先删除旧的 key
+	if len(oldKey) > 0 && oldKey != newKey {
+		p.Del(ctx, oldKey)
+	}
+	if c.After == nil {
+		return nil
+	}
+	doc := format.MappedRowMap(&r.TableMapping, t, c.After)
+	switch r.Type {
+	case TypeHash:
+		if c.Before != nil {
+			// 更新的时候整行覆盖， 避免残留已经不存在的字段
+			p.Del(ctx, newKey)
+		}
+		values := make(map[string]interface{}, len(doc))
+		for k, v := range doc {
+			values[k] = toString(v)
+		}
+		p.HSet(ctx, newKey, values)
+		if r.TTL > 0 {
+			p.Expire(ctx, newKey, time.Duration(r.TTL)*time.Second)
+		}
+	case TypeJSON:
+		d, err := json.Marshal(doc)
+		if err != nil {
+			return err
+		}
+		p.Set(ctx, newKey, d, time.Duration(r.TTL)*time.Second)
+	default:
+		return errors.New("unknown redis rule type: " + r.Type)
+	}
+	return nil
+}
+
+// applyZSet 维护有序集合索引， key 为集合， 成员默认为主键， 分数取自 Score 列
+func (r *RedisRule) applyZSet(ctx context.Context, p redis.Pipeliner, t *schema.Table, c *format.Change, oldKey, newKey string) error {
+	var oldMember, newMember string
+	if c.Before != nil {
+		oldMember = r.member(t, c.Before)
+	}
+	if c.After != nil {
+		newMember = r.member(t, c.After)
+	}
+	if len(oldMember) > 0 && (oldMember != newMember || oldKey != newKey) {
+		p.ZRem(ctx, oldKey, oldMember)
+	}
+	if c.After == nil {
+		return nil
+	}
+	idx := t.FindColumn(r.Score)
+	if idx < 0 || idx >= len(c.After) {
+		return fmt.Errorf("zset score column %s not found in %s", r.Score, t.String())
+	}
+	score, err := strconv.ParseFloat(toString(c.After[idx]), 64)
+	if err != nil {
+		return fmt.Errorf("zset score column %s is not a number: %w", r.Score, err)
+	}
+	p.ZAdd(ctx, newKey, &redis.Z{Score: score, Member: newMember})
+	if r.TTL > 0 {
+		p.Expire(ctx, newKey, time.Duration(r.TTL)*time.Second)
+	}
+	return nil
+}
+
+func (r *RedisRule) member(t *schema.Table, row []interface{}) string {
+	if len(r.Member) == 0 {
+		return format.RowKey(t, row)
+	}
+	return r.render(r.Member, t, row)
+}
+
+func (r *RedisRule) render(tpl string, t *schema.Table, row []interface{}) string {
+	vars := make(map[string]string, len(t.Columns)+2)
+	for i, col := range t.Columns {
+		if i < len(row) {
+			vars[col.Name] = toString(row[i])
+		}
+	}
+	vars["schema"] = t.Schema
+	vars["table"] = t.Name
+	return common.RenderTemplate(tpl, vars)
+}
+
+func toString(v interface{}) string {
+	switch val := v.(type) {
+	case nil:
+		return ""
+	case []byte:
+		return string(val)
+	case string:
+		return val
+	default:
+		return fmt.Sprint(val)
+	}
+}
+
+func Build(c string) (*RedisSinker, error) {
+	cfg := new(RedisSinkerConfig)
+	if err := json.Unmarshal([]byte(c), cfg); err != nil {
+		return nil, err
+	}
+	if len(cfg.Addr) == 0 {
+		return nil, errors.New("redis sinker: addr not configured")
+	}
+	for _, r := range cfg.Rules {
+		if len(r.Key) == 0 {
+			return nil, fmt.Errorf("redis sinker: key not configured for table %s", r.SrcTable)
+		}
+		if r.Type == TypeZSet && len(r.Score) == 0 {
+			return nil, fmt.Errorf("redis sinker: score not configured for table %s", r.SrcTable)
+		}
+	}
+	client := redis.NewClient(&redis.Options{
+		Addr:     cfg.Addr,
+		Password: cfg.Password,
+		DB:       cfg.DB,
+		PoolSize: cfg.PoolSize,
+	})
+	if err := client.Ping(context.Background()).Err(); err != nil {
+		_ = client.Close()
+		return nil, err
+	}
+	s := &RedisSinker{
+		ErrorContinue: cfg.ErrorContinue,
+		Filter:        cfg.Filter,
+		Rules:         cfg.Rules,
+		client:        client,
+		pipelineSize:  cfg.PipelineSize,
+		pipeline:      client.Pipeline(),
+	}
+	if s.pipelineSize <= 0 {
+		s.pipelineSize = defaultPipelineSize
+	}
+	return s, nil
+}
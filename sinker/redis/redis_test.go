@@ -0,0 +1,224 @@
+package redis
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/go-mysql-org/go-mysql/canal"
+	"github.com/go-mysql-org/go-mysql/schema"
+	"github.com/gridsx/datagos/common"
+)
+
+// standIn 进程内的 RESP 服务端， 记录收到的命令， 按 key 的类型回复 WRONGTYPE， down 时断开连接
+type standIn struct {
+	t  *testing.T
+	ln net.Listener
+
+	lock     sync.Mutex
+	down     bool
+	types    map[string]string
+	received [][]string
+}
+
+func newStandIn(t *testing.T) *standIn {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &standIn{t: t, ln: ln, types: map[string]string{}}
+	t.Cleanup(func() { _ = ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *standIn) addr() string {
+	return s.ln.Addr().String()
+}
+
+func (s *standIn) setDown(down bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.down = down
+}
+
+func (s *standIn) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		s.lock.Lock()
+		if s.down {
+			s.lock.Unlock()
+			return
+		}
+		s.received = append(s.received, args)
+		reply := s.reply(args)
+		s.lock.Unlock()
+		if _, err := conn.Write([]byte(reply)); err != nil {
+			return
+		}
+	}
+}
+
+func (s *standIn) reply(args []string) string {
+	cmd := strings.ToUpper(args[0])
+	typ := map[string]string{"HSET": "hash", "SET": "string", "ZADD": "zset"}[cmd]
+	switch {
+	case cmd == "PING":
+		return "+PONG\r\n"
+	case cmd == "DEL":
+		delete(s.types, args[1])
+		return ":1\r\n"
+	case len(typ) > 0:
+		if t, ok := s.types[args[1]]; ok && t != typ {
+			return "-WRONGTYPE Operation against a key holding the wrong kind of value\r\n"
+		}
+		s.types[args[1]] = typ
+		if cmd == "SET" {
+			return "+OK\r\n"
+		}
+		return ":1\r\n"
+	default:
+		return ":1\r\n"
+	}
+}
+
+func (s *standIn) commands(name string) [][]string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var result [][]string
+	for _, args := range s.received {
+		if strings.EqualFold(args[0], name) {
+			result = append(result, args)
+		}
+	}
+	return result
+}
+
+// readCommand 读取一个 RESP 数组形式的命令
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "*") {
+		return nil, fmt.Errorf("unexpected line: %q", line)
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		args = append(args, string(buf[:size]))
+	}
+	return args, nil
+}
+
+func newTestSinker(t *testing.T, s *standIn, pipelineSize int) *RedisSinker {
+	sinker, err := Build(fmt.Sprintf(`{"addr":"%s","pipelineSize":%d,"rules":[{"srcTable":"users","type":"hash","key":"user:${id}"}]}`,
+		s.addr(), pipelineSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = sinker.client.Close() })
+	return sinker
+}
+
+func testEvent(ids ...int64) *canal.RowsEvent {
+	table := &schema.Table{Schema: "db", Name: "users", PKColumns: []int{0}}
+	table.AddColumn("id", "bigint", "", "")
+	table.AddColumn("name", "varchar(32)", "", "")
+	rows := make([][]interface{}, 0, len(ids))
+	for _, id := range ids {
+		rows = append(rows, []interface{}{id, "n"})
+	}
+	return &canal.RowsEvent{Table: table, Action: canal.InsertAction, Rows: rows}
+}
+
+func keys(cmds [][]string) string {
+	result := make([]string, 0, len(cmds))
+	for _, args := range cmds {
+		result = append(result, args[1])
+	}
+	return strings.Join(result, ",")
+}
+
+// 被拒绝的命令丢弃， 同一批的其他命令正常执行， 之后的批次不受影响
+func TestRejectedCommandDropped(t *testing.T) {
+	s := newStandIn(t)
+	s.types["user:1"] = "string"
+	sinker := newTestSinker(t, s, 100)
+	if err := sinker.OnEvent(testEvent(1, 2)); err != nil {
+		t.Fatal(err)
+	}
+	if err := sinker.Flush(); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+	if err := sinker.OnEvent(testEvent(3)); err != nil {
+		t.Fatal(err)
+	}
+	if err := sinker.Flush(); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+	if got := keys(s.commands("HSET")); got != "user:1,user:2,user:3" {
+		t.Fatalf("hset: %s", got)
+	}
+}
+
+// 连接失败时命令保留， 当前事件已经放入 pipeline， 返回 BufferedError， 恢复之后每个命令只执行一次
+func TestFailedBatchKeptOnce(t *testing.T) {
+	s := newStandIn(t)
+	sinker := newTestSinker(t, s, 2)
+	if err := sinker.OnEvent(testEvent(1)); err != nil {
+		t.Fatal(err)
+	}
+	s.setDown(true)
+	var buffered *common.BufferedError
+	if err := sinker.OnEvent(testEvent(2)); !errors.As(err, &buffered) {
+		t.Fatalf("full pipeline: %v", err)
+	}
+	if sinker.queued != 2 {
+		t.Fatalf("queued: %d", sinker.queued)
+	}
+	s.setDown(false)
+	if err := sinker.Flush(); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+	if got := keys(s.commands("HSET")); got != "user:1,user:2" {
+		t.Fatalf("hset: %s", got)
+	}
+	if sinker.queued != 0 {
+		t.Fatalf("queued after flush: %d", sinker.queued)
+	}
+}
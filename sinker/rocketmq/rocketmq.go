@@ -0,0 +1,299 @@
+package rocketmq
+
+// 消息以主键作为 sharding key， 同一主键的消息总是发往同一个队列， 保证顺序
+// 发送失败的消息按队列记录， 同一队列后续的消息排在失败消息之后， 重试成功之后才会继续发送
+// sendOnCommit 时源库事务中的消息在事务提交之后才发送， 仍然逐条发送， 每条消息至少一次， 整个事务不是原子的：
+// 发送中途失败时， 剩余的消息排在失败队列中等待重试， 消费端可能先看到事务的一部分， 可以按 DATAGOS_TX_ID 属性聚合
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/apache/rocketmq-client-go/v2"
+	"github.com/apache/rocketmq-client-go/v2/primitive"
+	"github.com/apache/rocketmq-client-go/v2/producer"
+	"github.com/go-mysql-org/go-mysql/canal"
+	"github.com/go-mysql-org/go-mysql/mysql"
+	"github.com/gridsx/datagos/canal/mysql/filter"
+	"github.com/gridsx/datagos/common"
+	"github.com/gridsx/datagos/sinker/format"
+	"github.com/siddontang/go-log/log"
+)
+
+const (
+	defaultTopic     = "${schema}_${table}"
+	defaultGroup     = "datagos"
+	defaultMaxFailed = 10000
+
+	TagByTable  = "table"
+	TagByAction = "action"
+)
+
+// RocketMQSinkerConfig 对应 task_dests 的 config 字段
+type RocketMQSinkerConfig struct {
+	NameServers []string `json:"nameServers"`
+	Group       string   `json:"group,omitempty"`
+	// Topic 支持模板， 如 ${schema}_${table}， RocketMQ 的 topic 不支持 . 号
+	Topic string `json:"topic,omitempty"`
+	// TagBy 消息 tag 的取值： table 表名， action 操作类型， 不配置则不设置 tag
+	TagBy  string         `json:"tagBy,omitempty"`
+	Format *format.Config `json:"format,omitempty"`
+
+	// SendOnCommit 源库事务提交之后再发送事务中的消息， 逐条发送， 不保证事务的原子性
+	SendOnCommit  bool   `json:"sendOnCommit,omitempty"`
+	AccessKey     string `json:"accessKey,omitempty"`
+	SecretKey     string `json:"secretKey,omitempty"`
+	Retries       int    `json:"retries,omitempty"`
+	SendTimeoutMs int    `json:"sendTimeoutMs,omitempty"`
+	// MaxFailed 等待重试的消息数量上限， 超过之后返回错误
+	MaxFailed int `json:"maxFailed,omitempty"`
+
+	Filter        *filter.TableFilter `json:"filter,omitempty"`
+	ErrorContinue bool                `json:"errorContinue"`
+}
+
+type RocketMQSinker struct {
+	disabled      bool
+	ErrorContinue bool
+	Filter        *filter.TableFilter
+	Topic         string
+	TagBy         string
+
+	encoder      format.Encoder
+	source       format.Source
+	selector     *pkQueueSelector
+	producer     rocketmq.Producer
+	sendOnCommit bool
+	txIds        *txIds
+	maxFailed    int
+
+	lock sync.Mutex
+	// 每个队列发送失败、等待重试的消息， 按发送顺序排列
+	failed      map[string][]*primitive.Message
+	failedCount int
+	// sendOnCommit 时当前源库事务中的消息
+	txMessages []*primitive.Message
+}
+
+// SetPosition 与 OnEvent 在同一个协程中调用
+func (s *RocketMQSinker) SetPosition(pos mysql.Position, gtid string) {
+	s.source = format.Source{Position: pos, GTID: gtid}
+}
+
+func (s *RocketMQSinker) Enable() bool {
+	return !s.disabled
+}
+
+func (s *RocketMQSinker) Disable() {
+	s.disabled = true
+}
+
+func (s *RocketMQSinker) ContinueOnError() bool {
+	return s.ErrorContinue
+}
+
+func (s *RocketMQSinker) OnEvent(e *canal.RowsEvent) error {
+	if e == nil || e.Table == nil {
+		return nil
+	}
+	if s.Filter != nil && s.Filter.Match(e) {
+		return nil
+	}
+	messages, err := s.toMessages(e)
+	if err != nil {
+		return err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	// dump 的数据没有事务边界， 直接发送
+	if s.sendOnCommit && !format.IsSnapshot(e) {
+		s.txMessages = append(s.txMessages, messages...)
+		return nil
+	}
+	return s.send(messages)
+}
+
+// send 按顺序发送， 失败的消息进入所在队列的失败列表， 消息都已经接收， 超过上限时返回 BufferedError
+func (s *RocketMQSinker) send(messages []*primitive.Message) error {
+	s.retryFailed()
+	for _, msg := range messages {
+		q := s.selector.queueOf(msg)
+		// 同一队列之前有失败的消息， 排在后面， 保证顺序
+		if len(s.failed[q]) > 0 {
+			s.addFailed(q, msg)
+			continue
+		}
+		if err := s.sendOrdered(msg); err != nil {
+			log.Errorf("rocketmq sinker send error, topic: %s, err: %s\n", msg.Topic, err.Error())
+			s.addFailed(s.selector.queueOf(msg), msg)
+		}
+	}
+	if s.failedCount > s.maxFailed {
+		return &common.BufferedError{Err: fmt.Errorf("rocketmq sinker: %d messages waiting for retry", s.failedCount)}
+	}
+	return nil
+}
+
+// OnCommit 源库事务提交， sendOnCommit 时发送事务中的消息， 同一事务的消息带相同的事务id
+func (s *RocketMQSinker) OnCommit() error {
+	if !s.sendOnCommit {
+		return nil
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	messages := s.txMessages
+	s.txMessages = nil
+	if len(messages) == 0 {
+		return nil
+	}
+	txId := s.txIds.next()
+	for _, msg := range messages {
+		msg.WithProperty(txIdProperty, txId)
+	}
+	return s.send(messages)
+}
+
+// Flush 重试所有失败的消息， 仍有失败的则返回错误， 位点不会前进
+func (s *RocketMQSinker) Flush() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.retryFailed()
+	if s.failedCount > 0 {
+		return fmt.Errorf("rocketmq sinker: %d messages waiting for retry", s.failedCount)
+	}
+	return nil
+}
+
+func (s *RocketMQSinker) Close() error {
+	return s.producer.Shutdown()
+}
+
+func (s *RocketMQSinker) toMessages(e *canal.RowsEvent) ([]*primitive.Message, error) {
+	encoded, err := s.encoder.Encode(e, &s.source)
+	if err != nil {
+		return nil, err
+	}
+	topic := common.RenderTemplate(s.Topic, map[string]string{
+		"schema": e.Table.Schema,
+		"table":  e.Table.Name,
+		"action": e.Action,
+	})
+	messages := make([]*primitive.Message, 0, len(encoded))
+	for _, m := range encoded {
+		msg := primitive.NewMessage(topic, m.Value)
+		msg.WithShardingKey(string(m.Key))
+		msg.WithKeys([]string{string(m.Key)})
+		switch s.TagBy {
+		case TagByTable:
+			msg.WithTag(m.Table)
+		case TagByAction:
+			msg.WithTag(m.Action)
+		}
+		messages = append(messages, msg)
+	}
+	return messages, nil
+}
+
+func (s *RocketMQSinker) sendOrdered(msg *primitive.Message) error {
+	res, err := s.producer.SendSync(context.Background(), msg)
+	if err != nil {
+		return err
+	}
+	if res.Status != primitive.SendOK {
+		return fmt.Errorf("send status: %d", res.Status)
+	}
+	return nil
+}
+
+func (s *RocketMQSinker) addFailed(q string, msg *primitive.Message) {
+	s.failed[q] = append(s.failed[q], msg)
+	s.failedCount++
+}
+
+// retryFailed 按队列重试失败的消息， 每个队列遇到失败即停止， 保证队列内的顺序
+func (s *RocketMQSinker) retryFailed() {
+	for q, messages := range s.failed {
+		for len(messages) > 0 {
+			if err := s.sendOrdered(messages[0]); err != nil {
+				log.Warnf("rocketmq sinker retry failed, queue: %s, waiting: %d, err: %s\n", q, len(messages), err.Error())
+				break
+			}
+			messages = messages[1:]
+			s.failedCount--
+		}
+		if len(messages) == 0 {
+			delete(s.failed, q)
+		} else {
+			s.failed[q] = messages
+		}
+	}
+}
+
+func Build(c string) (*RocketMQSinker, error) {
+	cfg := new(RocketMQSinkerConfig)
+	if err := json.Unmarshal([]byte(c), cfg); err != nil {
+		return nil, err
+	}
+	if len(cfg.NameServers) == 0 {
+		return nil, errors.New("rocketmq sinker: nameServers not configured")
+	}
+	encoder, err := format.NewEncoder(cfg.Format)
+	if err != nil {
+		return nil, err
+	}
+	group := cfg.Group
+	if len(group) == 0 {
+		group = defaultGroup
+	}
+	selector := newPKQueueSelector()
+	opts := []producer.Option{
+		producer.WithNsResolver(primitive.NewPassthroughResolver(cfg.NameServers)),
+		producer.WithGroupName(group),
+		producer.WithQueueSelector(selector),
+	}
+	if cfg.Retries > 0 {
+		opts = append(opts, producer.WithRetry(cfg.Retries))
+	}
+	if cfg.SendTimeoutMs > 0 {
+		opts = append(opts, producer.WithSendMsgTimeout(time.Duration(cfg.SendTimeoutMs)*time.Millisecond))
+	}
+	if len(cfg.AccessKey) > 0 {
+		opts = append(opts, producer.WithCredentials(primitive.Credentials{
+			AccessKey: cfg.AccessKey,
+			SecretKey: cfg.SecretKey,
+		}))
+	}
+
+	p, err := rocketmq.NewProducer(opts...)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.Start(); err != nil {
+		return nil, err
+	}
+	s := &RocketMQSinker{
+		ErrorContinue: cfg.ErrorContinue,
+		Filter:        cfg.Filter,
+		Topic:         cfg.Topic,
+		TagBy:         cfg.TagBy,
+		encoder:       encoder,
+		selector:      selector,
+		producer:      p,
+		sendOnCommit:  cfg.SendOnCommit,
+		txIds:         newTxIds(),
+		maxFailed:     cfg.MaxFailed,
+		failed:        make(map[string][]*primitive.Message, 8),
+	}
+	if len(s.Topic) == 0 {
+		s.Topic = defaultTopic
+	}
+	if s.maxFailed <= 0 {
+		s.maxFailed = defaultMaxFailed
+	}
+	return s, nil
+}
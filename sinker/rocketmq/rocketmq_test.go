@@ -0,0 +1,126 @@
+package rocketmq
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/apache/rocketmq-client-go/v2"
+	"github.com/apache/rocketmq-client-go/v2/primitive"
+	"github.com/go-mysql-org/go-mysql/canal"
+	"github.com/go-mysql-org/go-mysql/replication"
+	"github.com/go-mysql-org/go-mysql/schema"
+	"github.com/gridsx/datagos/common"
+	"github.com/gridsx/datagos/sinker/format"
+)
+
+// fakeProducer 记录发送成功的消息， down 时发送失败
+type fakeProducer struct {
+	rocketmq.Producer
+	down bool
+	sent []*primitive.Message
+}
+
+func (p *fakeProducer) SendSync(ctx context.Context, msgs ...*primitive.Message) (*primitive.SendResult, error) {
+	if p.down {
+		return nil, errors.New("broker down")
+	}
+	p.sent = append(p.sent, msgs...)
+	return &primitive.SendResult{Status: primitive.SendOK}, nil
+}
+
+func (p *fakeProducer) Shutdown() error {
+	return nil
+}
+
+func newTestSinker(t *testing.T, sendOnCommit bool, maxFailed int) (*RocketMQSinker, *fakeProducer) {
+	encoder, err := format.NewEncoder(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &fakeProducer{}
+	return &RocketMQSinker{
+		Topic:        defaultTopic,
+		encoder:      encoder,
+		selector:     newPKQueueSelector(),
+		producer:     p,
+		sendOnCommit: sendOnCommit,
+		txIds:        newTxIds(),
+		maxFailed:    maxFailed,
+		failed:       make(map[string][]*primitive.Message),
+	}, p
+}
+
+func testEvent(ids ...int64) *canal.RowsEvent {
+	table := &schema.Table{Schema: "db", Name: "users", PKColumns: []int{0}}
+	table.AddColumn("id", "bigint", "", "")
+	table.AddColumn("name", "varchar(32)", "", "")
+	rows := make([][]interface{}, 0, len(ids))
+	for _, id := range ids {
+		rows = append(rows, []interface{}{id, "n"})
+	}
+	return &canal.RowsEvent{Table: table, Action: canal.InsertAction, Rows: rows,
+		Header: &replication.EventHeader{Timestamp: 1}}
+}
+
+func keys(messages []*primitive.Message) []string {
+	result := make([]string, 0, len(messages))
+	for _, m := range messages {
+		result = append(result, m.GetShardingKey())
+	}
+	return result
+}
+
+// 失败的消息排在队列中， 之后的消息跟在后面， 恢复之后按原来的顺序发送
+func TestFailedMessagesKeepOrder(t *testing.T) {
+	s, p := newTestSinker(t, false, 2)
+	p.down = true
+	if err := s.OnEvent(testEvent(1, 2)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Flush(); err == nil {
+		t.Fatal("flush succeeded with failed messages")
+	}
+	// 超过上限时事件已经接收， 返回 BufferedError， pipeline 不会重复处理
+	var buffered *common.BufferedError
+	if err := s.OnEvent(testEvent(3)); !errors.As(err, &buffered) {
+		t.Fatalf("over limit: %v", err)
+	}
+	p.down = false
+	if err := s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if got := keys(p.sent); len(got) != 3 || got[0] != "1" || got[1] != "2" || got[2] != "3" {
+		t.Fatalf("sent: %v", got)
+	}
+}
+
+// sendOnCommit 时提交之后才发送， 同一事务的消息带相同的事务id
+func TestSendOnCommit(t *testing.T) {
+	s, p := newTestSinker(t, true, 100)
+	if err := s.OnEvent(testEvent(1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.OnEvent(testEvent(2)); err != nil {
+		t.Fatal(err)
+	}
+	if len(p.sent) != 0 {
+		t.Fatalf("sent before commit: %v", keys(p.sent))
+	}
+	if err := s.OnCommit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.OnEvent(testEvent(3)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.OnCommit(); err != nil {
+		t.Fatal(err)
+	}
+	if got := keys(p.sent); len(got) != 3 || got[0] != "1" || got[2] != "3" {
+		t.Fatalf("sent: %v", got)
+	}
+	tx1, tx2 := p.sent[0].GetProperty(txIdProperty), p.sent[2].GetProperty(txIdProperty)
+	if len(tx1) == 0 || p.sent[1].GetProperty(txIdProperty) != tx1 || tx2 == tx1 {
+		t.Fatalf("transaction ids: %s %s %s", tx1, p.sent[1].GetProperty(txIdProperty), tx2)
+	}
+}
@@ -0,0 +1,48 @@
+package rocketmq
+
+import (
+	"hash/fnv"
+	"sync"
+
+	"github.com/apache/rocketmq-client-go/v2/primitive"
+)
+
+// pkQueueSelector 按主键（sharding key）hash选择队列， 同一主键总是发往同一个队列， 保证顺序
+// 同时记录每个topic的队列路由， 用于发送之前计算消息所属的队列
+type pkQueueSelector struct {
+	lock   sync.RWMutex
+	routes map[string][]*primitive.MessageQueue
+}
+
+func newPKQueueSelector() *pkQueueSelector {
+	return &pkQueueSelector{routes: make(map[string][]*primitive.MessageQueue, 8)}
+}
+
+func (s *pkQueueSelector) Select(msg *primitive.Message, queues []*primitive.MessageQueue) *primitive.MessageQueue {
+	if len(queues) == 0 {
+		return nil
+	}
+	s.lock.Lock()
+	s.routes[msg.Topic] = queues
+	s.lock.Unlock()
+	q := pick(msg.GetShardingKey(), queues)
+	msg.Queue = q
+	return q
+}
+
+// queueOf 消息将要发往的队列， 路由未知的时候返回 topic 本身
+func (s *pkQueueSelector) queueOf(msg *primitive.Message) string {
+	s.lock.RLock()
+	queues := s.routes[msg.Topic]
+	s.lock.RUnlock()
+	if len(queues) == 0 {
+		return msg.Topic
+	}
+	return pick(msg.GetShardingKey(), queues).String()
+}
+
+func pick(key string, queues []*primitive.MessageQueue) *primitive.MessageQueue {
+	hasher := fnv.New32a()
+	_, _ = hasher.Write([]byte(key))
+	return queues[hasher.Sum32()%uint32(len(queues))]
+}
@@ -0,0 +1,24 @@
+package rocketmq
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// 消息上记录的源库事务id， 同一个源库事务的消息 id 相同， 消费端可以据此按事务聚合
+const txIdProperty = "DATAGOS_TX_ID"
+
+// txIds 生成源库事务id， 前缀区分不同的进程
+type txIds struct {
+	seq    uint64
+	prefix string
+}
+
+func newTxIds() *txIds {
+	return &txIds{prefix: fmt.Sprintf("%d", time.Now().UnixNano())}
+}
+
+func (t *txIds) next() string {
+	return fmt.Sprintf("%s-%d", t.prefix, atomic.AddUint64(&t.seq, 1))
+}
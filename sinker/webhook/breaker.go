@@ -0,0 +1,60 @@
+package webhook
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var errCircuitOpen = errors.New("webhook circuit breaker is open")
+
+// breaker 熔断器， 连续失败达到阈值之后打开， 打开期间不再请求
+// 打开时间过去之后进入半开状态， 允许一次请求， 成功则关闭， 失败则重新打开
+type breaker struct {
+	threshold int
+	openFor   time.Duration
+
+	lock     sync.Mutex
+	failures int
+	openedAt time.Time
+	open     bool
+}
+
+func newBreaker(threshold int, openFor time.Duration) *breaker {
+	return &breaker{threshold: threshold, openFor: openFor}
+}
+
+// allow 熔断器打开的时候返回还需要等待的时间
+func (b *breaker) allow() (time.Duration, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if !b.open {
+		return 0, nil
+	}
+	if wait := b.openFor - time.Since(b.openedAt); wait > 0 {
+		return wait, errCircuitOpen
+	}
+	return 0, nil
+}
+
+func (b *breaker) success() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.failures = 0
+	b.open = false
+}
+
+// failure 返回熔断器是否由此打开
+func (b *breaker) failure() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.failures++
+	if b.open || b.failures >= b.threshold {
+		// 半开状态下失败， 重新计时
+		opened := !b.open
+		b.open = true
+		b.openedAt = time.Now()
+		return opened
+	}
+	return false
+}
@@ -0,0 +1,397 @@
+package webhook
+
+// 变更事件通过 HTTP POST 推送到配置的地址， 可以逐条推送， 也可以以 JSON 数组批量推送
+// 消息按主键哈希到不同的通道， 通道之间并发， 通道内部按顺序发送， 保证同一主键的顺序
+// 推送失败按指数退避重试， 连续失败达到阈值之后熔断， 熔断期间 OnEvent 阻塞， 任务暂停消费， 而不是禁用sinker，
+// 熔断结束之后从失败的地方继续推送； 服务端明确拒绝的请求（4xx）不会重试， 被拒绝的消息保留在通道中，
+// pipeline 暂停 sinker、 保持位点不前进， 之后按退避时间重新推送， 成功之后任务从位点重启
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-mysql-org/go-mysql/canal"
+	"github.com/go-mysql-org/go-mysql/mysql"
+	"github.com/gridsx/datagos/canal/mysql/filter"
+	"github.com/gridsx/datagos/common"
+	"github.com/gridsx/datagos/sinker/format"
+	"github.com/siddontang/go-log/log"
+)
+
+const (
+	defaultTimeoutMs        = 5000
+	defaultBatchSize        = 1
+	defaultLanes            = 4
+	defaultMaxRetries       = 3
+	defaultBackoffMs        = 200
+	defaultMaxBackoffMs     = 10000
+	defaultBreakerThreshold = 3
+	defaultBreakerOpenSec   = 30
+
+	HeaderSignature = "X-Datagos-Signature"
+	HeaderTimestamp = "X-Datagos-Timestamp"
+)
+
+// WebhookSinkerConfig 对应 task_dests 的 config 字段
+type WebhookSinkerConfig struct {
+	URL     string            `json:"url"`
+	Method  string            `json:"method,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+	// Secret 配置之后对请求签名， 签名为 hex(hmac-sha256(secret, 时间戳 + "." + 请求体))
+	Secret    string `json:"secret,omitempty"`
+	TimeoutMs int    `json:"timeoutMs,omitempty"`
+	// BatchSize 为 1 的时候逐条推送， 大于 1 的时候请求体为消息组成的 JSON 数组
+	BatchSize int `json:"batchSize,omitempty"`
+	// Lanes 并发推送的通道数， 同一主键总是在同一个通道
+	Lanes        int `json:"lanes,omitempty"`
+	MaxRetries   int `json:"maxRetries,omitempty"`
+	BackoffMs    int `json:"backoffMs,omitempty"`
+	MaxBackoffMs int `json:"maxBackoffMs,omitempty"`
+	// BreakerThreshold 连续失败多少次之后熔断， BreakerOpenSec 熔断持续时间
+	BreakerThreshold int            `json:"breakerThreshold,omitempty"`
+	BreakerOpenSec   int            `json:"breakerOpenSec,omitempty"`
+	Message          *format.Config `json:"message,omitempty"`
+
+	Filter        *filter.TableFilter `json:"filter,omitempty"`
+	ErrorContinue bool                `json:"errorContinue"`
+}
+
+type WebhookSinker struct {
+	// retries 累计重试次数
+	retries       uint64
+	disabled      bool
+	ErrorContinue bool
+	Filter        *filter.TableFilter
+
+	url         string
+	method      string
+	headers     map[string]string
+	contentType string
+	secret      []byte
+	client      *http.Client
+	encoder     format.Encoder
+	source      format.Source
+	batchSize   int
+	maxRetries  int
+	backoff     time.Duration
+	maxBackoff  time.Duration
+	breaker     *breaker
+
+	lock  sync.Mutex
+	lanes [][]*format.Message
+	done  chan struct{}
+	once  sync.Once
+}
+
+// permanentError 服务端拒绝的请求， 重试也不会成功
+type permanentError struct {
+	status int
+	body   string
+}
+
+func (e *permanentError) Error() string {
+	return fmt.Sprintf("webhook rejected, status: %d, body: %s", e.status, e.body)
+}
+
+func (s *WebhookSinker) Enable() bool {
+	return !s.disabled
+}
+
+func (s *WebhookSinker) Disable() {
+	s.disabled = true
+}
+
+func (s *WebhookSinker) ContinueOnError() bool {
+	return s.ErrorContinue
+}
+
+// Retries 累计重试次数， 用于监控
+func (s *WebhookSinker) Retries() uint64 {
+	return atomic.LoadUint64(&s.retries)
+}
+
+// SetPosition 与 OnEvent 在同一个协程中调用
+func (s *WebhookSinker) SetPosition(pos mysql.Position, gtid string) {
+	s.source = format.Source{Position: pos, GTID: gtid}
+}
+
+func (s *WebhookSinker) OnEvent(e *canal.RowsEvent) error {
+	if e == nil || e.Table == nil {
+		return nil
+	}
+	if s.Filter != nil && s.Filter.Match(e) {
+		return nil
+	}
+	messages, err := s.encoder.Encode(e, &s.source)
+	if err != nil {
+		return err
+	}
+	s.lock.Lock()
+	full := false
+	for _, m := range messages {
+		idx := laneOf(m.Key, len(s.lanes))
+		s.lanes[idx] = append(s.lanes[idx], m)
+		full = full || len(s.lanes[idx]) >= s.batchSize
+	}
+	s.lock.Unlock()
+	if !full {
+		return nil
+	}
+	return s.deliver(true)
+}
+
+// Flush 保存位点之前推送所有缓冲的消息， 熔断期间直接返回错误， 位点不前进
+func (s *WebhookSinker) Flush() error {
+	return s.deliver(false)
+}
+
+func (s *WebhookSinker) Close() error {
+	s.once.Do(func() {
+		close(s.done)
+	})
+	return nil
+}
+
+// deliver 推送所有通道的消息， block 为 true 的时候一直重试直到成功， 熔断期间阻塞等待
+func (s *WebhookSinker) deliver(block bool) error {
+	for {
+		if wait, err := s.breaker.allow(); err != nil {
+			if !block {
+				return err
+			}
+			select {
+			case <-time.After(wait):
+				continue
+			case <-s.done:
+				return errors.New("webhook sinker closed")
+			}
+		}
+		s.lock.Lock()
+		err := s.flushLanes()
+		s.lock.Unlock()
+		if err == nil {
+			s.breaker.success()
+			return nil
+		}
+		var rejected *permanentError
+		if errors.As(err, &rejected) {
+			return err
+		}
+		if s.breaker.failure() {
+			log.Errorf("webhook circuit breaker opened, task paused, url: %s, err: %v\n", s.url, err)
+		}
+		if !block {
+			return err
+		}
+	}
+}
+
+// flushLanes 各个通道并发推送， 失败的通道保留未推送的消息， 下次从失败的地方继续
+func (s *WebhookSinker) flushLanes() error {
+	errs := make([]error, len(s.lanes))
+	wg := sync.WaitGroup{}
+	for i := range s.lanes {
+		if len(s.lanes[i]) == 0 {
+			continue
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for len(s.lanes[i]) > 0 {
+				n := s.batchSize
+				if n > len(s.lanes[i]) {
+					n = len(s.lanes[i])
+				}
+				if err := s.sendWithRetry(s.lanes[i][:n]); err != nil {
+					// 被拒绝的消息不属于当前的事件， 保留在通道中， 交给 pipeline 暂停 sinker
+					var rejected *permanentError
+					if errors.As(err, &rejected) {
+						err = &common.BufferedError{Err: err}
+					}
+					errs[i] = err
+					return
+				}
+				s.lanes[i] = s.lanes[i][n:]
+			}
+		}(i)
+	}
+	wg.Wait()
+	// 被拒绝的错误优先返回， 不会被其他通道的网络错误掩盖
+	var first error
+	for _, err := range errs {
+		var buffered *common.BufferedError
+		if errors.As(err, &buffered) {
+			return err
+		}
+		if first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+func (s *WebhookSinker) sendWithRetry(batch []*format.Message) error {
+	body := s.body(batch)
+	backoff := s.backoff
+	var err error
+	for i := 0; ; i++ {
+		if err = s.send(body); err == nil {
+			return nil
+		}
+		var rejected *permanentError
+		if errors.As(err, &rejected) || i >= s.maxRetries {
+			return err
+		}
+		log.Warnf("webhook send failed, retry in %v, err: %v\n", backoff, err)
+		atomic.AddUint64(&s.retries, 1)
+		select {
+		case <-time.After(backoff):
+		case <-s.done:
+			return err
+		}
+		if backoff *= 2; backoff > s.maxBackoff {
+			backoff = s.maxBackoff
+		}
+	}
+}
+
+func (s *WebhookSinker) send(body []byte) error {
+	req, err := http.NewRequest(s.method, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", s.contentType)
+	for k, v := range s.headers {
+		req.Header.Set(k, v)
+	}
+	if len(s.secret) > 0 {
+		ts := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set(HeaderTimestamp, ts)
+		req.Header.Set(HeaderSignature, "sha256="+sign(s.secret, ts, body))
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode >= 400 && resp.StatusCode < 500 &&
+		resp.StatusCode != http.StatusRequestTimeout && resp.StatusCode != http.StatusTooManyRequests:
+		return &permanentError{status: resp.StatusCode, body: string(respBody)}
+	default:
+		return fmt.Errorf("webhook error, status: %d, body: %s", resp.StatusCode, string(respBody))
+	}
+}
+
+// body 逐条推送的时候请求体为消息本身， 批量的时候为 JSON 数组
+func (s *WebhookSinker) body(batch []*format.Message) []byte {
+	if s.batchSize == 1 && len(batch) == 1 {
+		return batch[0].Value
+	}
+	buf := bytes.Buffer{}
+	buf.WriteByte('[')
+	for i, m := range batch {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		buf.Write(m.Value)
+	}
+	buf.WriteByte(']')
+	return buf.Bytes()
+}
+
+// sign 签名包含时间戳， 接收方可以据此拒绝重放的请求
+func sign(secret []byte, ts string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(ts))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func laneOf(key []byte, n int) int {
+	h := fnv.New32a()
+	_, _ = h.Write(key)
+	return int(h.Sum32() % uint32(n))
+}
+
+func Build(c string) (*WebhookSinker, error) {
+	cfg := new(WebhookSinkerConfig)
+	if err := json.Unmarshal([]byte(c), cfg); err != nil {
+		return nil, err
+	}
+	if len(cfg.URL) == 0 {
+		return nil, errors.New("webhook sinker: url not configured")
+	}
+	encoder, err := format.NewEncoder(cfg.Message)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Message.IsBinary() && cfg.BatchSize > 1 {
+		return nil, errors.New("webhook sinker: binary message format can not be batched")
+	}
+	if len(cfg.Method) == 0 {
+		cfg.Method = http.MethodPost
+	}
+	if cfg.TimeoutMs <= 0 {
+		cfg.TimeoutMs = defaultTimeoutMs
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = defaultBatchSize
+	}
+	if cfg.Lanes <= 0 {
+		cfg.Lanes = defaultLanes
+	}
+	if cfg.MaxRetries <= 0 {
+		cfg.MaxRetries = defaultMaxRetries
+	}
+	if cfg.BackoffMs <= 0 {
+		cfg.BackoffMs = defaultBackoffMs
+	}
+	if cfg.MaxBackoffMs <= 0 {
+		cfg.MaxBackoffMs = defaultMaxBackoffMs
+	}
+	if cfg.BreakerThreshold <= 0 {
+		cfg.BreakerThreshold = defaultBreakerThreshold
+	}
+	if cfg.BreakerOpenSec <= 0 {
+		cfg.BreakerOpenSec = defaultBreakerOpenSec
+	}
+	s := &WebhookSinker{
+		ErrorContinue: cfg.ErrorContinue,
+		Filter:        cfg.Filter,
+		url:           cfg.URL,
+		method:        cfg.Method,
+		headers:       cfg.Headers,
+		contentType:   "application/json",
+		secret:        []byte(cfg.Secret),
+		client:        &http.Client{Timeout: time.Duration(cfg.TimeoutMs) * time.Millisecond},
+		encoder:       encoder,
+		batchSize:     cfg.BatchSize,
+		maxRetries:    cfg.MaxRetries,
+		backoff:       time.Duration(cfg.BackoffMs) * time.Millisecond,
+		maxBackoff:    time.Duration(cfg.MaxBackoffMs) * time.Millisecond,
+		breaker:       newBreaker(cfg.BreakerThreshold, time.Duration(cfg.BreakerOpenSec)*time.Second),
+		lanes:         make([][]*format.Message, cfg.Lanes),
+		done:          make(chan struct{}),
+	}
+	if cfg.Message.IsBinary() {
+		s.contentType = "application/x-protobuf"
+	}
+	return s, nil
+}
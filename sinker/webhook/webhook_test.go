@@ -0,0 +1,145 @@
+package webhook
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/go-mysql-org/go-mysql/canal"
+	"github.com/go-mysql-org/go-mysql/replication"
+	"github.com/go-mysql-org/go-mysql/schema"
+	"github.com/gridsx/datagos/common"
+)
+
+// receiver 本地的推送地址， status 为每次请求返回的状态码， 默认成功
+type receiver struct {
+	*httptest.Server
+	lock     sync.Mutex
+	status   int
+	requests []*http.Request
+	bodies   [][]byte
+}
+
+func newReceiver(t *testing.T) *receiver {
+	r := &receiver{status: http.StatusOK}
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		r.lock.Lock()
+		defer r.lock.Unlock()
+		r.requests = append(r.requests, req)
+		r.bodies = append(r.bodies, body)
+		w.WriteHeader(r.status)
+	}))
+	t.Cleanup(r.Close)
+	return r
+}
+
+func (r *receiver) setStatus(status int) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.status = status
+}
+
+func (r *receiver) count() int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return len(r.requests)
+}
+
+func newTestSinker(t *testing.T, r *receiver, extra string) *WebhookSinker {
+	s, err := Build(fmt.Sprintf(`{"url":"%s","lanes":1,"maxRetries":1,"backoffMs":1,"maxBackoffMs":1%s}`, r.URL, extra))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = s.Close() })
+	return s
+}
+
+func testEvent(ids ...int64) *canal.RowsEvent {
+	table := &schema.Table{Schema: "db", Name: "users", PKColumns: []int{0}}
+	table.AddColumn("id", "bigint", "", "")
+	table.AddColumn("name", "varchar(32)", "", "")
+	rows := make([][]interface{}, 0, len(ids))
+	for _, id := range ids {
+		rows = append(rows, []interface{}{id, "n"})
+	}
+	return &canal.RowsEvent{Table: table, Action: canal.InsertAction, Rows: rows,
+		Header: &replication.EventHeader{Timestamp: 1}}
+}
+
+// 配置了 secret 的请求带时间戳和签名， 签名覆盖时间戳和请求体
+func TestSignature(t *testing.T) {
+	r := newReceiver(t)
+	s := newTestSinker(t, r, `,"batchSize":10,"secret":"s3cret"`)
+	if err := s.OnEvent(testEvent(1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if r.count() != 1 {
+		t.Fatalf("requests: %d", r.count())
+	}
+	ts := r.requests[0].Header.Get(HeaderTimestamp)
+	if len(ts) == 0 {
+		t.Fatal("timestamp header missing")
+	}
+	want := "sha256=" + sign([]byte("s3cret"), ts, r.bodies[0])
+	if got := r.requests[0].Header.Get(HeaderSignature); got != want {
+		t.Fatalf("signature: %s, want: %s", got, want)
+	}
+}
+
+// 4xx 不重试， 消息保留在通道中， 返回 BufferedError 让 pipeline 暂停 sinker， 恢复之后重新推送
+func TestRejectedKeptForPause(t *testing.T) {
+	r := newReceiver(t)
+	r.setStatus(http.StatusBadRequest)
+	s := newTestSinker(t, r, "")
+	var buffered *common.BufferedError
+	if err := s.OnEvent(testEvent(1)); !errors.As(err, &buffered) {
+		t.Fatalf("rejected: %v", err)
+	}
+	if r.count() != 1 {
+		t.Fatalf("rejected request retried: %d", r.count())
+	}
+	if len(s.lanes[0]) != 1 {
+		t.Fatalf("rejected message not kept: %d", len(s.lanes[0]))
+	}
+	r.setStatus(http.StatusOK)
+	if err := s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if r.count() != 2 || string(r.bodies[0]) != string(r.bodies[1]) {
+		t.Fatalf("requests: %d", r.count())
+	}
+}
+
+// 连续失败达到阈值之后熔断， 熔断期间 Flush 不再请求
+func TestBreakerOpens(t *testing.T) {
+	r := newReceiver(t)
+	r.setStatus(http.StatusInternalServerError)
+	s := newTestSinker(t, r, `,"batchSize":10,"breakerThreshold":2`)
+	if err := s.OnEvent(testEvent(1)); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := s.Flush(); err == nil {
+			t.Fatal("flush succeeded on server error")
+		}
+	}
+	// 每次 flush 请求一次， 重试一次
+	sent := r.count()
+	if sent != 4 || s.Retries() != 2 {
+		t.Fatalf("requests: %d, retries: %d", sent, s.Retries())
+	}
+	if err := s.Flush(); !errors.Is(err, errCircuitOpen) {
+		t.Fatalf("open breaker: %v", err)
+	}
+	if r.count() != sent {
+		t.Fatalf("request sent while breaker open: %d", r.count())
+	}
+}
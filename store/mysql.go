@@ -16,10 +16,6 @@ var (
 	conf    = config.GetConf()
 )
 
-func init() {
-	initDb()
-}
-
 func initDb() {
 	once.Do(func() {
 		db, err := sql.Open("mysql", fmt.Sprintf("%s:%s@tcp(%s:%d)/%s?parseTime=true",
@@ -32,12 +28,12 @@ func initDb() {
 		pingErr := db.Ping()
 		if pingErr != nil {
 			panic(pingErr)
-			return
 		}
 		localDb = db
 	})
 }
 
+// GetDb 第一次使用时连接， 引用 store 的包不需要数据库也能测试
 func GetDb() *sql.DB {
 	if localDb != nil {
 		return localDb
@@ -17,6 +17,11 @@ const (
 	updateInstStateSql = `update tasks set state = ? where id = ?`
 	taskDetailSql      = `select id, title, src_type, src, dest, state, info, created, updated from tasks where id = ?`
 	taskListSql        = `select id, title, src_type, src, dest, state, info, created, updated from tasks LIMIT ?, ?`
+
+	// 集群模式下校验仍然持有任务锁， 被接管之后旧的持有者不能再写入
+	fencedPositionSql = `update tasks t join cluster_tasks c on c.task_id = t.id set t.info = ? where t.id = ? and c.owner = ? and c.token = ?`
+	fencedStateSql    = `update tasks t join cluster_tasks c on c.task_id = t.id set t.state = ? where t.id = ? and c.owner = ? and c.token = ?`
+	fenceSql          = `select count(*) from cluster_tasks where task_id = ? and owner = ? and token = ?`
 )
 
 var Manager = &metaManager{}
@@ -1,6 +1,8 @@
 package task
 
 import (
+	"database/sql"
+	"errors"
 	"fmt"
 	"time"
 )
@@ -10,6 +12,8 @@ type srcType int
 const (
 	Running = 1
 	Stopped = 2
+	// Failed 按重试策略停止或者恢复失败， 位点停在出错的事件之前
+	Failed = 3
 )
 
 const (
@@ -20,6 +24,15 @@ const (
 	SrcRedis
 )
 
+// ErrFenced 任务锁已经被其他节点接管， 不能再写入位点和状态
+var ErrFenced = errors.New("task lock lost")
+
+// Fence 集群模式下持有的任务锁， 写入位点和状态时校验
+type Fence struct {
+	Owner string
+	Token int64
+}
+
 const getDestSQL = `select id, type, name, config, created, updated from task_dests where id IN (%s)`
 
 // Task 对应数据库表 tasks
@@ -33,6 +46,8 @@ type Task struct {
 	Info    *string   `json:"info" gorm:"info"`
 	Created time.Time `json:"created" gorm:"created"`
 	Updated time.Time `json:"updated" gorm:"updated"`
+	// Fence 不为空时只有仍然持有任务锁才能写入
+	Fence *Fence `json:"-" gorm:"-"`
 }
 
 func (t *Task) TableName() string {
@@ -40,12 +55,22 @@ func (t *Task) TableName() string {
 }
 
 func (t *Task) UpdateTaskInfo(info string) error {
-	_, err := db.Exec(updatePositionSql, info, t.Id)
+	if t.Fence == nil {
+		_, err := db.Exec(updatePositionSql, info, t.Id)
+		return err
+	}
+	_, err := t.fenced(fencedPositionSql, info)
 	return err
 }
 
 func (t *Task) UpdateTaskState(state int) error {
-	a, err := db.Exec(updateInstStateSql, state, t.Id)
+	var a sql.Result
+	var err error
+	if t.Fence == nil {
+		a, err = db.Exec(updateInstStateSql, state, t.Id)
+	} else {
+		a, err = t.fenced(fencedStateSql, state)
+	}
 	if err != nil {
 		return err
 	}
@@ -55,6 +80,25 @@ func (t *Task) UpdateTaskState(state int) error {
 	return nil
 }
 
+// fenced 带任务锁校验的更新， 值没有变化时影响行数也是0， 需要再查一次锁
+func (t *Task) fenced(query string, value interface{}) (sql.Result, error) {
+	a, err := db.Exec(query, value, t.Id, t.Fence.Owner, t.Fence.Token)
+	if err != nil {
+		return nil, err
+	}
+	if r, _ := a.RowsAffected(); r > 0 {
+		return a, nil
+	}
+	var n int
+	if err := db.QueryRow(fenceSql, t.Id, t.Fence.Owner, t.Fence.Token).Scan(&n); err != nil {
+		return nil, err
+	}
+	if n == 0 {
+		return nil, fmt.Errorf("%w, task: %d, token: %d", ErrFenced, t.Id, t.Fence.Token)
+	}
+	return a, nil
+}
+
 func (t *Task) GetDest() ([]*Dest, error) {
 	if len(t.Dest) == 0 {
 		return nil, nil
@@ -85,6 +129,10 @@ const (
 	DestEs
 	DestMongo
 	DestRocketMQ
+	DestKafka
+	DestClickHouse
+	DestFile
+	DestWebhook
 )
 
 type Dest struct {
@@ -0,0 +1,269 @@
+package verify
+
+// 按最近一次校验的差异修复目标
+// 按主键重新读取源表当前的行， 源表存在则以 update 事件交给任务的 sinker（前后两行相同， MySQL 目标为 REPLACE INTO），
+// 源表已经不存在则以 delete 事件删除目标的行， 与同步走相同的映射和过滤， 修复之后重新对比确认
+// dryRun 只生成 SQL 不执行， 每一行的修复都记录到 repair_audit 表
+// 修复使用单独的 sinker， 调用方需要先停止任务， 避免与同步同时写目标
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-mysql-org/go-mysql/canal"
+	"github.com/go-mysql-org/go-mysql/replication"
+	"github.com/go-mysql-org/go-mysql/schema"
+	"github.com/gridsx/datagos/blender"
+	"github.com/gridsx/datagos/canal/mysql/meta"
+	"github.com/gridsx/datagos/common"
+	mysqlSinker "github.com/gridsx/datagos/sinker/mysql"
+	"github.com/gridsx/datagos/store"
+	"github.com/gridsx/datagos/task"
+	"github.com/siddontang/go-log/log"
+)
+
+const insertAuditSql = `INSERT INTO repair_audit (task_id, dest, src_table, row_key, kind, action, statements, dry_run, fixed, error)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+
+// Repair 一行的修复结果
+type Repair struct {
+	Dest  string                 `json:"dest"`
+	Table string                 `json:"table"`
+	Key   map[string]interface{} `json:"key"`
+	Kind  string                 `json:"kind"`
+	// Action 按源表当前的行决定， update 或 delete
+	Action     string   `json:"action"`
+	Statements []string `json:"statements"`
+	Fixed      bool     `json:"fixed"`
+	Error      string   `json:"error,omitempty"`
+}
+
+// RepairTask 修复任务最近一次完成的校验中的差异
+func RepairTask(taskId int, dryRun bool) ([]*Repair, error) {
+	job := Get(taskId)
+	if job == nil {
+		return nil, errors.New("no verification for task")
+	}
+	report := job.Report()
+	if report.State != StateDone {
+		return nil, errors.New("verification not done, state: " + report.State)
+	}
+	t, err := task.Manager.GetTask(taskId)
+	if err != nil {
+		return nil, err
+	}
+	srcCfg := new(meta.MySQLSrcConfig)
+	if err := json.Unmarshal([]byte(t.Src), srcCfg); err != nil {
+		return nil, err
+	}
+	dests, err := t.GetDest()
+	if err != nil {
+		return nil, err
+	}
+	src := srcCfg.MySQLInstance.ToDatasource()
+	if src == nil {
+		return nil, errors.New("error connecting source")
+	}
+	defer src.Close()
+
+	result := make([]*Repair, 0)
+	for _, d := range dests {
+		tables := make([]*TableReport, 0)
+		for _, tr := range report.Tables {
+			if tr.Dest == d.Name && len(tr.Diffs) > 0 {
+				tables = append(tables, tr)
+			}
+		}
+		if len(tables) == 0 {
+			continue
+		}
+		repairs, err := repairDest(t.Id, d, src, srcCfg.Database, tables, dryRun)
+		if err != nil {
+			return result, fmt.Errorf("repair dest %s error: %v", d.Name, err)
+		}
+		result = append(result, repairs...)
+	}
+	return result, nil
+}
+
+func repairDest(taskId int, d *task.Dest, src *sql.DB, schemaName string, tables []*TableReport, dryRun bool) ([]*Repair, error) {
+	cfg := new(mysqlSinker.MySQLSinkerConfig)
+	if err := json.Unmarshal([]byte(d.Config), cfg); err != nil {
+		return nil, err
+	}
+	s, err := blender.BuildSinker(d)
+	if err != nil {
+		return nil, err
+	}
+	ms, ok := s.(*mysqlSinker.MySQLSinker)
+	if !ok {
+		return nil, errors.New("only mysql dest supported")
+	}
+	defer closeSinker(s)
+	dst := cfg.DestDatasource.ToDatasource()
+	if dst == nil {
+		return nil, errors.New("error connecting dest")
+	}
+	defer dst.Close()
+
+	result := make([]*Repair, 0)
+	for _, tr := range tables {
+		// 报告中的源表为 库名.表名
+		table := tr.Source[strings.LastIndexByte(tr.Source, '.')+1:]
+		idx := -1
+		for i := range cfg.Mappings {
+			if cfg.Mappings[i].SrcTable == table {
+				idx = i
+				break
+			}
+		}
+		if idx < 0 {
+			return result, fmt.Errorf("mapping not found for table %s", tr.Source)
+		}
+		p, err := resolve(src, schemaName, cfg.DestDatasource.Database, &cfg.Mappings[idx])
+		if err != nil {
+			return result, err
+		}
+		tbl, err := schema.NewTableFromSqlDB(src, p.srcSchema, p.srcTable)
+		if err != nil {
+			return result, err
+		}
+		for _, diff := range tr.Diffs {
+			r := &Repair{Dest: d.Name, Table: tr.Source, Key: diff.Key, Kind: diff.Kind}
+			repairRow(r, ms, src, dst, p, tbl, dryRun)
+			audit(taskId, r, dryRun)
+			result = append(result, r)
+		}
+	}
+	if !dryRun {
+		if flusher, ok := s.(common.Flusher); ok {
+			if err := flusher.Flush(); err != nil {
+				return result, err
+			}
+		}
+	}
+	return result, nil
+}
+
+func repairRow(r *Repair, s *mysqlSinker.MySQLSinker, src, dst *sql.DB, p *tablePair, tbl *schema.Table, dryRun bool) {
+	key := make([]interface{}, len(p.srcKeys))
+	for i, k := range p.srcKeys {
+		key[i] = r.Key[k]
+	}
+	e, err := repairEvent(src, tbl, key)
+	if err != nil {
+		r.Error = err.Error()
+		return
+	}
+	r.Action = e.Action
+	for _, st := range s.Statements(e) {
+		r.Statements = append(r.Statements, render(st))
+	}
+	if dryRun {
+		return
+	}
+	if err := s.OnEvent(e); err != nil {
+		r.Error = err.Error()
+		return
+	}
+	kind, err := compareRow(src, dst, p, AlgoCRC32, key)
+	if err != nil {
+		r.Error = err.Error()
+		return
+	}
+	r.Fixed = len(kind) == 0
+}
+
+// repairEvent 按源表当前的行构造事件， 源表不存在的行只带主键
+func repairEvent(src *sql.DB, tbl *schema.Table, key []interface{}) (*canal.RowsEvent, error) {
+	names := make([]string, len(tbl.Columns))
+	for i, c := range tbl.Columns {
+		names[i] = c.Name
+	}
+	pks := make([]string, len(tbl.PKColumns))
+	for i, idx := range tbl.PKColumns {
+		pks[i] = tbl.Columns[idx].Name
+	}
+	holders := strings.TrimSuffix(strings.Repeat("?, ", len(pks)), ", ")
+	query := fmt.Sprintf("SELECT %s FROM %s.%s WHERE (%s) = (%s)",
+		quoteAll(names), quote(tbl.Schema), quote(tbl.Name), quoteAll(pks), holders)
+	row := make([]interface{}, len(names))
+	dest := make([]interface{}, len(names))
+	for i := range row {
+		dest[i] = &row[i]
+	}
+	header := &replication.EventHeader{Timestamp: uint32(time.Now().Unix())}
+	err := src.QueryRow(query, key...).Scan(dest...)
+	if errors.Is(err, sql.ErrNoRows) {
+		deleted := make([]interface{}, len(names))
+		for i, idx := range tbl.PKColumns {
+			deleted[idx] = key[i]
+		}
+		return &canal.RowsEvent{Table: tbl, Action: canal.DeleteAction, Rows: [][]interface{}{deleted}, Header: header}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for i, c := range tbl.Columns {
+		// 与 binlog 一致， 非二进制的字符串列为 string
+		if b, ok := row[i].([]byte); ok && !strings.Contains(c.RawType, "binary") && !strings.Contains(c.RawType, "blob") {
+			row[i] = string(b)
+		}
+	}
+	return &canal.RowsEvent{Table: tbl, Action: canal.UpdateAction, Rows: [][]interface{}{row, row}, Header: header}, nil
+}
+
+// render 参数代入之后的 SQL， 用于预览和审计
+func render(st *mysqlSinker.Statement) string {
+	var b strings.Builder
+	args := st.Args
+	for _, r := range st.SQL {
+		if r != '?' || len(args) == 0 {
+			b.WriteRune(r)
+			continue
+		}
+		b.WriteString(literal(args[0]))
+		args = args[1:]
+	}
+	return b.String()
+}
+
+func literal(v interface{}) string {
+	switch x := v.(type) {
+	case nil:
+		return "NULL"
+	case string:
+		return "'" + escape(x) + "'"
+	case []byte:
+		return "X'" + fmt.Sprintf("%x", x) + "'"
+	case time.Time:
+		return "'" + x.Format("2006-01-02 15:04:05.999999") + "'"
+	default:
+		return fmt.Sprint(x)
+	}
+}
+
+func escape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `'`, `\'`, "\n", `\n`, "\r", `\r`, "\x00", `\0`).Replace(s)
+}
+
+func audit(taskId int, r *Repair, dryRun bool) {
+	key, _ := json.Marshal(r.Key)
+	_, err := store.GetDb().Exec(insertAuditSql, taskId, r.Dest, r.Table, string(key), r.Kind, r.Action,
+		strings.Join(r.Statements, "\n"), dryRun, r.Fixed, r.Error)
+	if err != nil {
+		log.Errorf("error writing repair audit, task: %d, err: %v\n", taskId, err)
+	}
+}
+
+func closeSinker(s common.Sinker) {
+	if closer, ok := s.(common.Closer); ok {
+		if err := closer.Close(); err != nil {
+			log.Errorf("error closing sinker: %v\n", err)
+		}
+	}
+}
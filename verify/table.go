@@ -0,0 +1,270 @@
+package verify
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/gridsx/datagos/canal/mysql/mapper"
+)
+
+const (
+	AlgoCRC32 = "crc32"
+	AlgoMD5   = "md5"
+)
+
+// tablePair 源表和映射之后的目标表， 列按位置一一对应， 主键列在 keys 中的位置相同
+type tablePair struct {
+	srcSchema string
+	srcTable  string
+	dstSchema string
+	dstTable  string
+	srcCols   []string
+	dstCols   []string
+	srcKeys   []string
+	dstKeys   []string
+}
+
+func (p *tablePair) source() string {
+	return quote(p.srcSchema) + "." + quote(p.srcTable)
+}
+
+func (p *tablePair) target() string {
+	if len(p.dstSchema) == 0 {
+		return quote(p.dstTable)
+	}
+	return quote(p.dstSchema) + "." + quote(p.dstTable)
+}
+
+// resolve 按 sinker 的映射确定对比的列， 配置了 ColMappings 只对比映射的列， 否则对比源表所有列
+func resolve(src *sql.DB, schema, dstSchema string, m *mapper.TableMapping) (*tablePair, error) {
+	if len(m.Database) > 0 {
+		schema = m.Database
+	}
+	if len(schema) == 0 {
+		return nil, fmt.Errorf("source database unknown for table %s", m.SrcTable)
+	}
+	dst := m.DstTable
+	if len(dst) == 0 {
+		dst = m.SrcTable
+	}
+	p := &tablePair{srcSchema: schema, srcTable: m.SrcTable, dstSchema: dstSchema, dstTable: dst}
+	keys, err := primaryKeys(src, schema, m.SrcTable)
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("table %s.%s has no primary key", schema, m.SrcTable)
+	}
+	p.srcKeys = keys
+	for _, k := range keys {
+		p.dstKeys = append(p.dstKeys, m.DstName(k))
+	}
+	if len(m.ColMappings) > 0 {
+		for _, c := range m.ColMappings {
+			p.srcCols = append(p.srcCols, c.Src)
+			p.dstCols = append(p.dstCols, c.Dst)
+		}
+		return p, nil
+	}
+	cols, err := columns(src, schema, m.SrcTable)
+	if err != nil {
+		return nil, err
+	}
+	if len(cols) == 0 {
+		return nil, fmt.Errorf("table %s.%s not found", schema, m.SrcTable)
+	}
+	p.srcCols, p.dstCols = cols, cols
+	return p, nil
+}
+
+func primaryKeys(db *sql.DB, schema, table string) ([]string, error) {
+	return queryStrings(db, `SELECT COLUMN_NAME FROM information_schema.STATISTICS
+		WHERE TABLE_SCHEMA = ? AND TABLE_NAME = ? AND INDEX_NAME = 'PRIMARY' ORDER BY SEQ_IN_INDEX`, schema, table)
+}
+
+func columns(db *sql.DB, schema, table string) ([]string, error) {
+	return queryStrings(db, `SELECT COLUMN_NAME FROM information_schema.COLUMNS
+		WHERE TABLE_SCHEMA = ? AND TABLE_NAME = ? ORDER BY ORDINAL_POSITION`, schema, table)
+}
+
+func queryStrings(db *sql.DB, query string, args ...interface{}) ([]string, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	result := make([]string, 0)
+	for rows.Next() {
+		var s string
+		if err := rows.Scan(&s); err != nil {
+			return nil, err
+		}
+		result = append(result, s)
+	}
+	return result, rows.Err()
+}
+
+func quote(name string) string {
+	return "`" + strings.ReplaceAll(name, "`", "``") + "`"
+}
+
+func quoteAll(names []string) string {
+	quoted := make([]string, len(names))
+	for i, n := range names {
+		quoted[i] = quote(n)
+	}
+	return strings.Join(quoted, ", ")
+}
+
+// rowHash 单行的哈希， NULL 与空串通过 ISNULL 区分
+func rowHash(algo string, cols []string) string {
+	parts := make([]string, 0, len(cols)*2)
+	for _, c := range cols {
+		parts = append(parts, quote(c))
+	}
+	for _, c := range cols {
+		parts = append(parts, "ISNULL("+quote(c)+")")
+	}
+	concat := "CONCAT_WS('#', " + strings.Join(parts, ", ") + ")"
+	if algo == AlgoMD5 {
+		return "CAST(CONV(SUBSTRING(MD5(" + concat + "), 1, 16), 16, 10) AS UNSIGNED)"
+	}
+	return "CRC32(" + concat + ")"
+}
+
+// chunk 主键范围 (lower, upper]， 为 nil 表示没有边界
+type chunk struct {
+	lower []interface{}
+	upper []interface{}
+}
+
+// where 主键范围条件， 使用行构造器比较以便走主键索引
+func (c *chunk) where(keys []string) (string, []interface{}) {
+	conds := make([]string, 0, 2)
+	args := make([]interface{}, 0, len(keys)*2)
+	tuple := "(" + quoteAll(keys) + ")"
+	holders := "(" + strings.TrimSuffix(strings.Repeat("?, ", len(keys)), ", ") + ")"
+	if c.lower != nil {
+		conds = append(conds, tuple+" > "+holders)
+		args = append(args, c.lower...)
+	}
+	if c.upper != nil {
+		conds = append(conds, tuple+" <= "+holders)
+		args = append(args, c.upper...)
+	}
+	if len(conds) == 0 {
+		return "1 = 1", args
+	}
+	return strings.Join(conds, " AND "), args
+}
+
+// nextUpper 从 lower 开始第 size 行的主键， 没有则为最后一块
+func nextUpper(db *sql.DB, p *tablePair, lower []interface{}, size int) ([]interface{}, error) {
+	c := &chunk{lower: lower}
+	where, args := c.where(p.srcKeys)
+	query := fmt.Sprintf("SELECT %s FROM %s WHERE %s ORDER BY %s LIMIT 1 OFFSET %d",
+		quoteAll(p.srcKeys), p.source(), where, quoteAll(p.srcKeys), size-1)
+	values, err := scanRow(db.QueryRow(query, args...), len(p.srcKeys))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return values, err
+}
+
+// checksum 块内的行数以及行哈希的异或， 与行的顺序无关
+func checksum(db *sql.DB, table string, keys, cols []string, algo string, c *chunk) (int64, uint64, error) {
+	where, args := c.where(keys)
+	query := fmt.Sprintf("SELECT COUNT(*), COALESCE(BIT_XOR(%s), 0) FROM %s WHERE %s", rowHash(algo, cols), table, where)
+	var count int64
+	var sum uint64
+	err := db.QueryRow(query, args...).Scan(&count, &sum)
+	return count, sum, err
+}
+
+// rowHashes 块内每行的主键和哈希， key 为主键值拼接
+func rowHashes(db *sql.DB, table string, keys, cols []string, algo string, c *chunk) (map[string]*rowEntry, error) {
+	where, args := c.where(keys)
+	query := fmt.Sprintf("SELECT %s, %s FROM %s WHERE %s", quoteAll(keys), rowHash(algo, cols), table, where)
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	result := make(map[string]*rowEntry)
+	for rows.Next() {
+		values, hash, err := scanKeyHash(rows, len(keys))
+		if err != nil {
+			return nil, err
+		}
+		result[keyString(values)] = &rowEntry{key: values, hash: hash}
+	}
+	return result, rows.Err()
+}
+
+// rowHashByKey 单行的哈希， 行不存在时 ok 为 false
+func rowHashByKey(db *sql.DB, table string, keys, cols []string, algo string, key []interface{}) (uint64, bool, error) {
+	holders := strings.TrimSuffix(strings.Repeat("?, ", len(keys)), ", ")
+	query := fmt.Sprintf("SELECT %s FROM %s WHERE (%s) = (%s)", rowHash(algo, cols), table, quoteAll(keys), holders)
+	var hash uint64
+	err := db.QueryRow(query, key...).Scan(&hash)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, false, nil
+	}
+	return hash, err == nil, err
+}
+
+type rowEntry struct {
+	key  []interface{}
+	hash uint64
+}
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanRow(s scanner, n int) ([]interface{}, error) {
+	raw := make([]sql.NullString, n)
+	dest := make([]interface{}, n)
+	for i := range raw {
+		dest[i] = &raw[i]
+	}
+	if err := s.Scan(dest...); err != nil {
+		return nil, err
+	}
+	return keyValues(raw), nil
+}
+
+func scanKeyHash(s scanner, n int) ([]interface{}, uint64, error) {
+	raw := make([]sql.NullString, n)
+	var hash uint64
+	dest := make([]interface{}, n+1)
+	for i := range raw {
+		dest[i] = &raw[i]
+	}
+	dest[n] = &hash
+	if err := s.Scan(dest...); err != nil {
+		return nil, 0, err
+	}
+	return keyValues(raw), hash, nil
+}
+
+// keyValues 主键值按字符串传回数据库， 比较时由数据库转换类型
+func keyValues(raw []sql.NullString) []interface{} {
+	values := make([]interface{}, len(raw))
+	for i, v := range raw {
+		if v.Valid {
+			values[i] = v.String
+		}
+	}
+	return values
+}
+
+func keyString(values []interface{}) string {
+	parts := make([]string, len(values))
+	for i, v := range values {
+		parts[i] = fmt.Sprint(v)
+	}
+	return strings.Join(parts, "\x00")
+}
@@ -0,0 +1,363 @@
+package verify
+
+// 源表与目标表的数据校验， 目前支持 MySQL 源到 MySQL 目标， 按目标 sinker 的表映射和列映射对比
+// 按主键把源表切分为块， 两边分别计算块内行哈希的异或， 不一致的块逐行对比主键和行哈希，
+// 同步中的数据在两边可能暂时不一致， 有差异的行等待一段时间后重新对比， 多次之后仍然不一致才报告
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gridsx/datagos/canal/mysql/meta"
+	mysqlSinker "github.com/gridsx/datagos/sinker/mysql"
+	"github.com/gridsx/datagos/task"
+	"github.com/siddontang/go-log/log"
+)
+
+const (
+	defaultChunkSize    = 1000
+	defaultRechecks     = 3
+	defaultRecheckDelay = 5 * time.Second
+	defaultMaxDiffs     = 1000
+
+	StateRunning   = "running"
+	StateDone      = "done"
+	StateFailed    = "failed"
+	StateCancelled = "cancelled"
+
+	DiffMissing = "missing" // 目标缺少
+	DiffExtra   = "extra"   // 目标多出
+	DiffChanged = "changed" // 两边都有， 值不一致
+)
+
+// Options 校验参数， 零值使用默认值
+type Options struct {
+	// Table 只校验这个源表， 为空校验所有映射的表
+	Table     string `json:"table,omitempty"`
+	ChunkSize int    `json:"chunkSize,omitempty"`
+	// RowsPerSecond 每秒最多校验的源表行数， 0 为不限制
+	RowsPerSecond int    `json:"rowsPerSecond,omitempty"`
+	Algorithm     string `json:"algorithm,omitempty"`
+	// Rechecks 有差异的行重新对比的次数， RecheckDelay 每次之前等待的时间
+	Rechecks     int           `json:"rechecks,omitempty"`
+	RecheckDelay time.Duration `json:"recheckDelay,omitempty"`
+	// MaxDiffs 每个表最多报告的差异行数
+	MaxDiffs int `json:"maxDiffs,omitempty"`
+}
+
+func (o *Options) defaults() {
+	if o.ChunkSize <= 0 {
+		o.ChunkSize = defaultChunkSize
+	}
+	if o.Algorithm != AlgoMD5 {
+		o.Algorithm = AlgoCRC32
+	}
+	if o.Rechecks <= 0 {
+		o.Rechecks = defaultRechecks
+	}
+	if o.RecheckDelay <= 0 {
+		o.RecheckDelay = defaultRecheckDelay
+	}
+	if o.MaxDiffs <= 0 {
+		o.MaxDiffs = defaultMaxDiffs
+	}
+}
+
+// Report 校验报告， 运行中的任务也可以查看当前进度
+type Report struct {
+	TaskId   int            `json:"taskId"`
+	State    string         `json:"state"`
+	Error    string         `json:"error,omitempty"`
+	Started  time.Time      `json:"started"`
+	Finished *time.Time     `json:"finished,omitempty"`
+	Tables   []*TableReport `json:"tables"`
+}
+
+// TableReport 一个目标上一个表的校验结果
+type TableReport struct {
+	Dest           string `json:"dest"`
+	Source         string `json:"source"`
+	Target         string `json:"target"`
+	Chunks         int    `json:"chunks"`
+	Rows           int64  `json:"rows"`
+	MismatchChunks int    `json:"mismatchChunks"`
+	// Truncated 差异超过 MaxDiffs， 只保留了前面的部分
+	Truncated bool    `json:"truncated"`
+	Diffs     []*Diff `json:"diffs"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// Diff 不一致的行， Key 为源表主键列到值
+type Diff struct {
+	Key  map[string]interface{} `json:"key"`
+	Kind string                 `json:"kind"`
+}
+
+// Job 一个任务的后台校验
+type Job struct {
+	lock   sync.Mutex
+	report *Report
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// Report 当前进度的副本
+func (j *Job) Report() *Report {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	d, _ := json.Marshal(j.report)
+	r := new(Report)
+	_ = json.Unmarshal(d, r)
+	return r
+}
+
+func (j *Job) Cancel() {
+	j.cancel()
+	<-j.done
+}
+
+func (j *Job) update(f func(r *Report)) {
+	j.lock.Lock()
+	f(j.report)
+	j.lock.Unlock()
+}
+
+// jobs 每个任务保留最近一次校验
+var jobs = struct {
+	sync.Mutex
+	m map[int]*Job
+}{m: make(map[int]*Job)}
+
+// Start 开始后台校验， 同一个任务同时只能有一个校验
+func Start(taskId int, opts Options) (*Job, error) {
+	jobs.Lock()
+	defer jobs.Unlock()
+	if j, ok := jobs.m[taskId]; ok && j.Report().State == StateRunning {
+		return nil, errors.New("verification already running")
+	}
+	t, err := task.Manager.GetTask(taskId)
+	if err != nil {
+		return nil, err
+	}
+	if t.SrcType != int(task.SrcMySQL) {
+		return nil, errors.New("only mysql source supported")
+	}
+	opts.defaults()
+	ctx, cancel := context.WithCancel(context.Background())
+	j := &Job{
+		report: &Report{TaskId: taskId, State: StateRunning, Started: time.Now(), Tables: make([]*TableReport, 0)},
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	jobs.m[taskId] = j
+	go func() {
+		defer close(j.done)
+		err := run(ctx, j, t, &opts)
+		j.update(func(r *Report) {
+			now := time.Now()
+			r.Finished = &now
+			switch {
+			case ctx.Err() != nil:
+				r.State = StateCancelled
+			case err != nil:
+				r.State, r.Error = StateFailed, err.Error()
+			default:
+				r.State = StateDone
+			}
+		})
+		log.Infof("verification finished, task: %d, err: %v\n", taskId, err)
+	}()
+	return j, nil
+}
+
+// Get 任务最近一次校验， 没有则为 nil
+func Get(taskId int) *Job {
+	jobs.Lock()
+	defer jobs.Unlock()
+	return jobs.m[taskId]
+}
+
+func run(ctx context.Context, j *Job, t *task.Task, opts *Options) error {
+	srcCfg := new(meta.MySQLSrcConfig)
+	if err := json.Unmarshal([]byte(t.Src), srcCfg); err != nil {
+		return err
+	}
+	dests, err := t.GetDest()
+	if err != nil {
+		return err
+	}
+	src := srcCfg.MySQLInstance.ToDatasource()
+	if src == nil {
+		return errors.New("error connecting source")
+	}
+	defer src.Close()
+	for _, d := range dests {
+		if d.Type != int(task.DestMySQL) {
+			continue
+		}
+		cfg := new(mysqlSinker.MySQLSinkerConfig)
+		if err := json.Unmarshal([]byte(d.Config), cfg); err != nil {
+			return fmt.Errorf("invalid dest config %s: %v", d.Name, err)
+		}
+		dst := cfg.DestDatasource.ToDatasource()
+		if dst == nil {
+			return fmt.Errorf("error connecting dest %s", d.Name)
+		}
+		for i := range cfg.Mappings {
+			m := &cfg.Mappings[i]
+			if len(opts.Table) > 0 && m.SrcTable != opts.Table {
+				continue
+			}
+			tr := &TableReport{Dest: d.Name, Source: m.SrcTable, Target: m.DstTable, Diffs: make([]*Diff, 0)}
+			j.update(func(r *Report) { r.Tables = append(r.Tables, tr) })
+			p, err := resolve(src, srcCfg.Database, cfg.DestDatasource.Database, m)
+			if err == nil {
+				j.update(func(*Report) { tr.Source, tr.Target = p.srcSchema+"."+p.srcTable, p.dstTable })
+				err = verifyTable(ctx, j, tr, src, dst, p, opts)
+			}
+			if ctx.Err() != nil {
+				dst.Close()
+				return ctx.Err()
+			}
+			if err != nil {
+				log.Errorf("verify table error, task: %d, table: %s, err: %v\n", t.Id, m.SrcTable, err)
+				j.update(func(*Report) { tr.Error = err.Error() })
+			}
+		}
+		dst.Close()
+	}
+	return nil
+}
+
+// verifyTable 按主键顺序逐块对比， 每块之后按 RowsPerSecond 限速
+func verifyTable(ctx context.Context, j *Job, tr *TableReport, src, dst *sql.DB, p *tablePair, opts *Options) error {
+	var lower []interface{}
+	for {
+		start := time.Now()
+		upper, err := nextUpper(src, p, lower, opts.ChunkSize)
+		if err != nil {
+			return err
+		}
+		c := &chunk{lower: lower, upper: upper}
+		srcCount, srcSum, err := checksum(src, p.source(), p.srcKeys, p.srcCols, opts.Algorithm, c)
+		if err != nil {
+			return err
+		}
+		dstCount, dstSum, err := checksum(dst, p.target(), p.dstKeys, p.dstCols, opts.Algorithm, c)
+		if err != nil {
+			return err
+		}
+		var diffs []*Diff
+		if srcCount != dstCount || srcSum != dstSum {
+			if diffs, err = drill(ctx, src, dst, p, opts, c); err != nil {
+				return err
+			}
+		}
+		j.update(func(*Report) {
+			tr.Chunks++
+			tr.Rows += srcCount
+			if len(diffs) > 0 {
+				tr.MismatchChunks++
+			}
+			for _, d := range diffs {
+				if len(tr.Diffs) >= opts.MaxDiffs {
+					tr.Truncated = true
+					break
+				}
+				tr.Diffs = append(tr.Diffs, d)
+			}
+		})
+		if upper == nil {
+			return nil
+		}
+		lower = upper
+		wait := time.Duration(0)
+		if opts.RowsPerSecond > 0 {
+			wait = time.Duration(srcCount)*time.Second/time.Duration(opts.RowsPerSecond) - time.Since(start)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// drill 逐行对比不一致的块， 有差异的行等待之后重新对比， 同步追上之后一致的行不报告
+func drill(ctx context.Context, src, dst *sql.DB, p *tablePair, opts *Options, c *chunk) ([]*Diff, error) {
+	srcRows, err := rowHashes(src, p.source(), p.srcKeys, p.srcCols, opts.Algorithm, c)
+	if err != nil {
+		return nil, err
+	}
+	dstRows, err := rowHashes(dst, p.target(), p.dstKeys, p.dstCols, opts.Algorithm, c)
+	if err != nil {
+		return nil, err
+	}
+	candidates := make([][]interface{}, 0)
+	for k, s := range srcRows {
+		if d, ok := dstRows[k]; !ok || d.hash != s.hash {
+			candidates = append(candidates, s.key)
+		}
+	}
+	for k, d := range dstRows {
+		if _, ok := srcRows[k]; !ok {
+			candidates = append(candidates, d.key)
+		}
+	}
+	var diffs []*Diff
+	for i := 0; i < opts.Rechecks && len(candidates) > 0; i++ {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(opts.RecheckDelay):
+		}
+		remaining := candidates[:0]
+		diffs = diffs[:0]
+		for _, key := range candidates {
+			kind, err := compareRow(src, dst, p, opts.Algorithm, key)
+			if err != nil {
+				return nil, err
+			}
+			if len(kind) > 0 {
+				remaining = append(remaining, key)
+				diffs = append(diffs, &Diff{Key: keyMap(p.srcKeys, key), Kind: kind})
+			}
+		}
+		candidates = remaining
+	}
+	return diffs, nil
+}
+
+// compareRow 按主键对比单行， 一致返回空
+func compareRow(src, dst *sql.DB, p *tablePair, algo string, key []interface{}) (string, error) {
+	srcHash, inSrc, err := rowHashByKey(src, p.source(), p.srcKeys, p.srcCols, algo, key)
+	if err != nil {
+		return "", err
+	}
+	dstHash, inDst, err := rowHashByKey(dst, p.target(), p.dstKeys, p.dstCols, algo, key)
+	if err != nil {
+		return "", err
+	}
+	switch {
+	case inSrc && !inDst:
+		return DiffMissing, nil
+	case !inSrc && inDst:
+		return DiffExtra, nil
+	case inSrc && inDst && srcHash != dstHash:
+		return DiffChanged, nil
+	}
+	return "", nil
+}
+
+func keyMap(keys []string, values []interface{}) map[string]interface{} {
+	m := make(map[string]interface{}, len(keys))
+	for i, k := range keys {
+		m[k] = values[i]
+	}
+	return m
+}